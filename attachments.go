@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+)
+
+// Files are uploaded on their own first and then referenced by uuid from a
+// post, comment or chat message. An upload nobody references yet is visible
+// only to its uploader; once attached, it is visible to whoever can see the
+// thing it is attached to, and to nobody once that is deleted. Uploads still
+// unattached after ATTACHMENT_UNATTACHED_TTL are swept away.
+
+const (
+	TargetMessage     = "message"      // private_messages
+	TargetRoomMessage = "room_message" // conversation_messages
+)
+
+var (
+	// maxAttachmentSize is the largest upload in bytes.
+	maxAttachmentSize = int64(envInt("ATTACHMENT_MAX_BYTES", 10<<20))
+	// maxAttachmentsPerItem caps the files on one post, comment or message.
+	maxAttachmentsPerItem = envInt("ATTACHMENT_MAX_PER_ITEM", 10)
+	// unattachedTTL is how long an upload may wait to be attached.
+	unattachedTTL = envDuration("ATTACHMENT_UNATTACHED_TTL", 24*time.Hour)
+	// attachmentSweepInterval is how often abandoned uploads are looked for.
+	attachmentSweepInterval = envDuration("ATTACHMENT_SWEEP_INTERVAL", time.Hour)
+)
+
+// attachmentTypes are the accepted types, as sniffed from the content.
+// Images are the ones image.Decode understands, so they get thumbnails.
+var attachmentTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"application/pdf": true,
+	"text/plain":      true,
+}
+
+var (
+	ErrFileTooLarge        = errors.New("file is too large")
+	ErrUnsupportedFileType = errors.New("file type is not allowed")
+	ErrAttachmentNotFound  = errors.New("attachment not found")
+	ErrAttachmentInUse     = errors.New("attachment is already attached elsewhere")
+	ErrTooManyAttachments  = errors.New("too many attachments")
+)
+
+type Attachment struct {
+	UUID         string `json:"uuid"`
+	Filename     string `json:"filename"`
+	MimeType     string `json:"mime_type"`
+	Size         int64  `json:"size"`
+	Width        int    `json:"width,omitempty"` // images only
+	Height       int    `json:"height,omitempty"`
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+}
+
+func isImageType(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "image/")
+}
+
+func (a *Attachment) setURLs(hasThumbnail bool) {
+	a.URL = "/attachment?uuid=" + a.UUID
+	if hasThumbnail {
+		a.ThumbnailURL = a.URL + "&thumb=1"
+	}
+}
+
+func thumbnailKey(attachmentUUID string) string {
+	return attachmentUUID + ".thumb"
+}
+
+// cleanFilename keeps the base name of an uploaded file without control
+// characters. It is only ever shown, never used as a path.
+func cleanFilename(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	if len(name) > 255 {
+		name = name[:255]
+	}
+	if name == "" || name == "." || name == "/" {
+		name = "file"
+	}
+	return name
+}
+
+// SaveUpload checks an uploaded file, strips image metadata, stores the
+// bytes and a thumbnail in store and records the attachment as unattached.
+func SaveUpload(db *sql.DB, store BlobStore, uploaderUUID, filename string, data []byte) (Attachment, error) {
+	a := Attachment{UUID: uuid.New().String(), Filename: cleanFilename(filename)}
+
+	a.MimeType = http.DetectContentType(data)
+	mediaType, _, _ := mime.ParseMediaType(a.MimeType)
+	if !attachmentTypes[mediaType] {
+		return a, ErrUnsupportedFileType
+	}
+
+	var thumb []byte
+	if isImageType(mediaType) {
+		img, err := processImage(mediaType, data)
+		if err != nil {
+			return a, err
+		}
+		data, thumb = img.data, img.thumb
+		a.Width, a.Height = img.width, img.height
+	}
+	a.Size = int64(len(data))
+
+	if err := store.Put(a.UUID, bytes.NewReader(data)); err != nil {
+		return a, err
+	}
+	if thumb != nil {
+		if err := store.Put(thumbnailKey(a.UUID), bytes.NewReader(thumb)); err != nil {
+			store.Delete(a.UUID)
+			return a, err
+		}
+	}
+
+	_, err := db.Exec(`
+        INSERT INTO attachments (uuid, uploader_uuid, filename, mime_type, size, width, height, has_thumbnail, created_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		a.UUID, uploaderUUID, a.Filename, a.MimeType, a.Size, a.Width, a.Height, thumb != nil, time.Now())
+	if err != nil {
+		store.Delete(a.UUID)
+		store.Delete(thumbnailKey(a.UUID))
+		return a, err
+	}
+	a.setURLs(thumb != nil)
+	return a, nil
+}
+
+// attachFiles links the uploader's unattached uploads to a post, comment or
+// message. It runs inside the transaction that creates the target, so a
+// bad reference leaves nothing behind.
+func attachFiles(tx *sql.Tx, uploaderUUID string, attachmentUUIDs []string, targetType string, targetID int64) error {
+	attachmentUUIDs = uniqueStrings(attachmentUUIDs, "")
+	if len(attachmentUUIDs) > maxAttachmentsPerItem {
+		return ErrTooManyAttachments
+	}
+	for _, attachmentUUID := range attachmentUUIDs {
+		var attached bool
+		err := tx.QueryRow(`SELECT target_type IS NOT NULL FROM attachments WHERE uuid = ? AND uploader_uuid = ?`,
+			attachmentUUID, uploaderUUID).Scan(&attached)
+		if err == sql.ErrNoRows {
+			return ErrAttachmentNotFound
+		} else if err != nil {
+			return err
+		} else if attached {
+			return ErrAttachmentInUse
+		}
+		if _, err := tx.Exec(`UPDATE attachments SET target_type = ?, target_id = ? WHERE uuid = ?`,
+			targetType, targetID, attachmentUUID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sweepUnattached deletes uploads that were never attached and are older than
+// unattachedTTL, with their blobs, and returns how many it deleted. Each row
+// is only deleted if it is still unattached, so an upload being attached at
+// the same moment is kept.
+func sweepUnattached(db *sql.DB, store BlobStore, now time.Time) (int, error) {
+	rows, err := db.Query(`SELECT uuid FROM attachments
+        WHERE target_type IS NULL AND julianday(created_at) <= ?`, julianDay(now.Add(-unattachedTTL).Unix()))
+	if err != nil {
+		return 0, err
+	}
+	var stale []string
+	for rows.Next() {
+		var attachmentUUID string
+		if err := rows.Scan(&attachmentUUID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		stale = append(stale, attachmentUUID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, attachmentUUID := range stale {
+		res, err := db.Exec(`DELETE FROM attachments WHERE uuid = ? AND target_type IS NULL`, attachmentUUID)
+		if err != nil {
+			return deleted, err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		deleted++
+		for _, key := range []string{attachmentUUID, thumbnailKey(attachmentUUID)} {
+			if err := store.Delete(key); err != nil {
+				log.Printf("Error deleting blob %s: %v", key, err)
+			}
+		}
+	}
+	return deleted, nil
+}
+
+// RunAttachmentSweeper sweeps abandoned uploads every
+// ATTACHMENT_SWEEP_INTERVAL. It must be started exactly once.
+func RunAttachmentSweeper(db *sql.DB, store BlobStore) {
+	ticker := time.NewTicker(attachmentSweepInterval)
+	defer ticker.Stop()
+	for {
+		n, err := sweepUnattached(db, store, time.Now())
+		if err != nil {
+			log.Printf("Error sweeping unattached uploads: %v", err)
+		} else if n > 0 {
+			log.Printf("Deleted %d unattached uploads", n)
+		}
+		<-ticker.C
+	}
+}
+
+// attachmentErrorStatus is the HTTP status for an attachFiles error caused
+// by the request, or 0 for any other error.
+func attachmentErrorStatus(err error) int {
+	switch err {
+	case ErrAttachmentNotFound, ErrTooManyAttachments:
+		return http.StatusBadRequest
+	case ErrAttachmentInUse:
+		return http.StatusConflict
+	}
+	return 0
+}
+
+// attachmentColumns is what scanAttachment reads, before any extra columns.
+const attachmentColumns = `uuid, filename, mime_type, size, COALESCE(width, 0), COALESCE(height, 0), has_thumbnail`
+
+func scanAttachment(row interface{ Scan(...interface{}) error }, a *Attachment, extra ...interface{}) error {
+	var hasThumbnail bool
+	dest := append([]interface{}{&a.UUID, &a.Filename, &a.MimeType, &a.Size, &a.Width, &a.Height, &hasThumbnail}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return err
+	}
+	a.setURLs(hasThumbnail)
+	return nil
+}
+
+// LoadAttachments returns the attachments of several targets of one type,
+// keyed by target id, in upload order.
+func LoadAttachments(db *sql.DB, targetType string, targetIDs []int64) (map[int64][]Attachment, error) {
+	attachments := make(map[int64][]Attachment)
+	if len(targetIDs) == 0 {
+		return attachments, nil
+	}
+
+	args := append([]interface{}{targetType}, toInterfaceSlice(targetIDs)...)
+	rows, err := db.Query(`SELECT `+attachmentColumns+`, target_id
+        FROM attachments
+        WHERE target_type = ? AND target_id IN (`+strings.Repeat("?,", len(targetIDs)-1)+`?)
+        ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var targetID int64
+		var a Attachment
+		if err := scanAttachment(rows, &a, &targetID); err != nil {
+			return nil, err
+		}
+		attachments[targetID] = append(attachments[targetID], a)
+	}
+	return attachments, rows.Err()
+}
+
+// loadTargetAttachments is LoadAttachments for a single target.
+func loadTargetAttachments(db *sql.DB, targetType string, targetID int64) ([]Attachment, error) {
+	attachments, err := LoadAttachments(db, targetType, []int64{targetID})
+	return attachments[targetID], err
+}
+
+// loadMessageAttachments fills in the attachments of a page of history.
+// Deleted messages keep none.
+func loadMessageAttachments(db *sql.DB, targetType string, messages []MessageWithAuthor) error {
+	ids := make([]int64, len(messages))
+	for i, m := range messages {
+		ids[i] = m.id
+	}
+	attachments, err := LoadAttachments(db, targetType, ids)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		if !messages[i].Deleted {
+			messages[i].Attachments = attachments[messages[i].id]
+		}
+	}
+	return nil
+}
+
+// loadAttachmentsByUUID loads attachments given by uuid, in upload order.
+func loadAttachmentsByUUID(db *sql.DB, attachmentUUIDs []string) ([]Attachment, error) {
+	attachmentUUIDs = uniqueStrings(attachmentUUIDs, "")
+	if len(attachmentUUIDs) == 0 {
+		return nil, nil
+	}
+
+	args := make([]interface{}, len(attachmentUUIDs))
+	for i, u := range attachmentUUIDs {
+		args[i] = u
+	}
+	rows, err := db.Query(`SELECT `+attachmentColumns+`
+        FROM attachments
+        WHERE uuid IN (`+strings.Repeat("?,", len(args)-1)+`?)
+        ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []Attachment
+	for rows.Next() {
+		var a Attachment
+		if err := scanAttachment(rows, &a); err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
+
+// attachmentForViewer loads an attachment if viewerUUID may see it. Both a
+// missing attachment and one the viewer may not see give
+// ErrAttachmentNotFound, so private uploads cannot be probed for.
+func attachmentForViewer(db *sql.DB, attachmentUUID, viewerUUID string) (Attachment, bool, error) {
+	var a Attachment
+	var uploader string
+	var targetType sql.NullString
+	var targetID sql.NullInt64
+	var hasThumbnail bool
+	err := db.QueryRow(`
+        SELECT uuid, uploader_uuid, filename, mime_type, size, has_thumbnail, target_type, target_id
+        FROM attachments WHERE uuid = ?`, attachmentUUID).Scan(
+		&a.UUID, &uploader, &a.Filename, &a.MimeType, &a.Size, &hasThumbnail, &targetType, &targetID)
+	if err == sql.ErrNoRows {
+		return a, false, ErrAttachmentNotFound
+	} else if err != nil {
+		return a, false, err
+	}
+
+	var visible bool
+	switch targetType.String {
+	case "":
+		visible = uploader == viewerUUID
+	case TargetPost:
+		err = db.QueryRow(`SELECT EXISTS(SELECT 1 FROM posts WHERE id = ? AND deleted_at IS NULL)`, targetID.Int64).Scan(&visible)
+	case TargetComment:
+		err = db.QueryRow(`SELECT EXISTS(SELECT 1 FROM comments c JOIN posts p ON p.id = c.post_id
+            WHERE c.id = ? AND c.deleted_at IS NULL AND p.deleted_at IS NULL)`, targetID.Int64).Scan(&visible)
+	case TargetMessage:
+		err = db.QueryRow(`SELECT EXISTS(SELECT 1 FROM private_messages
+            WHERE id = ? AND deleted_at IS NULL AND (sender_uuid = ? OR receiver_uuid = ?))`,
+			targetID.Int64, viewerUUID, viewerUUID).Scan(&visible)
+	case TargetRoomMessage:
+		var roomUUID string
+		err = db.QueryRow(`SELECT c.uuid FROM conversation_messages m JOIN conversations c ON c.id = m.conversation_id
+            WHERE m.id = ?`, targetID.Int64).Scan(&roomUUID)
+		if err == nil {
+			var room *Room
+			if room, err = GetRoom(db, roomUUID, viewerUUID); err == nil {
+				visible = canReadRoom(room)
+			}
+		}
+		if err == sql.ErrNoRows || err == ErrRoomNotFound {
+			err = nil
+		}
+	}
+	if err != nil {
+		return a, false, err
+	}
+	if !visible {
+		return a, false, ErrAttachmentNotFound
+	}
+	return a, hasThumbnail, nil
+}
+
+// UploadAttachmentHandler: POST /attachments, multipart form with a "file" part
+func UploadAttachmentHandler(db *sql.DB, store BlobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		// Leave room for the multipart headers around the file.
+		r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentSize+64<<10)
+		mr, err := r.MultipartReader()
+		if err != nil {
+			http.Error(w, "Expected a multipart/form-data upload", http.StatusBadRequest)
+			return
+		}
+
+		var filename string
+		var data []byte
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				http.Error(w, ErrFileTooLarge.Error(), http.StatusRequestEntityTooLarge)
+				return
+			} else if err != nil {
+				http.Error(w, "Malformed upload", http.StatusBadRequest)
+				return
+			}
+			if part.FormName() != "file" {
+				part.Close()
+				continue
+			}
+			filename = part.FileName()
+			data, err = io.ReadAll(io.LimitReader(part, maxAttachmentSize+1))
+			part.Close()
+			if errors.As(err, &maxBytesErr) || int64(len(data)) > maxAttachmentSize {
+				http.Error(w, ErrFileTooLarge.Error(), http.StatusRequestEntityTooLarge)
+				return
+			} else if err != nil {
+				http.Error(w, "Malformed upload", http.StatusBadRequest)
+				return
+			}
+			break
+		}
+		if len(data) == 0 {
+			http.Error(w, "Missing 'file'", http.StatusBadRequest)
+			return
+		}
+
+		a, err := SaveUpload(db, store, userUUID, filename, data)
+		switch err {
+		case nil:
+		case ErrUnsupportedFileType:
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		case ErrBadImage, ErrImageTooLarge:
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		default:
+			log.Printf("Error saving upload: %v", err)
+			http.Error(w, "Failed to save upload", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(a)
+	}
+}
+
+// AttachmentHandler: GET /attachment?uuid=<uuid>[&thumb=1]
+func AttachmentHandler(db *sql.DB, store BlobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		attachmentUUID := r.URL.Query().Get("uuid")
+		if attachmentUUID == "" {
+			http.Error(w, "Missing attachment UUID", http.StatusBadRequest)
+			return
+		}
+
+		a, hasThumbnail, err := attachmentForViewer(db, attachmentUUID, userUUID)
+		if err == ErrAttachmentNotFound {
+			http.Error(w, "Attachment not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("Error loading attachment %s: %v", attachmentUUID, err)
+			http.Error(w, "Failed to load attachment", http.StatusInternalServerError)
+			return
+		}
+
+		key, contentType := a.UUID, a.MimeType
+		if r.URL.Query().Get("thumb") != "" && hasThumbnail {
+			key, contentType = thumbnailKey(a.UUID), thumbnailType(a.MimeType)
+		}
+		blob, err := store.Open(key)
+		if err != nil {
+			log.Printf("Error opening blob %s: %v", key, err)
+			http.Error(w, "Attachment not found", http.StatusNotFound)
+			return
+		}
+		defer blob.Close()
+
+		disposition := "attachment"
+		if isImageType(a.MimeType) {
+			disposition = "inline"
+		}
+		h := w.Header()
+		h.Set("Content-Type", contentType)
+		h.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Filename}))
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Content-Security-Policy", "default-src 'none'; sandbox")
+		h.Set("Cache-Control", "private, max-age=86400")
+		if key == a.UUID {
+			h.Set("Content-Length", strconv.FormatInt(a.Size, 10))
+		}
+		if _, err := io.Copy(w, blob); err != nil {
+			log.Printf("Error sending attachment %s: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Categories are managed by moderators. Posts link to categories by id, so a
+// rename keeps its posts; feeds and live topics use the slug, which only
+// changes when set explicitly. A restricted category only takes posts from
+// its post_role and above, and an archived one takes no new posts while its
+// existing posts stay visible.
+
+const (
+	maxCategoryNameLen        = 32
+	maxCategoryDescriptionLen = 256
+)
+
+var (
+	ErrCategoryNotFound   = errors.New("category not found")
+	ErrCategoryExists     = errors.New("a category with that name or slug already exists")
+	ErrCategoryArchived   = errors.New("category is archived")
+	ErrCategoryRestricted = errors.New("your role may not post in this category")
+	ErrInvalidCategory    = errors.New("category needs a name of at most 32 characters, a slug of lowercase letters, digits and dashes, and a post_role of user, moderator or admin")
+)
+
+type Category struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	Slug        string `json:"slug"`
+	Description string `json:"description"`
+	Position    int    `json:"position"`
+	PostRole    string `json:"post_role"` // lowest role that may post
+	Archived    bool   `json:"archived"`
+	PostCount   int    `json:"post_count"`
+	CanPost     bool   `json:"can_post"` // for the viewer
+}
+
+// roleRank orders roles from least to most privileged.
+func roleRank(role string) int {
+	switch role {
+	case RoleModerator:
+		return 1
+	case RoleAdmin:
+		return 2
+	}
+	return 0
+}
+
+func validRole(role string) bool {
+	return role == RoleUser || role == RoleModerator || role == RoleAdmin
+}
+
+// slugify lowercases a name and joins its runs of letters and digits with
+// dashes.
+func slugify(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
+}
+
+func validSlug(slug string) bool {
+	return slug != "" && len(slug) <= maxCategoryNameLen && slugify(slug) == slug
+}
+
+const categorySelect = `
+    SELECT c.id, c.name, c.slug, c.description, c.position, c.post_role, c.archived_at IS NOT NULL,
+           (SELECT COUNT(*) FROM post_categories pc JOIN posts p ON p.id = pc.post_id
+            WHERE pc.category_id = c.id AND p.deleted_at IS NULL)
+    FROM categories c`
+
+func scanCategory(row interface{ Scan(...interface{}) error }, c *Category, viewerRole string) error {
+	err := row.Scan(&c.ID, &c.Name, &c.Slug, &c.Description, &c.Position, &c.PostRole, &c.Archived, &c.PostCount)
+	c.CanPost = !c.Archived && roleRank(viewerRole) >= roleRank(c.PostRole)
+	return err
+}
+
+// ListCategories returns categories in display order, archived ones only
+// when asked for.
+func ListCategories(db *sql.DB, viewerRole string, archived bool) ([]Category, error) {
+	query := categorySelect
+	if !archived {
+		query += ` WHERE c.archived_at IS NULL`
+	}
+	rows, err := db.Query(query + ` ORDER BY c.position, c.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := []Category{}
+	for rows.Next() {
+		var c Category
+		if err := scanCategory(rows, &c, viewerRole); err != nil {
+			return nil, err
+		}
+		categories = append(categories, c)
+	}
+	return categories, rows.Err()
+}
+
+func GetCategory(db *sql.DB, slug, viewerRole string) (Category, error) {
+	var c Category
+	err := scanCategory(db.QueryRow(categorySelect+` WHERE c.slug = ?`, slug), &c, viewerRole)
+	if err == sql.ErrNoRows {
+		return c, ErrCategoryNotFound
+	}
+	return c, err
+}
+
+// categoryTaken reports whether another category uses the name or slug.
+func categoryTaken(tx *sql.Tx, name, slug string, id int64) (bool, error) {
+	var taken bool
+	err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM categories
+        WHERE (name = ? COLLATE NOCASE OR slug = ?) AND id != ?)`, name, slug, id).Scan(&taken)
+	return taken, err
+}
+
+// CreateCategory adds a category at the end of the display order.
+func CreateCategory(db *sql.DB, name, slug, description, postRole string) (string, error) {
+	if slug == "" {
+		slug = slugify(name)
+	}
+	if postRole == "" {
+		postRole = RoleUser
+	}
+	if name == "" || len(name) > maxCategoryNameLen || !validSlug(slug) || !validRole(postRole) || len(description) > maxCategoryDescriptionLen {
+		return "", ErrInvalidCategory
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if taken, err := categoryTaken(tx, name, slug, 0); err != nil {
+		return "", err
+	} else if taken {
+		return "", ErrCategoryExists
+	}
+	_, err = tx.Exec(`INSERT INTO categories (name, slug, description, post_role, position)
+        SELECT ?, ?, ?, ?, COALESCE(MAX(position), 0) + 1 FROM categories`, name, slug, description, postRole)
+	if err != nil {
+		return "", err
+	}
+	return slug, tx.Commit()
+}
+
+// CategoryUpdate holds the fields to change; nil fields are kept.
+type CategoryUpdate struct {
+	Name        *string `json:"name"`
+	Slug        *string `json:"slug"`
+	Description *string `json:"description"`
+	PostRole    *string `json:"post_role"`
+	Archived    *bool   `json:"archived"`
+}
+
+// UpdateCategory applies u to the category and returns its slug afterwards.
+func UpdateCategory(db *sql.DB, slug string, u CategoryUpdate, now time.Time) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var c Category
+	var archivedAt sql.NullTime
+	err = tx.QueryRow(`SELECT id, name, slug, description, post_role, archived_at FROM categories WHERE slug = ?`, slug).
+		Scan(&c.ID, &c.Name, &c.Slug, &c.Description, &c.PostRole, &archivedAt)
+	if err == sql.ErrNoRows {
+		return "", ErrCategoryNotFound
+	} else if err != nil {
+		return "", err
+	}
+
+	if u.Name != nil {
+		c.Name = strings.TrimSpace(*u.Name)
+	}
+	if u.Slug != nil {
+		c.Slug = strings.TrimSpace(*u.Slug)
+	}
+	if u.Description != nil {
+		c.Description = strings.TrimSpace(*u.Description)
+	}
+	if u.PostRole != nil {
+		c.PostRole = *u.PostRole
+	}
+	if u.Archived != nil && *u.Archived != archivedAt.Valid {
+		archivedAt = sql.NullTime{Time: now, Valid: *u.Archived}
+	}
+	if c.Name == "" || len(c.Name) > maxCategoryNameLen || !validSlug(c.Slug) || !validRole(c.PostRole) || len(c.Description) > maxCategoryDescriptionLen {
+		return "", ErrInvalidCategory
+	}
+
+	if taken, err := categoryTaken(tx, c.Name, c.Slug, c.ID); err != nil {
+		return "", err
+	} else if taken {
+		return "", ErrCategoryExists
+	}
+	_, err = tx.Exec(`UPDATE categories SET name = ?, slug = ?, description = ?, post_role = ?, archived_at = ? WHERE id = ?`,
+		c.Name, c.Slug, c.Description, c.PostRole, archivedAt, c.ID)
+	if err != nil {
+		return "", err
+	}
+	return c.Slug, tx.Commit()
+}
+
+// ReorderCategories puts the listed categories first, in the given order,
+// followed by the rest in their current order.
+func ReorderCategories(db *sql.DB, slugs []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id, slug FROM categories ORDER BY position, name`)
+	if err != nil {
+		return err
+	}
+	ids := map[string]int64{}
+	var current []int64
+	for rows.Next() {
+		var id int64
+		var slug string
+		if err := rows.Scan(&id, &slug); err != nil {
+			rows.Close()
+			return err
+		}
+		ids[slug] = id
+		current = append(current, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	order := make([]int64, 0, len(current))
+	placed := map[int64]bool{}
+	for _, slug := range slugs {
+		id, ok := ids[slug]
+		if !ok {
+			return ErrCategoryNotFound
+		}
+		if !placed[id] {
+			placed[id] = true
+			order = append(order, id)
+		}
+	}
+	for _, id := range current {
+		if !placed[id] {
+			order = append(order, id)
+		}
+	}
+
+	for i, id := range order {
+		if _, err := tx.Exec(`UPDATE categories SET position = ? WHERE id = ?`, i+1, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// checkPostCategories reports whether the user may post in every category,
+// given by name or slug. On failure it also returns the offending category.
+func checkPostCategories(db *sql.DB, userUUID string, categories []string) (string, error) {
+	if len(categories) == 0 {
+		return "", nil
+	}
+	role, err := GetUserRole(db, userUUID)
+	if err != nil {
+		return "", err
+	}
+	for _, category := range categories {
+		var postRole string
+		var archived bool
+		err := db.QueryRow(`SELECT post_role, archived_at IS NOT NULL FROM categories WHERE name = ? OR slug = ?`,
+			category, category).Scan(&postRole, &archived)
+		switch {
+		case err == sql.ErrNoRows:
+			return category, ErrCategoryNotFound
+		case err != nil:
+			return category, err
+		case archived:
+			return category, ErrCategoryArchived
+		case roleRank(role) < roleRank(postRole):
+			return category, ErrCategoryRestricted
+		}
+	}
+	return "", nil
+}
+
+// postCategorySlugs returns the slugs of a post's categories.
+func postCategorySlugs(db *sql.DB, postUUID string) ([]string, error) {
+	rows, err := db.Query(`
+        SELECT c.slug FROM post_categories pc
+        JOIN categories c ON pc.category_id = c.id
+        JOIN posts p ON pc.post_id = p.id
+        WHERE p.post_uuid = ?`, postUUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var slugs []string
+	for rows.Next() {
+		var slug string
+		if err := rows.Scan(&slug); err != nil {
+			return nil, err
+		}
+		slugs = append(slugs, slug)
+	}
+	return slugs, rows.Err()
+}
+
+func writeCategoryError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrCategoryNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case ErrNotModerator:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case ErrCategoryExists:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case ErrInvalidCategory:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Printf("Category error: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+	}
+}
+
+// GetCategoriesHandler: GET /categories[?archived=true]
+func GetCategoriesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		role, err := GetUserRole(db, userUUID)
+		if err != nil {
+			writeCategoryError(w, err)
+			return
+		}
+		archived, _ := strconv.ParseBool(r.URL.Query().Get("archived"))
+		categories, err := ListCategories(db, role, archived)
+		if err != nil {
+			log.Printf("ListCategories error: %v", err)
+			http.Error(w, "Failed to fetch categories", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(categories)
+	}
+}
+
+type CreateCategoryRequest struct {
+	Name        string `json:"name"`
+	Slug        string `json:"slug"` // derived from the name when empty
+	Description string `json:"description"`
+	PostRole    string `json:"post_role"` // defaults to user
+}
+
+// CreateCategoryHandler: POST /categories {name, slug, description, post_role}
+func CreateCategoryHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err := requireModerator(db, userUUID); err != nil {
+			writeCategoryError(w, err)
+			return
+		}
+
+		var req CreateCategoryRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		slug, err := CreateCategory(db, strings.TrimSpace(req.Name), strings.TrimSpace(req.Slug), strings.TrimSpace(req.Description), req.PostRole)
+		if err != nil {
+			writeCategoryError(w, err)
+			return
+		}
+		writeCategory(w, db, userUUID, slug, http.StatusCreated)
+	}
+}
+
+// UpdateCategoryHandler: PUT /category?slug= {name, slug, description,
+// post_role, archived}, each optional.
+func UpdateCategoryHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err := requireModerator(db, userUUID); err != nil {
+			writeCategoryError(w, err)
+			return
+		}
+
+		var req CategoryUpdate
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		slug, err := UpdateCategory(db, r.URL.Query().Get("slug"), req, time.Now())
+		if err != nil {
+			writeCategoryError(w, err)
+			return
+		}
+		writeCategory(w, db, userUUID, slug, http.StatusOK)
+	}
+}
+
+type ReorderCategoriesRequest struct {
+	Slugs []string `json:"slugs"`
+}
+
+// ReorderCategoriesHandler: PUT /categories/order {slugs}
+func ReorderCategoriesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err := requireModerator(db, userUUID); err != nil {
+			writeCategoryError(w, err)
+			return
+		}
+
+		var req ReorderCategoriesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		if err := ReorderCategories(db, req.Slugs); err != nil {
+			if err == ErrCategoryNotFound {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeCategoryError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// writeCategory responds with a category as the user sees it.
+func writeCategory(w http.ResponseWriter, db *sql.DB, userUUID, slug string, status int) {
+	role, err := GetUserRole(db, userUUID)
+	if err != nil {
+		writeCategoryError(w, err)
+		return
+	}
+	c, err := GetCategory(db, slug, role)
+	if err != nil {
+		writeCategoryError(w, fmt.Errorf("reloading category %s: %w", slug, err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(c)
+}
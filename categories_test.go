@@ -0,0 +1,138 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// newCategoryTest adds a category open to everyone, one for moderators, one
+// for admins and an archived one, and returns users of each role.
+func newCategoryTest(t *testing.T) (db *sql.DB, user, mod, admin string) {
+	t.Helper()
+	db = newTestDB(t)
+	for _, c := range []struct{ name, role string }{
+		{"Open Talk", RoleUser}, {"Mod Notes", RoleModerator}, {"Staff Room", RoleAdmin}, {"Old Stuff", RoleUser},
+	} {
+		if _, err := CreateCategory(db, c.name, "", "", c.role); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archived := true
+	if _, err := UpdateCategory(db, "old-stuff", CategoryUpdate{Archived: &archived}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	user, mod, admin = createTestUser(t, db, "alice"), createTestUser(t, db, "mod"), createTestUser(t, db, "admin")
+	if _, err := db.Exec(`UPDATE users SET role = CASE uuid WHEN ? THEN 'moderator' ELSE 'admin' END
+        WHERE uuid IN (?, ?)`, mod, mod, admin); err != nil {
+		t.Fatal(err)
+	}
+	return db, user, mod, admin
+}
+
+func TestCheckPostCategories(t *testing.T) {
+	db, user, mod, admin := newCategoryTest(t)
+	tests := []struct {
+		name       string
+		user       string
+		categories []string
+		bad        string // the category reported
+		err        error
+	}{
+		{"none", user, nil, "", nil},
+		{"open by slug", user, []string{"open-talk"}, "", nil},
+		{"open by name", user, []string{"Open Talk"}, "", nil},
+		{"moderator category for a user", user, []string{"open-talk", "mod-notes"}, "mod-notes", ErrCategoryRestricted},
+		{"moderator category for a moderator", mod, []string{"open-talk", "mod-notes"}, "", nil},
+		{"admin category for a moderator", mod, []string{"Staff Room"}, "Staff Room", ErrCategoryRestricted},
+		{"every category for an admin", admin, []string{"open-talk", "mod-notes", "staff-room"}, "", nil},
+		{"archived", admin, []string{"old-stuff"}, "old-stuff", ErrCategoryArchived},
+		{"unknown", admin, []string{"open-talk", "nowhere"}, "nowhere", ErrCategoryNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bad, err := checkPostCategories(db, tt.user, tt.categories)
+			if bad != tt.bad || err != tt.err {
+				t.Errorf("got %q, %v; want %q, %v", bad, err, tt.bad, tt.err)
+			}
+		})
+	}
+}
+
+func TestCategoryCanPost(t *testing.T) {
+	db, _, _, _ := newCategoryTest(t)
+	tests := []struct {
+		role string
+		can  map[string]bool
+	}{
+		{RoleUser, map[string]bool{"open-talk": true, "mod-notes": false, "staff-room": false, "old-stuff": false}},
+		{RoleModerator, map[string]bool{"open-talk": true, "mod-notes": true, "staff-room": false, "old-stuff": false}},
+		{RoleAdmin, map[string]bool{"open-talk": true, "mod-notes": true, "staff-room": true, "old-stuff": false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.role, func(t *testing.T) {
+			categories, err := ListCategories(db, tt.role, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seen := 0
+			for _, c := range categories {
+				if want, ok := tt.can[c.Slug]; ok {
+					seen++
+					if c.CanPost != want {
+						t.Errorf("%s: can post %v, want %v", c.Slug, c.CanPost, want)
+					}
+				}
+			}
+			if seen != len(tt.can) {
+				t.Errorf("listed %d of the %d categories", seen, len(tt.can))
+			}
+		})
+	}
+
+	// Archived categories are only listed when asked for.
+	categories, err := ListCategories(db, RoleAdmin, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range categories {
+		if c.Slug == "old-stuff" {
+			t.Error("archived category listed")
+		}
+	}
+}
+
+func TestUpdateCategoryPostRole(t *testing.T) {
+	db, user, _, _ := newCategoryTest(t)
+	role := RoleModerator
+	slug, err := UpdateCategory(db, "open-talk", CategoryUpdate{PostRole: &role}, time.Now())
+	if err != nil || slug != "open-talk" {
+		t.Fatalf("got %q, %v", slug, err)
+	}
+	if _, err := checkPostCategories(db, user, []string{"open-talk"}); err != ErrCategoryRestricted {
+		t.Errorf("user posting after restriction: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		slug string
+		u    CategoryUpdate
+		err  error
+	}{
+		{"unknown role", "open-talk", CategoryUpdate{PostRole: stringPtr("owner")}, ErrInvalidCategory},
+		{"bad slug", "open-talk", CategoryUpdate{Slug: stringPtr("Open Talk")}, ErrInvalidCategory},
+		{"name taken", "open-talk", CategoryUpdate{Name: stringPtr("mod notes")}, ErrCategoryExists},
+		{"unknown category", "nowhere", CategoryUpdate{PostRole: stringPtr(RoleUser)}, ErrCategoryNotFound},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := UpdateCategory(db, tt.slug, tt.u, time.Now()); err != tt.err {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+	if _, err := CreateCategory(db, "Secret", "", "", "owner"); err != ErrInvalidCategory {
+		t.Errorf("create with unknown role: %v", err)
+	}
+}
+
+func stringPtr(s string) *string { return &s }
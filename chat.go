@@ -3,33 +3,53 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
+	"net"
+	"slices"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
-var (
-	clients     = make(map[string]map[*Client]bool) // Each user can have multiple active connections
-	broadcast   = make(chan Message)                // channel for incoming messages
-	onlineUsers = make(map[string]*UserPresence)    // key = userUUID
-	typingUsers = make(map[*Client]*TypingStatus)   // key = userUUID
-)
-
 type Client struct {
 	Conn        *websocket.Conn
+	Protocol    int // negotiated protocol version, see protocol.go
 	UserUUID    string
+	Nickname    string
 	SessionUUID string
 	Send        chan []byte
+
+	// Replay state, owned by the hub goroutine.
+	connectedAt    time.Time
+	awaitingResume bool     // hold chat frames until the client resumes
+	held           []*Frame // chat frames queued while awaitingResume
+	heldDropped    int64    // highest seq dropped because held was full
+	lastSeq        int64    // highest message seq covered by the resume replay
+
+	// Feed state, owned by the hub goroutine.
+	viewingPost   string          // post open on this connection
+	subscriptions map[string]bool // topics, see subscriptions.go
 }
 
 type Message struct {
+	UUID    string `json:"uuid"`
 	From    string `json:"from"`
 	To      string `json:"to"`
+	Room    string `json:"room,omitempty"` // set instead of To for group and room messages
 	Content string `json:"content"`
 	SentAt  string `json:"sent_at"`
+
+	Attachments []Attachment `json:"attachments,omitempty"`
+
+	// Position of the message in each participant's log, see user_message_log.
+	SenderSeq   int64 `json:"-"`
+	ReceiverSeq int64 `json:"-"`
+
+	RoomMembers []string `json:"-"` // who a room message goes to
 }
 
 type UserPresence struct {
@@ -38,21 +58,32 @@ type UserPresence struct {
 	LastMessage     string    `json:"last_message"`      // preview of last message content
 	LastMessageTime time.Time `json:"last_message_time"` // timestamp for sorting
 	IsOnline        bool      `json:"is_online"`
+	UnreadCount     int       `json:"unread_count"` // messages from this user the viewer has not read
 }
 
 type MessageBroadcast struct {
-	From         string `json:"from"`
-	To           string `json:"to"`
-	Content      string `json:"content"`
-	SentAt       string `json:"sent_at"`
-	FromNickname string `json:"from_nickname"`
+	UUID         string       `json:"uuid"`
+	Seq          int64        `json:"seq,omitempty"` // position in the recipient's message log
+	From         string       `json:"from"`
+	To           string       `json:"to,omitempty"`
+	Room         string       `json:"room,omitempty"`
+	Content      string       `json:"content"`
+	ContentHTML  string       `json:"content_html"`
+	SentAt       string       `json:"sent_at"`
+	FromNickname string       `json:"from_nickname"`
+	Attachments  []Attachment `json:"attachments,omitempty"`
+	Edited       bool         `json:"edited,omitempty"`
+	Deleted      bool         `json:"deleted,omitempty"`
+
+	id int64 // private_messages row, set by LoadMessagesSince
 }
 
 type TypingMessage struct {
-	Type     string `json:"type"`     // "typing_start" or "typing_stop"
-	From     string `json:"from"`     // sender UUID
-	To       string `json:"to"`       // receiver UUID
-	Nickname string `json:"nickname"` // sender's nickname
+	Type     string `json:"type"`           // "typing_start" or "typing_stop"
+	From     string `json:"from"`           // sender UUID
+	To       string `json:"to"`             // receiver UUID
+	Room     string `json:"room,omitempty"` // room UUID, set instead of To
+	Nickname string `json:"nickname"`       // sender's nickname
 }
 
 type TypingStatus struct {
@@ -60,61 +91,61 @@ type TypingStatus struct {
 	IsTyping bool      `json:"is_typing"`
 	Nickname string    `json:"nickname"`
 	TypingTo string    `json:"typing_to"`
+	Room     string    `json:"room,omitempty"`
 	LastSeen time.Time `json:"last_seen"`
-}
 
-// MODIFIED: handleMessages is now much simpler.
-func handleMessages(db *sql.DB) {
-	for {
-		msg := <-broadcast
-
-		// Look up sender's nickname from our in-memory store.
-		fromNickname := "Unknown"
-		if sender, ok := onlineUsers[msg.From]; ok {
-			fromNickname = sender.Nickname
-		}
-
-		// Create the message payload that includes the nickname.
-		broadcastMsg := MessageBroadcast{
-			From:         msg.From,
-			To:           msg.To,
-			Content:      msg.Content,
-			SentAt:       msg.SentAt,
-			FromNickname: fromNickname,
-		}
-
-		data, err := json.Marshal(broadcastMsg)
-		if err != nil {
-			log.Println("json marshal error:", err)
-			continue
-		}
+	roomMembers []string // who to tell when a room typist disconnects
+}
 
-		// If receiver is online, send the message directly.
-		if receivers, ok := clients[msg.To]; ok {
-			for c := range receivers {
-				c.Send <- data
-			}
-		}
+// deliverMessage pushes a chat message to both participants and refreshes
+// their user lists. It reports whether the receiver had a connection to get
+// it. Runs on the hub goroutine.
+func (h *Hub) deliverMessage(msg Message) bool {
+	if msg.Room != "" {
+		h.deliverRoomMessage(msg)
+		return false
+	}
 
-		// Send back to sender as confirmation.
-		if senders, ok := clients[msg.From]; ok {
-			for c := range senders {
-				c.Send <- data
-			}
-		}
+	// Look up sender's nickname from our in-memory store.
+	fromNickname := "Unknown"
+	if sender, ok := h.onlineUsers[msg.From]; ok {
+		fromNickname = sender.Nickname
+	}
 
-		// --- REMOVED ---
-		// The entire block that updated onlineUsers[msg.To].LastMessage etc. has been removed.
-		// It was causing the bug by modifying global state incorrectly.
+	// Create the message payload that includes the nickname. Each side gets
+	// its own copy because the sequence numbers differ.
+	broadcastMsg := MessageBroadcast{
+		UUID:         msg.UUID,
+		Seq:          msg.ReceiverSeq,
+		From:         msg.From,
+		To:           msg.To,
+		Content:      msg.Content,
+		ContentHTML:  renderMarkdown(msg.Content),
+		SentAt:       msg.SentAt,
+		FromNickname: fromNickname,
+		Attachments:  msg.Attachments,
+	}
 
-		// Instead, we now generate and send personalized user lists to the participants.
-		sendPersonalizedUserLists(db, msg.From, msg.To)
+	// If receiver is online, send the message directly.
+	delivered := len(h.clients[msg.To]) > 0
+	if delivered {
+		h.sendToUser(msg.To, chatFrame(broadcastMsg))
+	}
 
+	// Send back to sender as confirmation.
+	if msg.From != msg.To {
+		broadcastMsg.Seq = msg.SenderSeq
+		h.sendToUser(msg.From, chatFrame(broadcastMsg))
 	}
+
+	// Generate and send personalized user lists to the participants.
+	h.sendPersonalizedUserLists(msg.From, msg.To)
+	return delivered
 }
 
-// NEW HELPER FUNCTION: Generates a contextual user list for a specific user.
-func generateUserListFor(db *sql.DB, viewerUUID string) ([]UserPresence, error) {
+// loadUserList builds a contextual user list for a specific user, sorted by
+// the latest conversation. IsOnline is left for the hub to fill in.
+func loadUserList(db *sql.DB, viewerUUID string) ([]UserPresence, error) {
 	rows, err := db.Query(`SELECT uuid, nickname FROM users WHERE uuid != ?`, viewerUUID)
 	if err != nil {
 		return nil, err
@@ -129,24 +160,34 @@ func generateUserListFor(db *sql.DB, viewerUUID string) ([]UserPresence, error)
 		if err := rows.Scan(&uuid, &nickname); err != nil {
 			return nil, err
 		}
-
-		// Is this user online?
-		isOnline := false
-		if presence, ok := onlineUsers[uuid]; ok {
-			isOnline = presence.IsOnline
-		}
-
-		// Get last message between viewer and this user
-		lastMsg, lastTime := getLastMessageBetweenUsers(db, viewerUUID, uuid)
-
 		users = append(users, UserPresence{
-			UserUUID:        uuid,
-			Nickname:        nickname,
-			IsOnline:        isOnline,
-			LastMessage:     lastMsg,
-			LastMessageTime: lastTime,
+			UserUUID: uuid,
+			Nickname: nickname,
 		})
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	// Read the last messages first: any message they show is then counted
+	// as unread too, even if it was saved between the two queries.
+	last, err := lastMessagesFor(db, viewerUUID)
+	if err != nil {
+		return nil, err
+	}
+	unread, err := UnreadCountsFor(db, viewerUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get last message between viewer and each user
+	for i := range users {
+		if m, ok := last[users[i].UserUUID]; ok {
+			users[i].LastMessage, users[i].LastMessageTime = m.content, m.createdAt
+		}
+		users[i].UnreadCount = unread[users[i].UserUUID]
+	}
 
 	// Sort the personalized list
 	sort.Slice(users, func(i, j int) bool {
@@ -168,288 +209,394 @@ func generateUserListFor(db *sql.DB, viewerUUID string) ([]UserPresence, error)
 	return users, nil
 }
 
-// MODIFIED FUNCTION: Renamed from sendOnlineUsersToAll and logic changed
-func sendPersonalizedUserLists(db *sql.DB, senderUUID, receiverUUID string) {
-	// Generate and send the list for the SENDER (all tabs/windows)
-	if conns, ok := clients[senderUUID]; ok {
-		userList, err := generateUserListFor(db, senderUUID)
-		if err != nil {
-			log.Printf("Error generating user list for sender %s: %v", senderUUID, err)
-		} else {
-			data := map[string]interface{}{"type": "user_list", "users": userList}
-			encoded, _ := json.Marshal(data)
-
-			for client := range conns {
-				select {
-				case client.Send <- encoded:
-				default:
-					log.Printf("Sender %s connection skipped (channel full)", senderUUID)
-				}
-			}
-		}
+type lastMessage struct {
+	content   string
+	createdAt time.Time
+}
+
+// lastMessagesFor returns the most recent message of each of the user's
+// conversations, keyed by the other user.
+func lastMessagesFor(db *sql.DB, userUUID string) (map[string]lastMessage, error) {
+	rows, err := db.Query(`
+        SELECT other, content, created_at FROM (
+            SELECT CASE WHEN sender_uuid = ? THEN receiver_uuid ELSE sender_uuid END AS other,
+                   content, created_at,
+                   ROW_NUMBER() OVER (
+                       PARTITION BY CASE WHEN sender_uuid = ? THEN receiver_uuid ELSE sender_uuid END
+                       ORDER BY created_at DESC, id DESC) AS n
+            FROM private_messages
+            WHERE sender_uuid = ? OR receiver_uuid = ?)
+        WHERE n = 1`, userUUID, userUUID, userUUID, userUUID)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	// Generate and send the list for the RECEIVER (all tabs/windows)
-	if conns, ok := clients[receiverUUID]; ok {
-		userList, err := generateUserListFor(db, receiverUUID)
-		if err != nil {
-			log.Printf("Error generating user list for receiver %s: %v", receiverUUID, err)
-		} else {
-			data := map[string]interface{}{"type": "user_list", "users": userList}
-			encoded, _ := json.Marshal(data)
-
-			for client := range conns {
-				select {
-				case client.Send <- encoded:
-				default:
-					log.Printf("Receiver %s connection skipped (channel full)", receiverUUID)
-				}
-			}
+	last := make(map[string]lastMessage)
+	for rows.Next() {
+		var other string
+		var m lastMessage
+		if err := rows.Scan(&other, &m.content, &m.createdAt); err != nil {
+			return nil, err
 		}
+		last[other] = m
 	}
+	return last, rows.Err()
 }
 
-// getLastMessageBetweenUsers gets the most recent message between current user and another user
-func getLastMessageBetweenUsers(db *sql.DB, userA, userB string) (string, time.Time) {
-	query := `
-        SELECT content, created_at 
-        FROM private_messages 
-        WHERE (sender_uuid = ? AND receiver_uuid = ?) 
-           OR (sender_uuid = ? AND receiver_uuid = ?)
-        ORDER BY created_at DESC 
-        LIMIT 1`
-
-	var content string
-	var createdAt time.Time
-
-	err := db.QueryRow(query, userA, userB, userB, userA).Scan(&content, &createdAt)
-	if err != nil {
-		return "", time.Time{} // No messages found
+// sendUserList asks for a personalized user_list to be sent to all
+// connections of one user. Runs on the hub goroutine; the list is built by
+// runUserLists, and repeated requests for a user it has not reached yet are
+// sent once.
+func (h *Hub) sendUserList(userUUID string) {
+	if _, ok := h.clients[userUUID]; !ok {
+		return
+	}
+	h.listMu.Lock()
+	h.listPending[userUUID] = true
+	h.listMu.Unlock()
+	select {
+	case h.listWake <- struct{}{}:
+	default:
 	}
-
-	return content, createdAt
 }
 
-// --- NO CHANGE NEEDED for loadUserPresenceFromDB ---
-// This function already loads contextual data correctly for the connecting user.
-func loadUserPresenceFromDB(db *sql.DB, userUUID string) {
-	// ... function content is correct and remains the same
+// runUserLists builds the user lists asked for by sendUserList, off the hub
+// goroutine, and hands each to the hub to send.
+func (h *Hub) runUserLists() {
+	for range h.listWake {
+		h.listMu.Lock()
+		pending := h.listPending
+		h.listPending = make(map[string]bool)
+		h.listMu.Unlock()
+
+		for userUUID := range pending {
+			userList, err := loadUserList(h.db, userUUID)
+			if err != nil {
+				log.Printf("Error generating user list for %s: %v", userUUID, err)
+				continue
+			}
+			h.do(func() { h.deliverUserList(userUUID, userList) })
+		}
+	}
 }
 
-// MODIFIED: This function now sends personalized lists to ALL connected clients.
-func sendOnlineUsersToAllConnected(db *sql.DB) {
-	for userUUID, conns := range clients {
-		userList, err := generateUserListFor(db, userUUID)
-		if err != nil {
-			log.Printf("Error generating user list for %s on global update: %v", userUUID, err)
-			continue
+// deliverUserList marks who is online and sends the list. Runs on the hub
+// goroutine.
+func (h *Hub) deliverUserList(userUUID string, userList []UserPresence) {
+	if _, ok := h.clients[userUUID]; !ok {
+		return
+	}
+	for i := range userList {
+		if presence, ok := h.onlineUsers[userList[i].UserUUID]; ok {
+			userList[i].IsOnline = presence.IsOnline
 		}
+	}
 
-		// Build response
-		data := map[string]interface{}{
-			"type":  "user_list",
-			"users": userList,
-		}
+	frame := NewFrame(FrameUserList, "",
+		map[string]interface{}{"users": userList},
+		map[string]interface{}{"type": FrameUserList, "users": userList})
 
-		encoded, err := json.Marshal(data)
-		if err != nil {
-			log.Println("Error marshaling user list for global update:", err)
-			continue
-		}
+	// Send to ALL connections for this user (all tabs/windows)
+	h.sendToUser(userUUID, frame)
+}
 
-		// Send to ALL connections for this user (all tabs/windows)
-		for client := range conns {
-			select {
-			case client.Send <- encoded:
-				log.Printf("Sent full user_list to %s (total users: %d)", userUUID, len(userList))
-			default:
-				log.Printf("Skipping blocked client during global update: %s (one of multiple connections)", client.UserUUID)
-			}
-		}
+func (h *Hub) sendPersonalizedUserLists(senderUUID, receiverUUID string) {
+	h.sendUserList(senderUUID)
+	if receiverUUID != senderUUID {
+		h.sendUserList(receiverUUID)
 	}
 }
 
-// MODIFIED: readPump and writePump need to pass the *sql.DB to sendOnlineUsersToAllConnected
-func readPump(db *sql.DB, client *Client) {
-	_, err := GetSession(db, client.SessionUUID)
-	if err != nil {
-		log.Printf("Invalid session %s for user %s, closing WS", client.SessionUUID, client.UserUUID)
-		return // ✅ end readPump immediately, defer cleanup runs
+// sendOnlineUsersToAllConnected sends personalized lists to ALL connected clients.
+// Runs on the hub goroutine.
+func (h *Hub) sendOnlineUsersToAllConnected() {
+	for userUUID := range h.clients {
+		h.sendUserList(userUUID)
 	}
+}
 
+func readPump(hub *Hub, client *Client) {
 	defer func() {
+		hub.Unregister(client)
 		client.Conn.Close()
-		delete(clients[client.UserUUID], client)
-		if len(clients[client.UserUUID]) == 0 {
-			delete(clients, client.UserUUID)
-			if u, ok := onlineUsers[client.UserUUID]; ok {
-				u.IsOnline = false
-			}
-		}
-
-		// If this client was typing, tell the recipient to stop
-		if status, ok := typingUsers[client]; ok && status.IsTyping {
-			typingStopMsg := TypingMessage{
-				Type:     "typing_stop",
-				From:     status.UserUUID,
-				To:       status.TypingTo,
-				Nickname: status.Nickname,
-			}
-
-			if conns, ok := clients[status.TypingTo]; ok {
-				if data, err := json.Marshal(typingStopMsg); err == nil {
-					for targetConn := range conns {
-						select {
-						case targetConn.Send <- data:
-						default:
-							log.Printf("Skipping blocked client %s during typing_stop", status.TypingTo)
-						}
-					}
-				}
-			}
-		}
-		// Clean up typing status when user disconnects
-		delete(typingUsers, client)
-		log.Printf("User %s disconnected. Total clients: %d", client.UserUUID, len(clients))
-
-		// Notify all users that this user went offline and stopped typing
-		sendOnlineUsersToAllConnected(db)
 	}()
 
+	client.Conn.SetReadLimit(hub.cfg.MaxMessageSize)
+	client.Conn.SetReadDeadline(time.Now().Add(hub.cfg.PongWait))
+	client.Conn.SetPongHandler(func(string) error {
+		return client.Conn.SetReadDeadline(time.Now().Add(hub.cfg.PongWait))
+	})
+
+	// Logout and revocation close the connection themselves, so the session
+	// is only re-read once per sessionTouchInterval; its expiry is checked
+	// on every frame.
+	var sessionExpiresAt, sessionCheckedAt time.Time
 	for {
-		// ✅ Check session validity each loop
-		_, err := GetSession(db, client.SessionUUID)
-		if err != nil {
+		now := time.Now()
+		if now.Sub(sessionCheckedAt) >= sessionTouchInterval {
+			session, err := GetSession(hub.db, client.SessionUUID)
+			if err != nil {
+				log.Printf("Session expired or invalid for %s, closing WS", client.UserUUID)
+				break
+			}
+			if err := TouchSession(hub.db, client.SessionUUID); err != nil {
+				log.Printf("Error updating session last seen: %v", err)
+			}
+			sessionExpiresAt, sessionCheckedAt = session.ExpiresAt, now
+		} else if now.After(sessionExpiresAt) {
 			log.Printf("Session expired or invalid for %s, closing WS", client.UserUUID)
-			client.Conn.Close()
 			break
 		}
 
 		// Read raw JSON message
 		_, message, err := client.Conn.ReadMessage()
 		if err != nil {
-			log.Println("read error:", err)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				hub.metrics.HeartbeatTimeouts.Add(1)
+				log.Printf("Heartbeat timeout for %s, closing WS", client.UserUUID)
+			} else {
+				log.Println("read error:", err)
+			}
 			break
 		}
+		// Any inbound frame proves the peer is alive.
+		client.Conn.SetReadDeadline(time.Now().Add(hub.cfg.PongWait))
 
-		// Parse the raw message to determine its type
-		var baseMsg map[string]interface{}
-		err = json.Unmarshal(message, &baseMsg)
+		frame, err := decodeInbound(client.Protocol, message)
 		if err != nil {
 			log.Println("JSON unmarshal error:", err)
+			hub.SendToClient(client, errorFrame("", "bad_frame", "frame is not valid JSON"))
 			continue
 		}
 
-		msgType, hasType := baseMsg["type"].(string)
+		handleInbound(hub, client, frame)
+	}
+}
 
-		if hasType && (msgType == "typing_start" || msgType == "typing_stop") {
-			// Handle typing message
-			var typingMsg TypingMessage
-			err = json.Unmarshal(message, &typingMsg)
-			if err != nil {
-				log.Println("typing message unmarshal error:", err)
-				continue
+// handleInbound dispatches one decoded client frame.
+func handleInbound(hub *Hub, client *Client, frame inboundFrame) {
+	switch frame.Type {
+	case FrameTypingStart, FrameTypingStop:
+		var p TypingPayload
+		if err := json.Unmarshal(frame.Payload, &p); err != nil || (p.To == "") == (p.Room == "") {
+			hub.SendToClient(client, errorFrame(frame.ID, "invalid_payload", "typing frames need either a 'to' user or a 'room'"))
+			return
+		}
+		var members []string
+		if p.Room != "" {
+			var err error
+			members, err = RoomMemberUUIDs(hub.db, p.Room)
+			if err != nil || !slices.Contains(members, client.UserUUID) {
+				hub.SendToClient(client, errorFrame(frame.ID, "not_member", ErrNotRoomMember.Error()))
+				return
 			}
+		}
 
-			typingMsg.From = client.UserUUID
+		hub.Typing(client, TypingMessage{
+			Type:     frame.Type,
+			From:     client.UserUUID,
+			To:       p.To,
+			Room:     p.Room,
+			Nickname: client.Nickname,
+		}, members)
+
+	case FrameChatMessage:
+		var p ChatPayload
+		if err := json.Unmarshal(frame.Payload, &p); err != nil {
+			log.Println("chat message unmarshal error:", err)
+			hub.SendToClient(client, errorFrame(frame.ID, "invalid_payload", "chat_message payload is malformed"))
+			return
+		}
+		if (p.To == "") == (p.Room == "") || (strings.TrimSpace(p.Content) == "" && len(p.Attachments) == 0) {
+			hub.SendToClient(client, errorFrame(frame.ID, "invalid_payload", "chat_message needs 'content' or 'attachments' and either 'to' or 'room'"))
+			return
+		}
+		if p.Room != "" {
+			handleRoomMessage(hub, client, frame.ID, p)
+			return
+		}
 
-			// Get sender's nickname
-			if sender, ok := onlineUsers[client.UserUUID]; ok {
-				typingMsg.Nickname = sender.Nickname
-			}
+		now := time.Now()
+		msg := Message{
+			From:    client.UserUUID,
+			To:      p.To,
+			Content: p.Content,
+			SentAt:  now.Format(time.RFC3339),
+		}
 
-			handleTypingMessage(client, typingMsg)
-		} else {
-			// Handle regular chat message
-			var msg Message
-			err = json.Unmarshal(message, &msg)
-			if err != nil {
-				log.Println("chat message unmarshal error:", err)
-				continue
+		log.Printf("Received message: From=%s, To=%s, Content=%s", msg.From, msg.To, msg.Content)
+
+		// Save to database; only persisted messages are delivered.
+		msg.UUID = uuid.New().String()
+		senderSeq, receiverSeq, err := SaveMessage(hub.db, msg.UUID, msg.From, msg.To, msg.Content, p.Attachments, now)
+		if attachmentErrorStatus(err) != 0 {
+			hub.SendToClient(client, errorFrame(frame.ID, "invalid_attachment", err.Error()))
+			return
+		} else if err != nil {
+			log.Printf("Failed to save message: %v", err)
+			hub.SendToClient(client, errorFrame(frame.ID, "save_failed", "message could not be saved"))
+			return
+		}
+		msg.SenderSeq, msg.ReceiverSeq = senderSeq, receiverSeq
+		if msg.Attachments, err = loadAttachmentsByUUID(hub.db, p.Attachments); err != nil {
+			log.Printf("Error loading attachments of message %s: %v", msg.UUID, err)
+		}
+
+		hub.SendToClient(client, ackFrame(frame.ID, AckPayload{MessageUUID: msg.UUID, SentAt: msg.SentAt, Seq: senderSeq}))
+
+		if msg.To != msg.From && !hub.IsOnline(msg.To) {
+			if err := notifyOfflineMessage(hub.db, msg.UUID); err != nil {
+				log.Printf("Error storing message notification: %v", err)
 			}
+		}
 
-			msg.From = client.UserUUID
-			msg.SentAt = time.Now().Format(time.RFC3339)
+		// Send to the hub for delivery
+		hub.Broadcast(msg)
+		notifyTargetUUID(hub, TargetMessage, msg.UUID)
 
-			log.Printf("Received message: From=%s, To=%s, Content=%s", msg.From, msg.To, msg.Content)
+	case FrameMarkRead:
+		var p MarkReadPayload
+		if err := json.Unmarshal(frame.Payload, &p); err != nil || p.With == "" {
+			hub.SendToClient(client, errorFrame(frame.ID, "invalid_payload", "mark_read needs a 'with' user"))
+			return
+		}
+		if _, err := markRead(hub, client.UserUUID, p.With, p.UpTo); err != nil {
+			hub.SendToClient(client, errorFrame(frame.ID, "mark_read_failed", err.Error()))
+			return
+		}
+		hub.SendToClient(client, NewFrame(FrameAck, frame.ID, nil, nil))
 
-			// Save to database
-			err = SaveMessage(db, uuid.New().String(), msg.From, msg.To, msg.Content, time.Now())
-			if err != nil {
-				log.Printf("Failed to save message: %v", err)
-			} else {
-				log.Printf("Message saved successfully")
+	case FrameEditMessage:
+		handleEditFrame(hub, client, frame)
+
+	case FrameDeleteMessage:
+		handleDeleteFrame(hub, client, frame)
+
+	case FrameViewPost:
+		var p ViewPostPayload
+		if len(frame.Payload) > 0 {
+			if err := json.Unmarshal(frame.Payload, &p); err != nil {
+				hub.SendToClient(client, errorFrame(frame.ID, "invalid_payload", "view_post payload is malformed"))
+				return
+			}
+		}
+		hub.ViewPost(client, p.PostUUID)
+		hub.SendToClient(client, NewFrame(FrameAck, frame.ID, nil, nil))
+
+	case FrameSubscribe, FrameUnsubscribe:
+		handleSubscribeFrame(hub, client, frame)
+
+	case FrameResume:
+		var p ResumePayload
+		if len(frame.Payload) > 0 {
+			if err := json.Unmarshal(frame.Payload, &p); err != nil {
+				hub.SendToClient(client, errorFrame(frame.ID, "invalid_payload", "resume payload is malformed"))
+				return
 			}
+		}
+		hub.Resume(client, frame.ID, p.LastSeq)
 
-			// Send to broadcast channel
-			broadcast <- msg
+	default:
+		hub.SendToClient(client, errorFrame(frame.ID, "unknown_type", "unknown frame type '"+frame.Type+"'"))
+	}
+}
+
+// markRead marks the conversation with another user read and pushes a
+// read_receipt to both users' connections.
+func markRead(hub *Hub, readerUUID, withUUID, upTo string) (ReadReceiptPayload, error) {
+	now := time.Now()
+	n, err := MarkConversationRead(hub.db, readerUUID, withUUID, upTo, now)
+	if err != nil {
+		if err != ErrMessageNotInConversation {
+			log.Printf("Error marking conversation %s/%s read: %v", readerUUID, withUUID, err)
 		}
+		return ReadReceiptPayload{}, err
 	}
+
+	receipt := ReadReceiptPayload{
+		Reader: readerUUID,
+		With:   withUUID,
+		UpTo:   upTo,
+		ReadAt: now.Format(time.RFC3339),
+		Count:  n,
+	}
+	if n > 0 {
+		hub.ReadReceipt(receipt)
+	}
+	return receipt, nil
 }
 
-func writePump(client *Client) {
+// writePump is the only goroutine that writes to the connection. It sends
+// pings every PingPeriod and exits when the hub closes client.Send or a
+// write fails; closing the connection then unblocks readPump.
+func writePump(hub *Hub, client *Client) {
+	ticker := time.NewTicker(hub.cfg.PingPeriod)
+	defer func() {
+		ticker.Stop()
+		client.Conn.Close()
+	}()
+
 	for {
-		msg, ok := <-client.Send
-		if !ok {
-			return
+		select {
+		case msg, ok := <-client.Send:
+			client.Conn.SetWriteDeadline(time.Now().Add(hub.cfg.WriteWait))
+			if !ok {
+				// The hub closed the channel.
+				client.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := client.Conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				hub.metrics.WriteErrors.Add(1)
+				log.Printf("write error for %s: %v", client.UserUUID, err)
+				return
+			}
+		case <-ticker.C:
+			client.Conn.SetWriteDeadline(time.Now().Add(hub.cfg.WriteWait))
+			if err := client.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				hub.metrics.WriteErrors.Add(1)
+				log.Printf("ping error for %s: %v", client.UserUUID, err)
+				return
+			}
 		}
-		client.Conn.WriteMessage(websocket.TextMessage, msg)
 	}
 }
 
-// handleTypingMessage processes typing start/stop messages
-func handleTypingMessage(client *Client, msg TypingMessage) {
+// handleTypingMessage processes typing start/stop messages. Runs on the hub goroutine.
+func (h *Hub) handleTypingMessage(client *Client, msg TypingMessage, roomMembers []string) {
 	log.Printf("Handling typing message: %s from %s to %s", msg.Type, msg.Nickname, msg.To)
 
-	if msg.Type == "typing_start" {
-		typingUsers[client] = &TypingStatus{
+	if msg.Type == FrameTypingStart {
+		h.typingUsers[client] = &TypingStatus{
 			UserUUID: msg.From,
 			IsTyping: true,
 			Nickname: msg.Nickname,
 			TypingTo: msg.To,
+			Room:     msg.Room,
 			LastSeen: time.Now(),
-		}
-	} else if msg.Type == "typing_stop" {
-		delete(typingUsers, client)
-	}
 
-	// Send typing status to ALL connections of the target user
-	if targets, ok := clients[msg.To]; ok {
-		data, err := json.Marshal(msg)
-		if err != nil {
-			log.Println("Error marshaling typing message:", err)
-			return
+			roomMembers: roomMembers,
 		}
+	} else if msg.Type == FrameTypingStop {
+		delete(h.typingUsers, client)
+	}
 
-		for c := range targets {
-			select {
-			case c.Send <- data:
-			default:
-				log.Printf("Failed to send typing status to %s (channel blocked)", msg.To)
-			}
-		}
+	if msg.Room != "" {
+		h.sendToRoom(roomMembers, msg.From, typingFrame(msg))
+		return
 	}
-}
 
-// cleanupOldTypingStatus removes stale typing statuses (optional, for cleanup)
-func cleanupOldTypingStatus() {
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
+	// Send typing status to ALL connections of the target user
+	h.sendToUser(msg.To, typingFrame(msg))
+}
 
-	for range ticker.C {
-		now := time.Now()
-		for client, status := range typingUsers {
-			if now.Sub(status.LastSeen) > 15*time.Second {
-				log.Printf("Cleaning up stale typing status for client %s (user %s)", client.UserUUID, status.UserUUID)
-				delete(typingUsers, client)
-			}
+// cleanupOldTypingStatus removes stale typing statuses. Runs on the hub goroutine.
+func (h *Hub) cleanupOldTypingStatus(now time.Time) {
+	for client, status := range h.typingUsers {
+		if now.Sub(status.LastSeen) > 15*time.Second {
+			log.Printf("Cleaning up stale typing status for client %s (user %s)", client.UserUUID, status.UserUUID)
+			delete(h.typingUsers, client)
 		}
 	}
 }
-
-// In your WebSocketHandler, you must also pass the `db` handle when calling `sendOnlineUsersToAllConnected`
-// ... inside WebSocketHandler ...
-// sendOnlineUsersToAllConnected(db) // on connect
-// go writePump(client)
-// readPump(db, client) // already passes db
-// ...
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Comments form reply trees. Each comment stores its depth and a
+// materialised path of zero-padded ids from the top-level comment down, so
+// ordering by path lists a thread depth-first with replies under their
+// parent, oldest first at every level.
+
+// maxCommentDepth is the deepest reply allowed; top-level comments are depth 0.
+var maxCommentDepth = envInt("COMMENT_MAX_DEPTH", 5)
+
+var ErrReplyTooDeep = errors.New("reply thread is too deep")
+
+// pathSegment pads ids so paths compare correctly as strings. SQL that
+// builds paths uses the same printf('%010d', id).
+func pathSegment(id int64) string {
+	return fmt.Sprintf("%010d", id)
+}
+
+// InsertComment stores a comment on a post, as a reply when parentUUID is
+// set, with the author's uploads in attachments. The parent must be a live
+// comment on the same post. It returns the new comment's id and uuid.
+func InsertComment(db *sql.DB, userUUID, postUUID, parentUUID, content string, attachments []string) (int64, string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback()
+
+	var postID int64
+	var postAuthor string
+	err = tx.QueryRow(`SELECT id, user_uuid FROM posts WHERE post_uuid = ? AND deleted_at IS NULL`, postUUID).Scan(&postID, &postAuthor)
+	if err == sql.ErrNoRows {
+		return 0, "", ErrPostNotFound
+	} else if err != nil {
+		return 0, "", err
+	}
+
+	var parentID sql.NullInt64
+	var parentAuthor string
+	depth, path := 0, ""
+	if parentUUID != "" {
+		var parentDepth int
+		err = tx.QueryRow(`SELECT id, depth, path, user_uuid FROM comments
+            WHERE comment_uuid = ? AND post_id = ? AND deleted_at IS NULL`, parentUUID, postID).Scan(&parentID, &parentDepth, &path, &parentAuthor)
+		if err == sql.ErrNoRows {
+			return 0, "", ErrCommentNotFound
+		} else if err != nil {
+			return 0, "", err
+		}
+		depth = parentDepth + 1
+		if depth > maxCommentDepth {
+			return 0, "", ErrReplyTooDeep
+		}
+		path += "/"
+	}
+
+	commentUUID := uuid.New().String()
+	res, err := tx.Exec(`
+		INSERT INTO comments (comment_uuid, post_id, parent_id, depth, user_uuid, content, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, commentUUID, postID, parentID, depth, userUUID, content, time.Now())
+	if err != nil {
+		return 0, "", err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, "", err
+	}
+	if _, err := tx.Exec(`UPDATE comments SET path = ? WHERE id = ?`, path+pathSegment(id), id); err != nil {
+		return 0, "", err
+	}
+	if err := attachFiles(tx, userUUID, attachments, TargetComment, id); err != nil {
+		return 0, "", err
+	}
+	if err := recordMentions(tx, TargetComment, id, userUUID, content); err != nil {
+		return 0, "", err
+	}
+	// The post author hears about every comment, unless the comment already
+	// notifies them as a reply to their own comment.
+	if err := addNotification(tx, parentAuthor, NotifyCommentReply, userUUID, TargetComment, id); err != nil {
+		return 0, "", err
+	}
+	if postAuthor != parentAuthor {
+		if err := addNotification(tx, postAuthor, NotifyReply, userUUID, TargetComment, id); err != nil {
+			return 0, "", err
+		}
+	}
+	return id, commentUUID, tx.Commit()
+}
+
+const (
+	CommentSortOldest = "oldest"
+	CommentSortNewest = "newest"
+	CommentSortTop    = "top" // likes minus dislikes
+
+	defaultCommentPageSize = 20
+	maxCommentPageSize     = 100
+)
+
+// threadReplyLimit is how many replies each thread on a page of comments
+// comes with; the rest are fetched with the thread's more_replies_cursor.
+var threadReplyLimit = envInt("COMMENT_THREAD_REPLY_LIMIT", 50)
+
+var ErrInvalidCommentCursor = errors.New("invalid comment cursor")
+
+// CommentQuery selects a page of threads. Sort and the page size apply to
+// top-level comments; each comes with up to threadReplyLimit of its replies
+// in thread order. Cursor is the next_cursor of the previous page, empty for
+// the first.
+//
+// With Thread set to the uuid of a top-level comment, it selects a page of
+// that thread's replies instead: Limit of them, in thread order, after the
+// reply whose id is Cursor. Sort does not apply.
+type CommentQuery struct {
+	Sort   string
+	Cursor string
+	Limit  int
+	Thread string
+}
+
+type CommentPage struct {
+	Comments   []Comment `json:"comments"`
+	NextCursor string    `json:"next_cursor,omitempty"` // empty on the last page
+}
+
+// commentCursor is the position after the last thread of a page: its
+// top-level comment id and, for top sort, that comment's score. It is
+// written as "id" or "score:id".
+type commentCursor struct {
+	score int
+	id    int64
+}
+
+func parseCommentCursor(sort, s string) (commentCursor, error) {
+	var c commentCursor
+	var err error
+	if sort == CommentSortTop {
+		scoreStr, idStr, ok := strings.Cut(s, ":")
+		if !ok {
+			return c, ErrInvalidCommentCursor
+		}
+		if c.score, err = strconv.Atoi(scoreStr); err != nil {
+			return c, ErrInvalidCommentCursor
+		}
+		s = idStr
+	}
+	if c.id, err = strconv.ParseInt(s, 10, 64); err != nil || c.id < 1 {
+		return c, ErrInvalidCommentCursor
+	}
+	return c, nil
+}
+
+func (c commentCursor) String(sort string) string {
+	if sort == CommentSortTop {
+		return fmt.Sprintf("%d:%d", c.score, c.id)
+	}
+	return strconv.FormatInt(c.id, 10)
+}
+
+// commentSelect reads what scanComment expects: a comment's fields, then the
+// id of the top-level comment of its thread, the first path segment.
+const commentSelect = `
+		SELECT comments.id, comments.comment_uuid, COALESCE(parent.comment_uuid, ''), comments.depth,
+		       comments.content, users.nickname, users.uuid, comments.created_at,
+		       comments.edited_at IS NOT NULL, comments.deleted_at IS NOT NULL,
+		       CAST(substr(comments.path, 1, 10) AS INTEGER)
+		FROM comments
+		JOIN users ON comments.user_uuid = users.uuid
+		LEFT JOIN comments parent ON parent.id = comments.parent_id`
+
+func scanComment(row interface{ Scan(...interface{}) error }, c *Comment, rootID *int64) error {
+	if err := row.Scan(&c.ID, &c.UUID, &c.ParentUUID, &c.Depth, &c.Content, &c.Author, &c.AuthorUUID, &c.CreatedAt, &c.Edited, &c.Deleted, rootID); err != nil {
+		return err
+	}
+	c.ContentHTML = renderMarkdown(c.Content)
+	return nil
+}
+
+// loadComment loads a single comment without the viewer's vote.
+func loadComment(db *sql.DB, commentID int64) (Comment, error) {
+	var c Comment
+	var rootID int64
+	err := scanComment(db.QueryRow(commentSelect+` WHERE comments.id = ?`, commentID), &c, &rootID)
+	if err == sql.ErrNoRows {
+		return c, ErrCommentNotFound
+	} else if err != nil {
+		return c, err
+	}
+	reactions, err := LoadReactions(db, TargetComment, []int64{commentID}, "")
+	if err != nil {
+		return c, err
+	}
+	c.Reactions = reactions[commentID]
+	if c.Attachments, err = loadTargetAttachments(db, TargetComment, commentID); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// LoadComments returns a page of comment threads on a post, or of one
+// thread's replies. Deleted comments stay in as tombstones so their replies
+// keep their place.
+func LoadComments(db *sql.DB, postID int64, q CommentQuery, viewerUUID string) (CommentPage, error) {
+	if q.Thread != "" {
+		return loadThreadReplies(db, postID, q, viewerUUID)
+	}
+	page := CommentPage{Comments: []Comment{}}
+
+	score := "0"
+	if q.Sort == CommentSortTop {
+		score = `(SELECT COALESCE(SUM(CASE WHEN is_like THEN 1 ELSE -1 END), 0)
+                  FROM likes_dislikes WHERE target_type = 'comment' AND target_id = c.id)`
+	}
+	query := `SELECT id, score FROM (
+            SELECT c.id, ` + score + ` AS score
+            FROM comments c
+            WHERE c.post_id = ? AND c.parent_id IS NULL
+        )`
+	args := []interface{}{postID}
+
+	if q.Cursor != "" {
+		after, err := parseCommentCursor(q.Sort, q.Cursor)
+		if err != nil {
+			return page, err
+		}
+		switch q.Sort {
+		case CommentSortNewest:
+			query += ` WHERE id < ?`
+			args = append(args, after.id)
+		case CommentSortTop:
+			query += ` WHERE score < ? OR (score = ? AND id > ?)`
+			args = append(args, after.score, after.score, after.id)
+		default:
+			query += ` WHERE id > ?`
+			args = append(args, after.id)
+		}
+	}
+	switch q.Sort {
+	case CommentSortNewest:
+		query += ` ORDER BY id DESC`
+	case CommentSortTop:
+		query += ` ORDER BY score DESC, id ASC`
+	default:
+		query += ` ORDER BY id ASC`
+	}
+	// One extra row tells whether there is another page.
+	query += ` LIMIT ?`
+	args = append(args, q.Limit+1)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+
+	var roots []commentCursor
+	for rows.Next() {
+		var c commentCursor
+		if err := rows.Scan(&c.id, &c.score); err != nil {
+			return page, err
+		}
+		roots = append(roots, c)
+	}
+	if err := rows.Err(); err != nil {
+		return page, err
+	}
+	rows.Close()
+
+	if len(roots) > q.Limit {
+		roots = roots[:q.Limit]
+		page.NextCursor = roots[len(roots)-1].String(q.Sort)
+	}
+	if len(roots) == 0 {
+		return page, nil
+	}
+
+	// The first path segment is the top-level comment of the thread, which
+	// sorts before its replies. Each thread is cut after threadReplyLimit
+	// replies, reading one more to tell whether it goes on.
+	rootIDs := make([]int64, len(roots))
+	for i, root := range roots {
+		rootIDs[i] = root.id
+	}
+	args = append([]interface{}{postID}, toInterfaceSlice(rootIDs)...)
+	rows, err = db.Query(`WITH numbered AS (
+		    SELECT id, ROW_NUMBER() OVER (PARTITION BY substr(path, 1, 10) ORDER BY path) - 1 AS reply
+		    FROM comments
+		    WHERE post_id = ? AND CAST(substr(path, 1, 10) AS INTEGER) IN (`+strings.Repeat("?,", len(rootIDs)-1)+`?)
+		)`+commentSelect+`
+		JOIN numbered ON numbered.id = comments.id
+		WHERE numbered.reply <= ?
+		ORDER BY comments.path
+	`, append(args, threadReplyLimit+1)...)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+
+	threads := make(map[int64][]Comment, len(roots))
+	for rows.Next() {
+		var rootID int64
+		var c Comment
+		if err := scanComment(rows, &c, &rootID); err != nil {
+			return page, err
+		}
+		thread := threads[rootID]
+		if len(thread) > threadReplyLimit {
+			// The root and threadReplyLimit replies are in already.
+			thread[0].MoreRepliesCursor = strconv.FormatInt(thread[len(thread)-1].ID, 10)
+			continue
+		}
+		threads[rootID] = append(thread, c)
+	}
+	if err := rows.Err(); err != nil {
+		return page, err
+	}
+
+	for _, root := range roots {
+		page.Comments = append(page.Comments, threads[root.id]...)
+	}
+	return page, fillComments(db, page.Comments, viewerUUID)
+}
+
+// loadThreadReplies is LoadComments for a page of one thread's replies.
+func loadThreadReplies(db *sql.DB, postID int64, q CommentQuery, viewerUUID string) (CommentPage, error) {
+	page := CommentPage{Comments: []Comment{}}
+	var rootPath string
+	err := db.QueryRow(`SELECT path FROM comments WHERE comment_uuid = ? AND post_id = ? AND parent_id IS NULL`,
+		q.Thread, postID).Scan(&rootPath)
+	if err == sql.ErrNoRows {
+		return page, ErrCommentNotFound
+	} else if err != nil {
+		return page, err
+	}
+
+	after := rootPath
+	if q.Cursor != "" {
+		id, err := strconv.ParseInt(q.Cursor, 10, 64)
+		if err != nil {
+			return page, ErrInvalidCommentCursor
+		}
+		err = db.QueryRow(`SELECT path FROM comments WHERE id = ? AND post_id = ? AND substr(path, 1, 10) = ?`,
+			id, postID, rootPath).Scan(&after)
+		if err == sql.ErrNoRows {
+			return page, ErrInvalidCommentCursor
+		} else if err != nil {
+			return page, err
+		}
+	}
+
+	// One extra row tells whether there is another page.
+	rows, err := db.Query(commentSelect+`
+		WHERE comments.post_id = ? AND substr(comments.path, 1, 10) = ? AND comments.path > ?
+		ORDER BY comments.path
+		LIMIT ?`, postID, rootPath, after, q.Limit+1)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rootID int64
+		var c Comment
+		if err := scanComment(rows, &c, &rootID); err != nil {
+			return page, err
+		}
+		page.Comments = append(page.Comments, c)
+	}
+	if err := rows.Err(); err != nil {
+		return page, err
+	}
+
+	if len(page.Comments) > q.Limit {
+		page.Comments = page.Comments[:q.Limit]
+		page.NextCursor = strconv.FormatInt(page.Comments[q.Limit-1].ID, 10)
+	}
+	return page, fillComments(db, page.Comments, viewerUUID)
+}
+
+// fillComments adds the viewer's reactions and the attachments to loaded
+// comments.
+func fillComments(db *sql.DB, comments []Comment, viewerUUID string) error {
+	commentIDs := make([]int64, len(comments))
+	for i, c := range comments {
+		commentIDs[i] = c.ID
+	}
+	reactions, err := LoadReactions(db, TargetComment, commentIDs, viewerUUID)
+	if err != nil {
+		return err
+	}
+	attachments, err := LoadAttachments(db, TargetComment, commentIDs)
+	if err != nil {
+		return err
+	}
+	for i := range comments {
+		c := &comments[i]
+		c.Reactions = reactions[c.ID]
+		if !c.Deleted {
+			c.Attachments = attachments[c.ID]
+		}
+	}
+	return nil
+}
+
+// LoadPostComments is LoadComments for a post given by uuid.
+func LoadPostComments(db *sql.DB, postUUID string, q CommentQuery, viewerUUID string) (CommentPage, error) {
+	var postID int64
+	err := db.QueryRow(`SELECT id FROM posts WHERE post_uuid = ? AND deleted_at IS NULL`, postUUID).Scan(&postID)
+	if err == sql.ErrNoRows {
+		return CommentPage{}, ErrPostNotFound
+	} else if err != nil {
+		return CommentPage{}, err
+	}
+	return LoadComments(db, postID, q, viewerUUID)
+}
+
+// parseCommentQuery reads sort, cursor and limit from a request. The page
+// size defaults to defaultCommentPageSize and is capped at
+// maxCommentPageSize.
+func parseCommentQuery(r *http.Request) (CommentQuery, error) {
+	v := r.URL.Query()
+	q := CommentQuery{Sort: v.Get("sort"), Cursor: v.Get("cursor"), Limit: defaultCommentPageSize, Thread: v.Get("thread")}
+	switch q.Sort {
+	case "":
+		q.Sort = CommentSortOldest
+	case CommentSortOldest, CommentSortNewest, CommentSortTop:
+	default:
+		return q, errors.New("'sort' must be oldest, newest or top")
+	}
+	if limitStr := v.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 1 {
+			return q, errors.New("'limit' must be a positive number")
+		}
+		q.Limit = min(limit, maxCommentPageSize)
+	}
+	return q, nil
+}
+
+// CommentsHandler: GET /comments?post=<uuid>[&sort=oldest|newest|top][&cursor=][&limit=]
+// or, for more of a thread's replies, GET /comments?post=<uuid>&thread=<uuid>[&cursor=][&limit=]
+func CommentsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		postUUID := r.URL.Query().Get("post")
+		if postUUID == "" {
+			http.Error(w, "Missing post UUID", http.StatusBadRequest)
+			return
+		}
+		q, err := parseCommentQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		viewerUUID, _ := UserUUIDFromContext(r.Context())
+		page, err := LoadPostComments(db, postUUID, q, viewerUUID)
+		switch err {
+		case nil:
+		case ErrPostNotFound:
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		case ErrCommentNotFound:
+			http.Error(w, "Thread not found", http.StatusNotFound)
+			return
+		case ErrInvalidCommentCursor:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		default:
+			log.Printf("Error loading comments: %v", err)
+			http.Error(w, "Failed to load comments", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// commentTree is a post with two threads:
+//
+//	a
+//	  a1
+//	    a1x
+//	  a2
+//	  a3
+//	    a3x
+//	b
+//	  b1
+type commentTree struct {
+	db   *sql.DB
+	user string
+	post string
+	ids  map[string]string // comment name to uuid
+}
+
+func newCommentTree(t *testing.T) *commentTree {
+	t.Helper()
+	db := newTestDB(t)
+	ct := &commentTree{db: db, user: createTestUser(t, db, "alice"), post: uuid.New().String(), ids: map[string]string{}}
+	if err := InsertPost(db, ct.post, ct.user, "Threads", "body", nil, nil, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ name, parent string }{
+		{"a", ""}, {"a1", "a"}, {"b", ""}, {"a1x", "a1"}, {"a2", "a"}, {"b1", "b"}, {"a3", "a"}, {"a3x", "a3"},
+	} {
+		_, commentUUID, err := InsertComment(db, ct.user, ct.post, ct.ids[c.parent], c.name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ct.ids[c.name] = commentUUID
+	}
+	return ct
+}
+
+func (ct *commentTree) load(t *testing.T, q CommentQuery) ([]string, CommentPage) {
+	t.Helper()
+	page, err := LoadPostComments(ct.db, ct.post, q, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, c := range page.Comments {
+		names = append(names, c.Content)
+	}
+	return names, page
+}
+
+func TestLoadCommentsCapsReplies(t *testing.T) {
+	old := threadReplyLimit
+	threadReplyLimit = 3
+	t.Cleanup(func() { threadReplyLimit = old })
+	ct := newCommentTree(t)
+
+	names, page := ct.load(t, CommentQuery{Sort: CommentSortOldest, Limit: 10})
+	if want := []string{"a", "a1", "a1x", "a2", "b", "b1"}; !slices.Equal(names, want) {
+		t.Fatalf("got %v, want %v", names, want)
+	}
+	a, b := page.Comments[0], page.Comments[4]
+	if a.MoreRepliesCursor == "" || b.MoreRepliesCursor != "" {
+		t.Fatalf("reply cursors %q and %q; want one for a only", a.MoreRepliesCursor, b.MoreRepliesCursor)
+	}
+
+	// The rest of a's thread, a page of one at a time.
+	var rest []string
+	cursor := a.MoreRepliesCursor
+	for pages := 0; cursor != ""; pages++ {
+		if pages == 5 {
+			t.Fatal("reply pages never end")
+		}
+		var names []string
+		names, page = ct.load(t, CommentQuery{Thread: ct.ids["a"], Cursor: cursor, Limit: 1})
+		rest = append(rest, names...)
+		cursor = page.NextCursor
+	}
+	if want := []string{"a3", "a3x"}; !slices.Equal(rest, want) {
+		t.Errorf("rest of the thread %v, want %v", rest, want)
+	}
+
+	// A whole thread from the start.
+	if names, page := ct.load(t, CommentQuery{Thread: ct.ids["b"], Limit: 10}); !slices.Equal(names, []string{"b1"}) || page.NextCursor != "" {
+		t.Errorf("b's replies %v, next cursor %q", names, page.NextCursor)
+	}
+}
+
+func TestLoadThreadRepliesErrors(t *testing.T) {
+	ct := newCommentTree(t)
+	_, page := ct.load(t, CommentQuery{Thread: ct.ids["b"], Limit: 10})
+	bCursor := page.Comments[0].ID
+
+	tests := []struct {
+		name   string
+		thread string
+		cursor string
+		err    error
+	}{
+		{"reply as thread", ct.ids["a1"], "", ErrCommentNotFound},
+		{"unknown thread", "no-such-comment", "", ErrCommentNotFound},
+		{"cursor from another thread", ct.ids["a"], itoa(bCursor), ErrInvalidCommentCursor},
+		{"malformed cursor", ct.ids["a"], "x", ErrInvalidCommentCursor},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadPostComments(ct.db, ct.post, CommentQuery{Thread: tt.thread, Cursor: tt.cursor, Limit: 10}, "")
+			if err != tt.err {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCommentTreeOrder(t *testing.T) {
+	ct := newCommentTree(t)
+	_, page := ct.load(t, CommentQuery{Sort: CommentSortOldest, Limit: 10})
+	var got []string
+	for _, c := range page.Comments {
+		got = append(got, fmt.Sprintf("%s:%d", c.Content, c.Depth))
+		if c.ParentUUID != ct.ids[parentName(c.Content)] {
+			t.Errorf("%s: parent %q", c.Content, c.ParentUUID)
+		}
+	}
+	want := []string{"a:0", "a1:1", "a1x:2", "a2:1", "a3:1", "a3x:2", "b:0", "b1:1"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// parentName is the name of a commentTree comment's parent: names drop their
+// last character to go up a level.
+func parentName(name string) string {
+	return name[:len(name)-1]
+}
+
+func TestInsertCommentDepth(t *testing.T) {
+	old := maxCommentDepth
+	maxCommentDepth = 2
+	t.Cleanup(func() { maxCommentDepth = old })
+	db := newTestDB(t)
+	alice := createTestUser(t, db, "alice")
+	postUUID := uuid.New().String()
+	if err := InsertPost(db, postUUID, alice, "Title", "body", nil, nil, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	parent, wantPath := "", ""
+	for depth := 0; depth <= maxCommentDepth; depth++ {
+		id, commentUUID, err := InsertComment(db, alice, postUUID, parent, "reply", nil)
+		if err != nil {
+			t.Fatalf("depth %d: %v", depth, err)
+		}
+		if depth > 0 {
+			wantPath += "/"
+		}
+		wantPath += pathSegment(id)
+		var gotDepth int
+		var gotPath string
+		if err := db.QueryRow(`SELECT depth, path FROM comments WHERE id = ?`, id).Scan(&gotDepth, &gotPath); err != nil {
+			t.Fatal(err)
+		}
+		if gotDepth != depth || gotPath != wantPath {
+			t.Errorf("depth %d, path %q; want %d, %q", gotDepth, gotPath, depth, wantPath)
+		}
+		parent = commentUUID
+	}
+	if _, _, err := InsertComment(db, alice, postUUID, parent, "too deep", nil); err != ErrReplyTooDeep {
+		t.Errorf("reply below the limit: %v", err)
+	}
+	var n int
+	db.QueryRow(`SELECT COUNT(*) FROM comments`).Scan(&n)
+	if n != maxCommentDepth+1 {
+		t.Errorf("%d comments stored, want %d", n, maxCommentDepth+1)
+	}
+}
+
+func TestInsertCommentParent(t *testing.T) {
+	tests := []struct {
+		name   string
+		post   string // "other" for a second post
+		parent func(t *testing.T, ct *commentTree) string
+		err    error
+	}{
+		{"unknown parent", "", func(t *testing.T, ct *commentTree) string { return "no-such-comment" }, ErrCommentNotFound},
+		{"parent on another post", "other", func(t *testing.T, ct *commentTree) string { return ct.ids["a"] }, ErrCommentNotFound},
+		{"deleted parent", "", func(t *testing.T, ct *commentTree) string {
+			var id int64
+			ct.db.QueryRow(`SELECT id FROM comments WHERE comment_uuid = ?`, ct.ids["a1"]).Scan(&id)
+			if err := DeleteComment(ct.db, id, ct.user, time.Now()); err != nil {
+				t.Fatal(err)
+			}
+			return ct.ids["a1"]
+		}, ErrCommentNotFound},
+		{"deleted post", "", func(t *testing.T, ct *commentTree) string {
+			if err := DeletePost(ct.db, ct.post, ct.user, time.Now()); err != nil {
+				t.Fatal(err)
+			}
+			return ""
+		}, ErrPostNotFound},
+		{"unknown post", "missing", func(t *testing.T, ct *commentTree) string { return "" }, ErrPostNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ct := newCommentTree(t)
+			postUUID := ct.post
+			switch tt.post {
+			case "other":
+				postUUID = uuid.New().String()
+				if err := InsertPost(ct.db, postUUID, ct.user, "Other", "body", nil, nil, time.Now()); err != nil {
+					t.Fatal(err)
+				}
+			case "missing":
+				postUUID = "no-such-post"
+			}
+			parent := tt.parent(t, ct)
+			if _, _, err := InsertComment(ct.db, ct.user, postUUID, parent, "reply", nil); err != tt.err {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
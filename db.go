@@ -4,9 +4,9 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"html"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,23 +16,43 @@ import (
 var ErrUserExists = errors.New("user already exists")
 
 type MessageWithAuthor struct {
-	From         string `json:"from"`
-	To           string `json:"to"`
-	Content      string `json:"content"`
-	SentAt       string `json:"sent_at"`
-	FromNickname string `json:"from_nickname"`
+	UUID         string       `json:"uuid"`
+	From         string       `json:"from"`
+	To           string       `json:"to,omitempty"`
+	Room         string       `json:"room,omitempty"`
+	Content      string       `json:"content"`
+	ContentHTML  string       `json:"content_html"`
+	SentAt       string       `json:"sent_at"`
+	FromNickname string       `json:"from_nickname"`
+	Attachments  []Attachment `json:"attachments,omitempty"`
+	DeliveredAt  *time.Time   `json:"delivered_at"`
+	ReadAt       *time.Time   `json:"read_at"`
+	Edited       bool         `json:"edited"`
+	Deleted      bool         `json:"deleted"`
+
+	id int64 // private_messages or conversation_messages row
 }
 
+// PrepopulateCategories seeds the default categories into an empty table.
+// After that moderators manage them, see categories.go.
 func PrepopulateCategories(db *sql.DB) error {
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM categories)").Scan(&exists); err != nil {
+		return fmt.Errorf("failed to check categories: %w", err)
+	}
+	if exists {
+		return nil
+	}
+
 	categories := []string{"Sports", "Politics", "Music", "Entertainment", "General"}
-	stmt, err := db.Prepare("INSERT OR IGNORE INTO categories (name) VALUES (?)")
+	stmt, err := db.Prepare("INSERT OR IGNORE INTO categories (name, slug, position) VALUES (?, ?, ?)")
 	if err != nil {
 		return fmt.Errorf("failed to prepare statement for categories: %w", err)
 	}
 	defer stmt.Close()
 
-	for _, category := range categories {
-		if _, err := stmt.Exec(category); err != nil {
+	for i, category := range categories {
+		if _, err := stmt.Exec(category, slugify(category), i+1); err != nil {
 			log.Printf("Could not insert category %s: %v", category, err)
 			// Continue trying to insert others
 		}
@@ -42,7 +62,10 @@ func PrepopulateCategories(db *sql.DB) error {
 }
 
 func InitDB(dbFile string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", dbFile)
+	// Wait for competing writers instead of failing with "database is locked".
+	// Transactions take the write lock up front: one that reads first and
+	// then finds another writer ahead of it would fail without waiting.
+	db, err := sql.Open("sqlite3", dbFile+"?_busy_timeout=5000&_txlock=immediate")
 	if err != nil {
 		return nil, err
 	}
@@ -64,6 +87,18 @@ func InitDB(dbFile string) (*sql.DB, error) {
 		return nil, err
 	}
 
+	if err := runMigrations(db); err != nil {
+		return nil, err
+	}
+
+	if err := setupSearch(db); err != nil {
+		return nil, err
+	}
+
+	if err := loadNicknames(db); err != nil {
+		return nil, err
+	}
+
 	if err := PrepopulateCategories(db); err != nil {
 		log.Printf("Warning: could not pre-populate categories: %v", err)
 	}
@@ -99,6 +134,9 @@ func InsertUserFull(db *sql.DB, uuid, nickname, email, passwordHash string, age
              VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
 	_, err := db.Exec(stmt, uuid, nickname, email, passwordHash, age, gender, firstName, lastName)
 	fmt.Println(err)
+	if err == nil {
+		addNickname(nickname)
+	}
 	return err
 }
 
@@ -114,10 +152,61 @@ func getUserAuth(db *sql.DB, query, id string) (string, string, error) {
 	return uuid, hash, err
 }
 
-// CreateSession inserts a session for a user
-func CreateSession(db *sql.DB, sessionUUID, userUUID string, expiresAt time.Time) error {
-	stmt := `INSERT INTO sessions (session_uuid, user_uuid, expires_at) VALUES (?, ?, ?)`
-	_, err := db.Exec(stmt, sessionUUID, userUUID, expiresAt)
+// Roles are assigned directly in the users table; everyone starts as a user.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+func GetUserRole(db *sql.DB, userUUID string) (string, error) {
+	var role string
+	err := db.QueryRow("SELECT role FROM users WHERE uuid = ?", userUUID).Scan(&role)
+	return role, err
+}
+
+var ErrNotModerator = errors.New("only moderators can do that")
+
+// canModerate reports whether a role may change other users' content.
+func canModerate(role string) bool {
+	return role == RoleModerator || role == RoleAdmin
+}
+
+// requireModerator looks up the user's role and fails unless they moderate.
+func requireModerator(db *sql.DB, userUUID string) error {
+	role, err := GetUserRole(db, userUUID)
+	if err != nil {
+		return err
+	}
+	if !canModerate(role) {
+		return ErrNotModerator
+	}
+	return nil
+}
+
+var (
+	ErrNotAdmin     = errors.New("only admins can do that")
+	ErrUserNotFound = errors.New("user not found")
+)
+
+// requireAdmin looks up the user's role and fails unless they are an admin.
+func requireAdmin(db *sql.DB, userUUID string) error {
+	role, err := GetUserRole(db, userUUID)
+	if err != nil {
+		return err
+	}
+	if role != RoleAdmin {
+		return ErrNotAdmin
+	}
+	return nil
+}
+
+// CreateSession inserts a session for a user, noting the device it is for
+func CreateSession(db *sql.DB, sessionUUID, userUUID string, expiresAt time.Time, userAgent, ip string) error {
+	now := time.Now()
+	stmt := `INSERT INTO sessions (session_uuid, user_uuid, expires_at, user_agent, ip, created_at, last_seen_at)
+             VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, err := db.Exec(stmt, sessionUUID, userUUID, expiresAt, userAgent, ip, now, now)
 	return err
 }
 
@@ -151,13 +240,34 @@ func DeleteSession(db *sql.DB, sessionUUID string) error {
 	return err
 }
 
-func InsertPost(db *sql.DB, postUUID, userUUID, title, content string, createdAt time.Time) error {
-	safeTitle := html.EscapeString(title)
-	safeContent := html.EscapeString(content)
+// InsertPost stores a post with the author's uploads in attachments and the
+// normalized tags.
+func InsertPost(db *sql.DB, postUUID, userUUID, title, content string, attachments, tags []string, createdAt time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
 	stmt := "INSERT INTO posts (post_uuid, user_uuid, title, content, created_at) VALUES (?, ?, ?, ?, ?)"
-	_, err := db.Exec(stmt, postUUID, userUUID, safeTitle, safeContent, createdAt)
-	return err
+	res, err := tx.Exec(stmt, postUUID, userUUID, title, content, createdAt)
+	if err != nil {
+		return err
+	}
+	postID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	if err := attachFiles(tx, userUUID, attachments, TargetPost, postID); err != nil {
+		return err
+	}
+	if err := tagPost(tx, postID, tags); err != nil {
+		return err
+	}
+	if err := recordMentions(tx, TargetPost, postID, userUUID, content); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func InsertPostCategories(db *sql.DB, postUUID string, categories []string) error {
@@ -177,7 +287,7 @@ func InsertPostCategories(db *sql.DB, postUUID string, categories []string) erro
 	}
 
 	// Prepare statement to get category ID
-	catStmt, err := tx.Prepare("SELECT id FROM categories WHERE name = ?")
+	catStmt, err := tx.Prepare("SELECT id FROM categories WHERE name = ? OR slug = ?")
 	if err != nil {
 		tx.Rollback()
 		return fmt.Errorf("failed to prepare category select statement: %w", err)
@@ -185,7 +295,7 @@ func InsertPostCategories(db *sql.DB, postUUID string, categories []string) erro
 	defer catStmt.Close()
 
 	// Prepare statement to insert into linking table
-	linkStmt, err := tx.Prepare("INSERT INTO post_categories (post_id, category_id) VALUES (?, ?)")
+	linkStmt, err := tx.Prepare("INSERT OR IGNORE INTO post_categories (post_id, category_id) VALUES (?, ?)")
 	if err != nil {
 		tx.Rollback()
 		return fmt.Errorf("failed to prepare post_categories insert statement: %w", err)
@@ -195,7 +305,7 @@ func InsertPostCategories(db *sql.DB, postUUID string, categories []string) erro
 	for _, catName := range categories {
 		var categoryID int
 		// Find the ID of the existing category.
-		err := catStmt.QueryRow(catName).Scan(&categoryID)
+		err := catStmt.QueryRow(catName, catName).Scan(&categoryID)
 		if err == sql.ErrNoRows {
 			// If a category from the frontend doesn't exist, we skip it.
 			// This prevents creating unwanted categories.
@@ -217,73 +327,322 @@ func InsertPostCategories(db *sql.DB, postUUID string, categories []string) erro
 	return tx.Commit()
 }
 
-func SaveMessage(db *sql.DB, uuid, sender, receiver, content string, createdAt time.Time) error {
-	safeContent := html.EscapeString(content)
+// SaveMessage stores a private message with the sender's uploads in
+// attachments and appends it to the sender's and receiver's message logs,
+// returning the per-user sequence numbers.
+func SaveMessage(db *sql.DB, uuid, sender, receiver, content string, attachments []string, createdAt time.Time) (senderSeq, receiverSeq int64, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			log.Printf("SaveMessage error: %v", err)
+		}
+	}()
 
 	stmt := `
         INSERT INTO private_messages (uuid, sender_uuid, receiver_uuid, content, created_at, sent_at)
         VALUES (?, ?, ?, ?, ?, ?)`
-	_, err := db.Exec(stmt, uuid, sender, receiver, safeContent, createdAt, createdAt)
+	res, err := tx.Exec(stmt, uuid, sender, receiver, content, createdAt, createdAt)
 	if err != nil {
-		log.Printf("SaveMessage error: %v", err)
-	} else {
-		log.Printf("SaveMessage success: %s -> %s: %s (UUID: %s)", sender, receiver, content, uuid)
+		return 0, 0, err
 	}
-	return err
+	messageID, err := res.LastInsertId()
+	if err != nil {
+		return 0, 0, err
+	}
+	if err = attachFiles(tx, sender, attachments, TargetMessage, messageID); err != nil {
+		return 0, 0, err
+	}
+	if err = recordMentions(tx, TargetMessage, messageID, sender, content); err != nil {
+		return 0, 0, err
+	}
+
+	if senderSeq, err = appendMessageLog(tx, sender, messageID); err != nil {
+		return 0, 0, err
+	}
+	receiverSeq = senderSeq
+	if receiver != sender {
+		if receiverSeq, err = appendMessageLog(tx, receiver, messageID); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	log.Printf("SaveMessage success: %s -> %s: %s (UUID: %s)", sender, receiver, content, uuid)
+	return senderSeq, receiverSeq, nil
 }
-func LoadMessages(db *sql.DB, userA, userB string, limit, offset int) ([]MessageWithAuthor, error) {
-	// Fixed SQL query - using correct column names from schema
+
+// appendMessageLog gives a message the next sequence number for one user.
+func appendMessageLog(tx *sql.Tx, userUUID string, messageID int64) (int64, error) {
+	var seq int64
+	err := tx.QueryRow(`
+        INSERT INTO user_message_log (user_uuid, seq, message_id)
+        SELECT ?, COALESCE(MAX(seq), 0) + 1, ? FROM user_message_log WHERE user_uuid = ?
+        RETURNING seq`, userUUID, messageID, userUUID).Scan(&seq)
+	return seq, err
+}
+
+// LatestMessageSeq returns the highest sequence number in a user's message log.
+func LatestMessageSeq(db *sql.DB, userUUID string) (int64, error) {
+	var seq int64
+	err := db.QueryRow("SELECT COALESCE(MAX(seq), 0) FROM user_message_log WHERE user_uuid = ?", userUUID).Scan(&seq)
+	return seq, err
+}
+
+// LoadMessagesSince returns up to limit messages from a user's log with a
+// sequence number greater than afterSeq, oldest first.
+func LoadMessagesSince(db *sql.DB, userUUID string, afterSeq int64, limit int) ([]MessageBroadcast, error) {
+	rows, err := db.Query(`
+        SELECT l.seq, m.id, m.uuid, m.sender_uuid, m.receiver_uuid, m.content, m.sent_at, u.nickname,
+               m.edited_at IS NOT NULL, m.deleted_at IS NOT NULL
+        FROM user_message_log l
+        JOIN private_messages m ON m.id = l.message_id
+        JOIN users u ON u.uuid = m.sender_uuid
+        WHERE l.user_uuid = ? AND l.seq > ?
+        ORDER BY l.seq ASC
+        LIMIT ?`, userUUID, afterSeq, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []MessageBroadcast
+	for rows.Next() {
+		var m MessageBroadcast
+		var sentAt time.Time
+		if err := rows.Scan(&m.Seq, &m.id, &m.UUID, &m.From, &m.To, &m.Content, &sentAt, &m.FromNickname, &m.Edited, &m.Deleted); err != nil {
+			return nil, err
+		}
+		m.ContentHTML = renderMarkdown(m.Content)
+		m.SentAt = sentAt.Format(time.RFC3339)
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	ids := make([]int64, len(messages))
+	for i, m := range messages {
+		ids[i] = m.id
+	}
+	attachments, err := LoadAttachments(db, TargetMessage, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range messages {
+		if !messages[i].Deleted {
+			messages[i].Attachments = attachments[messages[i].id]
+		}
+	}
+	return messages, nil
+}
+
+// Message history is paged by message id rather than by offset, so messages
+// arriving while a user scrolls never shift a page.
+const (
+	defaultMessagePageSize = 20
+	maxMessagePageSize     = 100
+)
+
+// MessageCursor selects one page of history. Before and After are message
+// UUIDs; with neither set the newest page is returned.
+type MessageCursor struct {
+	Before string
+	After  string
+	Limit  int
+}
+
+// MessagePage is a page of history, oldest first. NextCursor continues in the
+// same direction (older for before and the newest page, newer for after) and
+// is empty when there is nothing more to load.
+type MessagePage struct {
+	Messages   []MessageWithAuthor `json:"messages"`
+	NextCursor string              `json:"next_cursor,omitempty"`
+}
+
+// keysetClause returns the condition, ordering and limit that select a page
+// relative to the cursor message's id. One row beyond the page is fetched to
+// learn whether another page exists.
+func keysetClause(c MessageCursor, cursorID int64) (string, []interface{}) {
+	switch {
+	case c.After != "":
+		return " AND m.id > ? ORDER BY m.id ASC LIMIT ?", []interface{}{cursorID, c.Limit + 1}
+	case c.Before != "":
+		return " AND m.id < ? ORDER BY m.id DESC LIMIT ?", []interface{}{cursorID, c.Limit + 1}
+	default:
+		return " ORDER BY m.id DESC LIMIT ?", []interface{}{c.Limit + 1}
+	}
+}
+
+// finishPage drops the look-ahead row, puts messages oldest first and sets
+// NextCursor.
+func finishPage(messages []MessageWithAuthor, c MessageCursor) MessagePage {
+	more := len(messages) > c.Limit
+	if more {
+		messages = messages[:c.Limit]
+	}
+	if c.After == "" {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+
+	page := MessagePage{Messages: messages}
+	if more {
+		if c.After != "" {
+			page.NextCursor = messages[len(messages)-1].UUID
+		} else {
+			page.NextCursor = messages[0].UUID
+		}
+	}
+	return page
+}
+
+// LoadMessages returns one page of the private conversation between userA and
+// userB. A cursor that is not a message of this conversation yields
+// ErrMessageNotInConversation.
+func LoadMessages(db *sql.DB, userA, userB string, c MessageCursor) (MessagePage, error) {
+	var cursorID int64
+	if cursor := c.Before + c.After; cursor != "" {
+		err := db.QueryRow(`SELECT id FROM private_messages
+            WHERE uuid = ? AND ((sender_uuid = ? AND receiver_uuid = ?) OR (sender_uuid = ? AND receiver_uuid = ?))`,
+			cursor, userA, userB, userB, userA).Scan(&cursorID)
+		if err == sql.ErrNoRows {
+			return MessagePage{}, ErrMessageNotInConversation
+		} else if err != nil {
+			return MessagePage{}, err
+		}
+	}
+
+	clause, pageArgs := keysetClause(c, cursorID)
 	stmt := `
-        SELECT m.sender_uuid, m.receiver_uuid, m.content, m.sent_at, u.nickname
+        SELECT m.id, m.uuid, m.sender_uuid, m.receiver_uuid, m.content, m.sent_at, u.nickname, m.delivered_at, m.read_at,
+               m.edited_at IS NOT NULL, m.deleted_at IS NOT NULL
         FROM private_messages m
         JOIN users u ON m.sender_uuid = u.uuid
-        WHERE (m.sender_uuid = ? AND m.receiver_uuid = ?)
-           OR (m.sender_uuid = ? AND m.receiver_uuid = ?)
-        ORDER BY m.sent_at DESC
-        LIMIT ? OFFSET ?`
-
-	log.Printf("LoadMessages query: userA=%s, userB=%s, limit=%d, offset=%d", userA, userB, limit, offset)
+        WHERE ((m.sender_uuid = ? AND m.receiver_uuid = ?)
+            OR (m.sender_uuid = ? AND m.receiver_uuid = ?))` + clause
 
-	rows, err := db.Query(stmt, userA, userB, userB, userA, limit, offset)
+	rows, err := db.Query(stmt, append([]interface{}{userA, userB, userB, userA}, pageArgs...)...)
 	if err != nil {
 		log.Printf("LoadMessages query error: %v", err)
-		return []MessageWithAuthor{}, err // Return empty slice instead of nil
+		return MessagePage{}, err
 	}
 	defer rows.Close()
 
-	// Initialize as empty slice instead of nil slice
-	messages := make([]MessageWithAuthor, 0)
-
+	messages := make([]MessageWithAuthor, 0, c.Limit+1)
 	for rows.Next() {
 		var m MessageWithAuthor
 		var sentAt time.Time
+		var deliveredAt, readAt sql.NullTime
 
-		// Scan the fields - using correct field names
-		if err := rows.Scan(&m.From, &m.To, &m.Content, &sentAt, &m.FromNickname); err != nil {
+		if err := rows.Scan(&m.id, &m.UUID, &m.From, &m.To, &m.Content, &sentAt, &m.FromNickname, &deliveredAt, &readAt, &m.Edited, &m.Deleted); err != nil {
 			log.Printf("Error scanning message: %v", err)
 			continue
 		}
+		m.ContentHTML = renderMarkdown(m.Content)
 		m.SentAt = sentAt.Format(time.RFC3339)
-		messages = append([]MessageWithAuthor{m}, messages...)
+		if deliveredAt.Valid {
+			m.DeliveredAt = &deliveredAt.Time
+		}
+		if readAt.Valid {
+			m.ReadAt = &readAt.Time
+		}
+		messages = append(messages, m)
 	}
 
-	// Check for errors during iteration
 	if err = rows.Err(); err != nil {
 		log.Printf("LoadMessages rows iteration error: %v", err)
-		return []MessageWithAuthor{}, err // Return empty slice instead of nil
+		return MessagePage{}, err
 	}
 
-	log.Printf("LoadMessages returning %d messages", len(messages))
-	return messages, nil
+	page := finishPage(messages, c)
+	return page, loadMessageAttachments(db, TargetMessage, page.Messages)
+}
+
+// MarkMessageDelivered records the first delivery of a message to its receiver.
+func MarkMessageDelivered(db *sql.DB, messageUUID string, at time.Time) error {
+	_, err := db.Exec(`UPDATE private_messages SET delivered_at = ? WHERE uuid = ? AND delivered_at IS NULL`, at, messageUUID)
+	return err
+}
+
+// MarkAllDelivered records delivery of every pending message to a receiver.
+func MarkAllDelivered(db *sql.DB, receiverUUID string, at time.Time) error {
+	_, err := db.Exec(`UPDATE private_messages SET delivered_at = ? WHERE receiver_uuid = ? AND delivered_at IS NULL`, at, receiverUUID)
+	return err
+}
+
+var ErrMessageNotInConversation = errors.New("message does not belong to this conversation")
+
+// MarkConversationRead marks messages sent by other to reader as read. When
+// upToUUID is set only messages up to and including that one are marked.
+func MarkConversationRead(db *sql.DB, readerUUID, otherUUID, upToUUID string, at time.Time) (int64, error) {
+	query := `UPDATE private_messages SET read_at = ?
+        WHERE sender_uuid = ? AND receiver_uuid = ? AND read_at IS NULL`
+	args := []interface{}{at, otherUUID, readerUUID}
+
+	if upToUUID != "" {
+		var upToID int64
+		err := db.QueryRow(`SELECT id FROM private_messages
+            WHERE uuid = ? AND ((sender_uuid = ? AND receiver_uuid = ?) OR (sender_uuid = ? AND receiver_uuid = ?))`,
+			upToUUID, otherUUID, readerUUID, readerUUID, otherUUID).Scan(&upToID)
+		if err == sql.ErrNoRows {
+			return 0, ErrMessageNotInConversation
+		} else if err != nil {
+			return 0, err
+		}
+		query += " AND id <= ?"
+		args = append(args, upToID)
+	}
+
+	res, err := db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// UnreadCountsFor returns, per sender, how many messages the receiver has not read.
+func UnreadCountsFor(db *sql.DB, receiverUUID string) (map[string]int, error) {
+	rows, err := db.Query(`SELECT sender_uuid, COUNT(*) FROM private_messages
+        WHERE receiver_uuid = ? AND read_at IS NULL AND deleted_at IS NULL GROUP BY sender_uuid`, receiverUUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var sender string
+		var n int
+		if err := rows.Scan(&sender, &n); err != nil {
+			return nil, err
+		}
+		counts[sender] = n
+	}
+	return counts, rows.Err()
 }
 
 type Post struct {
-	UUID       string    `json:"uuid"`
-	Title      string    `json:"title"`
-	Content    string    `json:"content"`
-	CreatedAt  time.Time `json:"created_at"`
-	Nickname   string    `json:"nickname"` // author
-	Categories []string  `json:"categories"`
+	UUID        string    `json:"uuid"`
+	Title       string    `json:"title"`
+	Content     string    `json:"content"`      // Markdown as written
+	ContentHTML string    `json:"content_html"` // Content rendered, see markdown.go
+	CreatedAt   time.Time `json:"created_at"`
+	Nickname    string    `json:"nickname"` // author
+	AuthorUUID  string    `json:"author_uuid"`
+	Categories  []string  `json:"categories"`
+	Tags        []string  `json:"tags,omitempty"`
+	Edited      bool      `json:"edited,omitempty"`
+	// CommentCount counts comments that are not deleted, replies included.
+	CommentCount int          `json:"comment_count"`
+	Attachments  []Attachment `json:"attachments,omitempty"`
+	Reactions
 }
 
 func LoadAllPosts(db *sql.DB) ([]Post, error) {
@@ -307,73 +666,111 @@ func LoadAllPosts(db *sql.DB) ([]Post, error) {
 		if err != nil {
 			continue
 		}
+		p.ContentHTML = renderMarkdown(p.Content)
 		posts = append(posts, p)
 	}
 	return posts, nil
 }
 
 type Comment struct {
-	Content   string    `json:"content"`
-	Author    string    `json:"author"` // nickname
-	CreatedAt time.Time `json:"created_at"`
+	ID          int64        `json:"id"`
+	UUID        string       `json:"uuid"`
+	ParentUUID  string       `json:"parent_uuid,omitempty"` // empty for top-level comments
+	Depth       int          `json:"depth"`
+	Content     string       `json:"content"`
+	ContentHTML string       `json:"content_html"`
+	Author      string       `json:"author"` // nickname
+	AuthorUUID  string       `json:"author_uuid"`
+	CreatedAt   time.Time    `json:"created_at"`
+	Edited      bool         `json:"edited,omitempty"`
+	Deleted     bool         `json:"deleted,omitempty"` // content and attachments are hidden
+	Attachments []Attachment `json:"attachments,omitempty"`
+	Reactions
+	// MoreRepliesCursor is set on a top-level comment whose thread was cut
+	// short; it is the cursor for the rest, see CommentQuery.Thread.
+	MoreRepliesCursor string `json:"more_replies_cursor,omitempty"`
 }
 
 type FullPost struct {
 	Post
-	Comments []Comment `json:"comments"`
+	Comments          []Comment `json:"comments"` // thread order: each reply follows its parent
+	NextCommentCursor string    `json:"next_comment_cursor,omitempty"`
 }
 
-func LoadPostWithComments(db *sql.DB, postUUID string) (*FullPost, error) {
+// loadPost loads a post with its categories and reactions, and returns its
+// row id too.
+func loadPost(db *sql.DB, postUUID, viewerUUID string) (Post, int64, error) {
 	post := Post{}
+	var postID int64
 	err := db.QueryRow(`
-		SELECT posts.post_uuid, title, content, posts.created_at, users.nickname
+		SELECT posts.id, posts.post_uuid, title, content, posts.created_at, users.nickname, users.uuid,
+		       posts.edited_at IS NOT NULL,
+		       (SELECT COUNT(*) FROM comments WHERE comments.post_id = posts.id AND comments.deleted_at IS NULL)
 		FROM posts
 		JOIN users ON posts.user_uuid = users.uuid
-		WHERE posts.post_uuid = ?
-	`, postUUID).Scan(&post.UUID, &post.Title, &post.Content, &post.CreatedAt, &post.Nickname)
-	if err != nil {
-		return nil, err
+		WHERE posts.post_uuid = ? AND posts.deleted_at IS NULL
+	`, postUUID).Scan(&postID, &post.UUID, &post.Title, &post.Content, &post.CreatedAt, &post.Nickname, &post.AuthorUUID, &post.Edited, &post.CommentCount)
+	if err == sql.ErrNoRows {
+		return post, 0, ErrPostNotFound
+	} else if err != nil {
+		return post, 0, err
 	}
+	post.ContentHTML = renderMarkdown(post.Content)
 
 	rows, err := db.Query(`
-		SELECT comments.content, users.nickname, comments.created_at
-		FROM comments
-		JOIN users ON comments.user_uuid = users.uuid
-		JOIN posts ON posts.id = comments.post_id
-		WHERE posts.post_uuid = ?
-		ORDER BY comments.created_at ASC
-	`, postUUID)
+		SELECT c.name FROM post_categories pc
+		JOIN categories c ON pc.category_id = c.id
+		WHERE pc.post_id = ?
+	`, postID)
 	if err != nil {
-		return nil, err
+		return post, 0, err
 	}
 	defer rows.Close()
-
-	var comments []Comment
 	for rows.Next() {
-		var c Comment
-		err := rows.Scan(&c.Content, &c.Author, &c.CreatedAt)
-		if err != nil {
-			continue
+		var category string
+		if err := rows.Scan(&category); err != nil {
+			return post, 0, err
 		}
-		comments = append(comments, c)
+		post.Categories = append(post.Categories, category)
+	}
+	if err := rows.Err(); err != nil {
+		return post, 0, err
+	}
+
+	tags, err := LoadPostTags(db, []int64{postID})
+	if err != nil {
+		return post, 0, err
 	}
+	post.Tags = tags[postID]
 
-	log.Println("\n\n\n", post, "\n\n\n", comments)
-	return &FullPost{Post: post, Comments: comments}, nil
+	postReactions, err := LoadReactions(db, TargetPost, []int64{postID}, viewerUUID)
+	if err != nil {
+		return post, 0, err
+	}
+	post.Reactions = postReactions[postID]
+
+	if post.Attachments, err = loadTargetAttachments(db, TargetPost, postID); err != nil {
+		return post, 0, err
+	}
+	return post, postID, nil
 }
 
-func InsertComment(db *sql.DB, userUUID, postUUID, content string) error {
-	safeContent := html.EscapeString(content)
-	stmt := `
-		INSERT INTO comments (post_id, user_uuid, content, created_at)
-		VALUES ((SELECT id FROM posts WHERE post_uuid = ?), ?, ?, ?)
-	`
-	_, err := db.Exec(stmt, postUUID, userUUID, safeContent, time.Now())
-	return err
+// LoadPostWithComments loads a post and the first page of its comments.
+func LoadPostWithComments(db *sql.DB, postUUID, viewerUUID string, q CommentQuery) (*FullPost, error) {
+	post, postID, err := loadPost(db, postUUID, viewerUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := LoadComments(db, postID, q, viewerUUID)
+	if err != nil {
+		return nil, err
+	}
+	return &FullPost{Post: post, Comments: page.Comments, NextCommentCursor: page.NextCursor}, nil
 }
 
 func GetRecentPosts(db *sql.DB, limit int) ([]Post, error) {
-	rows, err := db.Query(`SELECT title, content, created_at FROM posts ORDER BY created_at DESC LIMIT ?`, limit)
+	rows, err := db.Query(`SELECT title, content, created_at FROM posts WHERE deleted_at IS NULL ORDER BY created_at DESC LIMIT ?`, limit)
 	if err != nil {
 		return nil, err
 	}
@@ -385,58 +782,229 @@ func GetRecentPosts(db *sql.DB, limit int) ([]Post, error) {
 		if err := rows.Scan(&p.Title, &p.Content, &p.CreatedAt); err != nil {
 			return nil, err
 		}
+		p.ContentHTML = renderMarkdown(p.Content)
 		posts = append(posts, p)
 	}
 	return posts, nil
 }
 
-func GetPostsPaginated(db *sql.DB, offset, limit int, category string) ([]Post, error) {
-	query := `
-        SELECT p.id, p.post_uuid, p.title, p.content, p.created_at, u.nickname
+const (
+	FeedSortNew    = "new"
+	FeedSortTop    = "top"    // likes minus dislikes, within Window
+	FeedSortHot    = "hot"    // votes and comments, decaying with age
+	FeedSortActive = "active" // latest comment, or creation when there is none
+
+	TopWindowDay  = "day"
+	TopWindowWeek = "week"
+	TopWindowAll  = "all"
+
+	defaultFeedPageSize = 10
+	maxFeedPageSize     = 50
+)
+
+var ErrInvalidFeedCursor = errors.New("invalid feed cursor")
+
+// FeedQuery selects a page of the post feed. Posts match any of Categories,
+// given by slug or name, and any of the normalized Tags (all posts when
+// empty), and, when Author is set, were written by the user
+// with that uuid or nickname. Cursor is the next_cursor of the previous page.
+type FeedQuery struct {
+	Sort       string
+	Window     string // top only
+	Categories []string
+	Tags       []string
+	Author     string
+	Cursor     string
+	Limit      int
+}
+
+type PostPage struct {
+	Posts      []Post `json:"posts"`
+	NextCursor string `json:"next_cursor,omitempty"` // empty on the last page
+}
+
+// feedCursor is the position after the last post of a page. ref is the time
+// the first page was loaded: later pages ignore newer posts and age posts
+// from that moment, so hot scores do not shift while paging. key is the sort
+// value of the last post. It is written as "ref:key:id".
+type feedCursor struct {
+	ref int64 // unix seconds
+	key float64
+	id  int64
+}
+
+func parseFeedCursor(s string) (feedCursor, error) {
+	var c feedCursor
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return c, ErrInvalidFeedCursor
+	}
+	var err1, err2, err3 error
+	c.ref, err1 = strconv.ParseInt(parts[0], 10, 64)
+	c.key, err2 = strconv.ParseFloat(parts[1], 64)
+	c.id, err3 = strconv.ParseInt(parts[2], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return c, ErrInvalidFeedCursor
+	}
+	return c, nil
+}
+
+func (c feedCursor) String() string {
+	return fmt.Sprintf("%d:%s:%d", c.ref, strconv.FormatFloat(c.key, 'f', -1, 64), c.id)
+}
+
+// julianDay converts unix seconds to the day number SQLite's julianday()
+// returns, so stored timestamps in any zone compare correctly. It divides
+// milliseconds since the julian epoch as SQLite does, so the same instant
+// gives the same float and equal times compare equal.
+func julianDay(unix int64) float64 {
+	return float64(unix*1000+210866760000000) / 86400000
+}
+
+// feedSortKey is the SQL for a sort's key over the columns of the inner feed
+// query. The hot score divides by the square of the age in hours, plus two so
+// brand new posts do not dominate. ref is bound to the first ?.
+func feedSortKey(sort string) string {
+	switch sort {
+	case FeedSortTop:
+		return "score"
+	case FeedSortHot:
+		return "(score + comment_count) / (((? - julianday(created_at)) * 24 + 2) * ((? - julianday(created_at)) * 24 + 2))"
+	case FeedSortActive:
+		return "last_activity"
+	default:
+		return "0" // id alone orders by creation
+	}
+}
+
+// GetPostsPaginated returns a page of the feed, keyset-paginated on the sort
+// key and then the post id.
+func GetPostsPaginated(db *sql.DB, q FeedQuery, viewerUUID string) (PostPage, error) {
+	page := PostPage{Posts: []Post{}}
+
+	after := feedCursor{ref: time.Now().Unix() + 1}
+	if q.Cursor != "" {
+		var err error
+		if after, err = parseFeedCursor(q.Cursor); err != nil {
+			return page, err
+		}
+	}
+	ref := julianDay(after.ref)
+
+	var keyArgs []interface{}
+	if q.Sort == FeedSortHot {
+		keyArgs = append(keyArgs, ref, ref)
+	}
+
+	inner := `
+        SELECT p.id, p.post_uuid, p.title, p.content, p.created_at, u.nickname, u.uuid AS author_uuid,
+               p.edited_at IS NOT NULL AS edited,
+               (SELECT COUNT(*) FROM comments c WHERE c.post_id = p.id AND c.deleted_at IS NULL) AS comment_count,
+               (SELECT COALESCE(SUM(CASE WHEN is_like THEN 1 ELSE -1 END), 0)
+                FROM likes_dislikes WHERE target_type = 'post' AND target_id = p.id) AS score,
+               julianday(COALESCE((SELECT MAX(c.created_at) FROM comments c WHERE c.post_id = p.id AND c.deleted_at IS NULL),
+                                  p.created_at)) AS last_activity
         FROM posts p
         JOIN users u ON p.user_uuid = u.uuid
+        WHERE p.deleted_at IS NULL AND julianday(p.created_at) <= ?
     `
-	var args []interface{}
+	innerArgs := []interface{}{ref}
+
+	if q.Sort == FeedSortTop {
+		switch q.Window {
+		case TopWindowDay:
+			inner += ` AND julianday(p.created_at) > ?`
+			innerArgs = append(innerArgs, ref-1)
+		case TopWindowWeek:
+			inner += ` AND julianday(p.created_at) > ?`
+			innerArgs = append(innerArgs, ref-7)
+		}
+	}
 
-	if category != "" {
-		query += `
-            WHERE EXISTS (
+	if len(q.Categories) > 0 {
+		inner += `
+            AND EXISTS (
                 SELECT 1
                 FROM post_categories pc
                 JOIN categories c ON pc.category_id = c.id
-                WHERE pc.post_id = p.id AND c.name = ?
+                WHERE pc.post_id = p.id AND (c.slug IN (` + strings.Repeat("?,", len(q.Categories)-1) + `?)
+                    OR c.name IN (` + strings.Repeat("?,", len(q.Categories)-1) + `?))
             )
         `
-		args = append(args, category)
+		for _, category := range q.Categories {
+			innerArgs = append(innerArgs, category)
+		}
+		for _, category := range q.Categories {
+			innerArgs = append(innerArgs, category)
+		}
 	}
 
-	query += `
-        ORDER BY p.created_at DESC
-        LIMIT ? OFFSET ?
-    `
-	args = append(args, limit, offset)
+	if len(q.Tags) > 0 {
+		inner += `
+            AND EXISTS (
+                SELECT 1
+                FROM post_tags pt
+                JOIN tags t ON pt.tag_id = t.id
+                WHERE pt.post_id = p.id AND t.banned_at IS NULL AND t.id IN (
+                    SELECT COALESCE(merged_into, id) FROM tags
+                    WHERE name IN (` + strings.Repeat("?,", len(q.Tags)-1) + `?))
+            )
+        `
+		for _, tag := range q.Tags {
+			innerArgs = append(innerArgs, tag)
+		}
+	}
+
+	if q.Author != "" {
+		inner += ` AND (u.uuid = ? OR u.nickname = ?)`
+		innerArgs = append(innerArgs, q.Author, q.Author)
+	}
+
+	query := `SELECT id, post_uuid, title, content, created_at, nickname, author_uuid, edited, comment_count, sort_key
+        FROM (SELECT *, ` + feedSortKey(q.Sort) + ` AS sort_key FROM (` + inner + `))`
+	args := append(keyArgs, innerArgs...)
+	if q.Cursor != "" {
+		query += ` WHERE sort_key < ? OR (sort_key = ? AND id < ?)`
+		args = append(args, after.key, after.key, after.id)
+	}
+	// One extra row tells whether there is another page.
+	query += ` ORDER BY sort_key DESC, id DESC LIMIT ?`
+	args = append(args, q.Limit+1)
 
 	rows, err := db.Query(query, args...)
 	if err != nil {
-		return nil, err
+		return page, err
 	}
 	defer rows.Close()
 
-	var posts []Post
-	var postIDs []int
-	idToPostIndex := make(map[int]int)
+	posts := page.Posts
+	var postIDs []int64
+	idToPostIndex := make(map[int64]int)
+	var last feedCursor
 
 	for rows.Next() {
 		var p Post
-		var id int
-		err := rows.Scan(&id, &p.UUID, &p.Title, &p.Content, &p.CreatedAt, &p.Nickname)
+		var id int64
+		var key float64
+		err := rows.Scan(&id, &p.UUID, &p.Title, &p.Content, &p.CreatedAt, &p.Nickname, &p.AuthorUUID, &p.Edited, &p.CommentCount, &key)
 		if err != nil {
-			continue
+			return page, err
 		}
+		if len(posts) == q.Limit {
+			page.NextCursor = last.String()
+			break
+		}
+		p.ContentHTML = renderMarkdown(p.Content)
 		posts = append(posts, p)
 		postIDs = append(postIDs, id)
 		idToPostIndex[id] = len(posts) - 1
+		last = feedCursor{ref: after.ref, key: key, id: id}
+	}
+	if err := rows.Err(); err != nil {
+		return page, err
 	}
+	rows.Close()
+	page.Posts = posts
 
 	if len(posts) > 0 {
 		placeholders := strings.Repeat("?,", len(postIDs)-1) + "?"
@@ -448,12 +1016,12 @@ func GetPostsPaginated(db *sql.DB, offset, limit int, category string) ([]Post,
         `
 		catRows, err := db.Query(catQuery, toInterfaceSlice(postIDs)...)
 		if err != nil {
-			return nil, err
+			return page, err
 		}
 		defer catRows.Close()
 
 		for catRows.Next() {
-			var postID int
+			var postID int64
 			var category string
 			if err := catRows.Scan(&postID, &category); err == nil {
 				if idx, ok := idToPostIndex[postID]; ok {
@@ -461,12 +1029,30 @@ func GetPostsPaginated(db *sql.DB, offset, limit int, category string) ([]Post,
 				}
 			}
 		}
+
+		reactions, err := LoadReactions(db, TargetPost, postIDs, viewerUUID)
+		if err != nil {
+			return page, err
+		}
+		attachments, err := LoadAttachments(db, TargetPost, postIDs)
+		if err != nil {
+			return page, err
+		}
+		tags, err := LoadPostTags(db, postIDs)
+		if err != nil {
+			return page, err
+		}
+		for id, idx := range idToPostIndex {
+			posts[idx].Reactions = reactions[id]
+			posts[idx].Attachments = attachments[id]
+			posts[idx].Tags = tags[id]
+		}
 	}
 
-	return posts, nil
+	return page, nil
 }
 
-func toInterfaceSlice(ints []int) []interface{} {
+func toInterfaceSlice(ints []int64) []interface{} {
 	s := make([]interface{}, len(ints))
 	for i, v := range ints {
 		s[i] = v
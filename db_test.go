@@ -0,0 +1,237 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// newTestDB opens a database with the full schema in a temporary directory.
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := InitDB(filepath.Join(t.TempDir(), "forum.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// createTestUser registers a user with the given nickname and returns their
+// uuid. Their email address is nickname@example.com.
+func createTestUser(t *testing.T, db *sql.DB, nickname string) string {
+	t.Helper()
+	userUUID := uuid.New().String()
+	if err := InsertUserFull(db, userUUID, nickname, nickname+"@example.com", "", 20, "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	return userUUID
+}
+
+func TestUnreadCounts(t *testing.T) {
+	now := testNow()
+	tests := []struct {
+		name   string
+		upTo   string // message name, "" for all
+		marked int64
+		err    error
+		alice  int // alice's messages bob has left unread
+	}{
+		{"all", "", 3, nil, 0},
+		{"up to a message", "a2", 2, nil, 1},
+		{"up to bob's own reply", "b1", 1, nil, 2},
+		{"message from another conversation", "c1", 0, ErrMessageNotInConversation, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			alice, bob, carol := createTestUser(t, db, "alice"), createTestUser(t, db, "bob"), createTestUser(t, db, "carol")
+			ids := map[string]string{}
+			for i, m := range []struct{ name, from, to string }{
+				{"a1", alice, bob}, {"b1", bob, alice}, {"a2", alice, bob}, {"a3", alice, bob}, {"c1", carol, bob},
+			} {
+				ids[m.name] = sendTestMessage(t, db, m.from, m.to, m.name, now.Add(time.Duration(i)*time.Second))
+			}
+
+			marked, err := MarkConversationRead(db, bob, alice, ids[tt.upTo], now)
+			if err != tt.err || marked != tt.marked {
+				t.Fatalf("got %d, %v; want %d, %v", marked, err, tt.marked, tt.err)
+			}
+			counts, err := UnreadCountsFor(db, bob)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if counts[alice] != tt.alice || counts[carol] != 1 {
+				t.Errorf("unread from alice %d, carol %d; want %d, 1", counts[alice], counts[carol], tt.alice)
+			}
+			// Bob's reply is only ever unread for alice.
+			if counts, _ := UnreadCountsFor(db, alice); counts[bob] != 1 {
+				t.Errorf("alice has %d unread from bob, want 1", counts[bob])
+			}
+			if marked, err := MarkConversationRead(db, bob, alice, ids[tt.upTo], now); tt.err == nil && (err != nil || marked != 0) {
+				t.Errorf("marking again: %d, %v", marked, err)
+			}
+		})
+	}
+}
+
+func TestUserListUnread(t *testing.T) {
+	db := newTestDB(t)
+	alice, bob := createTestUser(t, db, "alice"), createTestUser(t, db, "bob")
+	now := testNow()
+	sendTestMessage(t, db, alice, bob, "first", now)
+	deleted := sendTestMessage(t, db, alice, bob, "oops", now.Add(time.Second))
+	sendTestMessage(t, db, alice, bob, "last", now.Add(2*time.Second))
+	if _, err := DeleteMessage(db, deleted, alice, now.Add(3*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := loadUserList(db, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].UserUUID != alice {
+		t.Fatalf("bob's list %+v", users)
+	}
+	// The deleted message no longer counts.
+	if u := users[0]; u.UnreadCount != 2 || u.LastMessage != "last" {
+		t.Errorf("alice's entry: %d unread, last %q; want 2 and \"last\"", u.UnreadCount, u.LastMessage)
+	}
+
+	if _, err := MarkConversationRead(db, bob, alice, "", now); err != nil {
+		t.Fatal(err)
+	}
+	users, _ = loadUserList(db, bob)
+	if users[0].UnreadCount != 0 {
+		t.Errorf("%d unread after reading", users[0].UnreadCount)
+	}
+}
+
+func TestParseFeedCursor(t *testing.T) {
+	// Hot scores are small fractions; the key must come back exactly or
+	// the next page would repeat or skip posts.
+	for _, c := range []feedCursor{
+		{ref: 1700000000, key: 0, id: 7},
+		{ref: 1700000000, key: -3, id: 1},
+		{ref: 1700000000, key: 1.0 / 3, id: 42},
+		{ref: 1700000000, key: 2.5e-7, id: 9},
+		{ref: 1700000000, key: 2460000.123456789, id: 3},
+	} {
+		got, err := parseFeedCursor(c.String())
+		if err != nil || got != c {
+			t.Errorf("%q: got %+v, %v", c.String(), got, err)
+		}
+	}
+	for _, s := range []string{"", "1:2", "1:2:3:4", "x:0:1", "1:x:1", "1:0:x", "1:0.5"} {
+		if _, err := parseFeedCursor(s); err != ErrInvalidFeedCursor {
+			t.Errorf("%q: %v", s, err)
+		}
+	}
+}
+
+func TestFeedPaging(t *testing.T) {
+	db := newTestDB(t)
+	alice := createTestUser(t, db, "alice")
+	voters := []string{createTestUser(t, db, "bob"), createTestUser(t, db, "carol"), createTestUser(t, db, "dave")}
+	now := time.Now()
+	// Posts of different ages, votes and comments; a few share a score so
+	// ties fall back to the id.
+	for i, p := range []struct {
+		age      time.Duration
+		likes    int
+		comments int
+	}{
+		{30 * time.Hour, 3, 1}, {20 * time.Hour, 1, 0}, {5 * time.Hour, 0, 2}, {3 * time.Hour, 2, 0},
+		{2 * time.Hour, 1, 1}, {90 * time.Minute, 0, 0}, {time.Hour, 1, 0}, {10 * time.Minute, 0, 1},
+	} {
+		postUUID := uuid.New().String()
+		if err := InsertPost(db, postUUID, alice, "Post "+itoa(int64(i)), "body", nil, nil, now.Add(-p.age)); err != nil {
+			t.Fatal(err)
+		}
+		postID, _, err := resolveTarget(db, TargetPost, postUUID, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, voter := range voters[:p.likes] {
+			if _, err := ToggleReaction(db, voter, TargetPost, postID, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for j := 0; j < p.comments; j++ {
+			if _, _, err := InsertComment(db, voters[j], postUUID, "", "comment", nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	titles := func(posts []Post) []string {
+		var out []string
+		for _, p := range posts {
+			out = append(out, p.Title)
+		}
+		return out
+	}
+	for _, sort := range []string{FeedSortNew, FeedSortTop, FeedSortHot, FeedSortActive} {
+		t.Run(sort, func(t *testing.T) {
+			all, err := GetPostsPaginated(db, FeedQuery{Sort: sort, Window: TopWindowAll, Limit: maxFeedPageSize}, alice)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(all.Posts) != 8 || all.NextCursor != "" {
+				t.Fatalf("one page: %d posts, next cursor %q", len(all.Posts), all.NextCursor)
+			}
+
+			var paged []Post
+			cursor := ""
+			for pages := 0; ; pages++ {
+				if pages == 10 {
+					t.Fatal("pages never end")
+				}
+				page, err := GetPostsPaginated(db, FeedQuery{Sort: sort, Window: TopWindowAll, Cursor: cursor, Limit: 3}, alice)
+				if err != nil {
+					t.Fatal(err)
+				}
+				paged = append(paged, page.Posts...)
+				if cursor = page.NextCursor; cursor == "" {
+					break
+				}
+			}
+			if got, want := titles(paged), titles(all.Posts); !slices.Equal(got, want) {
+				t.Errorf("paged %v, want %v", got, want)
+			}
+		})
+	}
+
+	// Later pages leave out posts newer than the first page.
+	before := feedCursor{ref: now.Add(-100 * time.Minute).Unix(), key: 0, id: 1 << 40}
+	page, err := GetPostsPaginated(db, FeedQuery{Sort: FeedSortNew, Cursor: before.String(), Limit: maxFeedPageSize}, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := titles(page.Posts), []string{"Post 4", "Post 3", "Post 2", "Post 1", "Post 0"}; !slices.Equal(got, want) {
+		t.Errorf("posts before the cursor's time: %v, want %v", got, want)
+	}
+
+	if _, err := GetPostsPaginated(db, FeedQuery{Sort: FeedSortHot, Cursor: "not a cursor", Limit: 3}, alice); err != ErrInvalidFeedCursor {
+		t.Errorf("malformed cursor: %v", err)
+	}
+}
+
+func TestJulianDayMatchesSQLite(t *testing.T) {
+	db := newTestDB(t)
+	base := testNow()
+	for i := 0; i < 5000; i++ {
+		at := base.Add(time.Duration(i) * 7 * time.Second)
+		var want float64
+		if err := db.QueryRow(`SELECT julianday(?)`, at).Scan(&want); err != nil {
+			t.Fatal(err)
+		}
+		if got := julianDay(at.Unix()); got != want {
+			t.Fatalf("julianDay(%d) = %v, SQLite says %v", at.Unix(), got, want)
+		}
+	}
+}
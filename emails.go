@@ -0,0 +1,428 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Email notifications reach users who were not connected to /ws. A
+// notification nothing pushed, because its user was offline, is emailed once
+// EMAIL_DELAY has passed without the user reading it, if their preferences
+// take that kind. All of a user's waiting notifications go out together as
+// one digest, at most once per digest period. Emails are queued in
+// email_outbox and sent by RunEmailWorker, which retries failures with
+// backoff, so nothing is lost to a restart or a mail server outage.
+
+var (
+	emailFrom        = envString("EMAIL_FROM", "Forum <forum@localhost>")
+	emailBaseURL     = envString("EMAIL_BASE_URL", "http://localhost:8080")
+	emailDelay       = envDuration("EMAIL_DELAY", 5*time.Minute) // time to come back online first
+	emailInterval    = envDuration("EMAIL_INTERVAL", time.Minute)
+	emailRetryBase   = envDuration("EMAIL_RETRY_BASE", time.Minute) // doubled after every failed attempt
+	emailMaxAttempts = envInt("EMAIL_MAX_ATTEMPTS", 6)
+)
+
+const (
+	DigestInstant = "instant" // on the worker's next run
+	DigestHourly  = "hourly"
+	DigestDaily   = "daily"
+	DigestOff     = "off"
+
+	maxDigestItems = 50
+	outboxBatch    = 100
+)
+
+// digestPeriods is the least time between two digests to the same user.
+var digestPeriods = map[string]time.Duration{
+	DigestInstant: 0,
+	DigestHourly:  time.Hour,
+	DigestDaily:   24 * time.Hour,
+}
+
+var ErrInvalidDigest = errors.New("'digest' must be instant, hourly, daily or off")
+
+type EmailPreferences struct {
+	Messages bool   `json:"messages"` // private messages received while offline
+	Replies  bool   `json:"replies"`  // replies to my posts and comments
+	Mentions bool   `json:"mentions"`
+	Digest   string `json:"digest"` // instant, hourly, daily or off
+}
+
+// Users who never saved preferences get everything on the next run.
+var defaultEmailPreferences = EmailPreferences{Messages: true, Replies: true, Mentions: true, Digest: DigestInstant}
+
+// wants reports whether the preferences take email for a notification kind.
+func (p EmailPreferences) wants(kind string) bool {
+	switch kind {
+	case NotifyMessage:
+		return p.Messages
+	case NotifyReply, NotifyCommentReply:
+		return p.Replies
+	case NotifyMention:
+		return p.Mentions
+	}
+	return false
+}
+
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// loadEmailPreferences returns the user's preferences and when their last
+// digest was queued, zero if never.
+func loadEmailPreferences(q queryRower, userUUID string) (EmailPreferences, time.Time, error) {
+	p := defaultEmailPreferences
+	var last sql.NullTime
+	err := q.QueryRow(`SELECT messages, replies, mentions, digest, last_digest_at
+        FROM email_preferences WHERE user_uuid = ?`, userUUID).Scan(&p.Messages, &p.Replies, &p.Mentions, &p.Digest, &last)
+	if err == sql.ErrNoRows {
+		return defaultEmailPreferences, time.Time{}, nil
+	}
+	return p, last.Time, err
+}
+
+func GetEmailPreferences(db *sql.DB, userUUID string) (EmailPreferences, error) {
+	p, _, err := loadEmailPreferences(db, userUUID)
+	return p, err
+}
+
+func SetEmailPreferences(db *sql.DB, userUUID string, p EmailPreferences) error {
+	if _, ok := digestPeriods[p.Digest]; !ok && p.Digest != DigestOff {
+		return ErrInvalidDigest
+	}
+	_, err := db.Exec(`INSERT INTO email_preferences (user_uuid, messages, replies, mentions, digest)
+        VALUES (?, ?, ?, ?, ?)
+        ON CONFLICT(user_uuid) DO UPDATE SET
+            messages = excluded.messages, replies = excluded.replies,
+            mentions = excluded.mentions, digest = excluded.digest`,
+		userUUID, p.Messages, p.Replies, p.Mentions, p.Digest)
+	return err
+}
+
+// Each email has a <name>_subject and a <name>_body template. Bodies are
+// plain text, so nothing is HTML-escaped.
+var emailTemplates = template.Must(template.New("email").Parse(`
+{{define "digest_subject"}}{{if eq (len .Items) 1}}{{(index .Items 0).Summary}}{{else}}{{len .Items}} new notifications{{end}}{{end}}
+
+{{define "digest_body"}}Hi {{.Nickname}},
+
+Here is what happened while you were away:
+{{range .Items}}
+* {{.Summary}}{{if .Excerpt}}
+  "{{.Excerpt}}"{{end}}
+{{end}}
+Open the forum: {{.BaseURL}}/
+
+You get these emails because of your notification settings. You can change
+them, or turn emails off, from the notifications menu on the forum.
+{{end}}
+
+{{define "verify_email_subject"}}Confirm your email address{{end}}
+
+{{define "verify_email_body"}}Hi {{.Nickname}},
+
+Please confirm this is your email address by opening the link below:
+
+{{.Link}}
+
+The link works once and expires in {{.TTL}}. If you did not create an account
+on the forum, you can ignore this email.
+{{end}}
+
+{{define "password_reset_subject"}}Reset your password{{end}}
+
+{{define "password_reset_body"}}Hi {{.Nickname}},
+
+Someone asked to reset the password of your forum account. To choose a new
+password, open the link below:
+
+{{.Link}}
+
+The link works once and expires in {{.TTL}}. Resetting your password logs
+you out everywhere. If you did not ask for this, you can ignore this email;
+your password stays the same.
+{{end}}
+`))
+
+// renderEmail executes the subject and body templates of an email.
+func renderEmail(name string, data interface{}) (subject, body string, err error) {
+	var b strings.Builder
+	if err := emailTemplates.ExecuteTemplate(&b, name+"_subject", data); err != nil {
+		return "", "", err
+	}
+	subject = strings.Join(strings.Fields(b.String()), " ")
+	b.Reset()
+	if err := emailTemplates.ExecuteTemplate(&b, name+"_body", data); err != nil {
+		return "", "", err
+	}
+	return subject, strings.TrimLeft(b.String(), "\n"), nil
+}
+
+type digestItem struct {
+	Summary string
+	Excerpt string
+}
+
+type digestData struct {
+	Nickname string
+	Items    []digestItem
+	BaseURL  string
+}
+
+// notificationSummary is the one-line description of a notification.
+func notificationSummary(n Notification) string {
+	switch n.Kind {
+	case NotifyReply:
+		return n.ActorNickname + " commented on your post"
+	case NotifyCommentReply:
+		return n.ActorNickname + " replied to your comment"
+	case NotifyMention:
+		return n.ActorNickname + " mentioned you"
+	case NotifyReaction:
+		return n.ActorNickname + " reacted to your " + n.TargetType
+	case NotifyMessage:
+		return n.ActorNickname + " sent you a message"
+	}
+	return "New activity from " + n.ActorNickname
+}
+
+// QueueEmail adds an email to the outbox for the next worker run. The body of
+// a redacted email is blanked once it has been sent or given up on.
+func QueueEmail(tx *sql.Tx, userUUID, to, subject, body string, redact bool, now time.Time) error {
+	_, err := tx.Exec(`INSERT INTO email_outbox (user_uuid, to_address, subject, body, redact_body, created_at, next_attempt_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?)`, userUUID, to, subject, body, redact, now, now)
+	return err
+}
+
+// emailPendingWhere matches notifications waiting for the email digest: never
+// pushed, unread, old enough and about content that still exists.
+const emailPendingWhere = `
+        WHERE x.delivered_at IS NULL AND x.read_at IS NULL AND x.emailed_at IS NULL
+          AND julianday(x.created_at) <= ? AND ` + targetLocationLive
+
+// queueDigests queues a digest for every user with notifications waiting.
+func queueDigests(db *sql.DB, now time.Time) error {
+	cutoff := julianDay(now.Add(-emailDelay).Unix())
+	rows, err := db.Query(`SELECT DISTINCT x.user_uuid FROM notifications x`+targetLocationJoins+emailPendingWhere, cutoff)
+	if err != nil {
+		return err
+	}
+	var users []string
+	for rows.Next() {
+		var userUUID string
+		if err := rows.Scan(&userUUID); err != nil {
+			rows.Close()
+			return err
+		}
+		users = append(users, userUUID)
+	}
+	rows.Close()
+
+	for _, userUUID := range users {
+		if err := queueDigest(db, userUUID, now); err != nil {
+			log.Printf("Error queueing email digest for %s: %v", userUUID, err)
+		}
+	}
+	return nil
+}
+
+// queueDigest turns a user's waiting notifications into one outbox email.
+// Notifications their preferences leave out are marked handled all the same,
+// so turning a kind on later does not send old news.
+func queueDigest(db *sql.DB, userUUID string, now time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	prefs, last, err := loadEmailPreferences(tx, userUUID)
+	if err != nil {
+		return err
+	}
+	if period, ok := digestPeriods[prefs.Digest]; ok && now.Sub(last) < period {
+		return nil // the next digest is not due yet
+	}
+
+	rows, err := tx.Query(notificationSelect+emailPendingWhere+` AND x.user_uuid = ? ORDER BY x.id`,
+		julianDay(now.Add(-emailDelay).Unix()), userUUID)
+	if err != nil {
+		return err
+	}
+	notifications, err := scanNotifications(rows)
+	if err != nil {
+		return err
+	}
+
+	data := digestData{BaseURL: emailBaseURL}
+	ids := make([]int64, len(notifications))
+	for i, n := range notifications {
+		ids[i] = n.ID
+		if prefs.Digest != DigestOff && prefs.wants(n.Kind) && len(data.Items) < maxDigestItems {
+			data.Items = append(data.Items, digestItem{Summary: notificationSummary(n), Excerpt: n.Excerpt})
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	if _, err := tx.Exec(`UPDATE notifications SET emailed_at = ?
+        WHERE id IN (`+strings.Repeat("?,", len(ids)-1)+`?)`, append([]interface{}{now}, toInterfaceSlice(ids)...)...); err != nil {
+		return err
+	}
+
+	if len(data.Items) > 0 {
+		var to string
+		if err := tx.QueryRow(`SELECT email, nickname FROM users WHERE uuid = ?`, userUUID).Scan(&to, &data.Nickname); err != nil {
+			return err
+		}
+		subject, body, err := renderEmail("digest", data)
+		if err != nil {
+			return err
+		}
+		if err := QueueEmail(tx, userUUID, to, subject, body, false, now); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO email_preferences (user_uuid, digest, last_digest_at) VALUES (?, ?, ?)
+            ON CONFLICT(user_uuid) DO UPDATE SET last_digest_at = excluded.last_digest_at`,
+			userUUID, prefs.Digest, now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// sendOutbox sends the outbox emails that are due. A failed email is retried
+// after EMAIL_RETRY_BASE, doubling each time, and given up on after
+// EMAIL_MAX_ATTEMPTS attempts.
+func sendOutbox(db *sql.DB, sender MailSender, now time.Time) error {
+	rows, err := db.Query(`SELECT id, to_address, subject, body, attempts FROM email_outbox
+        WHERE status = 'pending' AND julianday(next_attempt_at) <= ?
+        ORDER BY id
+        LIMIT ?`, julianDay(now.Unix()), outboxBatch)
+	if err != nil {
+		return err
+	}
+	type outboxEmail struct {
+		id       int64
+		email    Email
+		attempts int
+	}
+	var due []outboxEmail
+	for rows.Next() {
+		o := outboxEmail{email: Email{From: emailFrom}}
+		if err := rows.Scan(&o.id, &o.email.To, &o.email.Subject, &o.email.Body, &o.attempts); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, o)
+	}
+	rows.Close()
+
+	for _, o := range due {
+		if err := sender.Send(o.email); err != nil {
+			o.attempts++
+			status := "pending"
+			if o.attempts >= emailMaxAttempts {
+				status = "failed"
+			}
+			log.Printf("Error sending email %d (attempt %d): %v", o.id, o.attempts, err)
+			next := now.Add(emailRetryBase << min(o.attempts-1, 16))
+			_, err = db.Exec(`UPDATE email_outbox SET status = ?, attempts = ?, last_error = ?, next_attempt_at = ?,
+                body = CASE WHEN redact_body AND ? THEN '' ELSE body END
+            WHERE id = ?`, status, o.attempts, err.Error(), next, status == "failed", o.id)
+		} else {
+			_, err = db.Exec(`UPDATE email_outbox SET status = 'sent', attempts = attempts + 1, sent_at = ?,
+                body = CASE WHEN redact_body THEN '' ELSE body END
+            WHERE id = ?`, now, o.id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emailWake asks the worker to run before its next tick.
+var emailWake = make(chan struct{}, 1)
+
+// wakeEmailWorker gets an email someone is waiting for, such as a password
+// reset link, out without waiting for EMAIL_INTERVAL.
+func wakeEmailWorker() {
+	select {
+	case emailWake <- struct{}{}:
+	default:
+	}
+}
+
+// RunEmailWorker queues digests and sends the outbox every EMAIL_INTERVAL,
+// and when woken. It must be started exactly once.
+func RunEmailWorker(db *sql.DB, sender MailSender) {
+	ticker := time.NewTicker(emailInterval)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		if err := queueDigests(db, now); err != nil {
+			log.Printf("Error queueing email digests: %v", err)
+		}
+		if err := sendOutbox(db, sender, now); err != nil {
+			log.Printf("Error sending outbox: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-emailWake:
+		}
+	}
+}
+
+// EmailPreferencesHandler: GET /notifications/email
+func EmailPreferencesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		prefs, err := GetEmailPreferences(db, userUUID)
+		if err != nil {
+			log.Printf("Error loading email preferences: %v", err)
+			http.Error(w, "Failed to load email preferences", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(prefs)
+	}
+}
+
+// UpdateEmailPreferencesHandler: PUT /notifications/email {messages, replies, mentions, digest}
+func UpdateEmailPreferencesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var prefs EmailPreferences
+		if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		switch err := SetEmailPreferences(db, userUUID, prefs); err {
+		case nil:
+		case ErrInvalidDigest:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		default:
+			log.Printf("Error saving email preferences: %v", err)
+			http.Error(w, "Failed to save email preferences", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(prefs)
+	}
+}
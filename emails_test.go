@@ -0,0 +1,351 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// fakeSender records what it is asked to send and fails with err if set.
+type fakeSender struct {
+	sent []Email
+	err  error
+}
+
+func (s *fakeSender) Send(e Email) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.sent = append(s.sent, e)
+	return nil
+}
+
+// emailTest is a recipient, bob, and an actor, alice, whose posts the
+// notifications point to.
+type emailTest struct {
+	db         *sql.DB
+	bob, alice string
+	now        time.Time
+}
+
+func newEmailTest(t *testing.T) *emailTest {
+	db := newTestDB(t)
+	return &emailTest{db: db, bob: createTestUser(t, db, "bob"), alice: createTestUser(t, db, "alice"), now: testNow()}
+}
+
+// testNow is the current time in whole seconds, the granularity of the
+// outbox and digest queries.
+func testNow() time.Time {
+	return time.Now().Truncate(time.Second)
+}
+
+// notify stores a notification for bob about a new post by alice, created
+// age before now. Each gets its own post, as bob has at most one unread
+// notification of a kind per target.
+func (e *emailTest) notify(t *testing.T, kind string, age time.Duration) int64 {
+	t.Helper()
+	postUUID := uuid.New().String()
+	if err := InsertPost(e.db, postUUID, e.alice, "Title", "Post body", nil, nil, e.now); err != nil {
+		t.Fatal(err)
+	}
+	var postID int64
+	if err := e.db.QueryRow(`SELECT id FROM posts WHERE post_uuid = ?`, postUUID).Scan(&postID); err != nil {
+		t.Fatal(err)
+	}
+	res, err := e.db.Exec(`INSERT INTO notifications (user_uuid, kind, actor_uuid, target_type, target_id, created_at)
+        VALUES (?, ?, ?, ?, ?, ?)`, e.bob, kind, e.alice, TargetPost, postID, e.now.Add(-age))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+	return id
+}
+
+func (e *emailTest) outbox(t *testing.T) []Email {
+	t.Helper()
+	rows, err := e.db.Query(`SELECT to_address, subject, body FROM email_outbox ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var emails []Email
+	for rows.Next() {
+		var m Email
+		if err := rows.Scan(&m.To, &m.Subject, &m.Body); err != nil {
+			t.Fatal(err)
+		}
+		emails = append(emails, m)
+	}
+	return emails
+}
+
+func (e *emailTest) emailed(t *testing.T, id int64) bool {
+	t.Helper()
+	var emailed bool
+	if err := e.db.QueryRow(`SELECT emailed_at IS NOT NULL FROM notifications WHERE id = ?`, id).Scan(&emailed); err != nil {
+		t.Fatal(err)
+	}
+	return emailed
+}
+
+func TestQueueDigestBatchesNotifications(t *testing.T) {
+	e := newEmailTest(t)
+	old := emailDelay + time.Minute
+	reply := e.notify(t, NotifyReply, old)
+	mention := e.notify(t, NotifyMention, old)
+	message := e.notify(t, NotifyMessage, old)
+	recent := e.notify(t, NotifyReply, emailDelay/2)
+	delivered := e.notify(t, NotifyMention, old)
+	if err := MarkNotificationsDelivered(e.db, []int64{delivered}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := queueDigests(e.db, e.now); err != nil {
+		t.Fatal(err)
+	}
+	emails := e.outbox(t)
+	if len(emails) != 1 {
+		t.Fatalf("queued %d emails, want one digest", len(emails))
+	}
+	m := emails[0]
+	if m.To != "bob@example.com" || m.Subject != "3 new notifications" {
+		t.Errorf("digest to %q with subject %q", m.To, m.Subject)
+	}
+	for _, want := range []string{"alice commented on your post", "alice mentioned you", "alice sent you a message"} {
+		if !strings.Contains(m.Body, want) {
+			t.Errorf("digest body lacks %q:\n%s", want, m.Body)
+		}
+	}
+	for _, id := range []int64{reply, mention, message} {
+		if !e.emailed(t, id) {
+			t.Errorf("notification %d not marked emailed", id)
+		}
+	}
+	// Too recent to email yet, and already seen online.
+	for _, id := range []int64{recent, delivered} {
+		if e.emailed(t, id) {
+			t.Errorf("notification %d marked emailed", id)
+		}
+	}
+
+	// Nothing is left to send on the next run.
+	if err := queueDigests(e.db, e.now); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(e.outbox(t)); n != 1 {
+		t.Errorf("%d emails after a second run, want 1", n)
+	}
+}
+
+func TestQueueDigestPreferences(t *testing.T) {
+	tests := []struct {
+		name  string
+		prefs EmailPreferences
+		want  []string // summaries in the digest; none means no email
+	}{
+		{"defaults", defaultEmailPreferences,
+			[]string{"alice commented on your post", "alice mentioned you", "alice sent you a message"}},
+		{"no messages", EmailPreferences{Replies: true, Mentions: true, Digest: DigestInstant},
+			[]string{"alice commented on your post", "alice mentioned you"}},
+		{"mentions only", EmailPreferences{Mentions: true, Digest: DigestDaily},
+			[]string{"alice mentioned you"}},
+		{"every kind off", EmailPreferences{Digest: DigestInstant}, nil},
+		{"digest off", EmailPreferences{Messages: true, Replies: true, Mentions: true, Digest: DigestOff}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newEmailTest(t)
+			if err := SetEmailPreferences(e.db, e.bob, tt.prefs); err != nil {
+				t.Fatal(err)
+			}
+			old := emailDelay + time.Minute
+			ids := []int64{
+				e.notify(t, NotifyReply, old),
+				e.notify(t, NotifyMention, old),
+				e.notify(t, NotifyMessage, old),
+				e.notify(t, NotifyReaction, old), // never emailed
+			}
+			if err := queueDigest(e.db, e.bob, e.now); err != nil {
+				t.Fatal(err)
+			}
+
+			emails := e.outbox(t)
+			if len(tt.want) == 0 {
+				if len(emails) != 0 {
+					t.Fatalf("queued %d emails, want none", len(emails))
+				}
+			} else {
+				if len(emails) != 1 {
+					t.Fatalf("queued %d emails, want 1", len(emails))
+				}
+				for _, want := range tt.want {
+					if !strings.Contains(emails[0].Body, want) {
+						t.Errorf("digest lacks %q", want)
+					}
+				}
+				if n := strings.Count(emails[0].Body, "\n* "); n != len(tt.want) {
+					t.Errorf("digest has %d items, want %d:\n%s", n, len(tt.want), emails[0].Body)
+				}
+			}
+			// Filtered kinds are handled too, so enabling them later does
+			// not send old news.
+			for _, id := range ids {
+				if !e.emailed(t, id) {
+					t.Errorf("notification %d not marked emailed", id)
+				}
+			}
+		})
+	}
+}
+
+func TestQueueDigestPeriod(t *testing.T) {
+	e := newEmailTest(t)
+	if err := SetEmailPreferences(e.db, e.bob, EmailPreferences{Replies: true, Digest: DigestHourly}); err != nil {
+		t.Fatal(err)
+	}
+	old := emailDelay + time.Minute
+	e.notify(t, NotifyReply, old)
+	if err := queueDigest(e.db, e.bob, e.now); err != nil {
+		t.Fatal(err)
+	}
+	next := e.notify(t, NotifyReply, old)
+
+	// Within the hour the second notification waits.
+	if err := queueDigest(e.db, e.bob, e.now.Add(30*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(e.outbox(t)); n != 1 || e.emailed(t, next) {
+		t.Fatalf("%d emails within the hour, want 1 and the new notification waiting", n)
+	}
+	if err := queueDigest(e.db, e.bob, e.now.Add(time.Hour+time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(e.outbox(t)); n != 2 || !e.emailed(t, next) {
+		t.Fatalf("%d emails after the hour, want 2", n)
+	}
+}
+
+func queueTestEmail(t *testing.T, db *sql.DB, userUUID string, now time.Time) int64 {
+	t.Helper()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := QueueEmail(tx, userUUID, "bob@example.com", "Subject", "Body", false, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	var id int64
+	db.QueryRow(`SELECT MAX(id) FROM email_outbox`).Scan(&id)
+	return id
+}
+
+func TestSendOutboxRetriesThenFails(t *testing.T) {
+	saved := emailMaxAttempts
+	emailMaxAttempts = 3
+	t.Cleanup(func() { emailMaxAttempts = saved })
+
+	db := newTestDB(t)
+	now := testNow()
+	id := queueTestEmail(t, db, createTestUser(t, db, "bob"), now)
+	sender := &fakeSender{err: errors.New("connection refused")}
+
+	state := func() (status string, attempts int, next time.Time, lastError sql.NullString) {
+		t.Helper()
+		err := db.QueryRow(`SELECT status, attempts, next_attempt_at, last_error FROM email_outbox WHERE id = ?`, id).
+			Scan(&status, &attempts, &next, &lastError)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	// Each failure doubles the wait before the next attempt.
+	at := now
+	for attempt := 1; attempt <= emailMaxAttempts; attempt++ {
+		if err := sendOutbox(db, sender, at); err != nil {
+			t.Fatal(err)
+		}
+		status, attempts, next, lastError := state()
+		if attempts != attempt || lastError.String != "connection refused" {
+			t.Fatalf("after attempt %d: attempts %d, last error %q", attempt, attempts, lastError.String)
+		}
+		wantStatus := "pending"
+		if attempt == emailMaxAttempts {
+			wantStatus = "failed"
+		}
+		if status != wantStatus {
+			t.Fatalf("after attempt %d: status %q, want %q", attempt, status, wantStatus)
+		}
+		wait := emailRetryBase << (attempt - 1)
+		if d := next.Sub(at); d < wait-time.Second || d > wait+time.Second {
+			t.Fatalf("after attempt %d: retry in %s, want %s", attempt, d, wait)
+		}
+
+		// Not retried before it is due.
+		if err := sendOutbox(db, sender, at); err != nil {
+			t.Fatal(err)
+		}
+		if _, n, _, _ := state(); n != attempt {
+			t.Fatalf("retried %d times before due", n-attempt)
+		}
+		at = next
+	}
+
+	// A failed email is never sent, even once the mail server is back.
+	sender.err = nil
+	if err := sendOutbox(db, sender, at.Add(24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if len(sender.sent) != 0 {
+		t.Errorf("failed email was sent")
+	}
+}
+
+func TestSendOutboxMaildir(t *testing.T) {
+	db := newTestDB(t)
+	now := testNow()
+	bob := createTestUser(t, db, "bob")
+	for i := 0; i < 3; i++ {
+		queueTestEmail(t, db, bob, now)
+	}
+	dir := t.TempDir()
+	sender, err := NewMaildirSender(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sendOutbox(db, sender, now); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := os.ReadDir(filepath.Join(dir, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("%d messages delivered, want 3", len(files))
+	}
+	raw, err := os.ReadFile(filepath.Join(dir, "new", files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, header := range []string{"To: bob@example.com", "Subject: Subject"} {
+		if !strings.Contains(string(raw), header) {
+			t.Errorf("message lacks %q:\n%s", header, raw)
+		}
+	}
+	var sent int
+	db.QueryRow(`SELECT COUNT(*) FROM email_outbox WHERE status = 'sent' AND sent_at IS NOT NULL`).Scan(&sent)
+	if sent != 3 {
+		t.Errorf("%d emails marked sent, want 3", sent)
+	}
+}
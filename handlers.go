@@ -3,6 +3,7 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -24,15 +25,24 @@ type RegisterRequest struct {
 	Password  string `json:"password"`
 }
 
+// newPassword applies the rules for choosing a password, at registration
+// and on reset: surrounding spaces are dropped and it must not be empty.
+func newPassword(password string) (string, bool) {
+	password = strings.TrimSpace(password)
+	return password, password != ""
+}
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
+	// Clients offering no subprotocol fall back to protocol version 1.
+	Subprotocols: []string{SubprotocolV2},
 }
 
-func RegisterHandler(db *sql.DB) http.HandlerFunc {
+func RegisterHandler(db *sql.DB, hub *Hub) http.HandlerFunc {
 	fmt.Println("register func")
 	return func(w http.ResponseWriter, r *http.Request) {
 		fmt.Println("register handler")
@@ -49,9 +59,10 @@ func RegisterHandler(db *sql.DB) http.HandlerFunc {
 		// Basic validation
 		req.Nickname = strings.TrimSpace(req.Nickname)
 		req.Email = strings.TrimSpace(req.Email)
-		req.Password = strings.TrimSpace(req.Password)
+		password, passwordOK := newPassword(req.Password)
+		req.Password = password
 
-		if req.Nickname == "" || req.Email == "" || req.Password == "" || req.Age <= 0 {
+		if req.Nickname == "" || req.Email == "" || !passwordOK || req.Age <= 0 {
 			fmt.Println("Eroor: missing fields")
 			http.Error(w, "Missing required fields", http.StatusBadRequest)
 			return
@@ -92,6 +103,10 @@ func RegisterHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		if err := SendVerificationEmail(db, userUUID); err != nil {
+			log.Printf("Error sending verification email: %v", err)
+		}
+
 		// After successful InsertUserFull:
 		newUser := UserPresence{
 			UserUUID:        userUUID,
@@ -101,22 +116,12 @@ func RegisterHandler(db *sql.DB) http.HandlerFunc {
 			LastMessageTime: time.Time{},
 		}
 
-		data := map[string]interface{}{
-			"type": "user_registered",
-			"user": newUser,
-		}
-		encoded, _ := json.Marshal(data)
+		frame := NewFrame(FrameUserRegistered, "",
+			map[string]interface{}{"user": newUser},
+			map[string]interface{}{"type": FrameUserRegistered, "user": newUser})
 
 		// Push to all connected clients (all users, all tabs)
-		for userUUID, conns := range clients {
-			for client := range conns {
-				select {
-				case client.Send <- encoded:
-				default:
-					log.Printf("Client %s channel full, skipping", userUUID)
-				}
-			}
-		}
+		hub.SendToAll(frame)
 
 		w.WriteHeader(http.StatusCreated)
 		w.Write([]byte("User registered successfully"))
@@ -156,37 +161,84 @@ func LoginHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		// Create session UUID and expiry
-		sessionUUID := uuid.New().String()
-		expiresAt := time.Now().Add(24 * time.Hour)
+		if requireEmailVerification {
+			verified, err := EmailVerified(db, userUUID)
+			if err != nil {
+				http.Error(w, "Server error", http.StatusInternalServerError)
+				return
+			}
+			if !verified {
+				if err := SendVerificationEmail(db, userUUID); err != nil {
+					log.Printf("Error sending verification email: %v", err)
+				}
+				http.Error(w, ErrEmailNotVerified.Error(), http.StatusForbidden)
+				return
+			}
+		}
 
-		// Save session in DB
-		err = CreateSession(db, sessionUUID, userUUID, expiresAt)
+		// With 2FA the password only earns a login challenge; the session
+		// comes from POST /login/2fa.
+		twoFactor, err := TwoFactorEnabled(db, userUUID)
 		if err != nil {
 			http.Error(w, "Server error", http.StatusInternalServerError)
 			return
 		}
+		if twoFactor {
+			token, expiresAt, err := CreateLoginChallenge(db, userUUID)
+			if err != nil {
+				writeTwoFactorError(w, err)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     loginChallengeCookie,
+				Value:    token,
+				Expires:  expiresAt,
+				HttpOnly: true,
+				Path:     "/login",
+				SameSite: http.SameSiteLaxMode,
+			})
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(map[string]bool{"two_factor_required": true})
+			return
+		}
 
-		log.Println("Setting cookie with session_token:", sessionUUID)
-
-		// Set cookie with session UUID
-		http.SetCookie(w, &http.Cookie{
-			Name:     "session_token",
-			Value:    sessionUUID,
-			Expires:  expiresAt,
-			HttpOnly: true,
-			Path:     "/",
-			SameSite: http.SameSiteLaxMode, // <--- important! //If SameSite is not explicitly set, some browsers block the cookie for fetch() even to localhost.
-		})
+		if err := startSession(w, r, db, userUUID); err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
 
 		w.Header().Set("Content-Type", "text/plain")
 		w.Write([]byte("Login successful"))
+	}
+}
+
+// startSession creates a session for the user and sets its cookie.
+func startSession(w http.ResponseWriter, r *http.Request, db *sql.DB, userUUID string) error {
+	// Create session UUID and expiry
+	sessionUUID := uuid.New().String()
+	expiresAt := time.Now().Add(24 * time.Hour)
 
-		log.Println("Login successful, session cookie set for", userUUID)
+	// Save session in DB
+	if err := CreateSession(db, sessionUUID, userUUID, expiresAt, r.UserAgent(), clientIP(r)); err != nil {
+		return err
 	}
+
+	// Set cookie with session UUID
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session_token",
+		Value:    sessionUUID,
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Path:     "/",
+		SameSite: http.SameSiteLaxMode, // <--- important! //If SameSite is not explicitly set, some browsers block the cookie for fetch() even to localhost.
+	})
+
+	log.Println("Login successful, session cookie set for", userUUID)
+	return nil
 }
 
-func LogoutHandler(db *sql.DB) http.HandlerFunc {
+func LogoutHandler(db *sql.DB, hub *Hub) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		cookie, err := r.Cookie("session_token")
 		if err != nil {
@@ -212,20 +264,7 @@ func LogoutHandler(db *sql.DB) http.HandlerFunc {
 		}
 
 		// Push real-time logout event and close WS connections for this session
-		if conns, ok := clients[userUUID]; ok {
-			for c := range conns {
-				if c.SessionUUID == sessionToken {
-					// Direct send before closing
-					logoutMsg, _ := json.Marshal(map[string]string{"type": "force_logout"})
-					c.Conn.WriteMessage(websocket.TextMessage, logoutMsg)
-					c.Conn.Close()
-					delete(conns, c)
-				}
-			}
-			if len(conns) == 0 {
-				delete(clients, userUUID)
-			}
-		}
+		hub.DisconnectSession(userUUID, sessionToken, forceLogoutFrame())
 
 		// Expire cookie
 		http.SetCookie(w, &http.Cookie{
@@ -241,34 +280,14 @@ func LogoutHandler(db *sql.DB) http.HandlerFunc {
 }
 
 type CreatePostRequest struct {
-	Title      string   `json:"title"`
-	Content    string   `json:"content"`
-	Categories []string `json:"categories"`
+	Title       string   `json:"title"`
+	Content     string   `json:"content"`
+	Categories  []string `json:"categories"`
+	Tags        []string `json:"tags"`
+	Attachments []string `json:"attachments"` // uuids from POST /attachments
 }
 
-func GetCategoriesHandler(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		rows, err := db.Query("SELECT name FROM categories")
-		if err != nil {
-			http.Error(w, "Failed to fetch categories", http.StatusInternalServerError)
-			return
-		}
-		defer rows.Close()
-
-		var categories []string
-		for rows.Next() {
-			var name string
-			if err := rows.Scan(&name); err == nil {
-				categories = append(categories, name)
-			}
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(categories)
-	}
-}
-
-func CreatePostHandler(db *sql.DB) http.HandlerFunc {
+func CreatePostHandler(db *sql.DB, hub *Hub) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		userUUID, ok := UserUUIDFromContext(r.Context())
@@ -291,15 +310,25 @@ func CreatePostHandler(db *sql.DB) http.HandlerFunc {
 			http.Error(w, "Title and content are required", http.StatusBadRequest)
 			return
 		}
-		if len(req.Categories) > 0 {
-			for _, category := range req.Categories {
-				var exists bool
-				err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM categories WHERE name = ?)", category).Scan(&exists)
-				if err != nil || !exists {
-					http.Error(w, fmt.Sprintf("Category '%s' does not exist", category), http.StatusBadRequest)
-					return
-				}
+		if category, err := checkPostCategories(db, userUUID, req.Categories); err != nil {
+			switch err {
+			case ErrCategoryNotFound:
+				http.Error(w, fmt.Sprintf("Category '%s' does not exist", category), http.StatusBadRequest)
+			case ErrCategoryArchived:
+				http.Error(w, fmt.Sprintf("Category '%s' is archived", category), http.StatusBadRequest)
+			case ErrCategoryRestricted:
+				http.Error(w, fmt.Sprintf("Your role may not post in category '%s'", category), http.StatusForbidden)
+			default:
+				log.Println("checkPostCategories error:", err)
+				http.Error(w, "Failed to check categories", http.StatusInternalServerError)
 			}
+			return
+		}
+
+		tags, err := normalizeTags(req.Tags)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 
 		postUUID := uuid.New().String()
@@ -307,8 +336,14 @@ func CreatePostHandler(db *sql.DB) http.HandlerFunc {
 
 		log.Println("Creating post:", postUUID, userUUID, req.Title, req.Content, now)
 
-		err := InsertPost(db, postUUID, userUUID, req.Title, req.Content, now)
-		if err != nil {
+		err = InsertPost(db, postUUID, userUUID, req.Title, req.Content, req.Attachments, tags, now)
+		if status := attachmentErrorStatus(err); status != 0 {
+			http.Error(w, err.Error(), status)
+			return
+		} else if errors.Is(err, ErrTagBanned) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
 			log.Println("InsertPost error:", err)
 			http.Error(w, "Failed to insert post", http.StatusInternalServerError)
 			return
@@ -321,13 +356,15 @@ func CreatePostHandler(db *sql.DB) http.HandlerFunc {
 			http.Error(w, "Failed to insert categories", http.StatusInternalServerError)
 			return
 		}
+		publishPostCreated(db, hub, postUUID)
+		notifyTargetUUID(hub, TargetPost, postUUID)
 
 		w.WriteHeader(http.StatusCreated)
 		w.Write([]byte("Post created successfully"))
 	}
 }
 
-func WebSocketHandler(db *sql.DB) http.HandlerFunc {
+func WebSocketHandler(db *sql.DB, hub *Hub) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userUUID, ok := UserUUIDFromContext(r.Context())
 		if !ok {
@@ -335,9 +372,15 @@ func WebSocketHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
+		cookie, err := r.Cookie("session_token")
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
 		// Fetch user's nickname from DB on connection.
 		var nickname string
-		err := db.QueryRow("SELECT nickname FROM users WHERE uuid = ?", userUUID).Scan(&nickname)
+		err = db.QueryRow("SELECT nickname FROM users WHERE uuid = ?", userUUID).Scan(&nickname)
 		if err != nil {
 			log.Printf("Could not find nickname for user %s: %v", userUUID, err)
 			http.Error(w, "User not found", http.StatusInternalServerError)
@@ -350,110 +393,67 @@ func WebSocketHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		cookie, err := r.Cookie("session_token")
-		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
+		protocol := ProtocolV1
+		if conn.Subprotocol() == SubprotocolV2 {
+			protocol = ProtocolV2
 		}
 
-		client := &Client{
-			Conn:        conn,
-			UserUUID:    userUUID,
-			SessionUUID: cookie.Value, // ✅ attach session
-			Send:        make(chan []byte, 256),
-		}
+		client := hub.NewClient(conn, protocol, userUUID, nickname, cookie.Value) // ✅ attach session
 
-		// ✅ Add client into map of connections for this user
-		if _, ok := clients[userUUID]; !ok {
-			clients[userUUID] = make(map[*Client]bool)
-		}
-		clients[userUUID][client] = true
+		// The hub marks the user online and pushes fresh user lists to everyone.
+		hub.Register(client)
+		hub.DeliverNotifications(userUUID)
 
-		log.Printf("User %s (%s) connected. Total clients for user: %d", userUUID, nickname, len(clients[userUUID]))
-
-		// STEP 1: Establish presence
-		var currentUserLastMsg string
-		var currentUserLastTime time.Time
-		row := db.QueryRow(`
-            SELECT content, sent_at 
-            FROM private_messages 
-            WHERE sender_uuid = ? 
-            ORDER BY sent_at DESC 
-            LIMIT 1`, userUUID)
-		err = row.Scan(&currentUserLastMsg, &currentUserLastTime)
-		if err == sql.ErrNoRows {
-			currentUserLastMsg = ""
-			currentUserLastTime = time.Time{}
-		} else if err != nil {
-			log.Printf("Error getting user's last message: %v", err)
-		}
+		// Run pumps; readPump unregisters the client when it returns.
+		go writePump(hub, client)
+		readPump(hub, client)
+	}
+}
 
-		if existingUser, exists := onlineUsers[userUUID]; exists {
-			existingUser.IsOnline = true
-			existingUser.Nickname = nickname
-			if !currentUserLastTime.IsZero() && currentUserLastTime.After(existingUser.LastMessageTime) {
-				existingUser.LastMessage = currentUserLastMsg
-				existingUser.LastMessageTime = currentUserLastTime
-			}
-		} else {
-			onlineUsers[userUUID] = &UserPresence{
-				UserUUID:        userUUID,
-				Nickname:        nickname,
-				IsOnline:        true,
-				LastMessage:     currentUserLastMsg,
-				LastMessageTime: currentUserLastTime,
-			}
+// WebSocketMetricsHandler reports connection counts and eviction counters to
+// admins.
+func WebSocketMetricsHandler(db *sql.DB, hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
 		}
-
-		// STEP 2: Load presence for other users
-		loadUserPresenceFromDB(db, userUUID)
-
-		rows, _ := db.Query(`
-            SELECT DISTINCT CASE
-                WHEN sender_uuid = ? THEN receiver_uuid
-                ELSE sender_uuid
-            END AS other_uuid
-            FROM private_messages
-            WHERE sender_uuid = ? OR receiver_uuid = ?`,
-			userUUID, userUUID, userUUID)
-		defer rows.Close()
-		for rows.Next() {
-			var other string
-			if err := rows.Scan(&other); err == nil {
-				if _, ok := onlineUsers[other]; !ok {
-					var nickname string
-					if err := db.QueryRow("SELECT nickname FROM users WHERE uuid = ?", other).Scan(&nickname); err == nil {
-						onlineUsers[other] = &UserPresence{
-							UserUUID: other,
-							Nickname: nickname,
-							IsOnline: false,
-						}
-					}
-				}
-			}
+		switch err := requireAdmin(db, userUUID); err {
+		case nil:
+		case ErrNotAdmin:
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		default:
+			log.Printf("Error checking role for metrics: %v", err)
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
 		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(hub.Metrics())
+	}
+}
 
-		sendOnlineUsersToAllConnected(db)
-
-		// Run pumps
-		go writePump(client)
-		readPump(db, client)
-
-		// ✅ Cleanup when this client disconnects
-		delete(clients[userUUID], client)
-		if len(clients[userUUID]) == 0 {
-			delete(clients, userUUID)
-			if u, ok := onlineUsers[userUUID]; ok {
-				u.IsOnline = false
-			}
-			sendOnlineUsersToAllConnected(db)
+// parseMessageCursor reads before, after and limit from a history request.
+// The page size defaults to defaultMessagePageSize and is capped at
+// maxMessagePageSize.
+func parseMessageCursor(r *http.Request) (MessageCursor, error) {
+	q := r.URL.Query()
+	c := MessageCursor{Before: q.Get("before"), After: q.Get("after"), Limit: defaultMessagePageSize}
+	if c.Before != "" && c.After != "" {
+		return c, errors.New("use either 'before' or 'after', not both")
+	}
+	if limitStr := q.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 1 {
+			return c, errors.New("'limit' must be a positive number")
 		}
-
-		log.Printf("User %s (%s) disconnected. Remaining connections: %d", userUUID, nickname, len(clients[userUUID]))
+		c.Limit = min(limit, maxMessagePageSize)
 	}
+	return c, nil
 }
 
-// fetch chat history
+// fetch chat history: GET /messages?with=<user>|room=<room>[&before=|after=<message uuid>][&limit=]
 func GetMessagesHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userUUID, ok := UserUUIDFromContext(r.Context())
@@ -464,38 +464,83 @@ func GetMessagesHandler(db *sql.DB) http.HandlerFunc {
 		}
 
 		otherUser := r.URL.Query().Get("with")
-		offsetStr := r.URL.Query().Get("offset")
+		roomUUID := r.URL.Query().Get("room")
 
-		if otherUser == "" {
+		if otherUser == "" && roomUUID == "" {
 			log.Println("GetMessagesHandler: Missing 'with' parameter")
-			http.Error(w, "Missing 'with' parameter", http.StatusBadRequest)
+			http.Error(w, "Missing 'with' or 'room' parameter", http.StatusBadRequest)
 			return
 		}
 
-		offset, err := strconv.Atoi(offsetStr)
+		cursor, err := parseMessageCursor(r)
 		if err != nil {
-			log.Printf("GetMessagesHandler: Invalid offset '%s', using 0", offsetStr)
-			offset = 0
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 
-		log.Printf("GetMessagesHandler: Loading messages between %s and %s, offset=%d", userUUID, otherUser, offset)
+		var page MessagePage
+		if roomUUID != "" {
+			room, err := GetRoom(db, roomUUID, userUUID)
+			if err == nil && !canReadRoom(room) {
+				err = ErrNotRoomMember
+			}
+			if err != nil {
+				writeRoomError(w, err)
+				return
+			}
 
-		messages, err := LoadMessages(db, userUUID, otherUser, 10, offset)
-		if err != nil {
-			log.Printf("GetMessagesHandler: LoadMessages error: %v", err)
-			http.Error(w, "Failed to fetch messages: "+err.Error(), http.StatusInternalServerError)
+			page, err = LoadRoomMessages(db, roomUUID, cursor)
+		} else {
+			page, err = LoadMessages(db, userUUID, otherUser, cursor)
+		}
+		if err == ErrMessageNotInConversation {
+			http.Error(w, "Unknown message cursor", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.Printf("GetMessagesHandler: error loading messages: %v", err)
+			http.Error(w, "Failed to fetch messages", http.StatusInternalServerError)
 			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(messages); err != nil {
+		if err := json.NewEncoder(w).Encode(page); err != nil {
 			log.Printf("GetMessagesHandler: JSON encoding error: %v", err)
-			http.Error(w, "Failed to encode messages", http.StatusInternalServerError)
 			return
 		}
-		log.Printf("API: Loading messages between %s and %s with offset %d. Found %d messages.", userUUID, otherUser, offset, len(messages))
+		log.Printf("GetMessagesHandler: returned %d messages for %s", len(page.Messages), userUUID)
+	}
+}
+
+// MarkReadHandler marks a conversation read: POST /messages/read {with, up_to}
+func MarkReadHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
 
-		log.Printf("GetMessagesHandler: Successfully returned %d messages", len(messages))
+		var req MarkReadPayload
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if req.With == "" {
+			http.Error(w, "Missing 'with' user", http.StatusBadRequest)
+			return
+		}
+
+		receipt, err := markRead(hub, userUUID, req.With, req.UpTo)
+		if err == ErrMessageNotInConversation {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to mark messages read", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(receipt)
 	}
 }
 
@@ -510,48 +555,106 @@ func MeHandler(db *sql.DB) http.Handler {
 		}
 
 		// Fetch user's nickname from database
-		var nickname string
-		err := db.QueryRow("SELECT nickname FROM users WHERE uuid = ?", userUUID).Scan(&nickname)
+		var nickname, role string
+		var verified bool
+		err := db.QueryRow("SELECT nickname, role, email_verified_at IS NOT NULL FROM users WHERE uuid = ?", userUUID).Scan(&nickname, &role, &verified)
 		if err != nil {
 			log.Printf("Could not find nickname for user %s: %v", userUUID, err)
 			http.Error(w, "User not found", http.StatusInternalServerError)
 			return
 		}
+		unread, err := CountUnreadNotifications(db, userUUID)
+		if err != nil {
+			log.Printf("Could not count notifications for user %s: %v", userUUID, err)
+		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{
-			"user_uuid": userUUID,
-			"nickname":  nickname,
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"user_uuid":            userUUID,
+			"nickname":             nickname,
+			"role":                 role,
+			"email_verified":       verified,
+			"unread_notifications": unread,
 		})
 	})
 }
 
-func GetPostsHandler(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		offsetStr := r.URL.Query().Get("offset")
-		limitStr := r.URL.Query().Get("limit")
-		category := r.URL.Query().Get("category")
-		offset, err := strconv.Atoi(offsetStr)
-		if err != nil {
-			offset = 0
+// parseFeedQuery reads the feed parameters. category and tag may repeat or
+// hold a comma-separated list.
+func parseFeedQuery(r *http.Request) (FeedQuery, error) {
+	v := r.URL.Query()
+	q := FeedQuery{Sort: v.Get("sort"), Window: v.Get("window"), Author: v.Get("author"), Cursor: v.Get("cursor"), Limit: defaultFeedPageSize}
+	switch q.Sort {
+	case "":
+		q.Sort = FeedSortNew
+	case FeedSortNew, FeedSortTop, FeedSortHot, FeedSortActive:
+	default:
+		return q, errors.New("'sort' must be new, top, hot or active")
+	}
+	switch q.Window {
+	case "":
+		q.Window = TopWindowAll
+	case TopWindowDay, TopWindowWeek, TopWindowAll:
+	default:
+		return q, errors.New("'window' must be day, week or all")
+	}
+	for _, list := range v["category"] {
+		for _, category := range strings.Split(list, ",") {
+			if category = strings.TrimSpace(category); category != "" {
+				q.Categories = append(q.Categories, category)
+			}
 		}
-
+	}
+	for _, list := range v["tag"] {
+		for _, tag := range strings.Split(list, ",") {
+			if strings.TrimSpace(tag) == "" {
+				continue
+			}
+			tag, err := normalizeTag(tag)
+			if err != nil {
+				return q, err
+			}
+			q.Tags = append(q.Tags, tag)
+		}
+	}
+	if limitStr := v.Get("limit"); limitStr != "" {
 		limit, err := strconv.Atoi(limitStr)
-		if err != nil || limit <= 0 || limit > 50 {
-			limit = 10
+		if err != nil || limit < 1 {
+			return q, errors.New("'limit' must be a positive number")
 		}
-		posts, err := GetPostsPaginated(db, offset, limit, category)
-		log.Println("posts bck", posts)
+		q.Limit = min(limit, maxFeedPageSize)
+	}
+	return q, nil
+}
 
+// GetPostsHandler: GET /posts[?sort=new|top|hot|active][&window=day|week|all]
+// [&category=][&tag=][&author=<uuid or nickname>][&cursor=][&limit=]
+func GetPostsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := parseFeedQuery(r)
 		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		viewerUUID, _ := UserUUIDFromContext(r.Context())
+		page, err := GetPostsPaginated(db, q, viewerUUID)
+		if err == ErrInvalidFeedCursor {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.Printf("Error loading posts: %v", err)
 			http.Error(w, "Failed to load posts", http.StatusInternalServerError)
 			return
 		}
 
-		json.NewEncoder(w).Encode(posts)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
 	}
 }
 
+// GetPostDetailsHandler: GET /post?uuid=[&sort=&cursor=&limit=], where the
+// paging parameters are those of /comments.
 func GetPostDetailsHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		postUUID := r.URL.Query().Get("uuid")
@@ -560,8 +663,21 @@ func GetPostDetailsHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		post, err := LoadPostWithComments(db, postUUID)
+		q, err := parseCommentQuery(r)
 		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		viewerUUID, _ := UserUUIDFromContext(r.Context())
+		post, err := LoadPostWithComments(db, postUUID, viewerUUID, q)
+		if err == ErrPostNotFound {
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		} else if err == ErrInvalidCommentCursor {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
 			log.Printf("Error loading post: %v", err)
 			http.Error(w, "Failed to load post", http.StatusInternalServerError)
 			return
@@ -573,11 +689,18 @@ func GetPostDetailsHandler(db *sql.DB) http.HandlerFunc {
 }
 
 type CommentRequest struct {
-	PostUUID string `json:"post_uuid"`
-	Content  string `json:"content"`
+	PostUUID        string   `json:"post_uuid"`
+	ParentCommentID string   `json:"parent_comment_id,omitempty"` // uuid of the comment replied to
+	Content         string   `json:"content"`
+	Attachments     []string `json:"attachments"` // uuids from POST /attachments
 }
 
-func CreateCommentHandler(db *sql.DB) http.HandlerFunc {
+type CommentCreatedResponse struct {
+	ID   int64  `json:"id"`
+	UUID string `json:"uuid"`
+}
+
+func CreateCommentHandler(db *sql.DB, hub *Hub) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userUUID, ok := UserUUIDFromContext(r.Context())
 		if !ok {
@@ -596,18 +719,33 @@ func CreateCommentHandler(db *sql.DB) http.HandlerFunc {
 			return
 		}
 
-		err := InsertComment(db, userUUID, req.PostUUID, req.Content)
-		if err != nil {
+		id, commentUUID, err := InsertComment(db, userUUID, req.PostUUID, req.ParentCommentID, req.Content, req.Attachments)
+		switch err {
+		case nil:
+		case ErrPostNotFound, ErrCommentNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case ErrReplyTooDeep:
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		case ErrAttachmentNotFound, ErrAttachmentInUse, ErrTooManyAttachments:
+			http.Error(w, err.Error(), attachmentErrorStatus(err))
+			return
+		default:
+			log.Printf("Error saving comment: %v", err)
 			http.Error(w, "Failed to save comment", http.StatusInternalServerError)
 			return
 		}
+		publishCommentCreated(db, hub, req.PostUUID, id)
+		notifyTarget(hub, TargetComment, id)
 
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
-		w.Write([]byte("Comment posted"))
+		json.NewEncoder(w).Encode(CommentCreatedResponse{ID: id, UUID: commentUUID})
 	}
 }
 
-func GetAllUsersHandler(db *sql.DB) http.HandlerFunc {
+func GetAllUsersHandler(db *sql.DB, hub *Hub) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		rows, err := db.Query(`SELECT uuid, nickname FROM users`)
 		if err != nil {
@@ -620,10 +758,7 @@ func GetAllUsersHandler(db *sql.DB) http.HandlerFunc {
 		for rows.Next() {
 			var uuid, nickname string
 			if err := rows.Scan(&uuid, &nickname); err == nil {
-				isOnline := false
-				if userPresence, ok := onlineUsers[uuid]; ok && userPresence.IsOnline {
-					isOnline = true
-				}
+				isOnline := hub.IsOnline(uuid)
 				users = append(users, map[string]interface{}{
 					"uuid":     uuid,
 					"nickname": nickname,
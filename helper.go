@@ -1,6 +1,12 @@
 package main
 
-import "context"
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
 
 type contextKey string
 
@@ -11,3 +17,39 @@ func UserUUIDFromContext(ctx context.Context) (string, bool) {
 	userUUID, ok := ctx.Value(userContextKey).(string)
 	return userUUID, ok
 }
+
+// envString reads a string from the environment.
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envDuration reads a time.Duration such as "30s" from the environment.
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid %s=%q, using %s", key, v, def)
+		return def
+	}
+	return d
+}
+
+// envInt reads a positive integer from the environment.
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		log.Printf("Invalid %s=%q, using %d", key, v, def)
+		return def
+	}
+	return n
+}
@@ -0,0 +1,672 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// HubConfig holds the WebSocket keepalive and buffering settings.
+type HubConfig struct {
+	WriteWait      time.Duration // time allowed to write a frame to the peer
+	PongWait       time.Duration // time allowed to read the next pong from the peer
+	PingPeriod     time.Duration // how often pings are sent; must be less than PongWait
+	MaxMessageSize int64         // largest inbound frame accepted
+	SendBufferSize int           // per-connection outbound queue length
+
+	ResumeMaxReplay int           // most messages replayed on resume before asking for a resync
+	ResumeGrace     time.Duration // how long live chat frames are held waiting for resume
+}
+
+func DefaultHubConfig() HubConfig {
+	return HubConfig{
+		WriteWait:      10 * time.Second,
+		PongWait:       60 * time.Second,
+		PingPeriod:     54 * time.Second,
+		MaxMessageSize: 64 * 1024,
+		SendBufferSize: 256,
+
+		ResumeMaxReplay: 500,
+		ResumeGrace:     10 * time.Second,
+	}
+}
+
+// LoadHubConfig reads overrides from WS_WRITE_WAIT, WS_PONG_WAIT,
+// WS_PING_PERIOD, WS_MAX_MESSAGE_SIZE, WS_SEND_BUFFER, WS_RESUME_MAX_REPLAY
+// and WS_RESUME_GRACE.
+func LoadHubConfig() HubConfig {
+	cfg := DefaultHubConfig()
+	cfg.WriteWait = envDuration("WS_WRITE_WAIT", cfg.WriteWait)
+	cfg.PongWait = envDuration("WS_PONG_WAIT", cfg.PongWait)
+	cfg.PingPeriod = envDuration("WS_PING_PERIOD", cfg.PongWait*9/10)
+	cfg.MaxMessageSize = int64(envInt("WS_MAX_MESSAGE_SIZE", int(cfg.MaxMessageSize)))
+	cfg.SendBufferSize = envInt("WS_SEND_BUFFER", cfg.SendBufferSize)
+	cfg.ResumeMaxReplay = envInt("WS_RESUME_MAX_REPLAY", cfg.ResumeMaxReplay)
+	cfg.ResumeGrace = envDuration("WS_RESUME_GRACE", cfg.ResumeGrace)
+	if cfg.PingPeriod >= cfg.PongWait {
+		log.Printf("WS_PING_PERIOD %s is not below WS_PONG_WAIT %s, using %s", cfg.PingPeriod, cfg.PongWait, cfg.PongWait*9/10)
+		cfg.PingPeriod = cfg.PongWait * 9 / 10
+	}
+	return cfg
+}
+
+// HubMetrics counts connection-level failures. Fields are updated atomically
+// from the hub and pump goroutines.
+type HubMetrics struct {
+	SlowConsumerEvictions atomic.Int64
+	HeartbeatTimeouts     atomic.Int64
+	WriteErrors           atomic.Int64
+}
+
+type HubMetricsSnapshot struct {
+	SlowConsumerEvictions int64 `json:"slow_consumer_evictions"`
+	HeartbeatTimeouts     int64 `json:"heartbeat_timeouts"`
+	WriteErrors           int64 `json:"write_errors"`
+	Connections           int   `json:"connections"`
+	OnlineUsers           int   `json:"online_users"`
+}
+
+// Hub is the single owner of all WebSocket connection state. Every read or
+// write of clients, onlineUsers and typingUsers happens inside Run, so the
+// rest of the code talks to it only through the methods below. The hub
+// goroutine never touches the database: callers load what it needs first,
+// and user lists are built by the worker in runUserLists.
+type Hub struct {
+	db      *sql.DB
+	cfg     HubConfig
+	metrics HubMetrics
+
+	clients     map[string]map[*Client]bool // Each user can have multiple active connections
+	onlineUsers map[string]*UserPresence    // key = userUUID
+	typingUsers map[*Client]*TypingStatus   // key = connection that is typing
+	postViewers map[string]map[*Client]bool // key = post uuid open on those connections
+	subscribers map[string]map[*Client]bool // key = topic, see subscriptions.go
+
+	register   chan *Client
+	unregister chan *Client
+	typing     chan typingEvent
+	actions    chan func() // arbitrary work that must run on the hub goroutine
+
+	evicted []*Client // slow consumers queued for removal by sendToUser
+
+	listMu      sync.Mutex
+	listPending map[string]bool // users waiting for a user_list, see sendUserList
+	listWake    chan struct{}
+
+	notifyMu sync.Mutex // serializes DeliverNotifications so none is sent twice
+}
+
+type typingEvent struct {
+	client      *Client
+	msg         TypingMessage
+	roomMembers []string
+}
+
+func NewHub(db *sql.DB, cfg HubConfig) *Hub {
+	return &Hub{
+		db:          db,
+		cfg:         cfg,
+		clients:     make(map[string]map[*Client]bool),
+		onlineUsers: make(map[string]*UserPresence),
+		typingUsers: make(map[*Client]*TypingStatus),
+		postViewers: make(map[string]map[*Client]bool),
+		subscribers: make(map[string]map[*Client]bool),
+		register:    make(chan *Client),
+		unregister:  make(chan *Client),
+		typing:      make(chan typingEvent),
+		actions:     make(chan func()),
+		listPending: make(map[string]bool),
+		listWake:    make(chan struct{}, 1),
+	}
+}
+
+// Run is the hub's event loop. It must be started exactly once.
+func (h *Hub) Run() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	go h.runUserLists()
+
+	for {
+		select {
+		case c := <-h.register:
+			h.addClient(c)
+		case c := <-h.unregister:
+			h.removeClient(c)
+		case ev := <-h.typing:
+			h.handleTypingMessage(ev.client, ev.msg, ev.roomMembers)
+		case fn := <-h.actions:
+			fn()
+		case now := <-ticker.C:
+			h.cleanupOldTypingStatus(now)
+			h.releaseExpiredHolds(now)
+		}
+		h.flushEvictions()
+	}
+}
+
+// NewClient builds a client whose outbound queue uses the hub's buffer size.
+func (h *Hub) NewClient(conn *websocket.Conn, protocol int, userUUID, nickname, sessionUUID string) *Client {
+	return &Client{
+		Conn:        conn,
+		Protocol:    protocol,
+		UserUUID:    userUUID,
+		Nickname:    nickname,
+		SessionUUID: sessionUUID,
+		Send:        make(chan []byte, h.cfg.SendBufferSize),
+	}
+}
+
+// Metrics returns a point-in-time copy of the hub counters.
+func (h *Hub) Metrics() HubMetricsSnapshot {
+	snap := HubMetricsSnapshot{
+		SlowConsumerEvictions: h.metrics.SlowConsumerEvictions.Load(),
+		HeartbeatTimeouts:     h.metrics.HeartbeatTimeouts.Load(),
+		WriteErrors:           h.metrics.WriteErrors.Load(),
+	}
+	h.do(func() {
+		for _, conns := range h.clients {
+			snap.Connections += len(conns)
+		}
+		snap.OnlineUsers = len(h.clients)
+	})
+	return snap
+}
+
+func (h *Hub) Register(c *Client)   { h.register <- c }
+func (h *Hub) Unregister(c *Client) { h.unregister <- c }
+
+// Broadcast delivers a saved chat message. A room message must carry the
+// room's members in RoomMembers.
+func (h *Hub) Broadcast(msg Message) {
+	var delivered bool
+	h.do(func() { delivered = h.deliverMessage(msg) })
+	if delivered {
+		if err := MarkMessageDelivered(h.db, msg.UUID, time.Now()); err != nil {
+			log.Printf("Error marking message %s delivered: %v", msg.UUID, err)
+		}
+	}
+}
+
+// Typing relays a typing_start or typing_stop. roomMembers lists the
+// members of msg.Room for room typing and is nil otherwise.
+func (h *Hub) Typing(c *Client, msg TypingMessage, roomMembers []string) {
+	h.typing <- typingEvent{client: c, msg: msg, roomMembers: roomMembers}
+}
+
+// do runs fn on the hub goroutine and waits for it to finish.
+func (h *Hub) do(fn func()) {
+	done := make(chan struct{})
+	h.actions <- func() {
+		fn()
+		close(done)
+	}
+	<-done
+}
+
+// IsOnline reports whether the user has at least one open connection.
+func (h *Hub) IsOnline(userUUID string) bool {
+	var online bool
+	h.do(func() {
+		if u, ok := h.onlineUsers[userUUID]; ok {
+			online = u.IsOnline
+		}
+	})
+	return online
+}
+
+// SendToAll pushes a frame to every connection of every user.
+func (h *Hub) SendToAll(f *Frame) {
+	h.do(func() {
+		for userUUID := range h.clients {
+			h.sendToUser(userUUID, f)
+		}
+	})
+}
+
+// SendToUser pushes a frame to every connection of one user.
+func (h *Hub) SendToUser(userUUID string, f *Frame) {
+	h.do(func() { h.sendToUser(userUUID, f) })
+}
+
+// DeliverNotifications pushes the user's stored notifications to their
+// connections. Version 1 clients have no notification frame, so they stay
+// undelivered until one of the user's version 2 connections takes them.
+func (h *Hub) DeliverNotifications(userUUID string) {
+	h.notifyMu.Lock()
+	defer h.notifyMu.Unlock()
+
+	notifications, err := LoadUndeliveredNotifications(h.db, userUUID)
+	if err != nil {
+		log.Printf("Error loading notifications for %s: %v", userUUID, err)
+		return
+	}
+	if len(notifications) == 0 {
+		return
+	}
+	frames := make([]*Frame, len(notifications))
+	for i, n := range notifications {
+		frames[i] = notificationFrame(n)
+	}
+	var delivered bool
+	h.do(func() {
+		for c := range h.clients[userUUID] {
+			got := true
+			for _, f := range frames {
+				got = h.sendToClient(c, f) && got
+			}
+			delivered = delivered || got
+		}
+	})
+	if !delivered {
+		return
+	}
+	ids := make([]int64, len(notifications))
+	for i, n := range notifications {
+		ids[i] = n.ID
+	}
+	if err := MarkNotificationsDelivered(h.db, ids); err != nil {
+		log.Printf("Error marking notifications delivered for %s: %v", userUUID, err)
+	}
+}
+
+// SendToClient pushes a frame to a single connection if it is still registered.
+func (h *Hub) SendToClient(c *Client, f *Frame) {
+	h.do(func() {
+		if h.clients[c.UserUUID][c] {
+			h.sendToClient(c, f)
+		}
+	})
+}
+
+// DisconnectSession sends a final frame to every connection opened with the
+// given session and then closes them.
+func (h *Hub) DisconnectSession(userUUID, sessionUUID string, final *Frame) {
+	h.do(func() {
+		for c := range h.clients[userUUID] {
+			if c.SessionUUID != sessionUUID {
+				continue
+			}
+			if data := final.Bytes(c.Protocol); data != nil {
+				select {
+				case c.Send <- data:
+				default:
+				}
+			}
+			h.removeClient(c)
+		}
+	})
+}
+
+// ConnectedSessions returns the sessions of the user with an open
+// connection.
+func (h *Hub) ConnectedSessions(userUUID string) map[string]bool {
+	sessions := make(map[string]bool)
+	h.do(func() {
+		for c := range h.clients[userUUID] {
+			sessions[c.SessionUUID] = true
+		}
+	})
+	return sessions
+}
+
+// DisconnectUser sends final to, and closes, every connection of the user,
+// whatever their session.
+func (h *Hub) DisconnectUser(userUUID string, final *Frame) {
+	h.do(func() {
+		for c := range h.clients[userUUID] {
+			if data := final.Bytes(c.Protocol); data != nil {
+				select {
+				case c.Send <- data:
+				default:
+				}
+			}
+			h.removeClient(c)
+		}
+	})
+}
+
+// ReadReceipt tells the sender's connections that their messages were read
+// and refreshes the reader's unread counts on all of their tabs.
+func (h *Hub) ReadReceipt(p ReadReceiptPayload) {
+	h.do(func() {
+		frame := readReceiptFrame(p)
+		h.sendToUser(p.With, frame)
+		if p.With != p.Reader {
+			h.sendToUser(p.Reader, frame)
+		}
+		h.sendUserList(p.Reader)
+	})
+}
+
+// ViewPost records which post a connection has open, replacing any earlier
+// one. An empty postUUID means none.
+func (h *Hub) ViewPost(c *Client, postUUID string) {
+	h.do(func() {
+		if h.clients[c.UserUUID][c] {
+			h.setViewingPost(c, postUUID)
+		}
+	})
+}
+
+// SendToPostViewers pushes a frame to every connection that has the post open
+// or is subscribed to it.
+func (h *Hub) SendToPostViewers(postUUID string, f *Frame) {
+	h.do(func() {
+		for c := range h.postViewers[postUUID] {
+			h.sendToClient(c, f)
+		}
+		for c := range h.subscribers[postTopic(postUUID)] {
+			if c.viewingPost != postUUID {
+				h.sendToClient(c, f)
+			}
+		}
+	})
+}
+
+// Subscribe adds a topic to a connection's subscriptions. It fails once the
+// connection holds maxSubscriptions topics.
+func (h *Hub) Subscribe(c *Client, topic string) error {
+	var err error
+	h.do(func() {
+		if !h.clients[c.UserUUID][c] || c.subscriptions[topic] {
+			return
+		}
+		if len(c.subscriptions) >= maxSubscriptions {
+			err = ErrTooManySubscriptions
+			return
+		}
+		if c.subscriptions == nil {
+			c.subscriptions = make(map[string]bool)
+		}
+		c.subscriptions[topic] = true
+		if h.subscribers[topic] == nil {
+			h.subscribers[topic] = make(map[*Client]bool)
+		}
+		h.subscribers[topic][c] = true
+	})
+	return err
+}
+
+// Unsubscribe removes a topic from a connection's subscriptions.
+func (h *Hub) Unsubscribe(c *Client, topic string) {
+	h.do(func() { h.unsubscribe(c, topic) })
+}
+
+// SendToTopics pushes a frame once to every connection subscribed to any of
+// the topics.
+func (h *Hub) SendToTopics(topics []string, f *Frame) {
+	h.do(func() {
+		sent := make(map[*Client]bool)
+		for _, topic := range topics {
+			for c := range h.subscribers[topic] {
+				if !sent[c] {
+					sent[c] = true
+					h.sendToClient(c, f)
+				}
+			}
+		}
+	})
+}
+
+// ConnectionCount returns the number of open connections for a user.
+func (h *Hub) ConnectionCount(userUUID string) int {
+	var n int
+	h.do(func() { n = len(h.clients[userUUID]) })
+	return n
+}
+
+func (h *Hub) addClient(c *Client) {
+	if _, ok := h.clients[c.UserUUID]; !ok {
+		h.clients[c.UserUUID] = make(map[*Client]bool)
+	}
+	h.clients[c.UserUUID][c] = true
+
+	// Version 2 clients announce what they already have with resume, so
+	// their live chat frames wait until then.
+	c.connectedAt = time.Now()
+	c.awaitingResume = c.Protocol >= ProtocolV2
+
+	if existing, ok := h.onlineUsers[c.UserUUID]; ok {
+		existing.IsOnline = true
+		existing.Nickname = c.Nickname
+	} else {
+		h.onlineUsers[c.UserUUID] = &UserPresence{
+			UserUUID: c.UserUUID,
+			Nickname: c.Nickname,
+			IsOnline: true,
+		}
+	}
+
+	log.Printf("User %s (%s) connected. Total clients for user: %d", c.UserUUID, c.Nickname, len(h.clients[c.UserUUID]))
+	h.sendOnlineUsersToAllConnected()
+}
+
+// removeClient drops a connection and closes its Send channel. It is safe to
+// call more than once for the same client.
+func (h *Hub) removeClient(c *Client) {
+	conns, ok := h.clients[c.UserUUID]
+	if !ok || !conns[c] {
+		return
+	}
+	delete(conns, c)
+	close(c.Send)
+
+	if len(conns) == 0 {
+		delete(h.clients, c.UserUUID)
+		if u, ok := h.onlineUsers[c.UserUUID]; ok {
+			u.IsOnline = false
+		}
+	}
+
+	// If this client was typing, tell the recipient to stop
+	if status, ok := h.typingUsers[c]; ok && status.IsTyping {
+		typingStopMsg := TypingMessage{
+			Type:     FrameTypingStop,
+			From:     status.UserUUID,
+			To:       status.TypingTo,
+			Room:     status.Room,
+			Nickname: status.Nickname,
+		}
+		if status.Room != "" {
+			h.sendToRoom(status.roomMembers, status.UserUUID, typingFrame(typingStopMsg))
+		} else {
+			h.sendToUser(status.TypingTo, typingFrame(typingStopMsg))
+		}
+	}
+	delete(h.typingUsers, c)
+	h.setViewingPost(c, "")
+	for topic := range c.subscriptions {
+		h.unsubscribe(c, topic)
+	}
+
+	log.Printf("User %s disconnected. Remaining connections: %d", c.UserUUID, len(h.clients[c.UserUUID]))
+	h.sendOnlineUsersToAllConnected()
+}
+
+func (h *Hub) setViewingPost(c *Client, postUUID string) {
+	if old := c.viewingPost; old != "" {
+		delete(h.postViewers[old], c)
+		if len(h.postViewers[old]) == 0 {
+			delete(h.postViewers, old)
+		}
+	}
+	c.viewingPost = postUUID
+	if postUUID == "" {
+		return
+	}
+	if h.postViewers[postUUID] == nil {
+		h.postViewers[postUUID] = make(map[*Client]bool)
+	}
+	h.postViewers[postUUID][c] = true
+}
+
+func (h *Hub) unsubscribe(c *Client, topic string) {
+	delete(c.subscriptions, topic)
+	delete(h.subscribers[topic], c)
+	if len(h.subscribers[topic]) == 0 {
+		delete(h.subscribers, topic)
+	}
+}
+
+// sendToUser must only be called from the hub goroutine. A connection whose
+// queue is full is never waited on; it is queued for eviction instead so one
+// stuck tab cannot stall delivery to everyone else.
+func (h *Hub) sendToUser(userUUID string, f *Frame) {
+	for c := range h.clients[userUUID] {
+		h.sendToClient(c, f)
+	}
+}
+
+// sendToClient reports whether the frame was queued for the connection. A
+// frame its protocol has no form of, or one held back for a resume, is not.
+func (h *Hub) sendToClient(c *Client, f *Frame) bool {
+	data := f.Bytes(c.Protocol)
+	if data == nil {
+		return false
+	}
+	if f.seq > 0 {
+		if c.awaitingResume {
+			if len(c.held) < h.cfg.SendBufferSize {
+				c.held = append(c.held, f)
+			} else if f.seq > c.heldDropped {
+				// The client is told to resync when the hold is released.
+				c.heldDropped = f.seq
+			}
+			return false
+		}
+		// Live frames can arrive out of seq order when messages are saved
+		// concurrently, so only the replay moves lastSeq.
+		if f.seq <= c.lastSeq {
+			return false // already delivered by a replay
+		}
+	}
+	select {
+	case c.Send <- data:
+		return true
+	default:
+		log.Printf("Client %s send buffer full, evicting", c.UserUUID)
+		h.evicted = append(h.evicted, c)
+		return false
+	}
+}
+
+// flushEvictions removes slow consumers. Removing a client pushes new user
+// lists, which may evict more clients, so it loops until the queue is empty.
+func (h *Hub) flushEvictions() {
+	for len(h.evicted) > 0 {
+		c := h.evicted[0]
+		h.evicted = h.evicted[1:]
+		if h.clients[c.UserUUID][c] {
+			h.metrics.SlowConsumerEvictions.Add(1)
+			h.removeClient(c)
+		}
+	}
+}
+
+// Resume replays messages the client missed after lastSeq and then releases
+// any live chat frames held since it connected. A nil lastSeq only reports
+// the current position. The log is read before handing the client to the
+// hub; frames saved meanwhile are held and released after the replay.
+func (h *Hub) Resume(c *Client, id string, lastSeq *int64) {
+	latest, err := LatestMessageSeq(h.db, c.UserUUID)
+	if err != nil {
+		log.Printf("Error loading latest message seq for %s: %v", c.UserUUID, err)
+		h.resumeFailed(c, id, "could not load message log")
+		return
+	}
+
+	from := latest
+	if lastSeq != nil {
+		from = *lastSeq
+	}
+
+	if from < 0 || from > latest || latest-from > int64(h.cfg.ResumeMaxReplay) {
+		log.Printf("Client %s too far behind (last_seq=%d, latest=%d), asking for resync", c.UserUUID, from, latest)
+		h.do(func() {
+			if !h.clients[c.UserUUID][c] {
+				return
+			}
+			c.awaitingResume = false
+			h.sendToClient(c, resyncFrame(id, ResyncPayload{LastSeq: latest}))
+			h.releaseHold(c, latest)
+		})
+		return
+	}
+
+	missed, err := LoadMessagesSince(h.db, c.UserUUID, from, h.cfg.ResumeMaxReplay)
+	if err != nil {
+		log.Printf("Error loading missed messages for %s: %v", c.UserUUID, err)
+		h.resumeFailed(c, id, "could not load missed messages")
+		return
+	}
+
+	var replayed bool
+	h.do(func() {
+		if !h.clients[c.UserUUID][c] {
+			return
+		}
+		c.awaitingResume = false
+		c.lastSeq = from
+		for _, m := range missed {
+			h.sendToClient(c, chatFrame(m))
+		}
+		h.sendToClient(c, resumedFrame(id, ResumedPayload{LastSeq: latest, Replayed: len(missed)}))
+		h.releaseHold(c, latest)
+		replayed = true
+	})
+	if replayed {
+		if err := MarkAllDelivered(h.db, c.UserUUID, time.Now()); err != nil {
+			log.Printf("Error marking messages delivered for %s: %v", c.UserUUID, err)
+		}
+	}
+}
+
+// resumeFailed reports a failed resume and switches the client to live
+// delivery.
+func (h *Hub) resumeFailed(c *Client, id, message string) {
+	h.do(func() {
+		if h.clients[c.UserUUID][c] {
+			h.sendToClient(c, errorFrame(id, "resume_failed", message))
+			h.releaseHold(c, 0)
+		}
+	})
+}
+
+// releaseHold switches a client to live delivery, dropping held frames at or
+// below upTo because the client already has them. If frames were dropped
+// because the hold was full, the rest are not sent either: the client gets
+// a resync past all of them and reloads its history instead.
+func (h *Hub) releaseHold(c *Client, upTo int64) {
+	held, dropped := c.held, c.heldDropped
+	c.held, c.heldDropped = nil, 0
+	c.awaitingResume = false
+	if upTo > c.lastSeq {
+		c.lastSeq = upTo
+	}
+	if dropped > 0 {
+		for _, f := range held {
+			dropped = max(dropped, f.seq)
+		}
+		c.lastSeq = max(c.lastSeq, dropped)
+		h.sendToClient(c, resyncFrame("", ResyncPayload{LastSeq: c.lastSeq}))
+		return
+	}
+	for _, f := range held {
+		h.sendToClient(c, f)
+	}
+}
+
+// releaseExpiredHolds stops waiting for clients that never sent resume.
+func (h *Hub) releaseExpiredHolds(now time.Time) {
+	for _, conns := range h.clients {
+		for c := range conns {
+			if c.awaitingResume && now.Sub(c.connectedAt) > h.cfg.ResumeGrace {
+				h.releaseHold(c, 0)
+			}
+		}
+	}
+}
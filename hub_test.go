@@ -0,0 +1,625 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// hubTest is a live hub behind an httptest server with a set of logged-in
+// users.
+type hubTest struct {
+	t     *testing.T
+	db    *sql.DB
+	hub   *Hub
+	srv   *httptest.Server
+	users []hubTestUser
+}
+
+type hubTestUser struct {
+	uuid, session string
+}
+
+func newHubTest(t *testing.T, users int) *hubTest {
+	db := newTestDB(t)
+	cfg := DefaultHubConfig()
+	cfg.SendBufferSize = 4096 // listeners must never be evicted as slow consumers
+	ht := &hubTest{t: t, db: db, hub: NewHub(db, cfg)}
+	go ht.hub.Run()
+
+	r := mux.NewRouter()
+	r.Handle("/ws", AuthMiddleware(WebSocketHandler(db, ht.hub), db)).Methods("GET")
+	ht.srv = httptest.NewServer(r)
+	t.Cleanup(ht.srv.Close)
+	// Runs before the server and database close: handlers of hijacked
+	// connections outlive srv.Close.
+	t.Cleanup(func() {
+		ht.waitForConnections(0)
+		waitForIdleDB(t, db)
+	})
+
+	for i := 0; i < users; i++ {
+		u := hubTestUser{uuid: createTestUser(t, db, fmt.Sprintf("user%d", i)), session: uuid.New().String()}
+		if err := CreateSession(db, u.session, u.uuid, time.Now().Add(time.Hour), "test", "127.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+		ht.users = append(ht.users, u)
+	}
+	return ht
+}
+
+// dial opens a connection for the user, speaking version 2 when v2 is set.
+func (ht *hubTest) dial(u hubTestUser, v2 bool) (*websocket.Conn, error) {
+	d := websocket.Dialer{HandshakeTimeout: 5 * time.Second}
+	if v2 {
+		d.Subprotocols = []string{SubprotocolV2}
+	}
+	header := http.Header{"Cookie": {"session_token=" + u.session}}
+	conn, _, err := d.Dial("ws"+strings.TrimPrefix(ht.srv.URL, "http")+"/ws", header)
+	return conn, err
+}
+
+func sendFrame(conn *websocket.Conn, frameType, id string, payload interface{}) error {
+	p, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return conn.WriteJSON(Envelope{V: ProtocolV2, Type: frameType, ID: id, Payload: p})
+}
+
+// expectFrame reads until a frame of the given type arrives.
+func expectFrame(t *testing.T, conn *websocket.Conn, frameType string) Envelope {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var env Envelope
+		if err := conn.ReadJSON(&env); err != nil {
+			t.Fatalf("waiting for %s: %v", frameType, err)
+		}
+		if env.Type == frameType {
+			return env
+		}
+	}
+}
+
+// waitForConnections polls until the hub holds n connections.
+func (ht *hubTest) waitForConnections(n int) {
+	ht.t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		got := ht.hub.Metrics().Connections
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			ht.t.Fatalf("hub holds %d connections, want %d", got, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitForIdleDB polls until no query is running, so that the user list
+// worker is not still reading the database when the test removes it.
+func waitForIdleDB(t *testing.T, db *sql.DB) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for idle := 0; idle < 3; {
+		if db.Stats().InUse == 0 {
+			idle++
+		} else {
+			idle = 0
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d database connections still in use", db.Stats().InUse)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// chatLog counts the chat and room messages a connection received, by
+// message UUID.
+type chatLog struct {
+	mu     sync.Mutex
+	seen   map[string]int
+	errors []string
+	conn   *websocket.Conn
+	done   chan struct{}
+}
+
+// listen keeps a resumed version 2 connection open for the user that
+// records every message it receives.
+func (ht *hubTest) listen(u hubTestUser) *chatLog {
+	ht.t.Helper()
+	conn, err := ht.dial(u, true)
+	if err != nil {
+		ht.t.Fatal(err)
+	}
+	ht.t.Cleanup(func() { conn.Close() })
+	sendFrame(conn, FrameResume, "r", ResumePayload{})
+	expectFrame(ht.t, conn, FrameResumed)
+	conn.SetReadDeadline(time.Time{})
+
+	l := &chatLog{seen: make(map[string]int), conn: conn, done: make(chan struct{})}
+	go func() {
+		defer close(l.done)
+		for {
+			var env Envelope
+			if err := conn.ReadJSON(&env); err != nil {
+				return
+			}
+			l.mu.Lock()
+			switch env.Type {
+			case FrameChatMessage, FrameRoomMessage:
+				var msg MessageBroadcast
+				json.Unmarshal(env.Payload, &msg)
+				l.seen[msg.UUID]++
+			case FrameError:
+				l.errors = append(l.errors, string(env.Payload))
+			}
+			l.mu.Unlock()
+		}
+	}()
+	return l
+}
+
+func (l *chatLog) count(messageUUID string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seen[messageUUID]
+}
+
+func (l *chatLog) total() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, c := range l.seen {
+		n += c
+	}
+	return n
+}
+
+func (l *chatLog) close() []string {
+	l.conn.Close()
+	<-l.done
+	return l.errors
+}
+
+// sentMessage is an acknowledged message and the users it must reach.
+type sentMessage struct {
+	uuid string
+	to   []string
+}
+
+// TestHubConcurrentClients connects, chats and disconnects from many
+// goroutines at once while others call into the hub directly. Every
+// acknowledged message must reach the listening connection of each of its
+// recipients exactly once. Run it with -race: every piece of connection
+// state must stay on the hub goroutine.
+func TestHubConcurrentClients(t *testing.T) {
+	const (
+		users   = 6
+		workers = 12
+		rounds  = 8
+	)
+	ht := newHubTest(t, users)
+	members := make([]string, users)
+	for i, u := range ht.users {
+		members[i] = u.uuid
+	}
+	room, err := CreateRoom(ht.db, RoomKindGroup, "stress", "", members[0], members[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners := make(map[string]*chatLog)
+	for _, u := range ht.users {
+		listeners[u.uuid] = ht.listen(u)
+	}
+
+	var wg sync.WaitGroup
+	sent := make(chan sentMessage, 2*workers*rounds)
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(w)))
+			me := ht.users[w%users]
+			for i := 0; i < rounds; i++ {
+				conn, err := ht.dial(me, true)
+				if err != nil {
+					errs <- err
+					return
+				}
+				// Drain whatever the hub pushes, passing on the replies to
+				// the two messages.
+				done, replies := make(chan struct{}), make(chan Envelope, 2)
+				go func() {
+					defer close(done)
+					for {
+						var env Envelope
+						if err := conn.ReadJSON(&env); err != nil {
+							return
+						}
+						if env.ID == "m" || env.ID == "g" {
+							replies <- env
+						}
+					}
+				}()
+
+				to := ht.users[rng.Intn(users)].uuid
+				if rng.Intn(2) == 0 {
+					// The rest leave before resuming, with chat frames held.
+					sendFrame(conn, FrameResume, "r", ResumePayload{})
+				}
+				sendFrame(conn, FrameTypingStart, "", TypingPayload{To: to})
+				sendFrame(conn, FrameChatMessage, "m", ChatPayload{To: to, Content: fmt.Sprintf("hello %d-%d", w, i)})
+				sendFrame(conn, FrameTypingStart, "", TypingPayload{Room: room.UUID})
+				sendFrame(conn, FrameChatMessage, "g", ChatPayload{Room: room.UUID, Content: fmt.Sprintf("hi all %d-%d", w, i)})
+				if rng.Intn(2) == 0 {
+					// Leave while typing to the room.
+					sendFrame(conn, FrameTypingStart, "", TypingPayload{Room: room.UUID})
+				}
+				for n := 0; n < 2; n++ {
+					select {
+					case env := <-replies:
+						var ack AckPayload
+						if env.Type != FrameAck || json.Unmarshal(env.Payload, &ack) != nil {
+							errs <- fmt.Errorf("worker %d: message %s-%d got %s %s", w, env.ID, i, env.Type, env.Payload)
+							conn.Close()
+							return
+						}
+						if env.ID == "m" {
+							sent <- sentMessage{uuid: ack.MessageUUID, to: []string{me.uuid, to}}
+						} else {
+							sent <- sentMessage{uuid: ack.MessageUUID, to: members}
+						}
+					case <-done:
+						errs <- fmt.Errorf("worker %d: connection closed before message %d was acknowledged", w, i)
+						return
+					case <-time.After(30 * time.Second):
+						errs <- fmt.Errorf("worker %d: no reply to message %d", w, i)
+						conn.Close()
+						return
+					}
+				}
+				conn.Close()
+				<-done
+			}
+		}(w)
+	}
+	stop := make(chan struct{})
+	var pokers sync.WaitGroup
+	for p := 0; p < 4; p++ {
+		pokers.Add(1)
+		go func(p int) {
+			defer pokers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				u := ht.users[p%users].uuid
+				ht.hub.IsOnline(u)
+				ht.hub.ConnectionCount(u)
+				ht.hub.SendToAll(NewFrame(FrameUserRegistered, "", map[string]string{"user_uuid": u}, nil))
+				ht.hub.RoomMembership(room.UUID, u, RoomActionJoined, u)
+				ht.hub.Metrics()
+				time.Sleep(5 * time.Millisecond)
+			}
+		}(p)
+	}
+	wg.Wait()
+	close(stop)
+	pokers.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	close(sent)
+
+	want := make(map[string]int)
+	var messages []sentMessage
+	for m := range sent {
+		messages = append(messages, m)
+	}
+	if len(messages) != 2*workers*rounds {
+		t.Fatalf("%d messages acknowledged, want %d", len(messages), 2*workers*rounds)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for _, m := range messages {
+		recipients := make(map[string]bool)
+		for _, user := range m.to {
+			recipients[user] = true
+		}
+		for user := range recipients {
+			want[user]++
+			for listeners[user].count(m.uuid) == 0 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if n := listeners[user].count(m.uuid); n != 1 {
+				t.Errorf("message %s reached %s's listener %d times, want once", m.uuid, user, n)
+			}
+		}
+	}
+	for user, l := range listeners {
+		if n := l.total(); n != want[user] {
+			t.Errorf("%s's listener got %d messages, want %d", user, n, want[user])
+		}
+		for _, e := range l.close() {
+			t.Errorf("%s's listener got error %s", user, e)
+		}
+	}
+
+	if m := ht.hub.Metrics(); m.SlowConsumerEvictions != 0 {
+		t.Errorf("%d slow consumers evicted", m.SlowConsumerEvictions)
+	}
+	ht.waitForConnections(0)
+	for _, u := range ht.users {
+		if ht.hub.IsOnline(u.uuid) {
+			t.Errorf("%s still online after every connection closed", u.uuid)
+		}
+	}
+	var saved int
+	ht.db.QueryRow(`SELECT COUNT(*) FROM private_messages`).Scan(&saved)
+	if saved != workers*rounds {
+		t.Errorf("%d private messages saved, want %d", saved, workers*rounds)
+	}
+}
+
+// TestHubDeliversAfterChurn checks the hub still routes messages after
+// connections came and went.
+func TestHubDeliversAfterChurn(t *testing.T) {
+	ht := newHubTest(t, 2)
+	alice, bob := ht.users[0], ht.users[1]
+	for i := 0; i < 20; i++ {
+		conn, err := ht.dial(bob, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+
+	a, err := ht.dial(alice, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := ht.dial(bob, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	for _, conn := range []*websocket.Conn{a, b} {
+		sendFrame(conn, FrameResume, "r", ResumePayload{})
+		expectFrame(t, conn, FrameResumed)
+	}
+	ht.waitForConnections(2)
+
+	sendFrame(a, FrameChatMessage, "m1", ChatPayload{To: bob.uuid, Content: "hello bob"})
+	expectFrame(t, a, FrameAck)
+	var msg MessageBroadcast
+	if err := json.Unmarshal(expectFrame(t, b, FrameChatMessage).Payload, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.From != alice.uuid || msg.Content != "hello bob" {
+		t.Errorf("bob got %+v", msg)
+	}
+
+	// Bob's user list shows alice online with the new message.
+	for {
+		var list struct {
+			Users []UserPresence `json:"users"`
+		}
+		if err := json.Unmarshal(expectFrame(t, b, FrameUserList).Payload, &list); err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Users) == 1 && list.Users[0].LastMessage == "hello bob" {
+			if !list.Users[0].IsOnline || list.Users[0].UnreadCount != 1 {
+				t.Errorf("alice in bob's list: %+v", list.Users[0])
+			}
+			break
+		}
+	}
+}
+
+// TestHubResyncsAfterHoldOverflow checks that a client whose held chat
+// frames overflowed before it resumed is told to resync past them instead
+// of silently missing some.
+func TestHubResyncsAfterHoldOverflow(t *testing.T) {
+	db := newTestDB(t)
+	cfg := DefaultHubConfig()
+	cfg.SendBufferSize = 2
+	hub := NewHub(db, cfg)
+	go hub.Run()
+	t.Cleanup(func() { waitForIdleDB(t, db) })
+	alice, bob := createTestUser(t, db, "alice"), createTestUser(t, db, "bob")
+
+	// A queue larger than the hold so the client is never evicted.
+	c := &Client{Protocol: ProtocolV2, UserUUID: bob, Nickname: "bob", Send: make(chan []byte, 64)}
+	hub.Register(c)
+	for seq := int64(1); seq <= 4; seq++ {
+		hub.Broadcast(Message{UUID: uuid.New().String(), From: alice, To: bob, Content: "hi", ReceiverSeq: seq, SenderSeq: seq})
+	}
+	var zero int64
+	hub.Resume(c, "r", &zero)
+	hub.Broadcast(Message{UUID: uuid.New().String(), From: alice, To: bob, Content: "live", ReceiverSeq: 5, SenderSeq: 5})
+
+	var frames []Envelope
+	for done := false; !done; {
+		select {
+		case data := <-c.Send:
+			var env Envelope
+			if err := json.Unmarshal(data, &env); err != nil {
+				t.Fatal(err)
+			}
+			if env.Type != FrameUserList {
+				frames = append(frames, env)
+			}
+		case <-time.After(200 * time.Millisecond):
+			done = true
+		}
+	}
+	if len(frames) != 3 || frames[0].Type != FrameResumed || frames[1].Type != FrameResync || frames[2].Type != FrameChatMessage {
+		t.Fatalf("got frames %+v, want resumed, resync and the live message", frames)
+	}
+	var resync ResyncPayload
+	json.Unmarshal(frames[1].Payload, &resync)
+	if resync.LastSeq != 4 {
+		t.Errorf("resync to %d, want 4", resync.LastSeq)
+	}
+	var live MessageBroadcast
+	json.Unmarshal(frames[2].Payload, &live)
+	if live.Seq != 5 || live.Content != "live" {
+		t.Errorf("live message %+v", live)
+	}
+}
+
+func TestHubKeepsNotificationsForV2Clients(t *testing.T) {
+	ht := newHubTest(t, 2)
+	bob, alice := ht.users[0], ht.users[1]
+	messageUUID := uuid.New().String()
+	if _, _, err := SaveMessage(ht.db, messageUUID, alice.uuid, bob.uuid, "hi", nil, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := notifyOfflineMessage(ht.db, messageUUID); err != nil {
+		t.Fatal(err)
+	}
+	undelivered := func() int {
+		t.Helper()
+		// Waits for any delivery still running, which holds notifyMu.
+		ht.hub.DeliverNotifications(bob.uuid)
+		n, err := LoadUndeliveredNotifications(ht.db, bob.uuid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(n)
+	}
+
+	// A version 1 tab cannot show it, so it waits.
+	v1, err := ht.dial(bob, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v1.Close()
+	ht.waitForConnections(1)
+	if n := undelivered(); n != 1 {
+		t.Fatalf("%d undelivered with a version 1 client, want 1", n)
+	}
+
+	v2, err := ht.dial(bob, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v2.Close()
+	var n Notification
+	if err := json.Unmarshal(expectFrame(t, v2, FrameNotification).Payload, &n); err != nil {
+		t.Fatal(err)
+	}
+	if n.Kind != NotifyMessage || n.MessageUUID != messageUUID {
+		t.Errorf("got %+v", n)
+	}
+	if n := undelivered(); n != 0 {
+		t.Errorf("%d undelivered after a version 2 client got them", n)
+	}
+}
+
+func TestHubEvictsFullClient(t *testing.T) {
+	db := newTestDB(t)
+	cfg := DefaultHubConfig()
+	cfg.SendBufferSize = 2
+	hub := NewHub(db, cfg)
+	go hub.Run()
+	t.Cleanup(func() { waitForIdleDB(t, db) })
+	alice, bob, carol := createTestUser(t, db, "alice"), createTestUser(t, db, "bob"), createTestUser(t, db, "carol")
+
+	// Bob's tab never reads; carol's queue is large enough to keep up.
+	stuck := hub.NewClient(nil, ProtocolV1, bob, "bob", "")
+	hub.Register(stuck)
+	healthy := &Client{Protocol: ProtocolV2, UserUUID: carol, Nickname: "carol", Send: make(chan []byte, 256)}
+	hub.Register(healthy)
+	var zero int64
+	hub.Resume(healthy, "r", &zero)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for seq := int64(1); seq <= 10; seq++ {
+			hub.Broadcast(Message{UUID: uuid.New().String(), From: alice, To: bob, Content: "hi", ReceiverSeq: seq, SenderSeq: seq})
+		}
+		hub.Broadcast(Message{UUID: uuid.New().String(), From: alice, To: carol, Content: "still here", ReceiverSeq: 1, SenderSeq: 11})
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("hub blocked on a full send buffer")
+	}
+
+	if got := hub.Metrics().SlowConsumerEvictions; got != 1 {
+		t.Errorf("%d evictions, want 1", got)
+	}
+	// The hub closes the evicted queue once it is drained.
+	for range stuck.Send {
+	}
+	if hub.IsOnline(bob) {
+		t.Error("bob still online after the only tab was evicted")
+	}
+
+	for {
+		select {
+		case data := <-healthy.Send:
+			var env Envelope
+			json.Unmarshal(data, &env)
+			if env.Type != FrameChatMessage {
+				continue
+			}
+			var msg MessageBroadcast
+			json.Unmarshal(env.Payload, &msg)
+			if msg.Content != "still here" {
+				t.Errorf("carol got %+v", msg)
+			}
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatal("other clients stopped getting messages")
+		}
+	}
+}
+
+func TestWebSocketMetricsRequiresAdmin(t *testing.T) {
+	ht := newHubTest(t, 2)
+	user, admin := ht.users[0], ht.users[1]
+	if _, err := ht.db.Exec(`UPDATE users SET role = 'admin' WHERE uuid = ?`, admin.uuid); err != nil {
+		t.Fatal(err)
+	}
+	handler := AuthMiddleware(WebSocketMetricsHandler(ht.db, ht.hub), ht.db)
+	for _, tt := range []struct {
+		name   string
+		cookie string
+		status int
+	}{
+		{"logged out", "", http.StatusUnauthorized},
+		{"user", user.session, http.StatusForbidden},
+		{"admin", admin.session, http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", "/ws/metrics", nil)
+		if tt.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "session_token", Value: tt.cookie})
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+}
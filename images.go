@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+)
+
+// Uploaded images are cleaned before they are stored: JPEG APP segments and
+// comments other than JFIF, ICC profiles and Adobe colour info are dropped,
+// as are PNG text, time and EXIF chunks. That removes camera details and GPS
+// positions. The EXIF orientation is the one thing kept, rewritten as a
+// minimal EXIF block, so photos still display upright. GIFs carry no EXIF
+// and are stored as uploaded.
+
+var (
+	// maxImagePixels guards against small files that decode to huge images.
+	maxImagePixels = envInt("ATTACHMENT_MAX_PIXELS", 40_000_000)
+	// thumbnailSize is the longest side of a thumbnail in pixels.
+	thumbnailSize = envInt("ATTACHMENT_THUMB_SIZE", 320)
+)
+
+var (
+	ErrBadImage      = errors.New("image could not be read")
+	ErrImageTooLarge = errors.New("image dimensions are too large")
+)
+
+// cleanImage is an uploaded image after metadata stripping.
+type cleanImage struct {
+	data          []byte
+	width, height int    // as displayed, after orientation
+	thumb         []byte // encoded as thumbnailType
+}
+
+// thumbnailType is the type of the thumbnail of an image: JPEG for JPEG
+// photos, PNG for everything else so transparency survives.
+func thumbnailType(mimeType string) string {
+	if mimeType == "image/jpeg" {
+		return "image/jpeg"
+	}
+	return "image/png"
+}
+
+func processImage(mimeType string, data []byte) (cleanImage, error) {
+	img := cleanImage{data: data}
+	orientation := 1
+	var err error
+	switch mimeType {
+	case "image/jpeg":
+		img.data, orientation, err = stripJPEGMetadata(data)
+	case "image/png":
+		img.data, err = stripPNGMetadata(data)
+	}
+	if err != nil {
+		return img, err
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(img.data))
+	if err != nil {
+		return img, ErrBadImage
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxImagePixels {
+		return img, ErrImageTooLarge
+	}
+	src, _, err := image.Decode(bytes.NewReader(img.data))
+	if err != nil {
+		return img, ErrBadImage
+	}
+
+	thumb := orient(scaleDown(src, thumbnailSize), orientation)
+	img.width, img.height = cfg.Width, cfg.Height
+	if orientation >= 5 {
+		img.width, img.height = cfg.Height, cfg.Width
+	}
+
+	var buf bytes.Buffer
+	if thumbnailType(mimeType) == "image/jpeg" {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 80})
+	} else {
+		err = png.Encode(&buf, thumb)
+	}
+	img.thumb = buf.Bytes()
+	return img, err
+}
+
+// stripJPEGMetadata copies the segments of a JPEG up to the image data,
+// leaving out metadata, and returns the EXIF orientation (1 when absent).
+func stripJPEGMetadata(data []byte) ([]byte, int, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, 0, ErrBadImage
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, 0xFF, 0xD8)
+	orientation, exifAt := 1, 2
+
+	for i := 2; ; {
+		if i >= len(data) || data[i] != 0xFF {
+			return nil, 0, ErrBadImage
+		}
+		for i < len(data) && data[i] == 0xFF {
+			i++
+		}
+		if i >= len(data) {
+			return nil, 0, ErrBadImage
+		}
+		marker := data[i]
+		i++
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			out = append(out, 0xFF, marker)
+			continue
+		}
+		if marker == 0xD9 {
+			return nil, 0, ErrBadImage // no image data
+		}
+		if i+2 > len(data) {
+			return nil, 0, ErrBadImage
+		}
+		n := int(data[i])<<8 | int(data[i+1])
+		if n < 2 || i+n > len(data) {
+			return nil, 0, ErrBadImage
+		}
+
+		switch {
+		case marker == 0xDA:
+			// Start of scan: the rest is image data.
+			out = append(out, 0xFF, marker)
+			out = append(out, data[i:]...)
+			if orientation != 1 {
+				out = append(out[:exifAt], append(orientationEXIF(orientation), out[exifAt:]...)...)
+			}
+			return out, orientation, nil
+		case marker == 0xE1:
+			// EXIF or XMP; only the orientation survives.
+			if seg := data[i+2 : i+n]; bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+				orientation = exifOrientation(seg[6:])
+			}
+		case marker == 0xFE, marker >= 0xE3 && marker <= 0xED, marker == 0xEF:
+			// Comments and the remaining APP segments are dropped.
+		default:
+			out = append(out, 0xFF, marker)
+			out = append(out, data[i:i+n]...)
+			if marker == 0xE0 && exifAt == 2 && len(out) == 2+2+n {
+				exifAt = len(out) // keep JFIF first
+			}
+		}
+		i += n
+	}
+}
+
+// exifOrientation reads the orientation tag from IFD0 of an EXIF TIFF block.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	off := int(order.Uint32(tiff[4:8]))
+	if off < 8 || off+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[off:]))
+	for k := 0; k < count; k++ {
+		e := off + 2 + 12*k
+		if e+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[e:]) == 0x0112 {
+			if v := int(order.Uint16(tiff[e+8:])); v >= 1 && v <= 8 {
+				return v
+			}
+			break
+		}
+	}
+	return 1
+}
+
+// orientationEXIF builds an APP1 segment holding only the orientation tag.
+func orientationEXIF(orientation int) []byte {
+	return []byte{
+		0xFF, 0xE1, 0x00, 0x22, // APP1, length 34
+		'E', 'x', 'i', 'f', 0, 0,
+		'M', 'M', 0x00, 0x2A, 0x00, 0x00, 0x00, 0x08, // big-endian TIFF, IFD0 at 8
+		0x00, 0x01, // one entry
+		0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, // orientation, SHORT, count 1
+		0x00, byte(orientation), 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, // no next IFD
+	}
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngMetadataChunks are dropped from uploaded PNGs.
+var pngMetadataChunks = map[string]bool{"eXIf": true, "tEXt": true, "zTXt": true, "iTXt": true, "tIME": true}
+
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, ErrBadImage
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, pngSignature...)
+	for i := len(pngSignature); i < len(data); {
+		if i+8 > len(data) {
+			return nil, ErrBadImage
+		}
+		n := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + n // length, type, data, crc
+		if end > len(data) {
+			return nil, ErrBadImage
+		}
+		kind := string(data[i+4 : i+8])
+		if !pngMetadataChunks[kind] {
+			out = append(out, data[i:end]...)
+		}
+		if kind == "IEND" {
+			return out, nil
+		}
+		i = end
+	}
+	return nil, ErrBadImage
+}
+
+// scaleDown fits src into a maxSide square, averaging a 4x4 grid of source
+// samples per pixel so the cost does not depend on the source size.
+func scaleDown(src image.Image, maxSide int) *image.NRGBA {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	tw, th := w, h
+	if w > maxSide || h > maxSide {
+		if w >= h {
+			tw, th = maxSide, max(1, h*maxSide/w)
+		} else {
+			tw, th = max(1, w*maxSide/h), maxSide
+		}
+	}
+
+	const samples = 4
+	dst := image.NewNRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		for x := 0; x < tw; x++ {
+			var r, g, bl, a uint32
+			for sy := 0; sy < samples; sy++ {
+				py := b.Min.Y + (2*(y*samples+sy)+1)*h/(2*th*samples)
+				for sx := 0; sx < samples; sx++ {
+					px := b.Min.X + (2*(x*samples+sx)+1)*w/(2*tw*samples)
+					cr, cg, cb, ca := src.At(px, py).RGBA()
+					r, g, bl, a = r+cr, g+cg, bl+cb, a+ca
+				}
+			}
+			const n = samples * samples
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// orient applies an EXIF orientation so the image displays upright.
+func orient(src *image.NRGBA, orientation int) *image.NRGBA {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // upside down
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored upside down
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated 90° clockwise
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90° anticlockwise
+				dx, dy = y, w-1-x
+			}
+			dst.SetNRGBA(dx, dy, src.NRGBAAt(x, y))
+		}
+	}
+	return dst
+}
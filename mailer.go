@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Email is one outgoing message. Bodies are plain UTF-8 text.
+type Email struct {
+	From    string
+	To      string
+	Subject string
+	Body    string
+}
+
+// MailSender delivers email. Send returning nil means the message was
+// handed off and must not be sent again.
+type MailSender interface {
+	Send(e Email) error
+}
+
+// NewMailSender picks the sender from EMAIL_SENDER: "smtp" uses SMTP_ADDR
+// with SMTP_USER and SMTP_PASSWORD when set; anything else writes to the
+// maildir in EMAIL_MAILDIR, for local development and tests.
+func NewMailSender() (MailSender, error) {
+	if envString("EMAIL_SENDER", "maildir") == "smtp" {
+		return &SMTPSender{
+			Addr:     envString("SMTP_ADDR", "localhost:25"),
+			Username: envString("SMTP_USER", ""),
+			Password: envString("SMTP_PASSWORD", ""),
+		}, nil
+	}
+	return NewMaildirSender(envString("EMAIL_MAILDIR", "maildir"))
+}
+
+// formatEmail renders e as an RFC 5322 message with a quoted-printable body.
+func formatEmail(e Email, date time.Time) ([]byte, error) {
+	id := make([]byte, 12)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	domain := "localhost"
+	if i := strings.LastIndexByte(e.From, '@'); i >= 0 {
+		domain = strings.Trim(e.From[i+1:], "<> ")
+	}
+
+	var b bytes.Buffer
+	for _, h := range [][2]string{
+		{"From", e.From},
+		{"To", e.To},
+		{"Subject", mime.QEncoding.Encode("utf-8", e.Subject)},
+		{"Date", date.Format(time.RFC1123Z)},
+		{"Message-ID", "<" + hex.EncodeToString(id) + "@" + domain + ">"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", `text/plain; charset="utf-8"`},
+		{"Content-Transfer-Encoding", "quoted-printable"},
+	} {
+		// Header values never span lines; a newline would start a new header.
+		if strings.ContainsAny(h[1], "\r\n") {
+			return nil, fmt.Errorf("email header %s contains a line break", h[0])
+		}
+		b.WriteString(h[0] + ": " + h[1] + "\r\n")
+	}
+	b.WriteString("\r\n")
+
+	w := quotedprintable.NewWriter(&b)
+	if _, err := w.Write([]byte(strings.ReplaceAll(e.Body, "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// SMTPSender relays through an SMTP server, authenticating with PLAIN when
+// a username is set.
+type SMTPSender struct {
+	Addr     string
+	Username string
+	Password string
+}
+
+func (s *SMTPSender) Send(e Email) error {
+	msg, err := formatEmail(e, time.Now())
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, _ := net.SplitHostPort(s.Addr)
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	return smtp.SendMail(s.Addr, auth, emailAddress(e.From), []string{emailAddress(e.To)}, msg)
+}
+
+// emailAddress strips a display name: "Forum <a@b.c>" becomes "a@b.c".
+func emailAddress(s string) string {
+	if i := strings.LastIndexByte(s, '<'); i >= 0 {
+		return strings.TrimSuffix(s[i+1:], ">")
+	}
+	return s
+}
+
+// MaildirSender delivers into a maildir: each message is written under tmp
+// and renamed into new, so readers never see a partial file.
+type MaildirSender struct {
+	dir string
+}
+
+func NewMaildirSender(dir string) (*MaildirSender, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o750); err != nil {
+			return nil, err
+		}
+	}
+	return &MaildirSender{dir: dir}, nil
+}
+
+func (s *MaildirSender) Send(e Email) error {
+	now := time.Now()
+	msg, err := formatEmail(e, now)
+	if err != nil {
+		return err
+	}
+	unique := make([]byte, 8)
+	if _, err := rand.Read(unique); err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	name := fmt.Sprintf("%d.%d_%s.%s", now.Unix(), os.Getpid(), hex.EncodeToString(unique), strings.ReplaceAll(host, "/", "_"))
+
+	tmp := filepath.Join(s.dir, "tmp", name)
+	if err := os.WriteFile(tmp, msg, 0o640); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, "new", name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
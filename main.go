@@ -16,22 +16,87 @@ func main() {
 
 	defer db.Close()
 
+	// Uploaded files
+	store, err := NewDiskStore(envString("ATTACHMENT_DIR", "uploads"))
+	if err != nil {
+		log.Fatalf("Failed to open attachment store: %v", err)
+	}
+	go RunAttachmentSweeper(db, store)
+
+	// Chat hub owns all WebSocket connection state
+	hub := NewHub(db, LoadHubConfig())
+	go hub.Run()
+
+	// Email notifications for users who were offline
+	mailer, err := NewMailSender()
+	if err != nil {
+		log.Fatalf("Failed to open mail sender: %v", err)
+	}
+	go RunEmailWorker(db, mailer)
+
 	// Router Setup
 	r := mux.NewRouter()
 	// Public Routes
-	r.HandleFunc("/register", RegisterHandler(db)).Methods("POST")
+	r.HandleFunc("/register", RegisterHandler(db, hub)).Methods("POST")
 	r.HandleFunc("/login", LoginHandler(db)).Methods("POST")
+	r.HandleFunc("/login/2fa", LoginTwoFactorHandler(db)).Methods("POST")
+	r.HandleFunc("/verify-email", VerifyEmailHandler(db)).Methods("POST")
+	r.HandleFunc("/password-reset/request", RequestPasswordResetHandler(db)).Methods("POST")
+	r.HandleFunc("/password-reset", ResetPasswordHandler(db, hub)).Methods("POST")
 	// Protected Routes
 	r.Handle("/me", AuthMiddleware(MeHandler(db), db)).Methods("GET")
-	r.Handle("/logout", AuthMiddleware(LogoutHandler(db), db)).Methods("POST")
-	r.Handle("/posts", AuthMiddleware(CreatePostHandler(db), db)).Methods("POST")
-	r.Handle("/ws", AuthMiddleware(WebSocketHandler(db), db)).Methods("GET")
+	r.Handle("/logout", AuthMiddleware(LogoutHandler(db, hub), db)).Methods("POST")
+	r.Handle("/sessions", AuthMiddleware(SessionsHandler(db, hub), db)).Methods("GET")
+	r.Handle("/sessions", AuthMiddleware(RevokeOtherSessionsHandler(db, hub), db)).Methods("DELETE")
+	r.Handle("/session", AuthMiddleware(RevokeSessionHandler(db, hub), db)).Methods("DELETE")
+	r.Handle("/verify-email/request", AuthMiddleware(RequestVerificationHandler(db), db)).Methods("POST")
+	r.Handle("/2fa", AuthMiddleware(TwoFactorStatusHandler(db), db)).Methods("GET")
+	r.Handle("/2fa/setup", AuthMiddleware(TwoFactorSetupHandler(db), db)).Methods("POST")
+	r.Handle("/2fa/confirm", AuthMiddleware(TwoFactorConfirmHandler(db), db)).Methods("POST")
+	r.Handle("/2fa/recovery-codes", AuthMiddleware(TwoFactorRecoveryCodesHandler(db), db)).Methods("POST")
+	r.Handle("/2fa/disable", AuthMiddleware(TwoFactorDisableHandler(db), db)).Methods("POST")
+	r.Handle("/2fa/reset", AuthMiddleware(TwoFactorResetHandler(db), db)).Methods("POST")
+	r.Handle("/posts", AuthMiddleware(CreatePostHandler(db, hub), db)).Methods("POST")
+	r.Handle("/ws", AuthMiddleware(WebSocketHandler(db, hub), db)).Methods("GET")
+	r.Handle("/ws/metrics", AuthMiddleware(WebSocketMetricsHandler(db, hub), db)).Methods("GET")
 	r.Handle("/messages", AuthMiddleware(GetMessagesHandler(db), db)).Methods("GET")
+	r.Handle("/messages", AuthMiddleware(EditMessageHandler(hub), db)).Methods("PUT")
+	r.Handle("/messages", AuthMiddleware(DeleteMessageHandler(hub), db)).Methods("DELETE")
+	r.Handle("/messages/edits", AuthMiddleware(MessageEditsHandler(db), db)).Methods("GET")
+	r.Handle("/messages/read", AuthMiddleware(MarkReadHandler(hub), db)).Methods("POST")
+	r.Handle("/rooms", AuthMiddleware(CreateRoomHandler(db, hub), db)).Methods("POST")
+	r.Handle("/rooms", AuthMiddleware(ListRoomsHandler(db), db)).Methods("GET")
+	r.Handle("/rooms/members", AuthMiddleware(RoomMembersHandler(db), db)).Methods("GET")
+	r.Handle("/rooms/invite", AuthMiddleware(RoomInviteHandler(db, hub), db)).Methods("POST")
+	r.Handle("/rooms/kick", AuthMiddleware(RoomKickHandler(db, hub), db)).Methods("POST")
+	r.Handle("/rooms/join", AuthMiddleware(RoomJoinHandler(db, hub), db)).Methods("POST")
+	r.Handle("/rooms/leave", AuthMiddleware(RoomLeaveHandler(db, store, hub), db)).Methods("POST")
 	r.Handle("/posts", AuthMiddleware(GetPostsHandler(db), db)).Methods("GET")
 	r.Handle("/post", AuthMiddleware(GetPostDetailsHandler(db), db)).Methods("GET")
-	r.Handle("/comment", AuthMiddleware(CreateCommentHandler(db), db)).Methods("POST")
-	r.Handle("/users", AuthMiddleware(GetAllUsersHandler(db), db)).Methods("GET")
+	r.Handle("/post", AuthMiddleware(EditPostHandler(db), db)).Methods("PUT")
+	r.Handle("/post", AuthMiddleware(DeletePostHandler(db), db)).Methods("DELETE")
+	r.Handle("/post/revisions", AuthMiddleware(PostRevisionsHandler(db), db)).Methods("GET")
+	r.Handle("/post/reaction", AuthMiddleware(PostReactionHandler(db, hub), db)).Methods("POST")
+	r.Handle("/comments", AuthMiddleware(CommentsHandler(db), db)).Methods("GET")
+	r.Handle("/comment", AuthMiddleware(CreateCommentHandler(db, hub), db)).Methods("POST")
+	r.Handle("/comment", AuthMiddleware(EditCommentHandler(db), db)).Methods("PUT")
+	r.Handle("/comment", AuthMiddleware(DeleteCommentHandler(db), db)).Methods("DELETE")
+	r.Handle("/comment/reaction", AuthMiddleware(CommentReactionHandler(db, hub), db)).Methods("POST")
+	r.Handle("/users", AuthMiddleware(GetAllUsersHandler(db, hub), db)).Methods("GET")
 	r.Handle("/categories", AuthMiddleware(GetCategoriesHandler(db), db)).Methods("GET")
+	r.Handle("/categories", AuthMiddleware(CreateCategoryHandler(db), db)).Methods("POST")
+	r.Handle("/categories/order", AuthMiddleware(ReorderCategoriesHandler(db), db)).Methods("PUT")
+	r.Handle("/category", AuthMiddleware(UpdateCategoryHandler(db), db)).Methods("PUT")
+	r.Handle("/tags", AuthMiddleware(TagsHandler(db), db)).Methods("GET")
+	r.Handle("/tags/merge", AuthMiddleware(MergeTagsHandler(db), db)).Methods("POST")
+	r.Handle("/tags/ban", AuthMiddleware(BanTagHandler(db), db)).Methods("POST")
+	r.Handle("/search", AuthMiddleware(SearchHandler(db), db)).Methods("GET")
+	r.Handle("/notifications", AuthMiddleware(NotificationsHandler(db), db)).Methods("GET")
+	r.Handle("/notifications/read", AuthMiddleware(MarkNotificationsReadHandler(db, hub), db)).Methods("POST")
+	r.Handle("/notifications/email", AuthMiddleware(EmailPreferencesHandler(db), db)).Methods("GET")
+	r.Handle("/notifications/email", AuthMiddleware(UpdateEmailPreferencesHandler(db), db)).Methods("PUT")
+	r.Handle("/attachments", AuthMiddleware(UploadAttachmentHandler(db, store), db)).Methods("POST")
+	r.Handle("/attachment", AuthMiddleware(AttachmentHandler(db, store), db)).Methods("GET")
 	// Serve static files
 	fs := http.FileServer(http.Dir("./static"))
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", fs))
@@ -47,8 +112,6 @@ func main() {
 	})
 	handler := InternalErrorHandler(r)
 	// Start server
-	go handleMessages(db)
-	go cleanupOldTypingStatus() // Add this line
 	log.Println("Starting server on http://localhost:8080")
 	err = http.ListenAndServe(":8080", handler)
 	if err != nil {
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Posts, comments and messages are stored as the Markdown their author typed
+// and rendered to HTML on the way out, as content_html next to content.
+//
+// The renderer supports a small subset: paragraphs with hard line breaks,
+// # headings, > quotes, - and 1. lists, ``` fenced code, --- rules, and
+// inline **strong**, *em*, ~~del~~, `code`, [links](url), bare http(s)
+// links and @nickname mentions of registered users (see mentions.go).
+// Everything else, raw HTML included, is escaped and shown as typed.
+// sanitizeHTML then keeps only allowlisted tags and attributes, so a bug in
+// the renderer cannot let markup through.
+
+// maxMarkdownNesting bounds quote and emphasis nesting.
+const maxMarkdownNesting = 8
+
+var (
+	mdFenceRe   = regexp.MustCompile("^ {0,3}(```|~~~)")
+	mdHeadingRe = regexp.MustCompile(`^ {0,3}(#{1,6})\s+(.*?)(?:\s+#+)?\s*$`)
+	mdRuleRe    = regexp.MustCompile(`^ {0,3}(?:(?:-\s*){3,}|(?:\*\s*){3,}|(?:_\s*){3,})$`)
+	mdQuoteRe   = regexp.MustCompile(`^ {0,3}> ?(.*)$`)
+	mdBulletRe  = regexp.MustCompile(`^ {0,3}[-*+]\s+(.*)$`)
+	mdOrderedRe = regexp.MustCompile(`^ {0,3}(\d{1,9})[.)]\s+(.*)$`)
+)
+
+// renderMarkdown turns stored content into safe HTML.
+func renderMarkdown(src string) string {
+	if strings.TrimSpace(src) == "" {
+		return ""
+	}
+	var b strings.Builder
+	renderBlocks(&b, strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n"), 0)
+	return sanitizeHTML(strings.TrimSuffix(b.String(), "\n"))
+}
+
+// startsBlock reports whether a line opens a block other than a paragraph.
+func startsBlock(line string, depth int) bool {
+	return mdFenceRe.MatchString(line) || mdHeadingRe.MatchString(line) || mdRuleRe.MatchString(line) ||
+		mdBulletRe.MatchString(line) || mdOrderedRe.MatchString(line) ||
+		(depth < maxMarkdownNesting && mdQuoteRe.MatchString(line))
+}
+
+func renderBlocks(b *strings.Builder, lines []string, depth int) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case strings.TrimSpace(line) == "":
+			i++
+
+		case mdFenceRe.MatchString(line):
+			fence := mdFenceRe.FindStringSubmatch(line)[1]
+			i++
+			start := i
+			for i < len(lines) && !strings.HasPrefix(strings.TrimLeft(lines[i], " "), fence) {
+				i++
+			}
+			b.WriteString("<pre><code>")
+			b.WriteString(html.EscapeString(strings.Join(lines[start:i], "\n")))
+			b.WriteString("</code></pre>\n")
+			i++ // closing fence, if any
+
+		case mdHeadingRe.MatchString(line):
+			m := mdHeadingRe.FindStringSubmatch(line)
+			tag := "h" + string(rune('0'+len(m[1])))
+			b.WriteString("<" + tag + ">")
+			renderInline(b, m[2], 0, false)
+			b.WriteString("</" + tag + ">\n")
+			i++
+
+		case mdRuleRe.MatchString(line):
+			b.WriteString("<hr>\n")
+			i++
+
+		case depth < maxMarkdownNesting && mdQuoteRe.MatchString(line):
+			var quoted []string
+			for ; i < len(lines) && mdQuoteRe.MatchString(lines[i]); i++ {
+				quoted = append(quoted, mdQuoteRe.FindStringSubmatch(lines[i])[1])
+			}
+			b.WriteString("<blockquote>\n")
+			renderBlocks(b, quoted, depth+1)
+			b.WriteString("</blockquote>\n")
+
+		case mdBulletRe.MatchString(line), mdOrderedRe.MatchString(line):
+			i = renderList(b, lines, i)
+
+		default:
+			b.WriteString("<p>")
+			for first := true; i < len(lines) && strings.TrimSpace(lines[i]) != ""; i++ {
+				if !first {
+					if startsBlock(lines[i], depth) {
+						break
+					}
+					b.WriteString("<br>\n")
+				}
+				first = false
+				renderInline(b, strings.TrimSpace(lines[i]), 0, false)
+			}
+			b.WriteString("</p>\n")
+		}
+	}
+}
+
+// renderList writes the list starting at lines[i] and returns the index of
+// the first line after it. Indented lines continue the previous item.
+func renderList(b *strings.Builder, lines []string, i int) int {
+	itemRe, tag := mdBulletRe, "ul"
+	if mdOrderedRe.MatchString(lines[i]) {
+		itemRe, tag = mdOrderedRe, "ol"
+	}
+
+	var items []string
+	open := "<" + tag + ">"
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		if m := itemRe.FindStringSubmatch(line); m != nil {
+			if tag == "ol" && len(items) == 0 {
+				if start := strings.TrimLeft(m[1], "0"); start != "1" && start != "" {
+					open = `<ol start="` + start + `">`
+				}
+			}
+			items = append(items, m[len(m)-1])
+		} else if strings.TrimSpace(line) != "" && (line[0] == ' ' || line[0] == '\t') && !startsBlock(line, 0) {
+			items[len(items)-1] += "\n" + strings.TrimSpace(line)
+		} else {
+			break
+		}
+	}
+
+	b.WriteString(open + "\n")
+	for _, item := range items {
+		b.WriteString("<li>")
+		for j, part := range strings.Split(item, "\n") {
+			if j > 0 {
+				b.WriteString("<br>\n")
+			}
+			renderInline(b, part, 0, false)
+		}
+		b.WriteString("</li>\n")
+	}
+	b.WriteString("</" + tag + ">\n")
+	return i
+}
+
+func isWordByte(c byte) bool {
+	return c >= 0x80 || c == '_' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isSpaceByte(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n'
+}
+
+// findCloser returns the offset in s of the first delim that can close an
+// emphasis span: not preceded by a space and, for underscores, not inside a
+// word. Single delimiters skip doubled ones so *a **b** c* nests.
+func findCloser(s, delim string) int {
+	for off := 1; off < len(s); {
+		j := strings.Index(s[off:], delim)
+		if j < 0 {
+			return -1
+		}
+		j += off
+		off = j + 1
+		if isSpaceByte(s[j-1]) {
+			continue
+		}
+		end := j + len(delim)
+		if delim[0] == '_' && end < len(s) && isWordByte(s[end]) {
+			continue
+		}
+		if len(delim) == 1 && ((end < len(s) && s[end] == delim[0]) || s[j-1] == delim[0]) {
+			off = end + 1
+			continue
+		}
+		return j
+	}
+	return -1
+}
+
+var inlineTags = map[string][]string{
+	"***": {"strong", "em"}, "___": {"strong", "em"},
+	"**": {"strong"}, "__": {"strong"}, "~~": {"del"},
+	"*": {"em"}, "_": {"em"},
+}
+
+// renderInline writes one line of inline Markdown. inLink stops links from
+// nesting inside link text.
+func renderInline(b *strings.Builder, s string, depth int, inLink bool) {
+	// A delimiter with no closer after one position has none after any later
+	// position either, so it is not searched for again.
+	noCloser := make(map[string]bool)
+
+	for i := 0; i < len(s); {
+		c := s[i]
+		rest := s[i:]
+
+		if c == '\\' && i+1 < len(s) && strings.IndexByte("\\`*_{}[]()#+-.!~>|", s[i+1]) >= 0 {
+			b.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i += 2
+			continue
+		}
+
+		if c == '`' {
+			n := len(rest) - len(strings.TrimLeft(rest, "`"))
+			delim := rest[:n]
+			if !noCloser[delim] {
+				if j := strings.Index(rest[n:], delim); j >= 0 {
+					code := rest[n : n+j]
+					if len(code) > 1 && code[0] == ' ' && code[len(code)-1] == ' ' {
+						code = code[1 : len(code)-1]
+					}
+					b.WriteString("<code>" + html.EscapeString(code) + "</code>")
+					i += n + j + n
+					continue
+				}
+				noCloser[delim] = true
+			}
+			b.WriteString(delim)
+			i += n
+			continue
+		}
+
+		if depth < maxMarkdownNesting && (c == '*' || c == '_' || c == '~') {
+			run := len(rest) - len(strings.TrimLeft(rest, string(c)))
+			opens := run < len(rest) && !isSpaceByte(rest[run]) && !(c == '_' && i > 0 && isWordByte(s[i-1]))
+
+			// The longest delimiter with a closer wins. A run of three that
+			// has no triple closer opens whichever of the double and single
+			// spans is longer: ***a** b* is em around strong and ***a* b**
+			// strong around em.
+			delim, end := "", -1
+			for n := min(run, 3); opens && n > 0; n-- {
+				d := rest[:n]
+				if _, ok := inlineTags[d]; !ok || noCloser[d] {
+					continue
+				}
+				j := findCloser(rest[n:], d)
+				if j < 0 {
+					noCloser[d] = true
+					continue
+				}
+				if n+j > end {
+					delim, end = d, n+j
+				}
+				if run < 3 || n == 3 {
+					break
+				}
+			}
+			if end < 0 {
+				b.WriteString(rest[:run])
+				i += run
+				continue
+			}
+
+			tags := inlineTags[delim]
+			for _, tag := range tags {
+				b.WriteString("<" + tag + ">")
+			}
+			renderInline(b, rest[len(delim):end], depth+1, inLink)
+			for k := len(tags) - 1; k >= 0; k-- {
+				b.WriteString("</" + tags[k] + ">")
+			}
+			i += end + len(delim)
+			continue
+		}
+
+		if c == '[' && !inLink && depth < maxMarkdownNesting && !noCloser["]("] {
+			// A '[' inside the text means the link starts there instead.
+			if j := strings.Index(rest, "]("); j < 0 {
+				noCloser["]("] = true
+			} else if k := strings.IndexByte(rest[j+2:], ')'); k >= 0 && strings.IndexByte(rest[1:j], '[') < 0 {
+				if href, ok := safeURL(rest[j+2 : j+2+k]); ok {
+					writeLink(b, href, func() { renderInline(b, rest[1:j], depth+1, true) })
+					i += j + 2 + k + 1
+					continue
+				}
+			}
+		}
+
+		if !inLink && (strings.HasPrefix(rest, "http://") || strings.HasPrefix(rest, "https://")) && (i == 0 || !isWordByte(s[i-1])) {
+			end := strings.IndexAny(rest, " \t\n<>\"")
+			if end < 0 {
+				end = len(rest)
+			}
+			url := strings.TrimRight(rest[:end], ".,:;!?'")
+			if strings.HasSuffix(url, ")") && strings.Count(url, "(") < strings.Count(url, ")") {
+				url = url[:len(url)-1]
+			}
+			if href, ok := safeURL(url); ok && len(url) > len("https://") {
+				writeLink(b, href, func() { b.WriteString(html.EscapeString(url)) })
+				i += len(url)
+				continue
+			}
+		}
+
+		if c == '@' && !inLink && (i == 0 || !isWordByte(s[i-1])) {
+			n := 1
+			for n < len(rest) && isNicknameByte(rest[n]) {
+				n++
+			}
+			nick := strings.TrimRight(rest[1:n], ".-")
+			if nick != "" && knownNickname(nick) {
+				b.WriteString(`<a href="/?user=` + html.EscapeString(url.QueryEscape(nick)) + `" class="mention">@` + html.EscapeString(nick) + `</a>`)
+				i += 1 + len(nick)
+				continue
+			}
+		}
+
+		b.WriteString(html.EscapeString(s[i : i+1]))
+		i++
+	}
+}
+
+func writeLink(b *strings.Builder, href string, text func()) {
+	b.WriteString(`<a href="` + html.EscapeString(href) + `" rel="nofollow noopener noreferrer">`)
+	text()
+	b.WriteString("</a>")
+}
+
+// safeURL accepts relative links and http, https and mailto URLs.
+func safeURL(u string) (string, bool) {
+	u = strings.TrimSpace(u)
+	if u == "" {
+		return "", false
+	}
+	for i := 0; i < len(u); i++ {
+		if u[i] <= ' ' || u[i] == 0x7f || strings.IndexByte("\"'<>`\\", u[i]) >= 0 {
+			return "", false
+		}
+	}
+	if i := strings.IndexAny(u, ":/?#"); i >= 0 && u[i] == ':' {
+		switch strings.ToLower(u[:i]) {
+		case "http", "https", "mailto":
+		default:
+			return "", false
+		}
+	}
+	return u, true
+}
+
+// allowedTags maps each tag sanitizeHTML keeps to the attributes it may have.
+var allowedTags = map[string][]string{
+	"p": nil, "br": nil, "hr": nil,
+	"h1": nil, "h2": nil, "h3": nil, "h4": nil, "h5": nil, "h6": nil,
+	"strong": nil, "em": nil, "del": nil, "code": nil, "pre": nil, "blockquote": nil,
+	"ul": nil, "ol": {"start"}, "li": nil,
+	"a": {"href", "rel", "class"},
+}
+
+var (
+	htmlTagRe    = regexp.MustCompile(`^<(/?)([a-z][a-z0-9]*)((?:\s+[a-z]+="[^"<>]*")*)\s*>`)
+	htmlAttrRe   = regexp.MustCompile(`([a-z]+)="([^"<>]*)"`)
+	htmlEntityRe = regexp.MustCompile(`^&(?:[a-zA-Z][a-zA-Z0-9]{1,31}|#[0-9]{1,7}|#[xX][0-9a-fA-F]{1,6});`)
+	digitsRe     = regexp.MustCompile(`^[0-9]{1,9}$`)
+)
+
+// sanitizeHTML keeps allowlisted tags with allowlisted attributes and
+// escapes every other '<', '>' and stray '&'.
+func sanitizeHTML(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		switch s[i] {
+		case '<':
+			if m := htmlTagRe.FindStringSubmatch(s[i:]); m != nil && tagAllowed(m[1] == "/", m[2], m[3]) {
+				b.WriteString(m[0])
+				i += len(m[0])
+				continue
+			}
+			b.WriteString("&lt;")
+		case '>':
+			b.WriteString("&gt;")
+		case '&':
+			if m := htmlEntityRe.FindString(s[i:]); m != "" {
+				b.WriteString(m)
+				i += len(m)
+				continue
+			}
+			b.WriteString("&amp;")
+		default:
+			b.WriteByte(s[i])
+		}
+		i++
+	}
+	return b.String()
+}
+
+func tagAllowed(closing bool, tag, attrs string) bool {
+	allowed, ok := allowedTags[tag]
+	if !ok {
+		return false
+	}
+	if closing {
+		return attrs == ""
+	}
+	for _, m := range htmlAttrRe.FindAllStringSubmatch(attrs, -1) {
+		name, value := m[1], html.UnescapeString(m[2])
+		if !slices.Contains(allowed, name) {
+			return false
+		}
+		switch name {
+		case "href":
+			if _, ok := safeURL(value); !ok {
+				return false
+			}
+		case "start":
+			if !digitsRe.MatchString(value) {
+				return false
+			}
+		case "class":
+			if value != "mention" {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const linkAttrs = ` rel="nofollow noopener noreferrer"`
+
+func TestRenderMarkdownXSS(t *testing.T) {
+	addNickname("bob")
+	tests := []struct {
+		name, in, want string
+	}{
+		// Dangerous schemes are left as text.
+		{"javascript link", "[x](javascript:alert(1))", "<p>[x](javascript:alert(1))</p>"},
+		{"mixed case scheme", "[x](JaVaScRiPt:alert(1))", "<p>[x](JaVaScRiPt:alert(1))</p>"},
+		{"leading space", "[x]( javascript:alert(1))", "<p>[x]( javascript:alert(1))</p>"},
+		{"tab in scheme", "[x](java\tscript:alert(1))", "<p>[x](java\tscript:alert(1))</p>"},
+		{"vbscript link", "[x](vbscript:msgbox)", "<p>[x](vbscript:msgbox)</p>"},
+		{"data link", "[x](data:text/html;base64,PHNjcmlwdD4=)", "<p>[x](data:text/html;base64,PHNjcmlwdD4=)</p>"},
+		{"bare data url", "data:text/html,<script>alert(1)</script>", "<p>data:text/html,&lt;script&gt;alert(1)&lt;/script&gt;</p>"},
+		{"bare javascript", "javascript:alert(1)", "<p>javascript:alert(1)</p>"},
+		{"nested link", "[[x](javascript:1)](http://a.com)",
+			`<p>[[x](javascript:1)](<a href="http://a.com"` + linkAttrs + `>http://a.com</a>)</p>`},
+
+		// Entities in a link stay entities: the browser sees the text typed,
+		// which is a relative URL, not a scheme.
+		{"entity in scheme", "[x](java&#115;cript:alert(1))",
+			`<p><a href="java&amp;#115;cript:alert(1"` + linkAttrs + `>x</a>)</p>`},
+
+		// Quotes and spaces end or reject a URL, so they cannot open an attribute.
+		{"double quote in link", `[x](http://a.com/"onmouseover="alert(1))`,
+			`<p>[x](<a href="http://a.com/"` + linkAttrs + `>http://a.com/</a>&#34;onmouseover=&#34;alert(1))</p>`},
+		{"single quote in link", `[x](http://a.com/'onmouseover='alert(1))`,
+			`<p>[x](http://a.com/&#39;onmouseover=&#39;alert(1))</p>`},
+		{"space in link", "[x](http://a.com/ onmouseover=alert(1))",
+			`<p>[x](<a href="http://a.com/"` + linkAttrs + `>http://a.com/</a> onmouseover=alert(1))</p>`},
+		{"backtick in link", "[x](http://a.com/`x)", "<p>[x](http://a.com/`x)</p>"},
+		{"quote after bare link", `http://a.com/"onmouseover="alert(1)`,
+			`<p><a href="http://a.com/"` + linkAttrs + `>http://a.com/</a>&#34;onmouseover=&#34;alert(1)</p>`},
+		{"angle bracket after bare link", "https://a.com/?a=1&b=<2>",
+			`<p><a href="https://a.com/?a=1&amp;b="` + linkAttrs + `>https://a.com/?a=1&amp;b=</a>&lt;2&gt;</p>`},
+		{"quote after mention", `@bob" onmouseover="x`,
+			`<p><a href="/?user=bob" class="mention">@bob</a>&#34; onmouseover=&#34;x</p>`},
+
+		// Raw HTML, closed or not, is shown as typed.
+		{"script", "<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>"},
+		{"img onerror", "<img src=x onerror=alert(1)>", "<p>&lt;img src=x onerror=alert(1)&gt;</p>"},
+		{"raw anchor", `<a href="javascript:alert(1)">x</a>`, "<p>&lt;a href=&#34;javascript:alert(1)&#34;&gt;x&lt;/a&gt;</p>"},
+		{"unclosed tag", "<b>bold", "<p>&lt;b&gt;bold</p>"},
+		{"unterminated tag", "<p", "<p>&lt;p</p>"},
+		{"closing allowed tag", "</p><script>", "<p>&lt;/p&gt;&lt;script&gt;</p>"},
+		{"html in emphasis", "**<script>**", "<p><strong>&lt;script&gt;</strong></p>"},
+		{"html in code", "`<script>`", "<p><code>&lt;script&gt;</code></p>"},
+		{"html in unclosed fence", "```\n<script>alert(1)</script>", "<pre><code>&lt;script&gt;alert(1)&lt;/script&gt;</code></pre>"},
+		{"html in quote", "> <script>", "<blockquote>\n<p>&lt;script&gt;</p>\n</blockquote>"},
+		{"html in list", "- <img src=x>", "<ul>\n<li>&lt;img src=x&gt;</li>\n</ul>"},
+		{"html in heading", "# <h1>", "<h1>&lt;h1&gt;</h1>"},
+		{"escaped bracket", `\<script>`, `<p>\&lt;script&gt;</p>`},
+		{"html after link", "[x](http://a.com)<script>", `<p><a href="http://a.com"` + linkAttrs + `>x</a>&lt;script&gt;</p>`},
+
+		// Entity-escaped payloads are escaped again, so they display as typed.
+		{"named entities", "&lt;script&gt;alert(1)&lt;/script&gt;", "<p>&amp;lt;script&amp;gt;alert(1)&amp;lt;/script&amp;gt;</p>"},
+		{"hex entities", "&#x3C;script&#x3E;", "<p>&amp;#x3C;script&amp;#x3E;</p>"},
+		{"decimal entities", "&#60;img src=x onerror=alert(1)&#62;", "<p>&amp;#60;img src=x onerror=alert(1)&amp;#62;</p>"},
+		{"double escaped", "&amp;lt;", "<p>&amp;amp;lt;</p>"},
+	}
+	for _, tt := range tests {
+		if got := renderMarkdown(tt.in); got != tt.want {
+			t.Errorf("%s: renderMarkdown(%q)\n got %s\nwant %s", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRenderMarkdownEmphasis(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"***a** b*", "<p><em><strong>a</strong> b</em></p>"},
+		{"***a* b**", "<p><strong><em>a</em> b</strong></p>"},
+		{"*a **b** c*", "<p><em>a <strong>b</strong> c</em></p>"},
+		{"**a *b* c**", "<p><strong>a <em>b</em> c</strong></p>"},
+		{"~~*a*~~", "<p><del><em>a</em></del></p>"},
+		{"__a_b__", "<p><strong>a_b</strong></p>"},
+		{"**unclosed *em", "<p>**unclosed *em</p>"},
+		{"``code", "<p>``code</p>"},
+		{"[*x*](http://a.com)", `<p><a href="http://a.com"` + linkAttrs + `><em>x</em></a></p>`},
+	}
+	for _, tt := range tests {
+		if got := renderMarkdown(tt.in); got != tt.want {
+			t.Errorf("renderMarkdown(%q)\n got %s\nwant %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+// Nesting deeper than maxMarkdownNesting must neither recurse without bound
+// nor leave a tag unclosed.
+func TestRenderMarkdownDeepNesting(t *testing.T) {
+	for _, in := range []string{
+		strings.Repeat("*", 200) + "x" + strings.Repeat("*", 200),
+		strings.Repeat("*a ", 100) + "x" + strings.Repeat(" a*", 100),
+		strings.Repeat("> ", 100) + "x",
+		strings.Repeat("[", 100) + "x" + strings.Repeat("](http://a.com)", 100),
+	} {
+		got := renderMarkdown(in)
+		for _, tag := range []string{"strong", "em", "blockquote", "a"} {
+			open := strings.Count(got, "<"+tag+">") + strings.Count(got, "<"+tag+" ")
+			if closed := strings.Count(got, "</"+tag+">"); open != closed {
+				t.Errorf("renderMarkdown(%.20q...): %d <%s> but %d </%s>", in, open, tag, closed, tag)
+			}
+		}
+	}
+}
+
+// sanitizeHTML is the second line of defence, so it is tested on markup the
+// renderer never produces.
+func TestSanitizeHTML(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"<p>ok</p>", "<p>ok</p>"},
+		{`<a href="http://a.com" rel="nofollow">x</a>`, `<a href="http://a.com" rel="nofollow">x</a>`},
+		{`<a href="javascript:alert(1)">x</a>`, `&lt;a href="javascript:alert(1)"&gt;x</a>`},
+		{`<a href="&#106;avascript:alert(1)">x</a>`, `&lt;a href="&#106;avascript:alert(1)"&gt;x</a>`},
+		{`<a href="java&#x09;script:alert(1)">x</a>`, `&lt;a href="java&#x09;script:alert(1)"&gt;x</a>`},
+		{`<a href="data:text/html,x">x</a>`, `&lt;a href="data:text/html,x"&gt;x</a>`},
+		{`<a onclick="alert(1)">x</a>`, `&lt;a onclick="alert(1)"&gt;x</a>`},
+		{`<a href="/" class="evil">x</a>`, `&lt;a href="/" class="evil"&gt;x</a>`},
+		{`<p onmouseover="alert(1)">x</p>`, `&lt;p onmouseover="alert(1)"&gt;x</p>`},
+		{`<ol start="1" onclick="x">`, `&lt;ol start="1" onclick="x"&gt;`},
+		{`<ol start="1 x">`, `&lt;ol start="1 x"&gt;`},
+		{`<a href='javascript:alert(1)'>`, `&lt;a href='javascript:alert(1)'&gt;`},
+		{`<a href=javascript:alert(1)>`, `&lt;a href=javascript:alert(1)&gt;`},
+		{`</a href="x">`, `&lt;/a href="x"&gt;`},
+		{"<script>alert(1)</script>", "&lt;script&gt;alert(1)&lt;/script&gt;"},
+		{"<svg/onload=alert(1)>", "&lt;svg/onload=alert(1)&gt;"},
+		{"<P>", "&lt;P&gt;"},
+		{"<p", "&lt;p"},
+		{"a & b &amp; &#60; &#x3c; &bogus", "a &amp; b &amp; &#60; &#x3c; &amp;bogus"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeHTML(tt.in); got != tt.want {
+			t.Errorf("sanitizeHTML(%q)\n got %s\nwant %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSafeURL(t *testing.T) {
+	tests := []struct {
+		in string
+		ok bool
+	}{
+		{"http://a.com", true},
+		{"HTTPS://a.com", true},
+		{"mailto:a@b.c", true},
+		{"/relative?a=1", true},
+		{"#top", true},
+		{"javascript:alert(1)", false},
+		{" javascript:alert(1)", false},
+		{"JAVASCRIPT:alert(1)", false},
+		{"data:text/html,x", false},
+		{"vbscript:x", false},
+		{"java\nscript:x", false},
+		{"java\x00script:x", false},
+		{`http://a.com/"x`, false},
+		{"http://a.com/<x", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if _, ok := safeURL(tt.in); ok != tt.ok {
+			t.Errorf("safeURL(%q) = %v, want %v", tt.in, ok, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An @nickname in a post, comment or chat message mentions that user. The
+// Markdown renderer links every @nickname that belongs to a registered user,
+// and the mentions it finds are recorded when the content is created. Edits
+// to private messages record the users they add; edits to posts and comments
+// do not mention anyone new. Each mention stores a notification (see
+// notifications.go), which is how the user hears about it. Private and room
+// messages only mention users who can read them.
+
+// mentionExcerptLen is the length in runes of Notification.Excerpt.
+const mentionExcerptLen = 140
+
+// nicknames is the set of registered nicknames the renderer links. It is
+// filled from the users table by InitDB and kept current on registration.
+var nicknames = struct {
+	sync.RWMutex
+	set map[string]bool
+}{set: make(map[string]bool)}
+
+func loadNicknames(db *sql.DB) error {
+	rows, err := db.Query(`SELECT nickname FROM users`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	nicknames.Lock()
+	defer nicknames.Unlock()
+	for rows.Next() {
+		var nick string
+		if err := rows.Scan(&nick); err != nil {
+			return err
+		}
+		nicknames.set[nick] = true
+	}
+	return rows.Err()
+}
+
+func addNickname(nick string) {
+	nicknames.Lock()
+	nicknames.set[nick] = true
+	nicknames.Unlock()
+}
+
+func knownNickname(nick string) bool {
+	nicknames.RLock()
+	defer nicknames.RUnlock()
+	return nicknames.set[nick]
+}
+
+func isNicknameByte(c byte) bool {
+	return isWordByte(c) || c == '-' || c == '.'
+}
+
+var mentionLinkRe = regexp.MustCompile(`<a href="/\?user=([^"]*)" class="mention">`)
+
+// mentionedNicknames returns the nicknames content mentions, in order and
+// without repeats. It reads them back from the rendered HTML so code spans,
+// links and escapes are treated exactly as the reader sees them.
+func mentionedNicknames(content string) []string {
+	var nicks []string
+	for _, m := range mentionLinkRe.FindAllStringSubmatch(renderMarkdown(content), -1) {
+		if nick, err := url.QueryUnescape(html.UnescapeString(m[1])); err == nil {
+			nicks = append(nicks, nick)
+		}
+	}
+	return uniqueStrings(nicks, "")
+}
+
+// mentionAudience restricts who a mention in a message can reach: the
+// receiver of a private message, the members of a room.
+var mentionAudience = map[string]string{
+	TargetPost:        ``,
+	TargetComment:     ``,
+	TargetMessage:     ` AND u.uuid = (SELECT receiver_uuid FROM private_messages WHERE id = ?)`,
+	TargetRoomMessage: ` AND u.uuid IN (SELECT cm.user_uuid FROM conversation_members cm JOIN conversation_messages m ON m.conversation_id = cm.conversation_id WHERE m.id = ?)`,
+}
+
+// recordMentions stores the mentions in new or edited content. Authors do
+// not mention themselves. Only users it mentions for the first time are
+// notified, so an edit does not repeat earlier notifications.
+func recordMentions(tx *sql.Tx, targetType string, targetID int64, authorUUID, content string) error {
+	nicks := mentionedNicknames(content)
+	if len(nicks) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	args := []interface{}{targetType, targetID, authorUUID, now, authorUUID}
+	for _, nick := range nicks {
+		args = append(args, nick)
+	}
+	audience := mentionAudience[targetType]
+	if audience != "" {
+		args = append(args, targetID)
+	}
+	_, err := tx.Exec(`
+        INSERT OR IGNORE INTO mentions (target_type, target_id, mentioned_uuid, author_uuid, created_at)
+        SELECT ?, ?, u.uuid, ?, ?
+        FROM users u
+        WHERE u.uuid != ? AND u.nickname IN (`+strings.Repeat("?,", len(nicks)-1)+`?)`+audience,
+		args...)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+        INSERT OR IGNORE INTO notifications (user_uuid, kind, actor_uuid, target_type, target_id, created_at)
+        SELECT mentioned_uuid, ?, author_uuid, target_type, target_id, created_at
+        FROM mentions
+        WHERE target_type = ? AND target_id = ? AND created_at = ?`, NotifyMention, targetType, targetID, now)
+	return err
+}
+
+// excerpt shortens s to at most n runes on one line.
+func excerpt(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if r := []rune(s); len(r) > n {
+		return string(r[:n-1]) + "…"
+	}
+	return s
+}
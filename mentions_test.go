@@ -0,0 +1,101 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestMentionedNicknames(t *testing.T) {
+	for _, nick := range []string{"bob", "carol", "mary.jane", "o-neil"} {
+		addNickname(nick)
+	}
+	tests := []struct {
+		content string
+		want    []string
+	}{
+		{"hi @bob", []string{"bob"}},
+		{"@carol and @bob, then @carol again", []string{"carol", "bob"}},
+		{"thanks @bob.", []string{"bob"}},
+		{"(@bob)", []string{"bob"}},
+		{"@mary.jane and @o-neil", []string{"mary.jane", "o-neil"}},
+		{"@nobody here", nil},
+		{"write to bob@example.com", nil},
+		{"`@bob` in code", nil},
+		{"```\n@bob\n```", nil},
+		{"[@bob](https://example.com)", nil},
+		{"**@bob**", []string{"bob"}},
+	}
+	for _, tt := range tests {
+		if got := mentionedNicknames(tt.content); !slices.Equal(got, tt.want) {
+			t.Errorf("mentionedNicknames(%q) = %v, want %v", tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestRecordMentions(t *testing.T) {
+	db := newTestDB(t)
+	alice, bob, carol, dave := createTestUser(t, db, "alice"), createTestUser(t, db, "bob"), createTestUser(t, db, "carol"), createTestUser(t, db, "dave")
+	now := testNow()
+	room, err := CreateRoom(db, RoomKindRoom, "garden", "", alice, []string{bob})
+	if err != nil {
+		t.Fatal(err)
+	}
+	postUUID := uuid.New().String()
+	all := "@alice @bob @carol @dave @bob"
+
+	// The cases run in order: the comment goes on the post.
+	tests := []struct {
+		name   string
+		post   func() error
+		target string
+		want   []string // mentioned, author excluded
+	}{
+		{"post", func() error {
+			return InsertPost(db, postUUID, alice, "Title", all, nil, nil, now)
+		}, TargetPost, []string{bob, carol, dave}},
+		{"comment", func() error {
+			_, _, err := InsertComment(db, alice, postUUID, "", all, nil)
+			return err
+		}, TargetComment, []string{bob, carol, dave}},
+		{"private message", func() error {
+			_, _, err := SaveMessage(db, uuid.New().String(), alice, carol, all, nil, now)
+			return err
+		}, TargetMessage, []string{carol}},
+		{"room message", func() error {
+			return SaveRoomMessage(db, uuid.New().String(), room.UUID, alice, all, nil, now)
+		}, TargetRoomMessage, []string{bob}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.post(); err != nil {
+				t.Fatal(err)
+			}
+			rows, err := db.Query(`SELECT m.mentioned_uuid, EXISTS(SELECT 1 FROM notifications n
+                WHERE n.user_uuid = m.mentioned_uuid AND n.kind = ? AND n.target_type = m.target_type AND n.target_id = m.target_id)
+                FROM mentions m WHERE m.target_type = ? ORDER BY m.mentioned_uuid`, NotifyMention, tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+			var got []string
+			for rows.Next() {
+				var user string
+				var notified bool
+				if err := rows.Scan(&user, &notified); err != nil {
+					t.Fatal(err)
+				}
+				if !notified {
+					t.Errorf("%s mentioned without a notification", user)
+				}
+				got = append(got, user)
+			}
+			want := slices.Clone(tt.want)
+			slices.Sort(want)
+			if !slices.Equal(got, want) {
+				t.Errorf("mentioned %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// messageEditWindow is how long after sending a private message its sender
+// may still edit or delete it. Override with MESSAGE_EDIT_WINDOW, e.g. "30m".
+var messageEditWindow = envDuration("MESSAGE_EDIT_WINDOW", 15*time.Minute)
+
+var (
+	ErrMessageNotFound  = errors.New("message not found")
+	ErrNotMessageSender = errors.New("only the sender can change this message")
+	ErrEditWindowClosed = errors.New("message can no longer be changed")
+	ErrMessageDeleted   = errors.New("message has been deleted")
+)
+
+// MessageChange describes an edit or deletion of a private message.
+type MessageChange struct {
+	UUID        string `json:"uuid"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+	Content     string `json:"content,omitempty"`
+	ContentHTML string `json:"content_html,omitempty"`
+	ChangedAt   string `json:"changed_at"`
+}
+
+type MessageEdit struct {
+	OldContent string    `json:"old_content"`
+	EditedAt   time.Time `json:"edited_at"`
+}
+
+// lockMessageForChange loads a message inside tx and checks that sender may
+// still change it.
+func lockMessageForChange(tx *sql.Tx, messageUUID, sender string, now time.Time) (id int64, content, receiver string, err error) {
+	var from string
+	var sentAt time.Time
+	var deletedAt sql.NullTime
+	err = tx.QueryRow(`SELECT id, sender_uuid, receiver_uuid, content, sent_at, deleted_at
+        FROM private_messages WHERE uuid = ?`, messageUUID).Scan(&id, &from, &receiver, &content, &sentAt, &deletedAt)
+	if err == sql.ErrNoRows {
+		return 0, "", "", ErrMessageNotFound
+	} else if err != nil {
+		return 0, "", "", err
+	}
+
+	if from != sender {
+		return 0, "", "", ErrNotMessageSender
+	}
+	if deletedAt.Valid {
+		return 0, "", "", ErrMessageDeleted
+	}
+	if now.Sub(sentAt) > messageEditWindow {
+		return 0, "", "", ErrEditWindowClosed
+	}
+	return id, content, receiver, nil
+}
+
+// EditMessage replaces a private message's content and keeps the previous
+// version in private_message_edits. Users first mentioned by the edit are
+// notified.
+func EditMessage(db *sql.DB, messageUUID, sender, content string, now time.Time) (*MessageChange, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	id, oldContent, receiver, err := lockMessageForChange(tx, messageUUID, sender, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`INSERT INTO private_message_edits (message_id, old_content, edited_at) VALUES (?, ?, ?)`,
+		id, oldContent, now); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`UPDATE private_messages SET content = ?, edited_at = ? WHERE id = ?`,
+		content, now, id); err != nil {
+		return nil, err
+	}
+	if err := recordMentions(tx, TargetMessage, id, sender, content); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &MessageChange{UUID: messageUUID, From: sender, To: receiver, Content: content, ContentHTML: renderMarkdown(content), ChangedAt: now.Format(time.RFC3339)}, nil
+}
+
+// DeleteMessage turns a private message into a tombstone. The row stays so
+// sequence numbers and read state are unaffected, but its content is
+// removed. Earlier versions stay in private_message_edits.
+func DeleteMessage(db *sql.DB, messageUUID, sender string, now time.Time) (*MessageChange, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	id, _, receiver, err := lockMessageForChange(tx, messageUUID, sender, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`UPDATE private_messages SET content = '', deleted_at = ? WHERE id = ?`, now, id); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &MessageChange{UUID: messageUUID, From: sender, To: receiver, ChangedAt: now.Format(time.RFC3339)}, nil
+}
+
+// LoadMessageEdits returns the previous versions of a message, oldest first,
+// if viewer took part in the conversation.
+func LoadMessageEdits(db *sql.DB, messageUUID, viewer string) ([]MessageEdit, error) {
+	var id int64
+	err := db.QueryRow(`SELECT id FROM private_messages WHERE uuid = ? AND (sender_uuid = ? OR receiver_uuid = ?)`,
+		messageUUID, viewer, viewer).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, ErrMessageNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT old_content, edited_at FROM private_message_edits WHERE message_id = ? ORDER BY id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	edits := make([]MessageEdit, 0)
+	for rows.Next() {
+		var e MessageEdit
+		if err := rows.Scan(&e.OldContent, &e.EditedAt); err != nil {
+			return nil, err
+		}
+		edits = append(edits, e)
+	}
+	return edits, rows.Err()
+}
+
+// editMessage applies an edit and tells both participants.
+func editMessage(hub *Hub, sender, messageUUID, content string) (*MessageChange, error) {
+	change, err := EditMessage(hub.db, messageUUID, sender, content, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	hub.MessageChanged(FrameMessageEdited, change)
+	notifyTargetUUID(hub, TargetMessage, messageUUID)
+	return change, nil
+}
+
+// deleteMessage applies a deletion and tells both participants.
+func deleteMessage(hub *Hub, sender, messageUUID string) (*MessageChange, error) {
+	change, err := DeleteMessage(hub.db, messageUUID, sender, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	hub.MessageChanged(FrameMessageDeleted, change)
+	return change, nil
+}
+
+// MessageChanged pushes a message_edited or message_deleted frame to every
+// connection of both participants. Deleting an unread message changes the
+// receiver's unread count, so their user list is refreshed as well.
+func (h *Hub) MessageChanged(frameType string, change *MessageChange) {
+	h.do(func() {
+		frame := NewFrame(frameType, "", change, nil)
+		h.sendToUser(change.From, frame)
+		if change.To != change.From {
+			h.sendToUser(change.To, frame)
+		}
+		if frameType == FrameMessageDeleted {
+			h.sendUserList(change.To)
+		}
+	})
+}
+
+// messageChangeError maps edit/delete errors to protocol error codes and
+// HTTP statuses.
+func messageChangeError(err error) (code string, status int) {
+	switch err {
+	case ErrMessageNotFound:
+		return "not_found", http.StatusNotFound
+	case ErrNotMessageSender:
+		return "forbidden", http.StatusForbidden
+	case ErrEditWindowClosed:
+		return "edit_window_closed", http.StatusConflict
+	case ErrMessageDeleted:
+		return "message_deleted", http.StatusConflict
+	default:
+		log.Printf("Message change error: %v", err)
+		return "server_error", http.StatusInternalServerError
+	}
+}
+
+func handleEditFrame(hub *Hub, client *Client, frame inboundFrame) {
+	var p EditMessagePayload
+	if err := json.Unmarshal(frame.Payload, &p); err != nil || p.UUID == "" || strings.TrimSpace(p.Content) == "" {
+		hub.SendToClient(client, errorFrame(frame.ID, "invalid_payload", "edit_message needs 'uuid' and 'content'"))
+		return
+	}
+
+	if _, err := editMessage(hub, client.UserUUID, p.UUID, p.Content); err != nil {
+		code, _ := messageChangeError(err)
+		hub.SendToClient(client, errorFrame(frame.ID, code, err.Error()))
+		return
+	}
+	hub.SendToClient(client, NewFrame(FrameAck, frame.ID, nil, nil))
+}
+
+func handleDeleteFrame(hub *Hub, client *Client, frame inboundFrame) {
+	var p DeleteMessagePayload
+	if err := json.Unmarshal(frame.Payload, &p); err != nil || p.UUID == "" {
+		hub.SendToClient(client, errorFrame(frame.ID, "invalid_payload", "delete_message needs 'uuid'"))
+		return
+	}
+
+	if _, err := deleteMessage(hub, client.UserUUID, p.UUID); err != nil {
+		code, _ := messageChangeError(err)
+		hub.SendToClient(client, errorFrame(frame.ID, code, err.Error()))
+		return
+	}
+	hub.SendToClient(client, NewFrame(FrameAck, frame.ID, nil, nil))
+}
+
+// EditMessageHandler: PUT /messages {uuid, content}
+func EditMessageHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req EditMessagePayload
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if req.UUID == "" || strings.TrimSpace(req.Content) == "" {
+			http.Error(w, "Missing message uuid or content", http.StatusBadRequest)
+			return
+		}
+
+		change, err := editMessage(hub, userUUID, req.UUID, req.Content)
+		if err != nil {
+			_, status := messageChangeError(err)
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(change)
+	}
+}
+
+// DeleteMessageHandler: DELETE /messages?uuid=
+func DeleteMessageHandler(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		messageUUID := r.URL.Query().Get("uuid")
+		if messageUUID == "" {
+			http.Error(w, "Missing message uuid", http.StatusBadRequest)
+			return
+		}
+
+		change, err := deleteMessage(hub, userUUID, messageUUID)
+		if err != nil {
+			_, status := messageChangeError(err)
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(change)
+	}
+}
+
+// MessageEditsHandler: GET /messages/edits?uuid=
+func MessageEditsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		edits, err := LoadMessageEdits(db, r.URL.Query().Get("uuid"), userUUID)
+		if err != nil {
+			_, status := messageChangeError(err)
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(edits)
+	}
+}
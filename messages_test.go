@@ -0,0 +1,249 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// sendTestMessage saves a private message sent at sentAt.
+func sendTestMessage(t *testing.T, db *sql.DB, from, to, content string, sentAt time.Time) string {
+	t.Helper()
+	messageUUID := uuid.New().String()
+	if _, _, err := SaveMessage(db, messageUUID, from, to, content, nil, sentAt); err != nil {
+		t.Fatal(err)
+	}
+	return messageUUID
+}
+
+func TestChangeMessage(t *testing.T) {
+	sentAt := testNow()
+	changes := []struct {
+		name  string
+		apply func(db *sql.DB, messageUUID, sender string, now time.Time) error
+	}{
+		{"edit", func(db *sql.DB, messageUUID, sender string, now time.Time) error {
+			_, err := EditMessage(db, messageUUID, sender, "edited", now)
+			return err
+		}},
+		{"delete", func(db *sql.DB, messageUUID, sender string, now time.Time) error {
+			_, err := DeleteMessage(db, messageUUID, sender, now)
+			return err
+		}},
+	}
+	tests := []struct {
+		name    string
+		message string // "" for the message, or another uuid
+		byBob   bool   // the receiver tries instead of the sender
+		deleted bool
+		at      time.Duration // after sending
+		err     error
+	}{
+		{"by the sender", "", false, false, time.Minute, nil},
+		{"at the end of the window", "", false, false, messageEditWindow, nil},
+		{"after the window", "", false, false, messageEditWindow + time.Second, ErrEditWindowClosed},
+		{"by the receiver", "", true, false, time.Minute, ErrNotMessageSender},
+		{"after deletion", "", false, true, time.Minute, ErrMessageDeleted},
+		{"unknown message", "no-such-message", false, false, time.Minute, ErrMessageNotFound},
+	}
+	for _, change := range changes {
+		for _, tt := range tests {
+			t.Run(change.name+" "+tt.name, func(t *testing.T) {
+				db := newTestDB(t)
+				alice, bob := createTestUser(t, db, "alice"), createTestUser(t, db, "bob")
+				messageUUID := sendTestMessage(t, db, alice, bob, "hello", sentAt)
+				if tt.deleted {
+					if _, err := DeleteMessage(db, messageUUID, alice, sentAt); err != nil {
+						t.Fatal(err)
+					}
+				}
+				target, sender := messageUUID, alice
+				if tt.message != "" {
+					target = tt.message
+				}
+				if tt.byBob {
+					sender = bob
+				}
+				if err := change.apply(db, target, sender, sentAt.Add(tt.at)); err != tt.err {
+					t.Fatalf("got %v, want %v", err, tt.err)
+				}
+
+				var content string
+				db.QueryRow(`SELECT content FROM private_messages WHERE uuid = ?`, messageUUID).Scan(&content)
+				want := "hello"
+				if tt.err == nil {
+					want = map[string]string{"edit": "edited", "delete": ""}[change.name]
+				} else if tt.deleted {
+					want = ""
+				}
+				if content != want {
+					t.Errorf("content %q, want %q", content, want)
+				}
+			})
+		}
+	}
+}
+
+func TestDeleteMessageKeepsEdits(t *testing.T) {
+	db := newTestDB(t)
+	alice, bob := createTestUser(t, db, "alice"), createTestUser(t, db, "bob")
+	now := testNow()
+	messageUUID := sendTestMessage(t, db, alice, bob, "first", now)
+	if _, err := EditMessage(db, messageUUID, alice, "second", now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DeleteMessage(db, messageUUID, alice, now.Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	var content string
+	var deletedAt sql.NullTime
+	db.QueryRow(`SELECT content, deleted_at FROM private_messages WHERE uuid = ?`, messageUUID).Scan(&content, &deletedAt)
+	if content != "" || !deletedAt.Valid {
+		t.Errorf("tombstone has content %q, deleted at %v", content, deletedAt)
+	}
+	edits, err := LoadMessageEdits(db, messageUUID, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(edits) != 1 || edits[0].OldContent != "first" {
+		t.Errorf("edits %+v, want the first version", edits)
+	}
+	if _, err := LoadMessageEdits(db, messageUUID, createTestUser(t, db, "carol")); err != ErrMessageNotFound {
+		t.Errorf("edits seen by an outsider: %v", err)
+	}
+}
+
+func TestEditMessageRecordsMentions(t *testing.T) {
+	db := newTestDB(t)
+	alice, bob := createTestUser(t, db, "alice"), createTestUser(t, db, "bob")
+	carol := createTestUser(t, db, "carol")
+	now := testNow()
+	messageUUID := sendTestMessage(t, db, alice, bob, "hello", now)
+
+	mentionNotifications := func(user string) int {
+		t.Helper()
+		var n int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM notifications WHERE user_uuid = ? AND kind = ?`, user, NotifyMention).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	// Carol is not in the conversation, so mentioning carol does nothing.
+	if _, err := EditMessage(db, messageUUID, alice, "hello @bob and @carol", now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if n := mentionNotifications(bob); n != 1 {
+		t.Fatalf("bob has %d mention notifications, want 1", n)
+	}
+	if n := mentionNotifications(carol); n != 0 {
+		t.Errorf("carol has %d mention notifications, want 0", n)
+	}
+
+	// Editing again does not repeat the notification, even once it is read.
+	if _, err := db.Exec(`UPDATE notifications SET read_at = ?`, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := EditMessage(db, messageUUID, alice, "hello again @bob", now.Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if n := mentionNotifications(bob); n != 1 {
+		t.Errorf("bob has %d mention notifications after a second edit, want 1", n)
+	}
+}
+
+func TestLoadMessagesCursors(t *testing.T) {
+	db := newTestDB(t)
+	alice, bob, carol := createTestUser(t, db, "alice"), createTestUser(t, db, "bob"), createTestUser(t, db, "carol")
+	now := testNow()
+	var ids []string // m1 to m7
+	for i := 1; i <= 7; i++ {
+		from, to := alice, bob
+		if i%2 == 0 {
+			from, to = bob, alice
+		}
+		ids = append(ids, sendTestMessage(t, db, from, to, fmt.Sprintf("m%d", i), now.Add(time.Duration(i)*time.Second)))
+		if i == 3 {
+			sendTestMessage(t, db, alice, carol, "elsewhere", now)
+		}
+	}
+	// walk loads pages from c until the last, returning their contents.
+	walk := func(c MessageCursor) [][]string {
+		t.Helper()
+		var pages [][]string
+		for {
+			page, err := LoadMessages(db, bob, alice, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var contents []string
+			for _, m := range page.Messages {
+				contents = append(contents, m.Content)
+			}
+			pages = append(pages, contents)
+			if page.NextCursor == "" || len(pages) > 5 {
+				return pages
+			}
+			if c.After != "" {
+				c.After = page.NextCursor
+			} else {
+				c.Before = page.NextCursor
+			}
+		}
+	}
+
+	tests := []struct {
+		name   string
+		cursor MessageCursor
+		want   string
+	}{
+		{"newest first", MessageCursor{Limit: 3}, "[[m5 m6 m7] [m2 m3 m4] [m1]]"},
+		{"before", MessageCursor{Before: ids[4], Limit: 2}, "[[m3 m4] [m1 m2]]"},
+		{"after", MessageCursor{After: ids[0], Limit: 4}, "[[m2 m3 m4 m5] [m6 m7]]"},
+		{"after the newest", MessageCursor{After: ids[6], Limit: 4}, "[[]]"},
+		{"exact page", MessageCursor{Limit: 7}, "[[m1 m2 m3 m4 m5 m6 m7]]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fmt.Sprint(walk(tt.cursor)); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	elsewhere, err := LoadMessages(db, alice, carol, MessageCursor{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []MessageCursor{{Before: elsewhere.Messages[0].UUID, Limit: 3}, {After: "no-such-message", Limit: 3}} {
+		if _, err := LoadMessages(db, bob, alice, c); err != ErrMessageNotInConversation {
+			t.Errorf("cursor %+v from outside the conversation: %v", c, err)
+		}
+	}
+}
+
+func TestParseMessageCursor(t *testing.T) {
+	tests := []struct {
+		query string
+		want  MessageCursor
+		ok    bool
+	}{
+		{"", MessageCursor{Limit: defaultMessagePageSize}, true},
+		{"before=x&limit=5", MessageCursor{Before: "x", Limit: 5}, true},
+		{"after=x&limit=100000", MessageCursor{After: "x", Limit: maxMessagePageSize}, true},
+		{"before=x&after=y", MessageCursor{}, false},
+		{"limit=0", MessageCursor{}, false},
+		{"limit=ten", MessageCursor{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parseMessageCursor(httptest.NewRequest("GET", "/messages?"+tt.query, nil))
+		if (err == nil) != tt.ok || (tt.ok && got != tt.want) {
+			t.Errorf("%q: got %+v, %v", tt.query, got, err)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"database/sql"
+	"log"
 	"net/http"
 )
 
@@ -22,6 +23,10 @@ func AuthMiddleware(next http.Handler, db *sql.DB) http.Handler {
 			return
 		}
 
+		if err := TouchSession(db, session.SessionUUID); err != nil {
+			log.Printf("Error updating session last seen: %v", err)
+		}
+
 		// Add user UUID to context
 		ctx := context.WithValue(r.Context(), userContextKey, session.UserUUID)
 		next.ServeHTTP(w, r.WithContext(ctx))
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"fmt"
+	"html"
+	"log"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// schema.sql only creates missing tables, so changes to existing tables and
+// one-off data fixes live here. Each migration runs once, in order, and is
+// recorded in schema_migrations.
+type migration struct {
+	name  string
+	apply func(tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{"004_backfill_user_message_log", backfillUserMessageLog},
+	{"005_private_message_read_state", addPrivateMessageReadState},
+	{"007_private_message_edits", addPrivateMessageEditState},
+	{"011_roles_and_post_edits", addRolesAndPostEditState},
+	{"012_comment_threads", addCommentThreads},
+	{"016_unescape_content", unescapeStoredContent},
+	{"018_category_management", addCategoryManagement},
+	{"022_notification_emails", addNotificationEmailState},
+	{"023_email_verification", addEmailVerification},
+	{"025_session_details", addSessionDetails},
+	{"026_redact_token_emails", addOutboxRedaction}, // was 023_redact_token_emails; safe to run again
+	{"027_two_factor_lockout", addTwoFactorLockout}, // was 024_two_factor_lockout; safe to run again
+}
+
+func runMigrations(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+        name TEXT PRIMARY KEY,
+        applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    )`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	for _, m := range migrations {
+		var done bool
+		err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM schema_migrations WHERE name = ?)", m.name).Scan(&done)
+		if err != nil {
+			return fmt.Errorf("failed to check migration %s: %w", m.name, err)
+		}
+		if done {
+			continue
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin migration %s: %w", m.name, err)
+		}
+		if err := m.apply(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %s failed: %w", m.name, err)
+		}
+		if _, err := tx.Exec("INSERT INTO schema_migrations (name) VALUES (?)", m.name); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to record migration %s: %w", m.name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit migration %s: %w", m.name, err)
+		}
+		log.Printf("Applied migration %s", m.name)
+	}
+	return nil
+}
+
+// addColumnIfMissing adds a column to an existing table. Fresh databases get
+// the column from schema.sql, so the ALTER is skipped there.
+func addColumnIfMissing(tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// backfillUserMessageLog numbers messages that predate per-user sequences.
+func backfillUserMessageLog(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+        INSERT OR IGNORE INTO user_message_log (user_uuid, seq, message_id)
+        SELECT user_uuid, ROW_NUMBER() OVER (PARTITION BY user_uuid ORDER BY id), id
+        FROM (
+            SELECT sender_uuid AS user_uuid, id FROM private_messages
+            UNION
+            SELECT receiver_uuid AS user_uuid, id FROM private_messages
+        )
+        WHERE NOT EXISTS (SELECT 1 FROM user_message_log)`)
+	return err
+}
+
+func addPrivateMessageReadState(tx *sql.Tx) error {
+	if err := addColumnIfMissing(tx, "private_messages", "delivered_at", "DATETIME"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(tx, "private_messages", "read_at", "DATETIME"); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`CREATE INDEX IF NOT EXISTS idx_private_messages_unread
+        ON private_messages(receiver_uuid, read_at)`)
+	return err
+}
+
+func addPrivateMessageEditState(tx *sql.Tx) error {
+	if err := addColumnIfMissing(tx, "private_messages", "edited_at", "DATETIME"); err != nil {
+		return err
+	}
+	return addColumnIfMissing(tx, "private_messages", "deleted_at", "DATETIME")
+}
+
+func addRolesAndPostEditState(tx *sql.Tx) error {
+	if err := addColumnIfMissing(tx, "users", "role", "TEXT NOT NULL DEFAULT 'user' CHECK(role IN ('user','moderator','admin'))"); err != nil {
+		return err
+	}
+	for _, table := range []string{"posts", "comments"} {
+		if err := addColumnIfMissing(tx, table, "edited_at", "DATETIME"); err != nil {
+			return err
+		}
+		if err := addColumnIfMissing(tx, table, "deleted_at", "DATETIME"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addCommentThreads gives existing comments a uuid and makes them top-level.
+func addCommentThreads(tx *sql.Tx) error {
+	if err := addColumnIfMissing(tx, "comments", "comment_uuid", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(tx, "comments", "parent_id", "INTEGER REFERENCES comments(id)"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(tx, "comments", "depth", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(tx, "comments", "path", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT id FROM comments WHERE comment_uuid IS NULL")
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := tx.Exec("UPDATE comments SET comment_uuid = ? WHERE id = ?", uuid.New().String(), id); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`UPDATE comments SET path = printf('%010d', id) WHERE path = ''`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_comments_uuid ON comments(comment_uuid)`); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`CREATE INDEX IF NOT EXISTS idx_comments_post_path ON comments(post_id, path)`)
+	return err
+}
+
+// Content used to be stored HTML-escaped. It is now stored as written and
+// escaped when rendered, so existing rows are unescaped once.
+func unescapeStoredContent(tx *sql.Tx) error {
+	columns := map[string][]string{
+		"posts":                 {"title", "content"},
+		"comments":              {"content"},
+		"private_messages":      {"content"},
+		"private_message_edits": {"old_content"},
+		"conversation_messages": {"content"},
+		"content_revisions":     {"old_title", "old_content", "diff"},
+	}
+	for table, cols := range columns {
+		if err := unescapeColumns(tx, table, cols); err != nil {
+			return fmt.Errorf("%s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+func unescapeColumns(tx *sql.Tx, table string, cols []string) error {
+	rows, err := tx.Query("SELECT id, " + strings.Join(cols, ", ") + " FROM " + table)
+	if err != nil {
+		return err
+	}
+	type change struct {
+		id     int64
+		values []interface{}
+	}
+	var changes []change
+	for rows.Next() {
+		var id int64
+		values := make([]sql.NullString, len(cols))
+		dest := []interface{}{&id}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return err
+		}
+
+		changed := false
+		args := make([]interface{}, len(cols))
+		for i, v := range values {
+			args[i] = v
+			if v.Valid && strings.Contains(v.String, "&") {
+				args[i] = html.UnescapeString(v.String)
+				changed = changed || args[i] != v.String
+			}
+		}
+		if changed {
+			changes = append(changes, change{id, args})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	stmt := "UPDATE " + table + " SET " + strings.Join(cols, " = ?, ") + " = ? WHERE id = ?"
+	for _, c := range changes {
+		if _, err := tx.Exec(stmt, append(c.values, c.id)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addCategoryManagement gives existing categories a slug and a position.
+func addCategoryManagement(tx *sql.Tx) error {
+	columns := [][2]string{
+		{"slug", "TEXT"},
+		{"description", "TEXT NOT NULL DEFAULT ''"},
+		{"position", "INTEGER NOT NULL DEFAULT 0"},
+		{"post_role", "TEXT NOT NULL DEFAULT 'user' CHECK(post_role IN ('user','moderator','admin'))"},
+		{"archived_at", "DATETIME"},
+	}
+	for _, c := range columns {
+		if err := addColumnIfMissing(tx, "categories", c[0], c[1]); err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.Query("SELECT id, name FROM categories WHERE slug IS NULL ORDER BY id")
+	if err != nil {
+		return err
+	}
+	slugs := map[int64]string{}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			rows.Close()
+			return err
+		}
+		slugs[id] = slugify(name)
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	used := map[string]bool{}
+	for _, id := range ids {
+		slug := slugs[id]
+		if slug == "" || used[slug] {
+			slug = fmt.Sprintf("%s-%d", cmp.Or(slug, "category"), id)
+		}
+		used[slug] = true
+		if _, err := tx.Exec("UPDATE categories SET slug = ?, position = id WHERE id = ?", slug, id); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_categories_slug ON categories(slug)`)
+	return err
+}
+
+func addNotificationEmailState(tx *sql.Tx) error {
+	return addColumnIfMissing(tx, "notifications", "emailed_at", "DATETIME")
+}
+
+// Accounts from before verification existed count as verified, so turning on
+// REQUIRE_EMAIL_VERIFICATION does not lock them out.
+func addEmailVerification(tx *sql.Tx) error {
+	if err := addColumnIfMissing(tx, "users", "email_verified_at", "DATETIME"); err != nil {
+		return err
+	}
+	_, err := tx.Exec("UPDATE users SET email_verified_at = COALESCE(created_at, CURRENT_TIMESTAMP) WHERE email_verified_at IS NULL")
+	return err
+}
+
+// Sessions from before this migration keep NULL details.
+func addSessionDetails(tx *sql.Tx) error {
+	for _, column := range []string{"user_agent TEXT", "ip TEXT", "created_at DATETIME", "last_seen_at DATETIME"} {
+		name, definition, _ := strings.Cut(column, " ")
+		if err := addColumnIfMissing(tx, "sessions", name, definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addOutboxRedaction(tx *sql.Tx) error {
+	return addColumnIfMissing(tx, "email_outbox", "redact_body", "BOOLEAN NOT NULL DEFAULT 0")
+}
+
+func addTwoFactorLockout(tx *sql.Tx) error {
+	for _, column := range []string{"failed_attempts INTEGER NOT NULL DEFAULT 0", "locked_until DATETIME"} {
+		name, definition, _ := strings.Cut(column, " ")
+		if err := addColumnIfMissing(tx, "user_totp", name, definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
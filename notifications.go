@@ -0,0 +1,325 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notifications tell a user about activity involving them: replies to their
+// posts and comments, mentions, reactions to their posts and comments, and
+// private messages sent while they were offline. Each one is pushed as a
+// notification frame to every connection the user has, or on their next
+// connect, and stays listed until it is marked read. Repeats of an unread
+// notification (the same actor reacting again, say) are not stored twice.
+
+const (
+	NotifyReply        = "reply"         // comment on my post
+	NotifyCommentReply = "comment_reply" // reply to my comment
+	NotifyMention      = "mention"
+	NotifyReaction     = "reaction" // like or dislike on my post or comment
+	NotifyMessage      = "message"  // private message while I was offline
+
+	defaultNotificationPageSize = 20
+	maxNotificationPageSize     = 100
+
+	// notificationReplayLimit bounds the stored notifications pushed on one
+	// connect; the rest follow on the next.
+	notificationReplayLimit = 50
+)
+
+// TargetLocation says where the post, comment or message a mention or
+// notification points to can be found. Only the fields that locate the
+// target are set: post_uuid for posts, post_uuid and comment_uuid for
+// comments, message_uuid for private messages, message_uuid and room for
+// room messages.
+type TargetLocation struct {
+	PostUUID    string `json:"post_uuid,omitempty"`
+	CommentUUID string `json:"comment_uuid,omitempty"`
+	MessageUUID string `json:"message_uuid,omitempty"`
+	Room        string `json:"room,omitempty"`
+}
+
+// The target location of a row aliased x with target_type and target_id
+// columns. targetLocationColumns scans into a TargetLocation followed by the
+// target's content; targetLocationLive leaves out missing and deleted
+// targets.
+const (
+	targetLocationColumns = `
+        COALESCE(p.post_uuid, cp.post_uuid, ''), COALESCE(c.comment_uuid, ''),
+        COALESCE(pm.uuid, rm.uuid, ''), COALESCE(r.uuid, ''),
+        COALESCE(p.content, c.content, pm.content, rm.content, '')`
+	targetLocationJoins = `
+        LEFT JOIN posts p ON x.target_type = 'post' AND p.id = x.target_id
+        LEFT JOIN comments c ON x.target_type = 'comment' AND c.id = x.target_id
+        LEFT JOIN posts cp ON cp.id = c.post_id
+        LEFT JOIN private_messages pm ON x.target_type = 'message' AND pm.id = x.target_id
+        LEFT JOIN conversation_messages rm ON x.target_type = 'room_message' AND rm.id = x.target_id
+        LEFT JOIN conversations r ON r.id = rm.conversation_id`
+	targetLocationLive = `
+        COALESCE(p.id, c.id, pm.id, rm.id) IS NOT NULL
+        AND p.deleted_at IS NULL AND c.deleted_at IS NULL
+        AND cp.deleted_at IS NULL AND pm.deleted_at IS NULL`
+)
+
+func (l *TargetLocation) scanDest(content *string) []interface{} {
+	return []interface{}{&l.PostUUID, &l.CommentUUID, &l.MessageUUID, &l.Room, content}
+}
+
+type Notification struct {
+	ID            int64  `json:"id"`
+	Kind          string `json:"kind"`
+	Actor         string `json:"actor"`
+	ActorNickname string `json:"actor_nickname"`
+	TargetType    string `json:"target_type"`
+	TargetLocation
+	Excerpt   string    `json:"excerpt"`
+	CreatedAt time.Time `json:"created_at"`
+	Read      bool      `json:"read"`
+}
+
+// NotificationPage is one page of a user's notifications, newest first.
+type NotificationPage struct {
+	Notifications []Notification `json:"notifications"`
+	NextCursor    string         `json:"next_cursor,omitempty"` // empty on the last page
+	Unread        int            `json:"unread"`
+}
+
+// addNotification stores a notification for recipient unless it is the
+// actor or an identical one is still unread.
+func addNotification(tx *sql.Tx, recipient, kind, actor, targetType string, targetID int64) error {
+	if recipient == "" || recipient == actor {
+		return nil
+	}
+	_, err := tx.Exec(`INSERT OR IGNORE INTO notifications (user_uuid, kind, actor_uuid, target_type, target_id, created_at)
+        VALUES (?, ?, ?, ?, ?, ?)`, recipient, kind, actor, targetType, targetID, time.Now())
+	return err
+}
+
+// notifyOfflineMessage stores a message notification for the receiver of a
+// private message.
+func notifyOfflineMessage(db *sql.DB, messageUUID string) error {
+	_, err := db.Exec(`INSERT OR IGNORE INTO notifications (user_uuid, kind, actor_uuid, target_type, target_id, created_at)
+        SELECT receiver_uuid, ?, sender_uuid, ?, id, created_at
+        FROM private_messages
+        WHERE uuid = ? AND receiver_uuid != sender_uuid`, NotifyMessage, TargetMessage, messageUUID)
+	return err
+}
+
+const notificationSelect = `
+        SELECT x.id, x.kind, x.actor_uuid, u.nickname, x.target_type, x.created_at, x.read_at IS NOT NULL,` + targetLocationColumns + `
+        FROM notifications x
+        JOIN users u ON u.uuid = x.actor_uuid` + targetLocationJoins
+
+func scanNotifications(rows *sql.Rows) ([]Notification, error) {
+	defer rows.Close()
+	notifications := []Notification{}
+	for rows.Next() {
+		var n Notification
+		var content string
+		dest := append([]interface{}{&n.ID, &n.Kind, &n.Actor, &n.ActorNickname, &n.TargetType, &n.CreatedAt, &n.Read},
+			n.TargetLocation.scanDest(&content)...)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		n.Excerpt = excerpt(content, mentionExcerptLen)
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+// ListNotifications returns a page of the user's notifications. cursor is
+// the next_cursor of the previous page, 0 for the first.
+func ListNotifications(db *sql.DB, userUUID string, unreadOnly bool, cursor int64, limit int) (NotificationPage, error) {
+	where := ` WHERE x.user_uuid = ? AND ` + targetLocationLive
+	args := []interface{}{userUUID}
+	if unreadOnly {
+		where += ` AND x.read_at IS NULL`
+	}
+	if cursor > 0 {
+		where += ` AND x.id < ?`
+		args = append(args, cursor)
+	}
+	rows, err := db.Query(notificationSelect+where+` ORDER BY x.id DESC LIMIT ?`, append(args, limit+1)...)
+	if err != nil {
+		return NotificationPage{}, err
+	}
+	page := NotificationPage{}
+	if page.Notifications, err = scanNotifications(rows); err != nil {
+		return page, err
+	}
+	if len(page.Notifications) > limit {
+		page.Notifications = page.Notifications[:limit]
+		page.NextCursor = strconv.FormatInt(page.Notifications[limit-1].ID, 10)
+	}
+	page.Unread, err = CountUnreadNotifications(db, userUUID)
+	return page, err
+}
+
+func CountUnreadNotifications(db *sql.DB, userUUID string) (int, error) {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM notifications x`+targetLocationJoins+`
+        WHERE x.user_uuid = ? AND x.read_at IS NULL AND `+targetLocationLive, userUUID).Scan(&n)
+	return n, err
+}
+
+// MarkNotificationsRead marks the given notifications of the user read, or
+// all of them when ids is empty.
+func MarkNotificationsRead(db *sql.DB, userUUID string, ids []int64) error {
+	query := `UPDATE notifications SET read_at = ? WHERE user_uuid = ? AND read_at IS NULL`
+	args := []interface{}{time.Now(), userUUID}
+	if len(ids) > 0 {
+		query += ` AND id IN (` + strings.Repeat("?,", len(ids)-1) + `?)`
+		args = append(args, toInterfaceSlice(ids)...)
+	}
+	_, err := db.Exec(query, args...)
+	return err
+}
+
+// LoadUndeliveredNotifications returns the user's notifications not yet
+// pushed to any connection, oldest first.
+func LoadUndeliveredNotifications(db *sql.DB, userUUID string) ([]Notification, error) {
+	rows, err := db.Query(notificationSelect+`
+        WHERE x.user_uuid = ? AND x.delivered_at IS NULL AND x.read_at IS NULL AND `+targetLocationLive+`
+        ORDER BY x.id
+        LIMIT ?`, userUUID, notificationReplayLimit)
+	if err != nil {
+		return nil, err
+	}
+	return scanNotifications(rows)
+}
+
+func MarkNotificationsDelivered(db *sql.DB, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := db.Exec(`UPDATE notifications SET delivered_at = ?
+        WHERE id IN (`+strings.Repeat("?,", len(ids)-1)+`?)`, append([]interface{}{time.Now()}, toInterfaceSlice(ids)...)...)
+	return err
+}
+
+// notifyTarget pushes the notifications just stored about a target to the
+// users they are for.
+func notifyTarget(hub *Hub, targetType string, targetID int64) {
+	rows, err := hub.db.Query(`SELECT DISTINCT user_uuid FROM notifications
+        WHERE target_type = ? AND target_id = ? AND delivered_at IS NULL`, targetType, targetID)
+	if err != nil {
+		log.Printf("Error loading notifications for %s %d: %v", targetType, targetID, err)
+		return
+	}
+	var users []string
+	for rows.Next() {
+		var userUUID string
+		if err := rows.Scan(&userUUID); err != nil {
+			log.Printf("Error loading notifications for %s %d: %v", targetType, targetID, err)
+			break
+		}
+		users = append(users, userUUID)
+	}
+	rows.Close()
+
+	for _, userUUID := range users {
+		hub.DeliverNotifications(userUUID)
+	}
+}
+
+// targetIDQueries find the id of a target from its uuid.
+var targetIDQueries = map[string]string{
+	TargetPost:        `SELECT id FROM posts WHERE post_uuid = ?`,
+	TargetMessage:     `SELECT id FROM private_messages WHERE uuid = ?`,
+	TargetRoomMessage: `SELECT id FROM conversation_messages WHERE uuid = ?`,
+}
+
+// notifyTargetUUID is notifyTarget for a target known by its uuid.
+func notifyTargetUUID(hub *Hub, targetType, targetUUID string) {
+	var targetID int64
+	if err := hub.db.QueryRow(targetIDQueries[targetType], targetUUID).Scan(&targetID); err != nil {
+		log.Printf("Error resolving %s %s: %v", targetType, targetUUID, err)
+		return
+	}
+	notifyTarget(hub, targetType, targetID)
+}
+
+// NotificationsHandler: GET /notifications?unread=true&cursor=&limit=
+func NotificationsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		v := r.URL.Query()
+		unreadOnly, _ := strconv.ParseBool(v.Get("unread"))
+		var cursor int64
+		if c := v.Get("cursor"); c != "" {
+			n, err := strconv.ParseInt(c, 10, 64)
+			if err != nil || n < 1 {
+				http.Error(w, "invalid cursor", http.StatusBadRequest)
+				return
+			}
+			cursor = n
+		}
+		limit := defaultNotificationPageSize
+		if limitStr := v.Get("limit"); limitStr != "" {
+			n, err := strconv.Atoi(limitStr)
+			if err != nil || n < 1 {
+				http.Error(w, "'limit' must be a positive number", http.StatusBadRequest)
+				return
+			}
+			limit = min(n, maxNotificationPageSize)
+		}
+
+		page, err := ListNotifications(db, userUUID, unreadOnly, cursor, limit)
+		if err != nil {
+			log.Printf("Error listing notifications: %v", err)
+			http.Error(w, "Failed to load notifications", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	}
+}
+
+type MarkNotificationsReadRequest struct {
+	IDs []int64 `json:"ids"` // empty marks everything read
+}
+
+// MarkNotificationsReadHandler: POST /notifications/read {ids}
+// The user's other tabs are told with a notifications_read frame.
+func MarkNotificationsReadHandler(db *sql.DB, hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req MarkNotificationsReadRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if err := MarkNotificationsRead(db, userUUID, req.IDs); err != nil {
+			log.Printf("Error marking notifications read: %v", err)
+			http.Error(w, "Failed to mark notifications read", http.StatusInternalServerError)
+			return
+		}
+		unread, err := CountUnreadNotifications(db, userUUID)
+		if err != nil {
+			log.Printf("Error counting notifications: %v", err)
+			http.Error(w, "Failed to mark notifications read", http.StatusInternalServerError)
+			return
+		}
+
+		p := NotificationsReadPayload{IDs: req.IDs, Unread: unread}
+		hub.SendToUser(userUUID, NewFrame(FrameNotificationsRead, "", p, nil))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// WebSocket protocol
+//
+// Clients that offer the "forum.v2" subprotocol in Sec-WebSocket-Protocol
+// speak protocol version 2: every frame in both directions is an Envelope
+//
+//	{"v": 2, "type": "<frame type>", "id": "<optional>", "payload": {...}}
+//
+// Inbound (client -> server) types:
+//
+//	chat_message    {to | room, content, attachments}   id is a client-generated message id;
+//	                attachments are uuids from POST /attachments, and with any,
+//	                content may be empty
+//	typing_start    {to | room}
+//	typing_stop     {to | room}
+//	resume          {last_seq}        see Missed messages below
+//	mark_read       {with, up_to}     up_to is a message uuid; omit it to mark everything
+//	edit_message    {uuid, content}   sender only, within MESSAGE_EDIT_WINDOW of sending
+//	delete_message  {uuid}            sender only, within MESSAGE_EDIT_WINDOW of sending
+//	view_post       {post_uuid}       the post open in this tab; omit post_uuid when it closes
+//	subscribe       {topic}           posts, category:<slug> or post:<uuid>, see subscriptions.go
+//	unsubscribe     {topic}
+//
+// Outbound (server -> client) types:
+//
+//	chat_message     MessageBroadcast
+//	room_message     MessageBroadcast with room set (version 2 only)
+//	room_membership  {room, user_uuid, action, actor_uuid}   action is invited, kicked, joined, left or promoted
+//	ack              {message_uuid, sent_at, seq}   id echoes the inbound id
+//	error            {code, message}                id echoes the inbound id, if any
+//	user_list        {users}
+//	user_registered  {user}
+//	typing_start     TypingMessage   room typing is version 2 only
+//	typing_stop      TypingMessage
+//	force_logout     no payload                     the session ended: logout, revocation or password reset
+//	resumed          {last_seq, replayed}
+//	resync           {last_seq}
+//	read_receipt     {reader_uuid, with, up_to, read_at, count}
+//	message_edited   {uuid, from, to, content, content_html, changed_at}   to both participants
+//	message_deleted  {uuid, from, to, changed_at}
+//	reaction_updated {post_uuid, target, comment_id, likes, dislikes}   to connections viewing the post
+//	post_created     Post                           to subscribers of posts or one of its categories
+//	comment_created  {post_uuid, comment}           to connections viewing or subscribed to the post
+//	notification     Notification                   to all of the user's connections; sent on connect if they were offline
+//	notifications_read {ids, unread}                after POST /notifications/read; no ids means all
+//
+// # Missed messages
+//
+// Every chat_message carries "seq", its position in the receiving user's
+// message log. Sequence numbers are per user, start at 1 and have no gaps.
+// On connect a client sends resume with the last seq it applied; the server
+// replays every newer message as chat_message frames, then answers resumed.
+// If more than the replay cap is missing, it answers resync instead and the
+// client should refetch history over HTTP. A client with no history yet sends
+// resume with no last_seq to learn the current position. Version 2 clients do
+// not receive live chat messages until they resume (or a short grace period
+// passes), so replayed and live frames never interleave. Clients should
+// ignore any chat_message whose seq is not above the last one applied.
+//
+// Clients that offer no subprotocol get version 1, the original unwrapped
+// frames: chat messages are bare MessageBroadcast objects and everything else
+// carries a top-level "type". Version 1 clients never receive ack or error.
+const (
+	ProtocolV1 = 1
+	ProtocolV2 = 2
+
+	SubprotocolV2 = "forum.v2"
+)
+
+const (
+	FrameChatMessage       = "chat_message"
+	FrameAck               = "ack"
+	FrameError             = "error"
+	FrameUserList          = "user_list"
+	FrameUserRegistered    = "user_registered"
+	FrameTypingStart       = "typing_start"
+	FrameTypingStop        = "typing_stop"
+	FrameForceLogout       = "force_logout"
+	FrameResume            = "resume"
+	FrameResumed           = "resumed"
+	FrameResync            = "resync"
+	FrameMarkRead          = "mark_read"
+	FrameReadReceipt       = "read_receipt"
+	FrameRoomMessage       = "room_message"
+	FrameRoomMembership    = "room_membership"
+	FrameEditMessage       = "edit_message"
+	FrameDeleteMessage     = "delete_message"
+	FrameMessageEdited     = "message_edited"
+	FrameMessageDeleted    = "message_deleted"
+	FrameViewPost          = "view_post"
+	FrameReactionUpdated   = "reaction_updated"
+	FrameSubscribe         = "subscribe"
+	FrameUnsubscribe       = "unsubscribe"
+	FramePostCreated       = "post_created"
+	FrameCommentCreated    = "comment_created"
+	FrameNotification      = "notification"
+	FrameNotificationsRead = "notifications_read"
+)
+
+const (
+	RoomActionInvited  = "invited"
+	RoomActionKicked   = "kicked"
+	RoomActionJoined   = "joined"
+	RoomActionLeft     = "left"
+	RoomActionPromoted = "promoted" // made owner when the owner left
+)
+
+type Envelope struct {
+	V       int             `json:"v"`
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type ChatPayload struct {
+	To          string   `json:"to"`
+	Room        string   `json:"room"`
+	Content     string   `json:"content"`
+	Attachments []string `json:"attachments"` // uuids from POST /attachments
+}
+
+type TypingPayload struct {
+	To   string `json:"to"`
+	Room string `json:"room"`
+}
+
+type RoomMembershipPayload struct {
+	Room   string `json:"room"`
+	User   string `json:"user_uuid"`
+	Action string `json:"action"`
+	Actor  string `json:"actor_uuid"`
+}
+
+type AckPayload struct {
+	MessageUUID string `json:"message_uuid"`
+	SentAt      string `json:"sent_at"`
+	Seq         int64  `json:"seq"` // position in the sender's message log
+}
+
+type ResumePayload struct {
+	LastSeq *int64 `json:"last_seq"`
+}
+
+type ResumedPayload struct {
+	LastSeq  int64 `json:"last_seq"`
+	Replayed int   `json:"replayed"`
+}
+
+type ResyncPayload struct {
+	LastSeq int64 `json:"last_seq"`
+}
+
+type MarkReadPayload struct {
+	With string `json:"with"`
+	UpTo string `json:"up_to"`
+}
+
+type EditMessagePayload struct {
+	UUID    string `json:"uuid"`
+	Content string `json:"content"`
+}
+
+type DeleteMessagePayload struct {
+	UUID string `json:"uuid"`
+}
+
+type ViewPostPayload struct {
+	PostUUID string `json:"post_uuid"`
+}
+
+type SubscribePayload struct {
+	Topic string `json:"topic"`
+}
+
+type CommentCreatedPayload struct {
+	PostUUID string  `json:"post_uuid"`
+	Comment  Comment `json:"comment"`
+}
+
+// ReadReceiptPayload says Reader has read With's messages up to UpTo.
+type ReadReceiptPayload struct {
+	Reader string `json:"reader_uuid"`
+	With   string `json:"with"`
+	UpTo   string `json:"up_to,omitempty"`
+	ReadAt string `json:"read_at"`
+	Count  int64  `json:"count"`
+}
+
+type NotificationsReadPayload struct {
+	IDs    []int64 `json:"ids,omitempty"` // empty when everything was marked read
+	Unread int     `json:"unread"`
+}
+
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Frame is an outbound event encoded once for each protocol version.
+type Frame struct {
+	v1  []byte // nil when the frame has no version 1 form
+	v2  []byte
+	seq int64 // message log position for chat messages, 0 otherwise
+}
+
+// NewFrame builds a frame. legacy is the version 1 body, or nil if version 1
+// clients should not receive this frame.
+func NewFrame(frameType, id string, payload, legacy interface{}) *Frame {
+	f := &Frame{}
+
+	env := Envelope{V: ProtocolV2, Type: frameType, ID: id}
+	if payload != nil {
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			log.Printf("Error marshaling %s payload: %v", frameType, err)
+			return f
+		}
+		env.Payload = raw
+	}
+	v2, err := json.Marshal(env)
+	if err != nil {
+		log.Printf("Error marshaling %s envelope: %v", frameType, err)
+		return f
+	}
+	f.v2 = v2
+
+	if legacy != nil {
+		v1, err := json.Marshal(legacy)
+		if err != nil {
+			log.Printf("Error marshaling legacy %s frame: %v", frameType, err)
+			return f
+		}
+		f.v1 = v1
+	}
+	return f
+}
+
+// Bytes returns the encoding for the given protocol version, or nil.
+func (f *Frame) Bytes(version int) []byte {
+	if version >= ProtocolV2 {
+		return f.v2
+	}
+	return f.v1
+}
+
+func ackFrame(id string, payload AckPayload) *Frame {
+	return NewFrame(FrameAck, id, payload, nil)
+}
+
+func errorFrame(id, code, message string) *Frame {
+	return NewFrame(FrameError, id, ErrorPayload{Code: code, Message: message}, nil)
+}
+
+func chatFrame(msg MessageBroadcast) *Frame {
+	f := NewFrame(FrameChatMessage, "", msg, msg)
+	f.seq = msg.Seq
+	return f
+}
+
+func resumedFrame(id string, p ResumedPayload) *Frame {
+	return NewFrame(FrameResumed, id, p, map[string]interface{}{"type": FrameResumed, "last_seq": p.LastSeq, "replayed": p.Replayed})
+}
+
+func resyncFrame(id string, p ResyncPayload) *Frame {
+	return NewFrame(FrameResync, id, p, map[string]interface{}{"type": FrameResync, "last_seq": p.LastSeq})
+}
+
+// Version 1 clients render any frame they do not recognise as a chat
+// message, so events added after version 1 are not sent to them.
+func readReceiptFrame(p ReadReceiptPayload) *Frame {
+	return NewFrame(FrameReadReceipt, "", p, nil)
+}
+
+func forceLogoutFrame() *Frame {
+	return NewFrame(FrameForceLogout, "", nil, map[string]string{"type": FrameForceLogout})
+}
+
+func notificationFrame(n Notification) *Frame {
+	return NewFrame(FrameNotification, "", n, nil)
+}
+
+func roomMessageFrame(msg MessageBroadcast) *Frame {
+	return NewFrame(FrameRoomMessage, "", msg, nil)
+}
+
+func roomMembershipFrame(p RoomMembershipPayload) *Frame {
+	return NewFrame(FrameRoomMembership, "", p, nil)
+}
+
+func typingFrame(msg TypingMessage) *Frame {
+	if msg.Room != "" {
+		return NewFrame(msg.Type, "", msg, nil)
+	}
+	return NewFrame(msg.Type, "", msg, msg)
+}
+
+// inboundFrame is a client frame after version-specific decoding.
+type inboundFrame struct {
+	Type    string
+	ID      string
+	Payload json.RawMessage
+}
+
+// decodeInbound normalises a raw client frame. Version 1 frames are sniffed
+// for a "type" field; anything without one is a chat message.
+func decodeInbound(version int, raw []byte) (inboundFrame, error) {
+	if version >= ProtocolV2 {
+		var env Envelope
+		if err := json.Unmarshal(raw, &env); err != nil {
+			return inboundFrame{}, err
+		}
+		return inboundFrame{Type: env.Type, ID: env.ID, Payload: env.Payload}, nil
+	}
+
+	var base struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(raw, &base); err != nil {
+		return inboundFrame{}, err
+	}
+	if base.Type == "" {
+		base.Type = FrameChatMessage
+	}
+	return inboundFrame{Type: base.Type, Payload: raw}, nil
+}
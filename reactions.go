@@ -0,0 +1,215 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	TargetPost    = "post"
+	TargetComment = "comment"
+
+	VoteLike    = "like"
+	VoteDislike = "dislike"
+)
+
+var ErrTargetNotFound = errors.New("post or comment not found")
+
+// Reactions are the like/dislike totals of a post or comment, plus the vote
+// of the user the response is for.
+type Reactions struct {
+	Likes    int `json:"likes"`
+	Dislikes int `json:"dislikes"`
+	MyVote   int `json:"my_vote"` // 1 liked, -1 disliked, 0 neither
+}
+
+// ReactionUpdatedPayload is pushed to everyone viewing the post. It carries
+// no my_vote because that differs per viewer.
+type ReactionUpdatedPayload struct {
+	PostUUID  string `json:"post_uuid"`
+	Target    string `json:"target"`               // post or comment
+	CommentID int64  `json:"comment_id,omitempty"` // set when target is comment
+	Likes     int    `json:"likes"`
+	Dislikes  int    `json:"dislikes"`
+}
+
+// resolveTarget finds the likes_dislikes target id of a post (by uuid) or a
+// comment (by id), and the uuid of the post it belongs to.
+func resolveTarget(db *sql.DB, targetType, postUUID string, commentID int64) (targetID int64, ownerPost string, err error) {
+	switch targetType {
+	case TargetPost:
+		err = db.QueryRow(`SELECT id, post_uuid FROM posts WHERE post_uuid = ? AND deleted_at IS NULL`, postUUID).Scan(&targetID, &ownerPost)
+	case TargetComment:
+		err = db.QueryRow(`SELECT c.id, p.post_uuid FROM comments c JOIN posts p ON p.id = c.post_id
+            WHERE c.id = ? AND c.deleted_at IS NULL AND p.deleted_at IS NULL`, commentID).Scan(&targetID, &ownerPost)
+	default:
+		return 0, "", ErrTargetNotFound
+	}
+	if err == sql.ErrNoRows {
+		return 0, "", ErrTargetNotFound
+	}
+	return targetID, ownerPost, err
+}
+
+// ToggleReaction applies a like or dislike. Repeating the current vote
+// removes it; the opposite vote replaces it.
+func ToggleReaction(db *sql.DB, userUUID, targetType string, targetID int64, like bool) (Reactions, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return Reactions{}, err
+	}
+	defer tx.Rollback()
+
+	var current bool
+	err = tx.QueryRow(`SELECT is_like FROM likes_dislikes WHERE user_uuid = ? AND target_type = ? AND target_id = ?`,
+		userUUID, targetType, targetID).Scan(&current)
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = tx.Exec(`INSERT INTO likes_dislikes (user_uuid, target_type, target_id, is_like) VALUES (?, ?, ?, ?)`,
+			userUUID, targetType, targetID, like)
+	case err != nil:
+		return Reactions{}, err
+	case current == like:
+		_, err = tx.Exec(`DELETE FROM likes_dislikes WHERE user_uuid = ? AND target_type = ? AND target_id = ?`,
+			userUUID, targetType, targetID)
+	default:
+		_, err = tx.Exec(`UPDATE likes_dislikes SET is_like = ?, created_at = CURRENT_TIMESTAMP
+            WHERE user_uuid = ? AND target_type = ? AND target_id = ?`, like, userUUID, targetType, targetID)
+	}
+	if err != nil {
+		return Reactions{}, err
+	}
+	if err := notifyReaction(tx, userUUID, targetType, targetID); err != nil {
+		return Reactions{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Reactions{}, err
+	}
+
+	counts, err := LoadReactions(db, targetType, []int64{targetID}, userUUID)
+	if err != nil {
+		return Reactions{}, err
+	}
+	return counts[targetID], nil
+}
+
+// notifyReaction tells the author of a post or comment about a vote the
+// user now has on it. Removing a vote notifies nobody.
+func notifyReaction(tx *sql.Tx, userUUID, targetType string, targetID int64) error {
+	table := "posts"
+	if targetType == TargetComment {
+		table = "comments"
+	}
+	var author string
+	err := tx.QueryRow(`SELECT user_uuid FROM `+table+` WHERE id = ? AND EXISTS (
+            SELECT 1 FROM likes_dislikes WHERE user_uuid = ? AND target_type = ? AND target_id = ?)`,
+		targetID, userUUID, targetType, targetID).Scan(&author)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return addNotification(tx, author, NotifyReaction, userUUID, targetType, targetID)
+}
+
+// LoadReactions returns reactions for several targets of one type, keyed by
+// target id. Targets nobody reacted to are missing from the map, which reads
+// as the zero Reactions.
+func LoadReactions(db *sql.DB, targetType string, targetIDs []int64, viewerUUID string) (map[int64]Reactions, error) {
+	reactions := make(map[int64]Reactions, len(targetIDs))
+	if len(targetIDs) == 0 {
+		return reactions, nil
+	}
+
+	args := append([]interface{}{viewerUUID, targetType}, toInterfaceSlice(targetIDs)...)
+	rows, err := db.Query(`
+        SELECT target_id,
+               SUM(CASE WHEN is_like THEN 1 ELSE 0 END),
+               SUM(CASE WHEN is_like THEN 0 ELSE 1 END),
+               COALESCE(MAX(CASE WHEN user_uuid = ? THEN CASE WHEN is_like THEN 1 ELSE -1 END END), 0)
+        FROM likes_dislikes
+        WHERE target_type = ? AND target_id IN (`+strings.Repeat("?,", len(targetIDs)-1)+`?)
+        GROUP BY target_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var r Reactions
+		if err := rows.Scan(&id, &r.Likes, &r.Dislikes, &r.MyVote); err != nil {
+			return nil, err
+		}
+		reactions[id] = r
+	}
+	return reactions, rows.Err()
+}
+
+type ReactionRequest struct {
+	PostUUID  string `json:"post_uuid"`  // for posts
+	CommentID int64  `json:"comment_id"` // for comments
+	Vote      string `json:"vote"`       // like or dislike
+}
+
+// PostReactionHandler: POST /post/reaction {post_uuid, vote}
+func PostReactionHandler(db *sql.DB, hub *Hub) http.HandlerFunc {
+	return reactionHandler(db, hub, TargetPost)
+}
+
+// CommentReactionHandler: POST /comment/reaction {comment_id, vote}
+func CommentReactionHandler(db *sql.DB, hub *Hub) http.HandlerFunc {
+	return reactionHandler(db, hub, TargetComment)
+}
+
+func reactionHandler(db *sql.DB, hub *Hub, targetType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req ReactionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if req.Vote != VoteLike && req.Vote != VoteDislike {
+			http.Error(w, "vote must be like or dislike", http.StatusBadRequest)
+			return
+		}
+
+		targetID, postUUID, err := resolveTarget(db, targetType, req.PostUUID, req.CommentID)
+		if err == ErrTargetNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("Error resolving %s reaction target: %v", targetType, err)
+			http.Error(w, "Failed to save reaction", http.StatusInternalServerError)
+			return
+		}
+
+		reactions, err := ToggleReaction(db, userUUID, targetType, targetID, req.Vote == VoteLike)
+		if err != nil {
+			log.Printf("Error saving %s reaction: %v", targetType, err)
+			http.Error(w, "Failed to save reaction", http.StatusInternalServerError)
+			return
+		}
+
+		update := ReactionUpdatedPayload{PostUUID: postUUID, Target: targetType, Likes: reactions.Likes, Dislikes: reactions.Dislikes}
+		if targetType == TargetComment {
+			update.CommentID = targetID
+		}
+		hub.SendToPostViewers(postUUID, NewFrame(FrameReactionUpdated, "", update, nil))
+		notifyTarget(hub, targetType, targetID)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reactions)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestToggleReaction(t *testing.T) {
+	tests := []struct {
+		name  string
+		votes []bool // bob's votes in order, true for like
+		want  Reactions
+	}{
+		{"like", []bool{true}, Reactions{Likes: 2, MyVote: 1}},
+		{"dislike", []bool{false}, Reactions{Likes: 1, Dislikes: 1, MyVote: -1}},
+		{"like twice removes it", []bool{true, true}, Reactions{Likes: 1}},
+		{"dislike replaces like", []bool{true, false}, Reactions{Likes: 1, Dislikes: 1, MyVote: -1}},
+		{"like replaces dislike", []bool{false, true}, Reactions{Likes: 2, MyVote: 1}},
+		{"like, remove, like", []bool{true, true, true}, Reactions{Likes: 2, MyVote: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			alice, bob, carol := createTestUser(t, db, "alice"), createTestUser(t, db, "bob"), createTestUser(t, db, "carol")
+			postUUID := uuid.New().String()
+			if err := InsertPost(db, postUUID, alice, "Title", "body", nil, nil, time.Now()); err != nil {
+				t.Fatal(err)
+			}
+			postID, _, err := resolveTarget(db, TargetPost, postUUID, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Carol's like is there throughout.
+			if _, err := ToggleReaction(db, carol, TargetPost, postID, true); err != nil {
+				t.Fatal(err)
+			}
+
+			var got Reactions
+			for _, like := range tt.votes {
+				if got, err = ToggleReaction(db, bob, TargetPost, postID, like); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			// Others see the totals without bob's vote.
+			seen, _ := LoadReactions(db, TargetPost, []int64{postID}, carol)
+			if r := seen[postID]; r.Likes != tt.want.Likes || r.Dislikes != tt.want.Dislikes || r.MyVote != 1 {
+				t.Errorf("carol sees %+v", r)
+			}
+
+			// However often bob's vote changes, alice has at most one
+			// unread notification about it.
+			var notified int
+			db.QueryRow(`SELECT COUNT(*) FROM notifications WHERE user_uuid = ? AND actor_uuid = ? AND kind = ?`,
+				alice, bob, NotifyReaction).Scan(&notified)
+			if notified != 1 {
+				t.Errorf("alice has %d reaction notifications from bob, want 1", notified)
+			}
+		})
+	}
+}
+
+func TestReactionTargets(t *testing.T) {
+	db := newTestDB(t)
+	alice := createTestUser(t, db, "alice")
+	now := time.Now()
+	live, deleted := uuid.New().String(), uuid.New().String()
+	for _, postUUID := range []string{live, deleted} {
+		if err := InsertPost(db, postUUID, alice, "Title", "body", nil, nil, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	comment, _, err := InsertComment(db, alice, live, "", "comment", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphan, _, err := InsertComment(db, alice, deleted, "", "comment", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DeletePost(db, deleted, alice, now); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		target    string
+		postUUID  string
+		commentID int64
+		ok        bool
+	}{
+		{"post", TargetPost, live, 0, true},
+		{"comment", TargetComment, "", comment, true},
+		{"deleted post", TargetPost, deleted, 0, false},
+		{"comment on a deleted post", TargetComment, "", orphan, false},
+		{"unknown target type", "message", live, 0, false},
+	}
+	for _, tt := range tests {
+		_, owner, err := resolveTarget(db, tt.target, tt.postUUID, tt.commentID)
+		if tt.ok && (err != nil || owner != live) {
+			t.Errorf("%s: got %q, %v", tt.name, owner, err)
+		}
+		if !tt.ok && err != ErrTargetNotFound {
+			t.Errorf("%s: got %v, want ErrTargetNotFound", tt.name, err)
+		}
+	}
+
+	// Voting on your own post notifies nobody.
+	postID, _, _ := resolveTarget(db, TargetPost, live, 0)
+	if _, err := ToggleReaction(db, alice, TargetPost, postID, true); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	db.QueryRow(`SELECT COUNT(*) FROM notifications`).Scan(&n)
+	if n != 0 {
+		t.Errorf("%d notifications for a vote on one's own post", n)
+	}
+}
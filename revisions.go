@@ -0,0 +1,509 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Posts and comments can be edited or deleted by their author or by a
+// moderator. Every change stores the previous version in content_revisions;
+// deletion is soft, so comment threads keep their shape.
+
+const (
+	RevisionEdit   = "edit"
+	RevisionDelete = "delete"
+)
+
+var (
+	ErrPostNotFound    = errors.New("post not found")
+	ErrCommentNotFound = errors.New("comment not found")
+	ErrNotAuthor       = errors.New("only the author or a moderator can change this")
+)
+
+type Revision struct {
+	ID         int64     `json:"id"`
+	Target     string    `json:"target"`               // post or comment
+	CommentID  int64     `json:"comment_id,omitempty"` // set when target is comment
+	EditorUUID string    `json:"editor_uuid"`
+	Editor     string    `json:"editor"` // nickname
+	Action     string    `json:"action"` // edit or delete
+	OldTitle   string    `json:"old_title,omitempty"`
+	OldContent string    `json:"old_content"`
+	Diff       string    `json:"diff"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// authorizeChange allows the author and moderators.
+func authorizeChange(db *sql.DB, editorUUID, authorUUID string) error {
+	if editorUUID == authorUUID {
+		return nil
+	}
+	role, err := GetUserRole(db, editorUUID)
+	if err != nil {
+		return err
+	}
+	if !canModerate(role) {
+		return ErrNotAuthor
+	}
+	return nil
+}
+
+// postText is what a post revision diffs: the title on the first line, then
+// the body.
+func postText(title, content string) string {
+	return title + "\n" + content
+}
+
+// lineDiff returns a line-by-line diff of two texts. Unchanged lines start
+// with two spaces, removed lines with "- " and added lines with "+ ".
+func lineDiff(oldText, newText string) string {
+	a, b := splitLines(oldText), splitLines(newText)
+
+	// Longest common subsequence, filled from the end so the walk below can
+	// go forwards. Very long texts skip it and show a full replacement.
+	var out strings.Builder
+	if len(a)*len(b) > 1_000_000 {
+		for _, l := range a {
+			out.WriteString("- " + l + "\n")
+		}
+		for _, l := range b {
+			out.WriteString("+ " + l + "\n")
+		}
+		return out.String()
+	}
+
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			out.WriteString("  " + a[i] + "\n")
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			out.WriteString("- " + a[i] + "\n")
+			i++
+		default:
+			out.WriteString("+ " + b[j] + "\n")
+			j++
+		}
+	}
+	return out.String()
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+func insertRevision(tx *sql.Tx, targetType string, targetID int64, editorUUID, action string, oldTitle sql.NullString, oldContent, diff string, at time.Time) error {
+	_, err := tx.Exec(`INSERT INTO content_revisions
+        (target_type, target_id, editor_uuid, action, old_title, old_content, diff, created_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		targetType, targetID, editorUUID, action, oldTitle, oldContent, diff, at)
+	return err
+}
+
+type postForChange struct {
+	id      int64
+	author  string
+	title   string
+	content string
+}
+
+func loadPostForChange(db *sql.DB, postUUID string) (*postForChange, error) {
+	var p postForChange
+	err := db.QueryRow(`SELECT id, user_uuid, title, content FROM posts WHERE post_uuid = ? AND deleted_at IS NULL`,
+		postUUID).Scan(&p.id, &p.author, &p.title, &p.content)
+	if err == sql.ErrNoRows {
+		return nil, ErrPostNotFound
+	}
+	return &p, err
+}
+
+// EditPost replaces a post's title and body.
+func EditPost(db *sql.DB, postUUID, editorUUID, title, content string, now time.Time) error {
+	p, err := loadPostForChange(db, postUUID)
+	if err != nil {
+		return err
+	}
+	if err := authorizeChange(db, editorUUID, p.author); err != nil {
+		return err
+	}
+
+	if title == p.title && content == p.content {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	diff := lineDiff(postText(p.title, p.content), postText(title, content))
+	if err := insertRevision(tx, TargetPost, p.id, editorUUID, RevisionEdit, sql.NullString{String: p.title, Valid: true}, p.content, diff, now); err != nil {
+		return err
+	}
+	// The deleted_at check guards against a deletion since loadPostForChange.
+	res, err := tx.Exec(`UPDATE posts SET title = ?, content = ?, edited_at = ? WHERE id = ? AND deleted_at IS NULL`,
+		title, content, now, p.id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrPostNotFound
+	}
+	return tx.Commit()
+}
+
+// DeletePost clears a post and hides it from the feed. Its previous text
+// stays in content_revisions.
+func DeletePost(db *sql.DB, postUUID, editorUUID string, now time.Time) error {
+	p, err := loadPostForChange(db, postUUID)
+	if err != nil {
+		return err
+	}
+	if err := authorizeChange(db, editorUUID, p.author); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	diff := lineDiff(postText(p.title, p.content), "")
+	if err := insertRevision(tx, TargetPost, p.id, editorUUID, RevisionDelete, sql.NullString{String: p.title, Valid: true}, p.content, diff, now); err != nil {
+		return err
+	}
+	res, err := tx.Exec(`UPDATE posts SET title = '', content = '', deleted_at = ? WHERE id = ? AND deleted_at IS NULL`, now, p.id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrPostNotFound
+	}
+	return tx.Commit()
+}
+
+type commentForChange struct {
+	author  string
+	content string
+}
+
+func loadCommentForChange(db *sql.DB, commentID int64) (*commentForChange, error) {
+	var c commentForChange
+	err := db.QueryRow(`SELECT c.user_uuid, c.content FROM comments c
+        JOIN posts p ON p.id = c.post_id
+        WHERE c.id = ? AND c.deleted_at IS NULL AND p.deleted_at IS NULL`, commentID).Scan(&c.author, &c.content)
+	if err == sql.ErrNoRows {
+		return nil, ErrCommentNotFound
+	}
+	return &c, err
+}
+
+// EditComment replaces a comment's text.
+func EditComment(db *sql.DB, commentID int64, editorUUID, content string, now time.Time) error {
+	c, err := loadCommentForChange(db, commentID)
+	if err != nil {
+		return err
+	}
+	if err := authorizeChange(db, editorUUID, c.author); err != nil {
+		return err
+	}
+
+	if content == c.content {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertRevision(tx, TargetComment, commentID, editorUUID, RevisionEdit, sql.NullString{}, c.content, lineDiff(c.content, content), now); err != nil {
+		return err
+	}
+	res, err := tx.Exec(`UPDATE comments SET content = ?, edited_at = ? WHERE id = ? AND deleted_at IS NULL`, content, now, commentID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrCommentNotFound
+	}
+	return tx.Commit()
+}
+
+// DeleteComment clears a comment but leaves it in place as a tombstone.
+func DeleteComment(db *sql.DB, commentID int64, editorUUID string, now time.Time) error {
+	c, err := loadCommentForChange(db, commentID)
+	if err != nil {
+		return err
+	}
+	if err := authorizeChange(db, editorUUID, c.author); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertRevision(tx, TargetComment, commentID, editorUUID, RevisionDelete, sql.NullString{}, c.content, lineDiff(c.content, ""), now); err != nil {
+		return err
+	}
+	res, err := tx.Exec(`UPDATE comments SET content = '', deleted_at = ? WHERE id = ? AND deleted_at IS NULL`, now, commentID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrCommentNotFound
+	}
+	return tx.Commit()
+}
+
+// LoadPostRevisions returns the revisions of a post, or of one of its
+// comments when commentID is set, oldest first. Revisions of deleted content
+// are only shown to moderators.
+func LoadPostRevisions(db *sql.DB, postUUID string, commentID int64, viewerUUID string) ([]Revision, error) {
+	var postID int64
+	var postDeleted, commentDeleted sql.NullTime
+	err := db.QueryRow(`SELECT id, deleted_at FROM posts WHERE post_uuid = ?`, postUUID).Scan(&postID, &postDeleted)
+	if err == sql.ErrNoRows {
+		return nil, ErrPostNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	targetType, targetID := TargetPost, postID
+	if commentID != 0 {
+		err := db.QueryRow(`SELECT deleted_at FROM comments WHERE id = ? AND post_id = ?`, commentID, postID).Scan(&commentDeleted)
+		if err == sql.ErrNoRows {
+			return nil, ErrCommentNotFound
+		} else if err != nil {
+			return nil, err
+		}
+		targetType, targetID = TargetComment, commentID
+	}
+
+	if postDeleted.Valid || commentDeleted.Valid {
+		role, err := GetUserRole(db, viewerUUID)
+		if err != nil {
+			return nil, err
+		}
+		if !canModerate(role) {
+			if commentID != 0 && !postDeleted.Valid {
+				return nil, ErrCommentNotFound
+			}
+			return nil, ErrPostNotFound
+		}
+	}
+
+	rows, err := db.Query(`
+        SELECT r.id, r.editor_uuid, u.nickname, r.action, COALESCE(r.old_title, ''), r.old_content, r.diff, r.created_at
+        FROM content_revisions r
+        JOIN users u ON u.uuid = r.editor_uuid
+        WHERE r.target_type = ? AND r.target_id = ?
+        ORDER BY r.id`, targetType, targetID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := make([]Revision, 0)
+	for rows.Next() {
+		rev := Revision{Target: targetType}
+		if targetType == TargetComment {
+			rev.CommentID = commentID
+		}
+		if err := rows.Scan(&rev.ID, &rev.EditorUUID, &rev.Editor, &rev.Action, &rev.OldTitle, &rev.OldContent, &rev.Diff, &rev.CreatedAt); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	return revisions, rows.Err()
+}
+
+// writeChangeError maps edit/delete errors to HTTP statuses.
+func writeChangeError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrPostNotFound, ErrCommentNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case ErrNotAuthor:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		log.Printf("Error changing post or comment: %v", err)
+		http.Error(w, "Failed to save changes", http.StatusInternalServerError)
+	}
+}
+
+type EditPostRequest struct {
+	UUID    string `json:"uuid"`
+	Title   string `json:"title"`
+	Content string `json:"content"`
+}
+
+// EditPostHandler: PUT /post {uuid, title, content}
+func EditPostHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req EditPostRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if req.UUID == "" || strings.TrimSpace(req.Title) == "" || strings.TrimSpace(req.Content) == "" {
+			http.Error(w, "Missing post UUID, title or content", http.StatusBadRequest)
+			return
+		}
+
+		if err := EditPost(db, req.UUID, userUUID, req.Title, req.Content, time.Now()); err != nil {
+			writeChangeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// DeletePostHandler: DELETE /post?uuid=
+func DeletePostHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		postUUID := r.URL.Query().Get("uuid")
+		if postUUID == "" {
+			http.Error(w, "Missing post UUID", http.StatusBadRequest)
+			return
+		}
+
+		if err := DeletePost(db, postUUID, userUUID, time.Now()); err != nil {
+			writeChangeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type EditCommentRequest struct {
+	ID      int64  `json:"id"`
+	Content string `json:"content"`
+}
+
+// EditCommentHandler: PUT /comment {id, content}
+func EditCommentHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req EditCommentRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if req.ID == 0 || strings.TrimSpace(req.Content) == "" {
+			http.Error(w, "Missing comment id or content", http.StatusBadRequest)
+			return
+		}
+
+		if err := EditComment(db, req.ID, userUUID, req.Content, time.Now()); err != nil {
+			writeChangeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// DeleteCommentHandler: DELETE /comment?id=
+func DeleteCommentHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		commentID, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil || commentID <= 0 {
+			http.Error(w, "Missing or invalid comment id", http.StatusBadRequest)
+			return
+		}
+
+		if err := DeleteComment(db, commentID, userUUID, time.Now()); err != nil {
+			writeChangeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// PostRevisionsHandler: GET /post/revisions?uuid=[&comment=<comment id>]
+func PostRevisionsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		postUUID := r.URL.Query().Get("uuid")
+		if postUUID == "" {
+			http.Error(w, "Missing post UUID", http.StatusBadRequest)
+			return
+		}
+		var commentID int64
+		if s := r.URL.Query().Get("comment"); s != "" {
+			id, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || id <= 0 {
+				http.Error(w, "Invalid comment id", http.StatusBadRequest)
+				return
+			}
+			commentID = id
+		}
+
+		revisions, err := LoadPostRevisions(db, postUUID, commentID, userUUID)
+		if err != nil {
+			writeChangeError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(revisions)
+	}
+}
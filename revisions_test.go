@@ -0,0 +1,198 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// revisionTest is a post by alice with one of bob's comments on it, and a
+// moderator and an admin who did not write either.
+type revisionTest struct {
+	db         *sql.DB
+	alice, bob string
+	mod, admin string
+	post       string
+	comment    int64
+	now        time.Time
+}
+
+func newRevisionTest(t *testing.T) *revisionTest {
+	t.Helper()
+	db := newTestDB(t)
+	rt := &revisionTest{
+		db:    db,
+		alice: createTestUser(t, db, "alice"),
+		bob:   createTestUser(t, db, "bob"),
+		mod:   createTestUser(t, db, "mod"),
+		admin: createTestUser(t, db, "admin"),
+		post:  uuid.New().String(),
+		now:   testNow(),
+	}
+	if _, err := db.Exec(`UPDATE users SET role = CASE uuid WHEN ? THEN 'moderator' ELSE 'admin' END
+        WHERE uuid IN (?, ?)`, rt.mod, rt.mod, rt.admin); err != nil {
+		t.Fatal(err)
+	}
+	if err := InsertPost(db, rt.post, rt.alice, "Title", "first line\nsecond line", nil, nil, rt.now); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	rt.comment, _, err = InsertComment(db, rt.bob, rt.post, "", "a comment", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rt
+}
+
+func TestChangePermissions(t *testing.T) {
+	changes := []struct {
+		name   string
+		author func(rt *revisionTest) string
+		change func(rt *revisionTest, editor string) error
+	}{
+		{"edit post", func(rt *revisionTest) string { return rt.alice }, func(rt *revisionTest, editor string) error {
+			return EditPost(rt.db, rt.post, editor, "New title", "new body", rt.now)
+		}},
+		{"delete post", func(rt *revisionTest) string { return rt.alice }, func(rt *revisionTest, editor string) error {
+			return DeletePost(rt.db, rt.post, editor, rt.now)
+		}},
+		{"edit comment", func(rt *revisionTest) string { return rt.bob }, func(rt *revisionTest, editor string) error {
+			return EditComment(rt.db, rt.comment, editor, "new comment", rt.now)
+		}},
+		{"delete comment", func(rt *revisionTest) string { return rt.bob }, func(rt *revisionTest, editor string) error {
+			return DeleteComment(rt.db, rt.comment, editor, rt.now)
+		}},
+	}
+	editors := []struct {
+		name   string
+		editor func(rt *revisionTest, author string) string
+		err    error
+	}{
+		{"author", func(rt *revisionTest, author string) string { return author }, nil},
+		{"moderator", func(rt *revisionTest, author string) string { return rt.mod }, nil},
+		{"admin", func(rt *revisionTest, author string) string { return rt.admin }, nil},
+		{"other user", func(rt *revisionTest, author string) string {
+			if author == rt.alice {
+				return rt.bob
+			}
+			return rt.alice
+		}, ErrNotAuthor},
+	}
+	for _, c := range changes {
+		for _, e := range editors {
+			t.Run(c.name+" by "+e.name, func(t *testing.T) {
+				rt := newRevisionTest(t)
+				editor := e.editor(rt, c.author(rt))
+				if err := c.change(rt, editor); err != e.err {
+					t.Fatalf("got %v, want %v", err, e.err)
+				}
+				var revisions int
+				rt.db.QueryRow(`SELECT COUNT(*) FROM content_revisions`).Scan(&revisions)
+				want := 1
+				if e.err != nil {
+					want = 0
+				}
+				if revisions != want {
+					t.Errorf("%d revisions stored, want %d", revisions, want)
+				}
+			})
+		}
+	}
+}
+
+func TestPostRevisionHistory(t *testing.T) {
+	rt := newRevisionTest(t)
+	if err := EditPost(rt.db, rt.post, rt.alice, "Title", "first line\nchanged line", rt.now); err != nil {
+		t.Fatal(err)
+	}
+	// Saving the same text again stores nothing.
+	if err := EditPost(rt.db, rt.post, rt.alice, "Title", "first line\nchanged line", rt.now); err != nil {
+		t.Fatal(err)
+	}
+	revisions, err := LoadPostRevisions(rt.db, rt.post, 0, rt.bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 1 {
+		t.Fatalf("got %d revisions, want 1", len(revisions))
+	}
+	rev := revisions[0]
+	wantDiff := "  Title\n  first line\n- second line\n+ changed line\n"
+	if rev.Action != RevisionEdit || rev.Editor != "alice" || rev.OldContent != "first line\nsecond line" || rev.Diff != wantDiff {
+		t.Errorf("got %+v, diff:\n%s", rev, rev.Diff)
+	}
+
+	if err := DeletePost(rt.db, rt.post, rt.mod, rt.now); err != nil {
+		t.Fatal(err)
+	}
+	if err := EditPost(rt.db, rt.post, rt.alice, "Back", "again", rt.now); err != ErrPostNotFound {
+		t.Errorf("edit after deletion: %v", err)
+	}
+	if err := DeletePost(rt.db, rt.post, rt.mod, rt.now); err != ErrPostNotFound {
+		t.Errorf("second deletion: %v", err)
+	}
+	// The history of deleted content is only for moderators.
+	if _, err := LoadPostRevisions(rt.db, rt.post, 0, rt.alice); err != ErrPostNotFound {
+		t.Errorf("author viewing deleted post: %v", err)
+	}
+	revisions, err = LoadPostRevisions(rt.db, rt.post, 0, rt.mod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 || revisions[1].Action != RevisionDelete || revisions[1].OldContent != "first line\nchanged line" {
+		t.Errorf("moderator got %+v", revisions)
+	}
+}
+
+func TestCommentRevisionVisibility(t *testing.T) {
+	tests := []struct {
+		name   string
+		delete func(rt *revisionTest) error
+		err    error // for viewers who are not moderators
+	}{
+		{"live", func(rt *revisionTest) error { return nil }, nil},
+		{"deleted comment", func(rt *revisionTest) error {
+			return DeleteComment(rt.db, rt.comment, rt.bob, rt.now)
+		}, ErrCommentNotFound},
+		{"deleted post", func(rt *revisionTest) error {
+			return DeletePost(rt.db, rt.post, rt.alice, rt.now)
+		}, ErrPostNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := newRevisionTest(t)
+			if err := EditComment(rt.db, rt.comment, rt.bob, "edited comment", rt.now); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.delete(rt); err != nil {
+				t.Fatal(err)
+			}
+			for _, viewer := range []string{rt.alice, rt.bob} {
+				if _, err := LoadPostRevisions(rt.db, rt.post, rt.comment, viewer); err != tt.err {
+					t.Errorf("got %v, want %v", err, tt.err)
+				}
+			}
+			revisions, err := LoadPostRevisions(rt.db, rt.post, rt.comment, rt.mod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(revisions) == 0 || revisions[0].CommentID != rt.comment || revisions[0].OldContent != "a comment" {
+				t.Errorf("moderator got %+v", revisions)
+			}
+		})
+	}
+
+	rt := newRevisionTest(t)
+	other := uuid.New().String()
+	if err := InsertPost(rt.db, other, rt.alice, "Other", "body", nil, nil, rt.now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPostRevisions(rt.db, other, rt.comment, rt.mod); err != ErrCommentNotFound {
+		t.Errorf("comment under another post: %v", err)
+	}
+	if _, err := LoadPostRevisions(rt.db, "no-such-post", 0, rt.mod); err != ErrPostNotFound {
+		t.Errorf("unknown post: %v", err)
+	}
+}
@@ -0,0 +1,743 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	RoomKindGroup = "group" // invite-only group conversation
+	RoomKindRoom  = "room"  // public topic room anyone can join
+
+	RoomRoleOwner  = "owner"
+	RoomRoleMember = "member"
+
+	maxRoomMembers  = 100
+	maxRoomNameLen  = 64
+	maxRoomTopicLen = 256
+)
+
+var (
+	ErrRoomNotFound   = errors.New("room not found")
+	ErrNotRoomMember  = errors.New("not a member of this room")
+	ErrRoomForbidden  = errors.New("not allowed in this room")
+	ErrRoomFull       = errors.New("room is full")
+	ErrAlreadyMember  = errors.New("user is already a member")
+	ErrUnknownInvitee = errors.New("invited user does not exist")
+)
+
+type Room struct {
+	UUID        string    `json:"uuid"`
+	Kind        string    `json:"kind"`
+	Name        string    `json:"name"`
+	Topic       string    `json:"topic"`
+	CreatedBy   string    `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+	MemberCount int       `json:"member_count"`
+	Role        string    `json:"role,omitempty"` // the viewer's role, empty if not a member
+
+	id int64
+}
+
+type RoomMember struct {
+	UserUUID string    `json:"user_uuid"`
+	Nickname string    `json:"nickname"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// CreateRoom inserts a room owned by creator with the given initial members.
+func CreateRoom(db *sql.DB, kind, name, topic, creator string, members []string) (*Room, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	room := &Room{
+		UUID:      uuid.New().String(),
+		Kind:      kind,
+		Name:      name,
+		Topic:     topic,
+		CreatedBy: creator,
+		CreatedAt: time.Now(),
+		Role:      RoomRoleOwner,
+	}
+
+	res, err := tx.Exec(`INSERT INTO conversations (uuid, kind, name, topic, created_by, created_at)
+        VALUES (?, ?, ?, ?, ?, ?)`, room.UUID, kind, name, topic, creator, room.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if room.id, err = res.LastInsertId(); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`INSERT INTO conversation_members (conversation_id, user_uuid, role) VALUES (?, ?, ?)`,
+		room.id, creator, RoomRoleOwner); err != nil {
+		return nil, err
+	}
+	room.MemberCount = 1
+
+	for _, m := range uniqueStrings(members, creator) {
+		res, err := tx.Exec(`INSERT OR IGNORE INTO conversation_members (conversation_id, user_uuid, role)
+            SELECT ?, uuid, ? FROM users WHERE uuid = ?`, room.id, RoomRoleMember, m)
+		if err != nil {
+			return nil, err
+		}
+		n, _ := res.RowsAffected()
+		if n == 0 {
+			return nil, ErrUnknownInvitee
+		}
+		room.MemberCount++
+	}
+
+	return room, tx.Commit()
+}
+
+// GetRoom loads a room and the viewer's role in it.
+func GetRoom(db *sql.DB, roomUUID, viewerUUID string) (*Room, error) {
+	var r Room
+	var role sql.NullString
+	err := db.QueryRow(`
+        SELECT c.id, c.uuid, c.kind, c.name, c.topic, c.created_by, c.created_at,
+               (SELECT COUNT(*) FROM conversation_members WHERE conversation_id = c.id),
+               (SELECT role FROM conversation_members WHERE conversation_id = c.id AND user_uuid = ?)
+        FROM conversations c
+        WHERE c.uuid = ?`, viewerUUID, roomUUID).Scan(
+		&r.id, &r.UUID, &r.Kind, &r.Name, &r.Topic, &r.CreatedBy, &r.CreatedAt, &r.MemberCount, &role)
+	if err == sql.ErrNoRows {
+		return nil, ErrRoomNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	r.Role = role.String
+	return &r, nil
+}
+
+// ListRooms returns the rooms the user belongs to, or every public room when
+// public is true.
+func ListRooms(db *sql.DB, userUUID string, public bool) ([]Room, error) {
+	query := `
+        SELECT c.uuid, c.kind, c.name, c.topic, c.created_by, c.created_at,
+               (SELECT COUNT(*) FROM conversation_members WHERE conversation_id = c.id),
+               COALESCE(m.role, '')
+        FROM conversations c
+        LEFT JOIN conversation_members m ON m.conversation_id = c.id AND m.user_uuid = ?`
+	if public {
+		query += ` WHERE c.kind = 'room'`
+	} else {
+		query += ` WHERE m.user_uuid IS NOT NULL`
+	}
+	query += ` ORDER BY c.name COLLATE NOCASE`
+
+	rows, err := db.Query(query, userUUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rooms := make([]Room, 0)
+	for rows.Next() {
+		var r Room
+		if err := rows.Scan(&r.UUID, &r.Kind, &r.Name, &r.Topic, &r.CreatedBy, &r.CreatedAt, &r.MemberCount, &r.Role); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, r)
+	}
+	return rooms, rows.Err()
+}
+
+func ListRoomMembers(db *sql.DB, roomUUID string) ([]RoomMember, error) {
+	rows, err := db.Query(`
+        SELECT m.user_uuid, u.nickname, m.role, m.joined_at
+        FROM conversation_members m
+        JOIN conversations c ON c.id = m.conversation_id
+        JOIN users u ON u.uuid = m.user_uuid
+        WHERE c.uuid = ?
+        ORDER BY u.nickname COLLATE NOCASE`, roomUUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make([]RoomMember, 0)
+	for rows.Next() {
+		var m RoomMember
+		if err := rows.Scan(&m.UserUUID, &m.Nickname, &m.Role, &m.JoinedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// RoomMemberUUIDs returns the user UUIDs of every member of a room.
+func RoomMemberUUIDs(db *sql.DB, roomUUID string) ([]string, error) {
+	rows, err := db.Query(`
+        SELECT m.user_uuid FROM conversation_members m
+        JOIN conversations c ON c.id = m.conversation_id
+        WHERE c.uuid = ?`, roomUUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []string
+	for rows.Next() {
+		var u string
+		if err := rows.Scan(&u); err != nil {
+			return nil, err
+		}
+		members = append(members, u)
+	}
+	return members, rows.Err()
+}
+
+// AddRoomMember adds userUUID to the room. The member count is read in the
+// same transaction as the insert, so concurrent joins cannot overfill it.
+func AddRoomMember(db *sql.DB, room *Room, userUUID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var members int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM conversation_members WHERE conversation_id = ?`, room.id).Scan(&members); err != nil {
+		return err
+	}
+	if members >= maxRoomMembers {
+		return ErrRoomFull
+	}
+	res, err := tx.Exec(`INSERT OR IGNORE INTO conversation_members (conversation_id, user_uuid, role)
+        SELECT ?, uuid, ? FROM users WHERE uuid = ?`, room.id, RoomRoleMember, userUUID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		var exists bool
+		tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE uuid = ?)", userUUID).Scan(&exists)
+		if !exists {
+			return ErrUnknownInvitee
+		}
+		return ErrAlreadyMember
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	room.MemberCount = members + 1
+	return nil
+}
+
+func RemoveRoomMember(db *sql.DB, room *Room, userUUID string) error {
+	res, err := db.Exec(`DELETE FROM conversation_members WHERE conversation_id = ? AND user_uuid = ?`, room.id, userUUID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotRoomMember
+	}
+	room.MemberCount--
+	return nil
+}
+
+// LeaveRoom removes userUUID from the room. When the owner leaves, the
+// longest-standing member becomes owner and is returned; when the last member
+// leaves, the room, its messages and their attachments are deleted together,
+// and the attachment blobs once that has committed.
+func LeaveRoom(db *sql.DB, store BlobStore, room *Room, userUUID string) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var role string
+	err = tx.QueryRow(`SELECT role FROM conversation_members WHERE conversation_id = ? AND user_uuid = ?`, room.id, userUUID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", ErrNotRoomMember
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`DELETE FROM conversation_members WHERE conversation_id = ? AND user_uuid = ?`, room.id, userUUID); err != nil {
+		return "", err
+	}
+
+	var heir string
+	var blobs []string
+	err = tx.QueryRow(`SELECT user_uuid FROM conversation_members WHERE conversation_id = ?
+        ORDER BY joined_at, rowid LIMIT 1`, room.id).Scan(&heir)
+	switch err {
+	case nil:
+		if role != RoomRoleOwner {
+			heir = ""
+			break
+		}
+		if _, err := tx.Exec(`UPDATE conversation_members SET role = ? WHERE conversation_id = ? AND user_uuid = ?`,
+			RoomRoleOwner, room.id, heir); err != nil {
+			return "", err
+		}
+	case sql.ErrNoRows:
+		if blobs, err = deleteRoomAttachments(tx, room.id); err != nil {
+			return "", err
+		}
+		for _, stmt := range []string{
+			`DELETE FROM conversation_messages WHERE conversation_id = ?`,
+			`DELETE FROM conversations WHERE id = ?`,
+		} {
+			if _, err := tx.Exec(stmt, room.id); err != nil {
+				return "", err
+			}
+		}
+	default:
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	room.MemberCount--
+	for _, key := range blobs {
+		if err := store.Delete(key); err != nil {
+			log.Printf("Error deleting blob %s: %v", key, err)
+		}
+	}
+	return heir, nil
+}
+
+// deleteRoomAttachments deletes the attachment rows of a room's messages and
+// returns the keys of their blobs.
+func deleteRoomAttachments(tx *sql.Tx, roomID int64) ([]string, error) {
+	const attached = `target_type = ? AND target_id IN (SELECT id FROM conversation_messages WHERE conversation_id = ?)`
+	rows, err := tx.Query(`SELECT uuid, has_thumbnail FROM attachments WHERE `+attached, TargetRoomMessage, roomID)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for rows.Next() {
+		var attachmentUUID string
+		var hasThumbnail bool
+		if err := rows.Scan(&attachmentUUID, &hasThumbnail); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		keys = append(keys, attachmentUUID)
+		if hasThumbnail {
+			keys = append(keys, thumbnailKey(attachmentUUID))
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(`DELETE FROM attachments WHERE `+attached, TargetRoomMessage, roomID)
+	return keys, err
+}
+
+func SaveRoomMessage(db *sql.DB, messageUUID, roomUUID, sender, content string, attachments []string, sentAt time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+        INSERT INTO conversation_messages (uuid, conversation_id, sender_uuid, content, sent_at)
+        VALUES (?, (SELECT id FROM conversations WHERE uuid = ?), ?, ?, ?)`,
+		messageUUID, roomUUID, sender, content, sentAt)
+	if err != nil {
+		return err
+	}
+	messageID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	if err := attachFiles(tx, sender, attachments, TargetRoomMessage, messageID); err != nil {
+		return err
+	}
+	if err := recordMentions(tx, TargetRoomMessage, messageID, sender, content); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// LoadRoomMessages returns one page of a room's history; see LoadMessages.
+func LoadRoomMessages(db *sql.DB, roomUUID string, c MessageCursor) (MessagePage, error) {
+	var cursorID int64
+	if cursor := c.Before + c.After; cursor != "" {
+		err := db.QueryRow(`SELECT m.id FROM conversation_messages m
+            JOIN conversations c ON c.id = m.conversation_id
+            WHERE m.uuid = ? AND c.uuid = ?`, cursor, roomUUID).Scan(&cursorID)
+		if err == sql.ErrNoRows {
+			return MessagePage{}, ErrMessageNotInConversation
+		} else if err != nil {
+			return MessagePage{}, err
+		}
+	}
+
+	clause, pageArgs := keysetClause(c, cursorID)
+	rows, err := db.Query(`
+        SELECT m.id, m.uuid, m.sender_uuid, m.content, m.sent_at, u.nickname
+        FROM conversation_messages m
+        JOIN conversations c ON c.id = m.conversation_id
+        JOIN users u ON u.uuid = m.sender_uuid
+        WHERE c.uuid = ?`+clause, append([]interface{}{roomUUID}, pageArgs...)...)
+	if err != nil {
+		return MessagePage{}, err
+	}
+	defer rows.Close()
+
+	messages := make([]MessageWithAuthor, 0, c.Limit+1)
+	for rows.Next() {
+		var m MessageWithAuthor
+		var sentAt time.Time
+		if err := rows.Scan(&m.id, &m.UUID, &m.From, &m.Content, &sentAt, &m.FromNickname); err != nil {
+			return MessagePage{}, err
+		}
+		m.Room = roomUUID
+		m.ContentHTML = renderMarkdown(m.Content)
+		m.SentAt = sentAt.Format(time.RFC3339)
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return MessagePage{}, err
+	}
+	page := finishPage(messages, c)
+	return page, loadMessageAttachments(db, TargetRoomMessage, page.Messages)
+}
+
+// canReadRoom reports whether a user may see a room's history.
+func canReadRoom(room *Room) bool {
+	return room.Role != "" || room.Kind == RoomKindRoom
+}
+
+type CreateRoomRequest struct {
+	Kind    string   `json:"kind"` // "group" or "room"
+	Name    string   `json:"name"`
+	Topic   string   `json:"topic"`
+	Members []string `json:"members"` // user UUIDs to add besides the creator
+}
+
+type RoomMemberRequest struct {
+	Room string `json:"room"`
+	User string `json:"user"`
+}
+
+// CreateRoomHandler: POST /rooms
+func CreateRoomHandler(db *sql.DB, hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req CreateRoomRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		req.Name = strings.TrimSpace(req.Name)
+		req.Topic = strings.TrimSpace(req.Topic)
+		if req.Kind == "" {
+			req.Kind = RoomKindGroup
+		}
+		if req.Kind != RoomKindGroup && req.Kind != RoomKindRoom {
+			http.Error(w, "Room kind must be 'group' or 'room'", http.StatusBadRequest)
+			return
+		}
+		if req.Name == "" || len(req.Name) > maxRoomNameLen || len(req.Topic) > maxRoomTopicLen {
+			http.Error(w, "Room name is required and must be at most 64 characters", http.StatusBadRequest)
+			return
+		}
+		req.Members = uniqueStrings(req.Members, userUUID)
+		if len(req.Members)+1 > maxRoomMembers {
+			http.Error(w, ErrRoomFull.Error(), http.StatusBadRequest)
+			return
+		}
+
+		room, err := CreateRoom(db, req.Kind, req.Name, req.Topic, userUUID, req.Members)
+		if err == ErrUnknownInvitee {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.Printf("CreateRoom error: %v", err)
+			http.Error(w, "Failed to create room", http.StatusInternalServerError)
+			return
+		}
+
+		for _, m := range req.Members {
+			hub.RoomMembership(room.UUID, m, RoomActionInvited, userUUID)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(room)
+	}
+}
+
+// ListRoomsHandler: GET /rooms lists my rooms, GET /rooms?public=true lists
+// every public room.
+func ListRoomsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		public, _ := strconv.ParseBool(r.URL.Query().Get("public"))
+		rooms, err := ListRooms(db, userUUID, public)
+		if err != nil {
+			log.Printf("ListRooms error: %v", err)
+			http.Error(w, "Failed to load rooms", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rooms)
+	}
+}
+
+// RoomMembersHandler: GET /rooms/members?room=
+func RoomMembersHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		room, err := GetRoom(db, r.URL.Query().Get("room"), userUUID)
+		if err != nil {
+			writeRoomError(w, err)
+			return
+		}
+		if !canReadRoom(room) {
+			writeRoomError(w, ErrNotRoomMember)
+			return
+		}
+
+		members, err := ListRoomMembers(db, room.UUID)
+		if err != nil {
+			log.Printf("ListRoomMembers error: %v", err)
+			http.Error(w, "Failed to load members", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(members)
+	}
+}
+
+// RoomInviteHandler: POST /rooms/invite {room, user}. Any member may invite.
+func RoomInviteHandler(db *sql.DB, hub *Hub) http.HandlerFunc {
+	return roomMemberAction(db, func(room *Room, actor string, req RoomMemberRequest) error {
+		if room.Role == "" {
+			return ErrNotRoomMember
+		}
+		if err := AddRoomMember(db, room, req.User); err != nil {
+			return err
+		}
+		hub.RoomMembership(room.UUID, req.User, RoomActionInvited, actor)
+		return nil
+	})
+}
+
+// RoomKickHandler: POST /rooms/kick {room, user}. Only the owner may kick.
+func RoomKickHandler(db *sql.DB, hub *Hub) http.HandlerFunc {
+	return roomMemberAction(db, func(room *Room, actor string, req RoomMemberRequest) error {
+		if room.Role != RoomRoleOwner || req.User == actor {
+			return ErrRoomForbidden
+		}
+		if err := RemoveRoomMember(db, room, req.User); err != nil {
+			return err
+		}
+		hub.RoomMembership(room.UUID, req.User, RoomActionKicked, actor)
+		return nil
+	})
+}
+
+// RoomJoinHandler: POST /rooms/join {room}. Only public rooms can be joined.
+func RoomJoinHandler(db *sql.DB, hub *Hub) http.HandlerFunc {
+	return roomMemberAction(db, func(room *Room, actor string, req RoomMemberRequest) error {
+		if room.Kind != RoomKindRoom {
+			return ErrRoomForbidden
+		}
+		if err := AddRoomMember(db, room, actor); err != nil {
+			return err
+		}
+		room.Role = RoomRoleMember
+		hub.RoomMembership(room.UUID, actor, RoomActionJoined, actor)
+		return nil
+	})
+}
+
+// RoomLeaveHandler: POST /rooms/leave {room}. An owner who leaves hands the
+// room on, see LeaveRoom.
+func RoomLeaveHandler(db *sql.DB, store BlobStore, hub *Hub) http.HandlerFunc {
+	return roomMemberAction(db, func(room *Room, actor string, req RoomMemberRequest) error {
+		heir, err := LeaveRoom(db, store, room, actor)
+		if err != nil {
+			return err
+		}
+		room.Role = ""
+		hub.RoomMembership(room.UUID, actor, RoomActionLeft, actor)
+		if heir != "" {
+			hub.RoomMembership(room.UUID, heir, RoomActionPromoted, actor)
+		}
+		return nil
+	})
+}
+
+// roomMemberAction decodes a RoomMemberRequest, loads the room as seen by the
+// caller and runs fn, mapping room errors to HTTP statuses.
+func roomMemberAction(db *sql.DB, fn func(room *Room, actor string, req RoomMemberRequest) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req RoomMemberRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		room, err := GetRoom(db, req.Room, userUUID)
+		if err != nil {
+			writeRoomError(w, err)
+			return
+		}
+
+		if err := fn(room, userUUID, req); err != nil {
+			writeRoomError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(room)
+	}
+}
+
+// uniqueStrings drops duplicates and any occurrence of skip, keeping order.
+func uniqueStrings(in []string, skip string) []string {
+	seen := map[string]bool{skip: true}
+	out := make([]string, 0, len(in))
+	for _, s := range in {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func writeRoomError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrRoomNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case ErrNotRoomMember, ErrRoomForbidden:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case ErrRoomFull, ErrAlreadyMember, ErrUnknownInvitee:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Printf("Room error: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+	}
+}
+
+// handleRoomMessage persists a message to a room the client belongs to and
+// hands it to the hub for fan-out.
+func handleRoomMessage(hub *Hub, client *Client, frameID string, p ChatPayload) {
+	members, err := RoomMemberUUIDs(hub.db, p.Room)
+	if err != nil || !slices.Contains(members, client.UserUUID) {
+		hub.SendToClient(client, errorFrame(frameID, "not_member", ErrNotRoomMember.Error()))
+		return
+	}
+
+	now := time.Now()
+	msg := Message{
+		UUID:    uuid.New().String(),
+		From:    client.UserUUID,
+		Room:    p.Room,
+		Content: p.Content,
+		SentAt:  now.Format(time.RFC3339),
+
+		RoomMembers: members,
+	}
+
+	err = SaveRoomMessage(hub.db, msg.UUID, msg.Room, msg.From, msg.Content, p.Attachments, now)
+	if attachmentErrorStatus(err) != 0 {
+		hub.SendToClient(client, errorFrame(frameID, "invalid_attachment", err.Error()))
+		return
+	} else if err != nil {
+		log.Printf("Failed to save room message: %v", err)
+		hub.SendToClient(client, errorFrame(frameID, "save_failed", "message could not be saved"))
+		return
+	}
+	if msg.Attachments, err = loadAttachmentsByUUID(hub.db, p.Attachments); err != nil {
+		log.Printf("Error loading attachments of message %s: %v", msg.UUID, err)
+	}
+
+	hub.SendToClient(client, ackFrame(frameID, AckPayload{MessageUUID: msg.UUID, SentAt: msg.SentAt}))
+	hub.Broadcast(msg)
+	notifyTargetUUID(hub, TargetRoomMessage, msg.UUID)
+}
+
+// deliverRoomMessage fans a room message out to every member's connections.
+// Runs on the hub goroutine.
+func (h *Hub) deliverRoomMessage(msg Message) {
+	fromNickname := "Unknown"
+	if sender, ok := h.onlineUsers[msg.From]; ok {
+		fromNickname = sender.Nickname
+	}
+
+	h.sendToRoom(msg.RoomMembers, "", roomMessageFrame(MessageBroadcast{
+		UUID:         msg.UUID,
+		From:         msg.From,
+		Room:         msg.Room,
+		Content:      msg.Content,
+		ContentHTML:  renderMarkdown(msg.Content),
+		SentAt:       msg.SentAt,
+		FromNickname: fromNickname,
+		Attachments:  msg.Attachments,
+	}))
+}
+
+// sendToRoom pushes a frame to the connections of every room member in
+// members except skipUser. Runs on the hub goroutine.
+func (h *Hub) sendToRoom(members []string, skipUser string, f *Frame) {
+	for _, m := range members {
+		if m != skipUser {
+			h.sendToUser(m, f)
+		}
+	}
+}
+
+// RoomMembership announces a membership change to the room and to the
+// affected user, who may no longer be a member.
+func (h *Hub) RoomMembership(roomUUID, userUUID, action, actorUUID string) {
+	members, err := RoomMemberUUIDs(h.db, roomUUID)
+	if err != nil {
+		log.Printf("Error loading members of room %s: %v", roomUUID, err)
+	}
+	h.do(func() {
+		frame := roomMembershipFrame(RoomMembershipPayload{Room: roomUUID, User: userUUID, Action: action, Actor: actorUUID})
+		h.sendToRoom(members, userUUID, frame)
+		h.sendToUser(userUUID, frame)
+	})
+}
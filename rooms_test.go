@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestLeaveRoom(t *testing.T) {
+	db := newTestDB(t)
+	store, err := NewDiskStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, bob, carol := createTestUser(t, db, "alice"), createTestUser(t, db, "bob"), createTestUser(t, db, "carol")
+	room, err := CreateRoom(db, RoomKindRoom, "garden", "", alice, []string{bob, carol})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload, err := SaveUpload(db, store, bob, "notes.txt", []byte("plant in spring"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveRoomMessage(db, uuid.New().String(), room.UUID, bob, "notes", []string{upload.UUID}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	// Another room's attachment is left alone.
+	other, err := CreateRoom(db, RoomKindGroup, "", "", alice, []string{bob})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, err := SaveUpload(db, store, alice, "kept.txt", []byte("keep me"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveRoomMessage(db, uuid.New().String(), other.UUID, alice, "kept", []string{kept.UUID}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	leave := func(user, wantHeir string) {
+		t.Helper()
+		r, err := GetRoom(db, room.UUID, user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if heir, err := LeaveRoom(db, store, r, user); err != nil || heir != wantHeir {
+			t.Fatalf("got heir %q, %v; want %q", heir, err, wantHeir)
+		}
+	}
+	// The owner hands the room to the longest-standing member; others
+	// hand nothing on.
+	leave(alice, bob)
+	leave(carol, "")
+	if _, err := LeaveRoom(db, store, room, carol); err != ErrNotRoomMember {
+		t.Errorf("leaving twice: %v", err)
+	}
+	if _, err := store.Open(upload.UUID); err != nil {
+		t.Fatalf("blob deleted while the room has members: %v", err)
+	}
+
+	leave(bob, "")
+	if _, err := GetRoom(db, room.UUID, bob); err != ErrRoomNotFound {
+		t.Errorf("empty room: %v", err)
+	}
+	var messages, attachments int
+	db.QueryRow(`SELECT COUNT(*) FROM conversation_messages`).Scan(&messages)
+	db.QueryRow(`SELECT COUNT(*) FROM attachments`).Scan(&attachments)
+	if messages != 1 || attachments != 1 {
+		t.Errorf("%d messages and %d attachments left, want the other room's one", messages, attachments)
+	}
+	if _, err := store.Open(upload.UUID); err != ErrBlobNotFound {
+		t.Errorf("blob of the deleted room: %v", err)
+	}
+	if f, err := store.Open(kept.UUID); err != nil {
+		t.Errorf("blob of the other room: %v", err)
+	} else {
+		f.Close()
+	}
+}
+
+func TestAddRoomMemberCapacity(t *testing.T) {
+	db := newTestDB(t)
+	owner := createTestUser(t, db, "owner")
+	var members []string
+	for i := 0; i < maxRoomMembers-3; i++ {
+		members = append(members, createTestUser(t, db, fmt.Sprintf("member%d", i)))
+	}
+	room, err := CreateRoom(db, RoomKindRoom, "crowded", "", owner, members)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AddRoomMember(db, room, members[0]); err != ErrAlreadyMember {
+		t.Errorf("adding a member twice: %v", err)
+	}
+	if err := AddRoomMember(db, room, "no-such-user"); err != ErrUnknownInvitee {
+		t.Errorf("adding an unknown user: %v", err)
+	}
+
+	// Ten users join at once for the last two places.
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		user := createTestUser(t, db, fmt.Sprintf("joiner%d", i))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := GetRoom(db, room.UUID, user)
+			if err == nil {
+				err = AddRoomMember(db, r, user)
+			}
+			errs[i] = err
+		}()
+	}
+	wg.Wait()
+
+	joined := 0
+	for _, err := range errs {
+		switch err {
+		case nil:
+			joined++
+		case ErrRoomFull:
+		default:
+			t.Errorf("join: %v", err)
+		}
+	}
+	r, err := GetRoom(db, room.UUID, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if joined != 2 || r.MemberCount != maxRoomMembers {
+		t.Errorf("%d joined, room has %d members; want 2 and %d", joined, r.MemberCount, maxRoomMembers)
+	}
+}
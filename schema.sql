@@ -11,6 +11,8 @@ CREATE TABLE IF NOT EXISTS users (
     first_name TEXT,
     last_name TEXT,
     password_hash TEXT NOT NULL,
+    role TEXT NOT NULL DEFAULT 'user' CHECK(role IN ('user','moderator','admin')),
+    email_verified_at DATETIME,
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 );
 
@@ -20,13 +22,22 @@ CREATE TABLE IF NOT EXISTS sessions (
     session_uuid TEXT UNIQUE NOT NULL,
     user_uuid TEXT NOT NULL,
     expires_at DATETIME NOT NULL,
+    user_agent TEXT,
+    ip TEXT,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at DATETIME,
     FOREIGN KEY(user_uuid) REFERENCES users(uuid) ON DELETE CASCADE
 );
 
 -- Categories table
 CREATE TABLE IF NOT EXISTS categories (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
-    name TEXT UNIQUE NOT NULL
+    name TEXT UNIQUE NOT NULL,
+    slug TEXT, -- unique, see idx_categories_slug in migrations.go
+    description TEXT NOT NULL DEFAULT '',
+    position INTEGER NOT NULL DEFAULT 0, -- display order
+    post_role TEXT NOT NULL DEFAULT 'user' CHECK(post_role IN ('user','moderator','admin')), -- lowest role that may post
+    archived_at DATETIME -- no new posts; existing posts stay visible
 );
 
 -- Posts table
@@ -37,6 +48,8 @@ CREATE TABLE IF NOT EXISTS posts (
     title TEXT NOT NULL,
     content TEXT NOT NULL,
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    edited_at DATETIME,  -- last edit, see content_revisions
+    deleted_at DATETIME, -- soft deletion; title and content are cleared
     FOREIGN KEY(user_uuid) REFERENCES users(uuid) ON DELETE CASCADE
 );
 
@@ -52,10 +65,16 @@ CREATE TABLE IF NOT EXISTS post_categories (
 -- Comments table
 CREATE TABLE IF NOT EXISTS comments (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
+    comment_uuid TEXT NOT NULL, -- unique, see idx_comments_uuid in migrations.go
     post_id INTEGER NOT NULL,
+    parent_id INTEGER REFERENCES comments(id), -- NULL for top-level comments
+    depth INTEGER NOT NULL DEFAULT 0,
+    path TEXT NOT NULL DEFAULT '', -- zero-padded ids from the top-level comment down
     user_uuid TEXT NOT NULL,
     content TEXT NOT NULL,
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    edited_at DATETIME,  -- last edit, see content_revisions
+    deleted_at DATETIME, -- soft deletion; content is cleared
     FOREIGN KEY(post_id) REFERENCES posts(id) ON DELETE CASCADE,
     FOREIGN KEY(user_uuid) REFERENCES users(uuid) ON DELETE CASCADE
 );
@@ -72,6 +91,10 @@ CREATE TABLE IF NOT EXISTS likes_dislikes (
     FOREIGN KEY(user_uuid) REFERENCES users(uuid) ON DELETE CASCADE
 );
 
+-- reaction totals are aggregated per target
+CREATE INDEX IF NOT EXISTS idx_likes_dislikes_target
+ON likes_dislikes(target_type, target_id);
+
 -- FIXED: PrivateMessages table - using 'sent_at' to match the code
 CREATE TABLE IF NOT EXISTS private_messages (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -81,6 +104,10 @@ CREATE TABLE IF NOT EXISTS private_messages (
     content TEXT NOT NULL,
     sent_at DATETIME DEFAULT CURRENT_TIMESTAMP,
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    delivered_at DATETIME, -- first pushed to one of the receiver's connections
+    read_at DATETIME,      -- receiver marked the conversation read up to here
+    edited_at DATETIME,    -- last edit by the sender, see private_message_edits
+    deleted_at DATETIME,   -- soft-deletion tombstone; content is cleared
     FOREIGN KEY(sender_uuid) REFERENCES users(uuid) ON DELETE CASCADE,
     FOREIGN KEY(receiver_uuid) REFERENCES users(uuid) ON DELETE CASCADE
 );
@@ -92,3 +119,258 @@ ON private_messages(sender_uuid, receiver_uuid, sent_at);
 CREATE INDEX IF NOT EXISTS idx_private_messages_sent_at 
 ON private_messages(sent_at);
 
+
+
+-- Per-user ordering of private messages. Each message gets one row for the
+-- sender and one for the receiver so a reconnecting client can ask for
+-- everything after the last seq it saw.
+CREATE TABLE IF NOT EXISTS user_message_log (
+    user_uuid TEXT NOT NULL,
+    seq INTEGER NOT NULL,
+    message_id INTEGER NOT NULL,
+    PRIMARY KEY (user_uuid, seq),
+    FOREIGN KEY(user_uuid) REFERENCES users(uuid) ON DELETE CASCADE,
+    FOREIGN KEY(message_id) REFERENCES private_messages(id) ON DELETE CASCADE
+);
+
+-- Group conversations and public rooms. 'group' is invite-only, 'room' is a
+-- public topic room anyone can join.
+CREATE TABLE IF NOT EXISTS conversations (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    uuid TEXT UNIQUE NOT NULL,
+    kind TEXT NOT NULL CHECK(kind IN ('group','room')),
+    name TEXT NOT NULL,
+    topic TEXT NOT NULL DEFAULT '',
+    created_by TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(created_by) REFERENCES users(uuid) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS conversation_members (
+    conversation_id INTEGER NOT NULL,
+    user_uuid TEXT NOT NULL,
+    role TEXT NOT NULL DEFAULT 'member' CHECK(role IN ('owner','member')),
+    joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (conversation_id, user_uuid),
+    FOREIGN KEY(conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
+    FOREIGN KEY(user_uuid) REFERENCES users(uuid) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_conversation_members_user
+ON conversation_members(user_uuid);
+
+CREATE TABLE IF NOT EXISTS conversation_messages (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    uuid TEXT UNIQUE NOT NULL,
+    conversation_id INTEGER NOT NULL,
+    sender_uuid TEXT NOT NULL,
+    content TEXT NOT NULL,
+    sent_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
+    FOREIGN KEY(sender_uuid) REFERENCES users(uuid) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_conversation_messages_conversation
+ON conversation_messages(conversation_id, sent_at);
+
+-- Previous versions of edited private messages, newest last.
+CREATE TABLE IF NOT EXISTS private_message_edits (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    message_id INTEGER NOT NULL,
+    old_content TEXT NOT NULL,
+    edited_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(message_id) REFERENCES private_messages(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_private_message_edits_message
+ON private_message_edits(message_id);
+
+-- Previous versions of edited or deleted posts and comments
+CREATE TABLE IF NOT EXISTS content_revisions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    target_type TEXT NOT NULL CHECK(target_type IN ('post','comment')),
+    target_id INTEGER NOT NULL,
+    editor_uuid TEXT NOT NULL,
+    action TEXT NOT NULL CHECK(action IN ('edit','delete')),
+    old_title TEXT,            -- posts only
+    old_content TEXT NOT NULL,
+    diff TEXT NOT NULL,        -- line diff from the old version to the new one
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(editor_uuid) REFERENCES users(uuid) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_content_revisions_target
+ON content_revisions(target_type, target_id);
+
+-- Uploaded files, see attachments.go. The bytes live in the blob store under
+-- uuid. target_type and target_id stay NULL until the upload is attached.
+CREATE TABLE IF NOT EXISTS attachments (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    uuid TEXT UNIQUE NOT NULL,
+    uploader_uuid TEXT NOT NULL,
+    filename TEXT NOT NULL,
+    mime_type TEXT NOT NULL,   -- sniffed from the content
+    size INTEGER NOT NULL,
+    width INTEGER,             -- images only
+    height INTEGER,
+    has_thumbnail BOOLEAN NOT NULL DEFAULT 0,
+    target_type TEXT CHECK(target_type IN ('post','comment','message','room_message')),
+    target_id INTEGER,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY(uploader_uuid) REFERENCES users(uuid) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_attachments_target
+ON attachments(target_type, target_id);
+
+-- Free-form post tags, see tags.go. A merged tag keeps its row so later uses
+-- of its name go to merged_into; a banned tag is hidden and cannot be used.
+CREATE TABLE IF NOT EXISTS tags (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT UNIQUE NOT NULL, -- normalized
+    merged_into INTEGER REFERENCES tags(id),
+    banned_at DATETIME,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS post_tags (
+    post_id INTEGER NOT NULL,
+    tag_id INTEGER NOT NULL,
+    PRIMARY KEY (post_id, tag_id),
+    FOREIGN KEY(post_id) REFERENCES posts(id),
+    FOREIGN KEY(tag_id) REFERENCES tags(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_post_tags_tag
+ON post_tags(tag_id);
+
+-- @nickname mentions, see mentions.go.
+CREATE TABLE IF NOT EXISTS mentions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    target_type TEXT NOT NULL CHECK(target_type IN ('post','comment','message','room_message')),
+    target_id INTEGER NOT NULL,
+    mentioned_uuid TEXT NOT NULL,
+    author_uuid TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    delivered_at DATETIME, -- pushed to one of the mentioned user's connections
+    UNIQUE(target_type, target_id, mentioned_uuid),
+    FOREIGN KEY(mentioned_uuid) REFERENCES users(uuid) ON DELETE CASCADE,
+    FOREIGN KEY(author_uuid) REFERENCES users(uuid) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_mentions_user
+ON mentions(mentioned_uuid, delivered_at);
+
+-- Per-user notifications, see notifications.go. The target is the comment,
+-- post or message the notification is about.
+CREATE TABLE IF NOT EXISTS notifications (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_uuid TEXT NOT NULL,
+    kind TEXT NOT NULL CHECK(kind IN ('reply','comment_reply','mention','reaction','message')),
+    actor_uuid TEXT NOT NULL,
+    target_type TEXT NOT NULL CHECK(target_type IN ('post','comment','message','room_message')),
+    target_id INTEGER NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    delivered_at DATETIME, -- pushed to one of the user's connections
+    read_at DATETIME,
+    emailed_at DATETIME, -- handled by the email digest, sent or left out by preferences
+    FOREIGN KEY(user_uuid) REFERENCES users(uuid) ON DELETE CASCADE,
+    FOREIGN KEY(actor_uuid) REFERENCES users(uuid) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_notifications_user
+ON notifications(user_uuid, id);
+
+CREATE INDEX IF NOT EXISTS idx_notifications_target
+ON notifications(target_type, target_id);
+
+-- At most one unread copy of each notification.
+CREATE UNIQUE INDEX IF NOT EXISTS idx_notifications_unread
+ON notifications(user_uuid, kind, actor_uuid, target_type, target_id) WHERE read_at IS NULL;
+
+-- Email notification settings, see emails.go. Users without a row get the
+-- defaults: every kind, instant digests.
+CREATE TABLE IF NOT EXISTS email_preferences (
+    user_uuid TEXT PRIMARY KEY,
+    messages BOOLEAN NOT NULL DEFAULT 1,
+    replies BOOLEAN NOT NULL DEFAULT 1,
+    mentions BOOLEAN NOT NULL DEFAULT 1,
+    digest TEXT NOT NULL DEFAULT 'instant' CHECK(digest IN ('instant','hourly','daily','off')),
+    last_digest_at DATETIME,
+    FOREIGN KEY(user_uuid) REFERENCES users(uuid) ON DELETE CASCADE
+);
+
+-- Emails waiting to be sent, and the record of those that were.
+CREATE TABLE IF NOT EXISTS email_outbox (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_uuid TEXT,
+    to_address TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    body TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending' CHECK(status IN ('pending','sent','failed')),
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    next_attempt_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    sent_at DATETIME,
+    redact_body BOOLEAN NOT NULL DEFAULT 0, -- blank the body once sent or failed; it holds a token link
+    FOREIGN KEY(user_uuid) REFERENCES users(uuid) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_email_outbox_due
+ON email_outbox(status, next_attempt_at);
+
+-- Email verification and password reset tokens, see tokens.go. Only an
+-- HMAC of the token is kept.
+CREATE TABLE IF NOT EXISTS auth_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_uuid TEXT NOT NULL,
+    purpose TEXT NOT NULL CHECK(purpose IN ('verify_email','reset_password')),
+    token_hash TEXT UNIQUE NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    expires_at DATETIME NOT NULL,
+    used_at DATETIME, -- redeemed, or superseded by a newer token
+    FOREIGN KEY(user_uuid) REFERENCES users(uuid) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_auth_tokens_user
+ON auth_tokens(user_uuid, purpose);
+
+-- Two-factor authentication, see totp.go. A secret without confirmed_at is
+-- an enrollment the user has not finished.
+CREATE TABLE IF NOT EXISTS user_totp (
+    user_uuid TEXT PRIMARY KEY,
+    secret TEXT NOT NULL, -- base32
+    confirmed_at DATETIME,
+    last_step INTEGER NOT NULL DEFAULT 0, -- time step of the last code used, which cannot be used again
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    failed_attempts INTEGER NOT NULL DEFAULT 0, -- login codes tried since the last that worked
+    locked_until DATETIME, -- no login codes are checked before then
+    FOREIGN KEY(user_uuid) REFERENCES users(uuid) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS totp_recovery_codes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_uuid TEXT NOT NULL,
+    code_hash TEXT NOT NULL,
+    used_at DATETIME,
+    FOREIGN KEY(user_uuid) REFERENCES users(uuid) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_totp_recovery_codes_user
+ON totp_recovery_codes(user_uuid, code_hash);
+
+-- Logins waiting for their second factor. Only an HMAC of the challenge is
+-- kept.
+CREATE TABLE IF NOT EXISTS login_challenges (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    challenge_hash TEXT UNIQUE NOT NULL,
+    user_uuid TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    expires_at DATETIME NOT NULL,
+    FOREIGN KEY(user_uuid) REFERENCES users(uuid) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_user
+ON sessions(user_uuid);
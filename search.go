@@ -0,0 +1,408 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"html"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Full-text search uses SQLite FTS5, which go-sqlite3 only compiles in when
+// built with -tags sqlite_fts5 (go build -tags sqlite_fts5). The tag is
+// optional: a plain go build drops the index triggers so writes keep working,
+// and /search falls back to scanning with LIKE, with the same matching rules
+// but newest results first instead of ranked. The next FTS5-enabled start
+// rebuilds the index from scratch.
+var searchEnabled bool
+
+// The index tables use external content, so they store only the index and
+// read text back from posts, comments and private_messages.
+const searchSchema = `
+CREATE VIRTUAL TABLE IF NOT EXISTS posts_fts USING fts5(title, content, content='posts', content_rowid='id');
+CREATE VIRTUAL TABLE IF NOT EXISTS comments_fts USING fts5(content, content='comments', content_rowid='id');
+CREATE VIRTUAL TABLE IF NOT EXISTS private_messages_fts USING fts5(content, content='private_messages', content_rowid='id');
+
+CREATE TRIGGER posts_fts_ai AFTER INSERT ON posts BEGIN
+    INSERT INTO posts_fts(rowid, title, content) VALUES (new.id, new.title, new.content);
+END;
+CREATE TRIGGER posts_fts_ad AFTER DELETE ON posts BEGIN
+    INSERT INTO posts_fts(posts_fts, rowid, title, content) VALUES ('delete', old.id, old.title, old.content);
+END;
+CREATE TRIGGER posts_fts_au AFTER UPDATE OF title, content ON posts BEGIN
+    INSERT INTO posts_fts(posts_fts, rowid, title, content) VALUES ('delete', old.id, old.title, old.content);
+    INSERT INTO posts_fts(rowid, title, content) VALUES (new.id, new.title, new.content);
+END;
+
+CREATE TRIGGER comments_fts_ai AFTER INSERT ON comments BEGIN
+    INSERT INTO comments_fts(rowid, content) VALUES (new.id, new.content);
+END;
+CREATE TRIGGER comments_fts_ad AFTER DELETE ON comments BEGIN
+    INSERT INTO comments_fts(comments_fts, rowid, content) VALUES ('delete', old.id, old.content);
+END;
+CREATE TRIGGER comments_fts_au AFTER UPDATE OF content ON comments BEGIN
+    INSERT INTO comments_fts(comments_fts, rowid, content) VALUES ('delete', old.id, old.content);
+    INSERT INTO comments_fts(rowid, content) VALUES (new.id, new.content);
+END;
+
+CREATE TRIGGER private_messages_fts_ai AFTER INSERT ON private_messages BEGIN
+    INSERT INTO private_messages_fts(rowid, content) VALUES (new.id, new.content);
+END;
+CREATE TRIGGER private_messages_fts_ad AFTER DELETE ON private_messages BEGIN
+    INSERT INTO private_messages_fts(private_messages_fts, rowid, content) VALUES ('delete', old.id, old.content);
+END;
+CREATE TRIGGER private_messages_fts_au AFTER UPDATE OF content ON private_messages BEGIN
+    INSERT INTO private_messages_fts(private_messages_fts, rowid, content) VALUES ('delete', old.id, old.content);
+    INSERT INTO private_messages_fts(rowid, content) VALUES (new.id, new.content);
+END;
+
+INSERT INTO posts_fts(posts_fts) VALUES ('rebuild');
+INSERT INTO comments_fts(comments_fts) VALUES ('rebuild');
+INSERT INTO private_messages_fts(private_messages_fts) VALUES ('rebuild');
+`
+
+var searchTriggers = []string{
+	"posts_fts_ai", "posts_fts_ad", "posts_fts_au",
+	"comments_fts_ai", "comments_fts_ad", "comments_fts_au",
+	"private_messages_fts_ai", "private_messages_fts_ad", "private_messages_fts_au",
+}
+
+// setupSearch creates the search index on first start, or rebuilds it when a
+// start without FTS5 dropped its triggers.
+func setupSearch(db *sql.DB) error {
+	var fts5 bool
+	if err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts5); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if !fts5 {
+		for _, name := range searchTriggers {
+			if _, err := tx.Exec("DROP TRIGGER IF EXISTS " + name); err != nil {
+				return err
+			}
+		}
+		log.Println("Warning: SQLite was built without FTS5 (build with -tags sqlite_fts5); search falls back to unindexed LIKE queries")
+		return tx.Commit()
+	}
+
+	var indexed bool
+	if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'trigger' AND name = 'posts_fts_ai')`).Scan(&indexed); err != nil {
+		return err
+	}
+	if !indexed {
+		if _, err := tx.Exec(searchSchema); err != nil {
+			return err
+		}
+		log.Println("Built full-text search index")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	searchEnabled = true
+	return nil
+}
+
+const (
+	SearchScopePosts    = "posts"
+	SearchScopeComments = "comments"
+	SearchScopeMessages = "messages"
+)
+
+// SearchResult is one hit. Snippet is HTML: escaped text with matched terms
+// wrapped in <mark>.
+type SearchResult struct {
+	PostUUID    string    `json:"post_uuid,omitempty"`    // posts and comments
+	PostTitle   string    `json:"post_title,omitempty"`   // posts and comments
+	CommentID   int64     `json:"comment_id,omitempty"`   // comments
+	MessageUUID string    `json:"message_uuid,omitempty"` // messages
+	With        string    `json:"with,omitempty"`         // messages: the other participant
+	Snippet     string    `json:"snippet"`
+	Author      string    `json:"author"` // nickname
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type SearchResponse struct {
+	Results    []SearchResult `json:"results"`
+	NextOffset int            `json:"next_offset,omitempty"` // 0 when there are no more results
+}
+
+// matchQuery turns what a user typed into an FTS5 query. Every word must
+// appear and the last may be a prefix, so results narrow while typing. Words
+// are quoted, which makes FTS5 operators in the input plain text.
+func matchQuery(q string) string {
+	words := strings.Fields(q)
+	for i, w := range words {
+		words[i] = `"` + strings.ReplaceAll(w, `"`, `""`) + `"`
+	}
+	if len(words) > 0 {
+		words[len(words)-1] += "*"
+	}
+	return strings.Join(words, " ")
+}
+
+// snippet() marks matches with control characters, which escaping leaves
+// alone, and snippetHTML turns them into <mark> tags after escaping.
+var snippetMarks = strings.NewReplacer("\x02", "<mark>", "\x03", "</mark>")
+
+func snippetHTML(snippet string) string {
+	return snippetMarks.Replace(html.EscapeString(snippet))
+}
+
+// Search runs a ranked full-text query in one scope. Message search only
+// covers conversations viewerUUID takes part in.
+func Search(db *sql.DB, viewerUUID, scope, q string, limit, offset int) ([]SearchResult, error) {
+	if !searchEnabled {
+		return likeSearch(db, viewerUUID, scope, q, limit, offset)
+	}
+	match := matchQuery(q)
+
+	var rows *sql.Rows
+	var err error
+	switch scope {
+	case SearchScopePosts:
+		// Title hits count for more than body hits.
+		rows, err = db.Query(`
+            SELECT p.post_uuid, p.title, snippet(posts_fts, -1, char(2), char(3), '…', 16), u.nickname, p.created_at
+            FROM posts_fts
+            JOIN posts p ON p.id = posts_fts.rowid
+            JOIN users u ON u.uuid = p.user_uuid
+            WHERE posts_fts MATCH ? AND p.deleted_at IS NULL
+            ORDER BY bm25(posts_fts, 5.0, 1.0)
+            LIMIT ? OFFSET ?`, match, limit, offset)
+	case SearchScopeComments:
+		rows, err = db.Query(`
+            SELECT c.id, p.post_uuid, p.title, snippet(comments_fts, 0, char(2), char(3), '…', 16), u.nickname, c.created_at
+            FROM comments_fts
+            JOIN comments c ON c.id = comments_fts.rowid
+            JOIN posts p ON p.id = c.post_id
+            JOIN users u ON u.uuid = c.user_uuid
+            WHERE comments_fts MATCH ? AND c.deleted_at IS NULL AND p.deleted_at IS NULL
+            ORDER BY comments_fts.rank
+            LIMIT ? OFFSET ?`, match, limit, offset)
+	case SearchScopeMessages:
+		rows, err = db.Query(`
+            SELECT m.uuid, CASE WHEN m.sender_uuid = ? THEN m.receiver_uuid ELSE m.sender_uuid END,
+                   snippet(private_messages_fts, 0, char(2), char(3), '…', 16), u.nickname, m.sent_at
+            FROM private_messages_fts
+            JOIN private_messages m ON m.id = private_messages_fts.rowid
+            JOIN users u ON u.uuid = m.sender_uuid
+            WHERE private_messages_fts MATCH ?
+              AND (m.sender_uuid = ? OR m.receiver_uuid = ?)
+              AND m.deleted_at IS NULL
+            ORDER BY private_messages_fts.rank
+            LIMIT ? OFFSET ?`, viewerUUID, match, viewerUUID, viewerUUID, limit, offset)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return scanSearchResults(rows, scope, snippetHTML)
+}
+
+// likeWhere requires every word of the query in one of the columns.
+func likeWhere(words []string, columns ...string) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	escape := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	for _, w := range words {
+		var either []string
+		for _, col := range columns {
+			either = append(either, col+` LIKE ? ESCAPE '\'`)
+			args = append(args, "%"+escape.Replace(w)+"%")
+		}
+		conds = append(conds, "("+strings.Join(either, " OR ")+")")
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// likeSearch is Search for builds without FTS5. Words match anywhere,
+// case-insensitively for ASCII, and results come newest first.
+func likeSearch(db *sql.DB, viewerUUID, scope, q string, limit, offset int) ([]SearchResult, error) {
+	words := strings.Fields(q)
+	if len(words) == 0 {
+		return []SearchResult{}, nil
+	}
+
+	var rows *sql.Rows
+	var err error
+	switch scope {
+	case SearchScopePosts:
+		where, args := likeWhere(words, "p.title", "p.content")
+		rows, err = db.Query(`
+            SELECT p.post_uuid, p.title, p.content, u.nickname, p.created_at
+            FROM posts p
+            JOIN users u ON u.uuid = p.user_uuid
+            WHERE `+where+` AND p.deleted_at IS NULL
+            ORDER BY p.id DESC
+            LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+	case SearchScopeComments:
+		where, args := likeWhere(words, "c.content")
+		rows, err = db.Query(`
+            SELECT c.id, p.post_uuid, p.title, c.content, u.nickname, c.created_at
+            FROM comments c
+            JOIN posts p ON p.id = c.post_id
+            JOIN users u ON u.uuid = c.user_uuid
+            WHERE `+where+` AND c.deleted_at IS NULL AND p.deleted_at IS NULL
+            ORDER BY c.id DESC
+            LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+	case SearchScopeMessages:
+		where, args := likeWhere(words, "m.content")
+		args = append([]interface{}{viewerUUID}, args...)
+		rows, err = db.Query(`
+            SELECT m.uuid, CASE WHEN m.sender_uuid = ? THEN m.receiver_uuid ELSE m.sender_uuid END,
+                   m.content, u.nickname, m.sent_at
+            FROM private_messages m
+            JOIN users u ON u.uuid = m.sender_uuid
+            WHERE `+where+`
+              AND (m.sender_uuid = ? OR m.receiver_uuid = ?)
+              AND m.deleted_at IS NULL
+            ORDER BY m.id DESC
+            LIMIT ? OFFSET ?`, append(args, viewerUUID, viewerUUID, limit, offset)...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return scanSearchResults(rows, scope, func(text string) string { return likeSnippet(text, words) })
+}
+
+// likeSnippetContext is how many bytes of text likeSnippet keeps either side
+// of the first match.
+const likeSnippetContext = 60
+
+// likeSnippet is the fallback for FTS5's snippet(): the text around the first
+// match, escaped, with every match wrapped in <mark>.
+func likeSnippet(text string, words []string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		quoted[i] = regexp.QuoteMeta(w)
+	}
+	re, err := regexp.Compile(`(?i)` + strings.Join(quoted, "|"))
+	if err != nil || len(words) == 0 {
+		return html.EscapeString(excerpt(text, 2*likeSnippetContext))
+	}
+
+	start, end := 0, len(text)
+	if first := re.FindStringIndex(text); first != nil {
+		start = max(0, first[0]-likeSnippetContext)
+		end = min(len(text), first[1]+likeSnippetContext)
+	} else {
+		end = min(len(text), 2*likeSnippetContext)
+	}
+	// Cut at spaces so no word, or character, is split.
+	if start > 0 {
+		if i := strings.IndexByte(text[start:], ' '); i >= 0 {
+			start += i + 1
+		}
+	}
+	if end < len(text) {
+		if i := strings.LastIndexByte(text[:end], ' '); i > start {
+			end = i
+		}
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	window := text[start:end]
+	last := 0
+	for _, m := range re.FindAllStringIndex(window, -1) {
+		b.WriteString(html.EscapeString(window[last:m[0]]))
+		b.WriteString("<mark>" + html.EscapeString(window[m[0]:m[1]]) + "</mark>")
+		last = m[1]
+	}
+	b.WriteString(html.EscapeString(window[last:]))
+	if end < len(text) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// scanSearchResults reads the rows of a search query, turning the snippet
+// column into HTML with snippet.
+func scanSearchResults(rows *sql.Rows, scope string, snippet func(string) string) ([]SearchResult, error) {
+	defer rows.Close()
+
+	results := make([]SearchResult, 0)
+	for rows.Next() {
+		var res SearchResult
+		var err error
+		switch scope {
+		case SearchScopePosts:
+			err = rows.Scan(&res.PostUUID, &res.PostTitle, &res.Snippet, &res.Author, &res.CreatedAt)
+		case SearchScopeComments:
+			err = rows.Scan(&res.CommentID, &res.PostUUID, &res.PostTitle, &res.Snippet, &res.Author, &res.CreatedAt)
+		case SearchScopeMessages:
+			err = rows.Scan(&res.MessageUUID, &res.With, &res.Snippet, &res.Author, &res.CreatedAt)
+		}
+		if err != nil {
+			return nil, err
+		}
+		res.Snippet = snippet(res.Snippet)
+		results = append(results, res)
+	}
+	return results, rows.Err()
+}
+
+// SearchHandler: GET /search?q=&scope=posts|comments|messages[&limit=&offset=]
+func SearchHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		q := strings.TrimSpace(r.URL.Query().Get("q"))
+		if q == "" {
+			http.Error(w, "Missing search query", http.StatusBadRequest)
+			return
+		}
+
+		scope := r.URL.Query().Get("scope")
+		if scope == "" {
+			scope = SearchScopePosts
+		}
+		if scope != SearchScopePosts && scope != SearchScopeComments && scope != SearchScopeMessages {
+			http.Error(w, "scope must be posts, comments or messages", http.StatusBadRequest)
+			return
+		}
+
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = 20
+		}
+		limit = min(limit, 50)
+		offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+		if err != nil || offset < 0 {
+			offset = 0
+		}
+
+		// Fetch one extra row to tell whether there is another page.
+		results, err := Search(db, userUUID, scope, q, limit+1, offset)
+		if err != nil {
+			log.Printf("Search error (scope=%s, q=%q): %v", scope, q, err)
+			http.Error(w, "Search failed", http.StatusInternalServerError)
+			return
+		}
+
+		resp := SearchResponse{Results: results}
+		if len(results) > limit {
+			resp.Results = results[:limit]
+			resp.NextOffset = offset + limit
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"database/sql"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// searchTest holds a post, comment and messages about tomatoes, plus the
+// same in deleted form.
+type searchTest struct {
+	db                        *sql.DB
+	alice, bob, carol         string
+	post, deletedPost         string
+	comment, orphan           int64 // orphan is on the deleted post
+	message, carols, deletedM string
+}
+
+func newSearchTest(t *testing.T) *searchTest {
+	t.Helper()
+	db := newTestDB(t)
+	st := &searchTest{db: db,
+		alice: createTestUser(t, db, "alice"), bob: createTestUser(t, db, "bob"), carol: createTestUser(t, db, "carol")}
+	now := time.Now()
+
+	post := func(title, content string) string {
+		postUUID := uuid.New().String()
+		if err := InsertPost(db, postUUID, st.alice, title, content, nil, nil, now); err != nil {
+			t.Fatal(err)
+		}
+		return postUUID
+	}
+	comment := func(postUUID, content string) int64 {
+		id, _, err := InsertComment(db, st.bob, postUUID, "", content, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	message := func(from, to, content string) string {
+		messageUUID := uuid.New().String()
+		if _, _, err := SaveMessage(db, messageUUID, from, to, content, nil, now); err != nil {
+			t.Fatal(err)
+		}
+		return messageUUID
+	}
+
+	st.post = post("Growing tomatoes", "They need sun.")
+	st.comment = comment(st.post, "Mine are tomatoes from seed")
+	st.deletedPost = post("Old tomatoes thread", "tomatoes again")
+	st.orphan = comment(st.deletedPost, "tomatoes in a deleted thread")
+	deletedComment := comment(st.post, "deleted tomatoes")
+	st.message = message(st.alice, st.bob, "tomatoes for dinner?")
+	st.carols = message(st.bob, st.carol, "bob has tomatoes")
+	st.deletedM = message(st.alice, st.bob, "tomatoes, never mind")
+
+	if err := DeleteComment(db, deletedComment, st.bob, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeletePost(db, st.deletedPost, st.alice, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DeleteMessage(db, st.deletedM, st.alice, now); err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func TestSearch(t *testing.T) {
+	paths := []struct {
+		name   string
+		search func(db *sql.DB, viewerUUID, scope, q string, limit, offset int) ([]SearchResult, error)
+		ranked bool // needs the FTS5 index
+	}{
+		{"like", likeSearch, false},
+		{"fts5", Search, true},
+	}
+	for _, path := range paths {
+		t.Run(path.name, func(t *testing.T) {
+			st := newSearchTest(t)
+			if path.ranked && !searchEnabled {
+				t.Skip("SQLite built without FTS5; run with -tags sqlite_fts5")
+			}
+			tests := []struct {
+				name   string
+				viewer string
+				scope  string
+				q      string
+				want   []string // post uuids, comment ids or message uuids
+			}{
+				{"posts", st.bob, SearchScopePosts, "tomatoes", []string{st.post}},
+				{"posts by prefix", st.bob, SearchScopePosts, "growing tomat", []string{st.post}},
+				{"posts without a match", st.bob, SearchScopePosts, "potatoes", nil},
+				{"comments", st.bob, SearchScopeComments, "tomatoes", []string{itoa(st.comment)}},
+				{"messages as sender", st.alice, SearchScopeMessages, "tomatoes", []string{st.message}},
+				{"messages as receiver", st.bob, SearchScopeMessages, "tomatoes", []string{st.message, st.carols}},
+				{"messages of others", st.carol, SearchScopeMessages, "dinner", nil},
+			}
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					results, err := path.search(st.db, tt.viewer, tt.scope, tt.q, 10, 0)
+					if err != nil {
+						t.Fatal(err)
+					}
+					var got []string
+					for _, r := range results {
+						switch tt.scope {
+						case SearchScopePosts:
+							got = append(got, r.PostUUID)
+						case SearchScopeComments:
+							got = append(got, itoa(r.CommentID))
+						case SearchScopeMessages:
+							got = append(got, r.MessageUUID)
+						}
+					}
+					slices.Sort(got)
+					want := slices.Clone(tt.want)
+					slices.Sort(want)
+					if !slices.Equal(got, want) {
+						t.Errorf("got %v, want %v", got, want)
+					}
+				})
+			}
+
+			// Results name the post and the other participant, with marked
+			// snippets.
+			results, _ := path.search(st.db, st.bob, SearchScopeComments, "seed", 10, 0)
+			if len(results) != 1 || results[0].PostUUID != st.post || results[0].PostTitle != "Growing tomatoes" {
+				t.Errorf("comment result %+v", results)
+			}
+			results, _ = path.search(st.db, st.carol, SearchScopeMessages, "tomatoes", 10, 0)
+			if len(results) != 1 || results[0].With != st.bob || results[0].Snippet != "bob has <mark>tomatoes</mark>" {
+				t.Errorf("message result %+v", results)
+			}
+		})
+	}
+}
+
+func itoa(n int64) string {
+	return strconv.FormatInt(n, 10)
+}
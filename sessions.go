@@ -0,0 +1,255 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Users can see where they are logged in and end any of those sessions.
+// Sessions record the user agent and IP they were created from and when
+// they were last used; the session_uuid itself is the cookie value and
+// never leaves the server, so sessions are named by their row id instead.
+// Revoking a session deletes it and logs out its open tabs with a
+// force_logout frame, as LogoutHandler does for the current one.
+
+var (
+	// sessionTouchInterval limits how often last_seen_at is written for a
+	// session that keeps making requests.
+	sessionTouchInterval = envDuration("SESSION_TOUCH_INTERVAL", time.Minute)
+	// trustProxyHeaders takes the client IP from X-Forwarded-For, for
+	// deployments behind a reverse proxy that sets it.
+	trustProxyHeaders = envString("TRUST_PROXY_HEADERS", "false") == "true"
+)
+
+var ErrSessionNotOwned = errors.New("session not found")
+
+type SessionInfo struct {
+	ID         int64     `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`   // the session making the request
+	Connected  bool      `json:"connected"` // has an open WebSocket
+}
+
+// clientIP is the address a request came from.
+func clientIP(r *http.Request) string {
+	if trustProxyHeaders {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// sessionTouches remembers when last_seen_at was last written for each
+// session, so a busy session costs one UPDATE per sessionTouchInterval
+// rather than one per request.
+var sessionTouches = struct {
+	sync.Mutex
+	at       map[string]time.Time
+	prunedAt time.Time
+}{at: make(map[string]time.Time)}
+
+// TouchSession records that the session was just used.
+func TouchSession(db *sql.DB, sessionUUID string) error {
+	now := time.Now()
+	sessionTouches.Lock()
+	if now.Sub(sessionTouches.at[sessionUUID]) < sessionTouchInterval {
+		sessionTouches.Unlock()
+		return nil
+	}
+	sessionTouches.at[sessionUUID] = now
+	// Entries older than the interval no longer hold back a write.
+	if now.Sub(sessionTouches.prunedAt) >= sessionTouchInterval {
+		for s, at := range sessionTouches.at {
+			if now.Sub(at) >= sessionTouchInterval {
+				delete(sessionTouches.at, s)
+			}
+		}
+		sessionTouches.prunedAt = now
+	}
+	sessionTouches.Unlock()
+
+	_, err := db.Exec(`UPDATE sessions SET last_seen_at = ? WHERE session_uuid = ?`, now, sessionUUID)
+	return err
+}
+
+// ListSessions returns the user's unexpired sessions, most recently used
+// first.
+func ListSessions(db *sql.DB, hub *Hub, userUUID, currentUUID string) ([]SessionInfo, error) {
+	rows, err := db.Query(`SELECT id, session_uuid, COALESCE(user_agent, ''), COALESCE(ip, ''),
+            created_at, last_seen_at, expires_at
+        FROM sessions
+        WHERE user_uuid = ? AND julianday(expires_at) > ?
+        ORDER BY COALESCE(last_seen_at, created_at) DESC, id DESC`, userUUID, julianDay(time.Now().Unix()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	connected := hub.ConnectedSessions(userUUID)
+	sessions := []SessionInfo{}
+	for rows.Next() {
+		var s SessionInfo
+		var sessionUUID string
+		var createdAt, lastSeenAt sql.NullTime // unknown for sessions from before they were recorded
+		if err := rows.Scan(&s.ID, &sessionUUID, &s.UserAgent, &s.IP, &createdAt, &lastSeenAt, &s.ExpiresAt); err != nil {
+			return nil, err
+		}
+		s.CreatedAt = createdAt.Time
+		s.LastSeenAt = lastSeenAt.Time
+		if !lastSeenAt.Valid {
+			s.LastSeenAt = createdAt.Time
+		}
+		s.Current = sessionUUID == currentUUID
+		s.Connected = connected[sessionUUID]
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeSession deletes one of the user's sessions and returns its uuid.
+func RevokeSession(db *sql.DB, userUUID string, id int64) (string, error) {
+	var sessionUUID string
+	err := db.QueryRow(`SELECT session_uuid FROM sessions WHERE id = ? AND user_uuid = ?`, id, userUUID).Scan(&sessionUUID)
+	if err == sql.ErrNoRows {
+		return "", ErrSessionNotOwned
+	}
+	if err != nil {
+		return "", err
+	}
+	return sessionUUID, DeleteSession(db, sessionUUID)
+}
+
+// RevokeOtherSessions deletes all of the user's sessions but the current
+// one and returns their uuids.
+func RevokeOtherSessions(db *sql.DB, userUUID, currentUUID string) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT session_uuid FROM sessions WHERE user_uuid = ? AND session_uuid != ?`, userUUID, currentUUID)
+	if err != nil {
+		return nil, err
+	}
+	var revoked []string
+	for rows.Next() {
+		var sessionUUID string
+		if err := rows.Scan(&sessionUUID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		revoked = append(revoked, sessionUUID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM sessions WHERE user_uuid = ? AND session_uuid != ?`, userUUID, currentUUID); err != nil {
+		return nil, err
+	}
+	return revoked, tx.Commit()
+}
+
+// SessionsHandler: GET /sessions
+func SessionsHandler(db *sql.DB, hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		cookie, _ := r.Cookie("session_token") // AuthMiddleware checked it
+		sessions, err := ListSessions(db, hub, userUUID, cookie.Value)
+		if err != nil {
+			log.Printf("Error listing sessions: %v", err)
+			http.Error(w, "Failed to load sessions", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sessions)
+	}
+}
+
+// RevokeSessionHandler: DELETE /session?id=
+func RevokeSessionHandler(db *sql.DB, hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "'id' must be a session id", http.StatusBadRequest)
+			return
+		}
+		sessionUUID, err := RevokeSession(db, userUUID, id)
+		switch err {
+		case nil:
+		case ErrSessionNotOwned:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		default:
+			log.Printf("Error revoking session: %v", err)
+			http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+			return
+		}
+
+		hub.DisconnectSession(userUUID, sessionUUID, forceLogoutFrame())
+
+		// Revoking the current session is logging out.
+		if cookie, _ := r.Cookie("session_token"); cookie != nil && cookie.Value == sessionUUID {
+			http.SetCookie(w, &http.Cookie{
+				Name:     "session_token",
+				Value:    "",
+				Path:     "/",
+				MaxAge:   -1,
+				HttpOnly: true,
+			})
+		}
+		w.Write([]byte("Session revoked"))
+	}
+}
+
+// RevokeOtherSessionsHandler: DELETE /sessions, ending every session but the
+// current one
+func RevokeOtherSessionsHandler(db *sql.DB, hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		cookie, _ := r.Cookie("session_token")
+		revoked, err := RevokeOtherSessions(db, userUUID, cookie.Value)
+		if err != nil {
+			log.Printf("Error revoking sessions: %v", err)
+			http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+			return
+		}
+		for _, sessionUUID := range revoked {
+			hub.DisconnectSession(userUUID, sessionUUID, forceLogoutFrame())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"revoked": len(revoked)})
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// addSession creates another session for the user, expiring after ttl.
+func addSession(t *testing.T, db *sql.DB, userUUID string, ttl time.Duration) string {
+	t.Helper()
+	sessionUUID := uuid.New().String()
+	if err := CreateSession(db, sessionUUID, userUUID, time.Now().Add(ttl), "other", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	return sessionUUID
+}
+
+// sessionIDs maps the user's listed sessions from uuid to row id.
+func sessionIDs(t *testing.T, db *sql.DB, userUUID string) map[string]int64 {
+	t.Helper()
+	rows, err := db.Query(`SELECT session_uuid, id FROM sessions WHERE user_uuid = ?`, userUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	ids := make(map[string]int64)
+	for rows.Next() {
+		var sessionUUID string
+		var id int64
+		if err := rows.Scan(&sessionUUID, &id); err != nil {
+			t.Fatal(err)
+		}
+		ids[sessionUUID] = id
+	}
+	return ids
+}
+
+func TestListSessions(t *testing.T) {
+	ht := newHubTest(t, 2)
+	bob, alice := ht.users[0], ht.users[1]
+	other := addSession(t, ht.db, bob.uuid, time.Hour)
+	addSession(t, ht.db, bob.uuid, -time.Second) // expired
+	conn, err := ht.dial(bob, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ht.waitForConnections(1)
+
+	sessions, err := ListSessions(ht.db, ht.hub, bob.uuid, bob.session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := sessionIDs(t, ht.db, bob.uuid)
+	want := map[int64]SessionInfo{
+		ids[bob.session]: {UserAgent: "test", IP: "127.0.0.1", Current: true, Connected: true},
+		ids[other]:       {UserAgent: "other", IP: "10.0.0.1"},
+	}
+	if len(sessions) != len(want) {
+		t.Fatalf("got %d sessions, want %d: %+v", len(sessions), len(want), sessions)
+	}
+	for _, s := range sessions {
+		w, ok := want[s.ID]
+		if !ok {
+			t.Errorf("unexpected session %+v", s)
+			continue
+		}
+		if s.UserAgent != w.UserAgent || s.IP != w.IP || s.Current != w.Current || s.Connected != w.Connected {
+			t.Errorf("session %d: got %+v, want %+v", s.ID, s, w)
+		}
+		if s.LastSeenAt.IsZero() {
+			t.Errorf("session %d has no last use", s.ID)
+		}
+	}
+
+	// Alice sees only alice's own.
+	sessions, err = ListSessions(ht.db, ht.hub, alice.uuid, alice.session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || !sessions[0].Current || sessions[0].Connected {
+		t.Errorf("alice's sessions: %+v", sessions)
+	}
+}
+
+func TestRevokeSession(t *testing.T) {
+	db := newTestDB(t)
+	bob := createTestUser(t, db, "bob")
+	alice := createTestUser(t, db, "alice")
+	mine := addSession(t, db, bob, time.Hour)
+	kept := addSession(t, db, bob, time.Hour)
+	theirs := addSession(t, db, alice, time.Hour)
+	bobs, alices := sessionIDs(t, db, bob), sessionIDs(t, db, alice)
+
+	tests := []struct {
+		name string
+		id   int64
+		want string
+		err  error
+	}{
+		{"another user's", alices[theirs], "", ErrSessionNotOwned},
+		{"unknown", -1, "", ErrSessionNotOwned},
+		{"own", bobs[mine], mine, nil},
+		{"already revoked", bobs[mine], "", ErrSessionNotOwned},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := RevokeSession(db, bob, tt.id)
+			if got != tt.want || err != tt.err {
+				t.Errorf("got %q, %v; want %q, %v", got, err, tt.want, tt.err)
+			}
+		})
+	}
+	if _, err := GetSession(db, mine); err != ErrSessionNotFound {
+		t.Errorf("revoked session: %v", err)
+	}
+	for _, s := range []string{kept, theirs} {
+		if _, err := GetSession(db, s); err != nil {
+			t.Errorf("session %s: %v", s, err)
+		}
+	}
+}
+
+func TestRevokeOtherSessions(t *testing.T) {
+	db := newTestDB(t)
+	bob := createTestUser(t, db, "bob")
+	alice := createTestUser(t, db, "alice")
+	current := addSession(t, db, bob, time.Hour)
+	others := map[string]bool{addSession(t, db, bob, time.Hour): true, addSession(t, db, bob, time.Hour): true}
+	theirs := addSession(t, db, alice, time.Hour)
+
+	revoked, err := RevokeOtherSessions(db, bob, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked) != len(others) {
+		t.Errorf("revoked %v, want %d sessions", revoked, len(others))
+	}
+	for _, s := range revoked {
+		if !others[s] {
+			t.Errorf("revoked %s", s)
+		}
+		if _, err := GetSession(db, s); err != ErrSessionNotFound {
+			t.Errorf("revoked session %s: %v", s, err)
+		}
+	}
+	for _, s := range []string{current, theirs} {
+		if _, err := GetSession(db, s); err != nil {
+			t.Errorf("session %s: %v", s, err)
+		}
+	}
+}
+
+func TestDisconnectSession(t *testing.T) {
+	ht := newHubTest(t, 1)
+	bob := ht.users[0]
+	other := hubTestUser{uuid: bob.uuid, session: addSession(t, ht.db, bob.uuid, time.Hour)}
+
+	dial := func(u hubTestUser) *websocket.Conn {
+		conn, err := ht.dial(u, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	revoked := []*websocket.Conn{dial(bob), dial(bob)}
+	kept := dial(other)
+	ht.waitForConnections(3)
+
+	ht.hub.DisconnectSession(bob.uuid, bob.session, forceLogoutFrame())
+	for _, conn := range revoked {
+		expectFrame(t, conn, FrameForceLogout)
+		if _, _, err := conn.ReadMessage(); err == nil {
+			t.Error("connection left open after force_logout")
+		}
+	}
+	ht.waitForConnections(1)
+	if got := ht.hub.ConnectedSessions(bob.uuid); len(got) != 1 || !got[other.session] {
+		t.Errorf("connected sessions: %v", got)
+	}
+
+	// The other session's tab is still served and never saw the frame.
+	sendFrame(kept, FrameResume, "r", ResumePayload{})
+	kept.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var env Envelope
+		if err := kept.ReadJSON(&env); err != nil {
+			t.Fatalf("other session: %v", err)
+		}
+		if env.Type == FrameForceLogout {
+			t.Fatal("force_logout sent to another session")
+		}
+		if env.Type == FrameResumed {
+			break
+		}
+	}
+}
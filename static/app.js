@@ -1,17 +1,23 @@
 let socket = null
 let chatWith = ""
-let messagesOffset = 0
+let messagesCursor = null // next_cursor of the last history page loaded
+let hasMoreMessages = true
 let currentUserUUID = ""
-let postOffset = 0
+let currentUserRole = ""
+let postsCursor = "" // next_cursor of the last feed page, "" before the first
+let postSort = "new"
+let postWindow = "all" // top sort only
 const postLimit = 5
 let allUsers = []
 let notificationTimeout;
+let unreadNotifications = 0;
 let typingTimer = null
 let isCurrentlyTyping = false
 let typingUsers = new Map() // Map of userUUID -> {nickname, isTyping}
 const postModal = document.getElementById('post-modal');
 const modalCloseBtn = document.getElementById('modal-close-btn');
-let currentCategory = "";
+let currentCategory = ""; // slug of the selected category, "" for all
+let currentTag = ""; // tag the feed is filtered by, "" for none
 let isLoadingMessages = false;
 let chatScrollHandlerAttached = false;
 
@@ -43,6 +49,7 @@ function renderRoute(path, isLoggedIn = false) {
 function showLoginUI() {
   document.getElementById("login-section").style.display = "block"
   document.getElementById("register-section").style.display = "none"
+  document.getElementById("reset-section").style.display = "none"
   document.getElementById("forum-view").style.display = "none"
   document.getElementById("main-header").style.display = "none"
   document.getElementById("chat-popup").style.display = "none"
@@ -54,6 +61,7 @@ function showChatUI() {
   document.getElementById("error-page").style.display = "none";
   document.getElementById("login-section").style.display = "none"
   document.getElementById("register-section").style.display = "none"
+  document.getElementById("reset-section").style.display = "none"
   document.getElementById("main-header").style.display = "flex"
   document.getElementById("forum-view").style.display = "block"
   document.getElementById("chat-popup").style.display = "flex"
@@ -84,10 +92,11 @@ function populateCategoriesSelector() {
     .then(categories => {
       const select = document.getElementById("post-categories-select");
       select.innerHTML = ""; // Clear existing options
-      categories.forEach(cat => {
+      // Only offer the categories this user may post in.
+      categories.filter(cat => cat.can_post).forEach(cat => {
         const option = document.createElement("option");
-        option.value = cat;
-        option.textContent = cat;
+        option.value = cat.slug;
+        option.textContent = cat.name;
         select.appendChild(option);
       });
     })
@@ -108,7 +117,8 @@ function hideChatPopup() {
 
   // Clear chat state when closing
   chatWith = "";
-  messagesOffset = 0;
+  messagesCursor = null;
+  hasMoreMessages = true;
 
   // Clear typing status
   clearTimeout(typingTimer);
@@ -157,32 +167,73 @@ function setupChatScrollHandler() {
 function createMessageElement(msg) {
   const div = document.createElement("div");
   div.classList.add("message-item");
+  if (msg.uuid) div.dataset.uuid = msg.uuid;
 
   // Determine if the message is from the current user or someone else
   const isSelf = msg.from === currentUserUUID;
   const author = isSelf ? "You" : msg.from_nickname;
 
   div.classList.add(isSelf ? "self" : "other");
-  // html escaping to prevent html injections
-  const safeContent = msg.content
-    .replace(/&/g, "&amp;")
-    .replace(/</g, "&lt;")
-    .replace(/>/g, "&gt;")
-    .replace(/"/g, "&quot;")
-    .replace(/'/g, "&#x27;")
-    .replace(/\//g, "&#x2F;");
 
   // Format the timestamp
   const time = new Date(msg.sent_at).toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' });
 
+  const status = isSelf ? `<span class="message-status">${msg.read_at ? "Read" : ""}</span>` : "";
+  const edited = msg.edited && !msg.deleted ? `<span class="message-edited">(edited)</span>` : "";
+
   div.innerHTML = `
     <div class="message-author">${author}</div>
-    <div class="message-content">${safeContent}</div>
-    <div class="message-time">${time}</div>
+    <div class="message-content">${msg.content_html}</div>
+    ${renderAttachments(msg.attachments)}
+    <div class="message-time">${time} ${edited} ${status}</div>
   `;
+  if (msg.deleted) markMessageDeleted(div);
   return div;
 }
 
+// uploadAttachments sends the files picked in input to the server one at a
+// time and resolves to their uuids, ready to reference from a post, comment
+// or message.
+function uploadAttachments(input) {
+  const files = input ? [...input.files] : [];
+  return Promise.all(files.map(file => {
+    const form = new FormData();
+    form.append("file", file);
+    return fetch("/attachments", { method: "POST", credentials: "include", body: form })
+      .then(res => {
+        if (!res.ok) {
+          handleHttpError(res);
+          throw new Error(`HTTP ${res.status}`);
+        }
+        return res.json();
+      })
+      .then(a => a.uuid);
+  }));
+}
+
+// renderAttachments shows images as thumbnails and other files as links.
+// Filenames come from the uploader, so they are escaped.
+function renderAttachments(list) {
+  if (!list || list.length === 0) return "";
+  const items = list.map(a => {
+    const name = a.filename.replace(/&/g, '&amp;').replace(/</g, '&lt;').replace(/>/g, '&gt;').replace(/"/g, '&quot;');
+    if (a.thumbnail_url) {
+      return `<a class="attachment-image" href="${a.url}" target="_blank" rel="noopener" onclick="event.stopPropagation()"><img src="${a.thumbnail_url}" alt="${name}" loading="lazy"></a>`;
+    }
+    return `<a class="attachment-file" href="${a.url}" target="_blank" rel="noopener" onclick="event.stopPropagation()">📄 ${name}</a>`;
+  });
+  return `<div class="attachments">${items.join("")}</div>`;
+}
+
+function markMessageDeleted(div) {
+  div.classList.add("deleted");
+  div.querySelector(".message-content").textContent = "Message deleted";
+  const attachments = div.querySelector(".attachments");
+  if (attachments) attachments.remove();
+  const edited = div.querySelector(".message-edited");
+  if (edited) edited.remove();
+}
+
 // On Page Load
 window.addEventListener("DOMContentLoaded", () => {
   console.log("DOM loaded, initializing application...");
@@ -198,6 +249,26 @@ window.addEventListener("DOMContentLoaded", () => {
       }
     });
   }
+  // @mention links open a chat with the mentioned user.
+  document.addEventListener('click', (e) => {
+    const link = e.target.closest && e.target.closest('a.mention');
+    if (!link) return;
+    e.preventDefault();
+    const nickname = new URLSearchParams(link.search).get('user');
+    const user = allUsers.find(u => u.nickname === nickname);
+    if (user && user.uuid !== currentUserUUID) {
+      if (!postModal.classList.contains("hidden")) closePostModal();
+      openChatFocused(user.uuid);
+    }
+  });
+
+  const notificationsBtn = document.getElementById('notifications-btn');
+  if (notificationsBtn) {
+    notificationsBtn.addEventListener('click', toggleNotificationsPanel);
+    document.getElementById('notifications-read-all').addEventListener('click', () => markNotificationsRead([]));
+    document.getElementById('email-preferences').addEventListener('change', saveEmailPreferences);
+  }
+
   const toggleBtn = document.getElementById('toggle-theme-btn');
   if (toggleBtn) {
     const saved = localStorage.getItem('theme');
@@ -209,11 +280,16 @@ window.addEventListener("DOMContentLoaded", () => {
     });
   }
 
+  // Links from verification and password reset emails
+  const linkParams = new URLSearchParams(window.location.search)
+  const resetToken = linkParams.get("reset")
+  const verifying = linkParams.has("verify") ? verifyEmailLink(linkParams.get("verify")) : Promise.resolve()
+
   // Check session first
-  fetch("/me", {
+  verifying.then(() => fetch("/me", {
     method: "GET",
     credentials: "include"
-  })
+  }))
     .then(res => {
       if (!res.ok) {
         handleHttpError(res);
@@ -226,7 +302,10 @@ window.addEventListener("DOMContentLoaded", () => {
 
       console.log("User authenticated:", data);
       currentUserUUID = data.user_uuid
+      currentUserRole = data.role
       updateWelcomeMessage(data.nickname);
+      setUnreadNotifications(data.unread_notifications);
+      setEmailVerified(data.email_verified);
       console.log("11111111111111111111111111");
 
       renderRoute(window.location.pathname, true);
@@ -237,6 +316,9 @@ window.addEventListener("DOMContentLoaded", () => {
       console.log("2222222222222222222222222222");
       renderRoute(window.location.pathname);
     })
+    .then(() => {
+      if (resetToken) showResetUI(resetToken)
+    })
 
 
   // Login form submit
@@ -277,6 +359,35 @@ window.addEventListener("DOMContentLoaded", () => {
     })
   }
 
+  document.getElementById("show-reset").addEventListener("click", () => showResetUI(""))
+  document.getElementById("reset-back-login").addEventListener("click", () => {
+    window.history.replaceState({}, "", "/")
+    showLoginUI()
+  })
+  document.getElementById("reset-request-form").addEventListener("submit", e => {
+    e.preventDefault()
+    requestPasswordReset()
+  })
+  document.getElementById("reset-password-form").addEventListener("submit", e => {
+    e.preventDefault()
+    resetPassword()
+  })
+  document.getElementById("verify-resend-btn").addEventListener("click", resendVerificationEmail)
+
+  document.getElementById("two-factor-login-form").addEventListener("submit", e => {
+    e.preventDefault()
+    loginTwoFactor()
+  })
+  document.getElementById("security-btn").addEventListener("click", toggleSecurityPanel)
+  document.getElementById("two-factor-setup-btn").addEventListener("click", beginTwoFactorSetup)
+  document.getElementById("two-factor-confirm-form").addEventListener("submit", e => {
+    e.preventDefault()
+    confirmTwoFactorSetup()
+  })
+  document.getElementById("recovery-codes-btn").addEventListener("click", regenerateRecoveryCodes)
+  document.getElementById("two-factor-disable-btn").addEventListener("click", disableTwoFactor)
+  document.getElementById("revoke-other-sessions-btn").addEventListener("click", revokeOtherSessions)
+
   // Logout button
   const logoutBtn = document.getElementById("logout-btn");
   if (logoutBtn) {
@@ -299,6 +410,10 @@ window.addEventListener("DOMContentLoaded", () => {
   if (submitPostBtn) {
     submitPostBtn.addEventListener("click", submitPost)
   }
+  const postTagsInput = document.getElementById("post-tags");
+  if (postTagsInput) {
+    postTagsInput.addEventListener("input", suggestTags)
+  }
 
   // Submit comment button
   const submitCommentBtn = document.getElementById("submit-comment");
@@ -307,22 +422,39 @@ window.addEventListener("DOMContentLoaded", () => {
       const content = document.getElementById("comment-text").value.trim()
       if (!content || !currentPostUUID) return alert("Cannot post empty comment")
 
-      fetch("/comment", {
-        method: "POST",
-        credentials: "include",
-        headers: { "Content-Type": "application/json" },
-        body: JSON.stringify({ post_uuid: currentPostUUID, content })
-      }).then(res => {
-        if (res.ok) {
+      const files = document.getElementById("comment-files")
+      uploadAttachments(files)
+        .then(attachments => postComment(content, undefined, attachments))
+        .then(() => {
           document.getElementById("comment-text").value = ""
-          openPostView(currentPostUUID) // reload comments
-        } else {
-          handleHttpError(res);
-          throw new Error(`HTTP ${res.status}`);
-        }
-      })
+          files.value = ""
+        })
+        .catch(err => console.error("Error commenting:", err))
+    })
+  }
+  const postSortSelect = document.getElementById("post-sort");
+  const postWindowSelect = document.getElementById("post-window");
+  if (postSortSelect && postWindowSelect) {
+    const changeFeedSort = () => {
+      postSort = postSortSelect.value;
+      postWindow = postWindowSelect.value;
+      postWindowSelect.style.display = postSort === "top" ? "" : "none";
+      resetPostFeed();
+    };
+    postSortSelect.addEventListener("change", changeFeedSort);
+    postWindowSelect.addEventListener("change", changeFeedSort);
+  }
+  const commentSortSelect = document.getElementById("comment-sort");
+  if (commentSortSelect) {
+    commentSortSelect.addEventListener("change", () => {
+      commentSort = commentSortSelect.value;
+      if (currentPostUUID) openPostView(currentPostUUID);
     })
   }
+  const loadMoreCommentsBtn = document.getElementById("load-more-comments");
+  if (loadMoreCommentsBtn) {
+    loadMoreCommentsBtn.addEventListener("click", loadMoreComments);
+  }
   initializeChatInput();
 
   console.log("Application initialization complete");
@@ -337,7 +469,8 @@ function updateWelcomeMessage(nickname) {
   }
 }
 
-function showCustomNotification(title, message, senderUUID = null) {
+// onClick, if given, runs when the notification body is clicked.
+function showCustomNotification(title, message, onClick = null) {
   const notificationPopup = document.getElementById('notification-popup');
   const notificationTitle = document.getElementById('notification-title');
   const notificationMessage = document.getElementById('notification-message');
@@ -376,8 +509,8 @@ function showCustomNotification(title, message, senderUUID = null) {
     });
   }
 
-  // Make the notification clickable if we have a sender UUID
-  if (senderUUID) {
+  // Make the notification clickable if it leads somewhere
+  if (onClick) {
     newNotificationPopup.style.cursor = 'pointer';
 
     // Add click listener to the notification content area
@@ -387,8 +520,6 @@ function showCustomNotification(title, message, senderUUID = null) {
         return;
       }
 
-      console.log(`Opening chat with ${senderUUID} from notification click`);
-
       // Hide the notification
       newNotificationPopup.classList.remove('visible');
 
@@ -397,16 +528,7 @@ function showCustomNotification(title, message, senderUUID = null) {
         clearTimeout(notificationTimeout);
       }
 
-      // Open the chat with the sender
-      openChat(senderUUID);
-
-      // Optional: Focus the chat input after opening
-      setTimeout(() => {
-        const chatInput = document.getElementById('chat-input');
-        if (chatInput) {
-          chatInput.focus();
-        }
-      }, 100);
+      onClick();
     });
   } else {
     newNotificationPopup.style.cursor = 'default';
@@ -438,38 +560,321 @@ function login() {
     body: JSON.stringify({ identifier, password })
   })
     .then(res => {
+      if (res.status === 403) {
+        alert("Please confirm your email address first. We sent you a new link.")
+        throw new Error("email not verified")
+      }
       if (!res.ok) {
         handleHttpError(res);
         throw new Error(`HTTP ${res.status}`);
       }
-      return res.text()
+      if (res.status === 202) {
+        // Two-factor authentication: a code is needed before the session.
+        document.getElementById("login-form").classList.add("hidden")
+        document.getElementById("two-factor-login-form").classList.remove("hidden")
+        document.getElementById("two-factor-login-code").focus()
+        return
+      }
+      return res.text().then(afterLogin)
     })
-    .then(() => {
-      // Refetch user UUID and show chat
-      fetch("/me", {
-        method: "GET",
-        credentials: "include"
-      })
-        .then(res => {
-          if (!res.ok) {
-            handleHttpError(res);
-            throw new Error(`HTTP ${res.status}`);
-          }
-          return res.json()
-        })
-        .then(data => {
-          currentUserUUID = data.user_uuid
-          updateWelcomeMessage(data.nickname);
-          showChatUI()
-          connectWebSocket()
-          // fetchAllUsers()
-        })
+    .catch(err => {
+      alert("Login failed: " + err.message)
+    })
+}
+
+// loginTwoFactor sends the second step of a login. Six digits are an app
+// code; anything else is taken for a recovery code.
+function loginTwoFactor() {
+  const input = document.getElementById("two-factor-login-code")
+  const value = input.value.trim()
+  const body = /^\d{6}$/.test(value.replace(/\s/g, "")) ? { code: value } : { recovery_code: value }
+  fetch("/login/2fa", {
+    method: "POST",
+    credentials: "include",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify(body)
+  })
+    .then(res => res.text().then(text => {
+      if (!res.ok) throw new Error(text.trim())
+      input.value = ""
+      document.getElementById("two-factor-login-form").classList.add("hidden")
+      document.getElementById("login-form").classList.remove("hidden")
+      afterLogin()
+    }))
+    .catch(err => {
+      alert("Login failed: " + err.message)
+      if (err.message.startsWith("login expired")) {
+        document.getElementById("two-factor-login-form").classList.add("hidden")
+        document.getElementById("login-form").classList.remove("hidden")
+      }
+    })
+}
+
+// afterLogin loads the logged-in user and opens the forum.
+function afterLogin() {
+  fetch("/me", {
+    method: "GET",
+    credentials: "include"
+  })
+    .then(res => {
+      if (!res.ok) {
+        handleHttpError(res);
+        throw new Error(`HTTP ${res.status}`);
+      }
+      return res.json()
+    })
+    .then(data => {
+      currentUserUUID = data.user_uuid
+      currentUserRole = data.role
+      updateWelcomeMessage(data.nickname);
+      setUnreadNotifications(data.unread_notifications);
+      setEmailVerified(data.email_verified);
+      showChatUI()
+      connectWebSocket()
+      // fetchAllUsers()
     })
     .catch(err => {
       alert("Login failed: " + err.message)
     })
 }
 
+// Password reset: without a token the section asks for the email to send
+// a link to; the link brings the user back with ?reset=<token>.
+function showResetUI(token) {
+  document.getElementById("login-section").style.display = "none"
+  document.getElementById("register-section").style.display = "none"
+  document.getElementById("forum-view").style.display = "none"
+  document.getElementById("main-header").style.display = "none"
+  document.getElementById("reset-section").style.display = "block"
+  document.getElementById("reset-section").dataset.token = token
+  document.getElementById("reset-request-form").classList.toggle("hidden", token !== "")
+  document.getElementById("reset-password-form").classList.toggle("hidden", token === "")
+}
+
+function requestPasswordReset() {
+  const email = document.getElementById("reset-email").value.trim()
+  fetch("/password-reset/request", {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({ email })
+  })
+    .then(res => {
+      if (!res.ok) {
+        handleHttpError(res);
+        throw new Error(`HTTP ${res.status}`);
+      }
+      alert("If an account uses this address, we sent it a reset link.")
+      showLoginUI()
+    })
+    .catch(err => console.error("Error requesting password reset:", err))
+}
+
+function resetPassword() {
+  const token = document.getElementById("reset-section").dataset.token
+  const password = document.getElementById("reset-password").value.trim()
+  fetch("/password-reset", {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({ token, password })
+  })
+    .then(res => res.text().then(text => {
+      if (!res.ok) throw new Error(text.trim())
+      alert("Your password was changed. Please log in.")
+      window.history.replaceState({}, "", "/")
+      showLoginUI()
+    }))
+    .catch(err => alert("Password reset failed: " + err.message))
+}
+
+// verifyEmailLink redeems the token from a verification email.
+function verifyEmailLink(token) {
+  window.history.replaceState({}, "", "/")
+  return fetch("/verify-email", {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({ token })
+  })
+    .then(res => res.text().then(text => {
+      alert(res.ok ? "Thanks, your email address is confirmed." : "Email verification failed: " + text.trim())
+    }))
+    .catch(err => console.error("Error verifying email:", err))
+}
+
+function setEmailVerified(verified) {
+  document.getElementById("verify-banner").classList.toggle("hidden", verified !== false)
+}
+
+function resendVerificationEmail() {
+  fetch("/verify-email/request", { method: "POST", credentials: "include" })
+    .then(res => {
+      if (res.status === 409) {
+        setEmailVerified(true)
+        return
+      }
+      if (!res.ok) throw new Error(`HTTP ${res.status}`)
+      alert("We sent you a new confirmation link.")
+    })
+    .catch(err => console.error("Error resending verification email:", err))
+}
+
+// Security panel: two-factor authentication.
+function toggleSecurityPanel() {
+  const panel = document.getElementById("security-panel")
+  panel.classList.toggle("hidden")
+  if (!panel.classList.contains("hidden")) {
+    loadTwoFactorStatus()
+    loadSessions()
+  }
+}
+
+function loadTwoFactorStatus() {
+  fetch("/2fa", { credentials: "include" })
+    .then(res => {
+      if (!res.ok) throw new Error(`HTTP ${res.status}`)
+      return res.json()
+    })
+    .then(renderTwoFactorStatus)
+    .catch(err => console.error("Error loading two-factor status:", err))
+}
+
+function renderTwoFactorStatus(status) {
+  document.getElementById("two-factor-status").textContent = status.enabled
+    ? `On. ${status.recovery_codes_left} recovery codes left.`
+    : "Off. Turn it on to ask for a code from your phone when you log in."
+  document.getElementById("two-factor-setup-btn").classList.toggle("hidden", status.enabled)
+  document.getElementById("two-factor-manage-form").classList.toggle("hidden", !status.enabled)
+  document.getElementById("two-factor-enroll").classList.add("hidden")
+}
+
+// twoFactorRequest posts to a 2FA endpoint and rejects with the server's
+// error message.
+function twoFactorRequest(path, body) {
+  return fetch(path, {
+    method: "POST",
+    credentials: "include",
+    headers: { "Content-Type": "application/json" },
+    body: body ? JSON.stringify(body) : undefined
+  }).then(res => {
+    const type = res.headers.get("Content-Type") || ""
+    const data = type.includes("application/json") ? res.json() : res.text()
+    return data.then(d => {
+      if (!res.ok) throw new Error(String(d).trim())
+      return d
+    })
+  })
+}
+
+function beginTwoFactorSetup() {
+  twoFactorRequest("/2fa/setup")
+    .then(setup => {
+      document.getElementById("two-factor-uri").href = setup.uri
+      document.getElementById("two-factor-secret").textContent = setup.secret
+      document.getElementById("two-factor-setup-btn").classList.add("hidden")
+      document.getElementById("two-factor-enroll").classList.remove("hidden")
+      document.getElementById("two-factor-confirm-code").focus()
+    })
+    .catch(err => alert("Could not start two-factor setup: " + err.message))
+}
+
+function confirmTwoFactorSetup() {
+  const input = document.getElementById("two-factor-confirm-code")
+  twoFactorRequest("/2fa/confirm", { code: input.value.trim() })
+    .then(data => {
+      input.value = ""
+      showRecoveryCodes(data.recovery_codes)
+      loadTwoFactorStatus()
+    })
+    .catch(err => alert("Could not turn on two-factor authentication: " + err.message))
+}
+
+function showRecoveryCodes(codes) {
+  const list = document.getElementById("recovery-codes-list")
+  list.innerHTML = ""
+  codes.forEach(code => {
+    const li = document.createElement("li")
+    li.textContent = code
+    list.appendChild(li)
+  })
+  document.getElementById("recovery-codes").classList.remove("hidden")
+}
+
+function regenerateRecoveryCodes() {
+  const password = document.getElementById("two-factor-password")
+  twoFactorRequest("/2fa/recovery-codes", { password: password.value })
+    .then(data => {
+      password.value = ""
+      showRecoveryCodes(data.recovery_codes)
+      loadTwoFactorStatus()
+    })
+    .catch(err => alert("Could not create recovery codes: " + err.message))
+}
+
+function disableTwoFactor() {
+  const password = document.getElementById("two-factor-password")
+  if (!confirm("Turn off two-factor authentication?")) return
+  twoFactorRequest("/2fa/disable", { password: password.value })
+    .then(() => {
+      password.value = ""
+      document.getElementById("recovery-codes").classList.add("hidden")
+      loadTwoFactorStatus()
+    })
+    .catch(err => alert("Could not turn off two-factor authentication: " + err.message))
+}
+
+// Sessions: every device the user is logged in on, most recent first.
+function loadSessions() {
+  fetch("/sessions", { credentials: "include" })
+    .then(res => {
+      if (!res.ok) throw new Error(`HTTP ${res.status}`)
+      return res.json()
+    })
+    .then(sessions => {
+      const list = document.getElementById("sessions-list")
+      list.innerHTML = ""
+      sessions.forEach(s => list.appendChild(renderSessionItem(s)))
+    })
+    .catch(err => console.error("Error loading sessions:", err))
+}
+
+function renderSessionItem(s) {
+  const li = document.createElement("li")
+  li.className = "session-item"
+  const info = document.createElement("div")
+  const device = document.createElement("strong")
+  device.textContent = s.user_agent || "Unknown device"
+  const details = document.createElement("p")
+  const seen = s.connected ? "active now" : `last seen ${new Date(s.last_seen_at).toLocaleString()}`
+  details.textContent = `${s.ip || "unknown IP"} · ${s.current ? "this session" : seen}`
+  info.append(device, details)
+  li.appendChild(info)
+  if (!s.current) {
+    const btn = document.createElement("button")
+    btn.textContent = "Log out"
+    btn.addEventListener("click", () => revokeSession(s.id))
+    li.appendChild(btn)
+  }
+  return li
+}
+
+function revokeSession(id) {
+  fetch(`/session?id=${id}`, { method: "DELETE", credentials: "include" })
+    .then(res => {
+      if (!res.ok) throw new Error(`HTTP ${res.status}`)
+      loadSessions()
+    })
+    .catch(err => console.error("Error revoking session:", err))
+}
+
+function revokeOtherSessions() {
+  if (!confirm("Log out everywhere except here?")) return
+  fetch("/sessions", { method: "DELETE", credentials: "include" })
+    .then(res => {
+      if (!res.ok) throw new Error(`HTTP ${res.status}`)
+      loadSessions()
+    })
+    .catch(err => console.error("Error revoking sessions:", err))
+}
+
 // Register Logic
 function register() {
   const data = {
@@ -532,8 +937,11 @@ function logout() {
 
     // Reset app state
     currentUserUUID = "";
+    currentUserRole = "";
     chatWith = "";
-    messagesOffset = 0;
+    messagesCursor = null;
+    hasMoreMessages = true;
+    lastSeq = null;
     isCurrentlyTyping = false;
     typingUsers.clear();
     allUsers = [];
@@ -561,6 +969,24 @@ function logout() {
 
 
 // WebSocket
+const WS_SUBPROTOCOL = "forum.v2";
+const pendingMessages = new Map(); // client message id -> content awaiting ack
+let lastSeq = null; // highest chat message seq applied, null until the first resume
+
+// unwrapFrame flattens a v2 envelope into the shape the handlers below expect.
+// Frames from a server that did not accept the v2 subprotocol pass through.
+function unwrapFrame(frame) {
+  if (!frame || frame.v === undefined) return frame;
+  return { ...(frame.payload || {}), type: frame.type, id: frame.id };
+}
+
+function sendFrame(type, payload, id) {
+  const frame = socket.protocol === WS_SUBPROTOCOL
+    ? { v: 2, type: type, id: id, payload: payload }
+    : (type === "chat_message" ? payload : { type: type, ...payload });
+  socket.send(JSON.stringify(frame));
+}
+
 function connectWebSocket() {
   // Cleanup old socket before making a new one
   if (socket) {
@@ -576,21 +1002,89 @@ function connectWebSocket() {
   }
 
   console.log("Attempting to connect WebSocket...");
-  socket = new WebSocket("ws://localhost:8080/ws")
+  socket = new WebSocket("ws://localhost:8080/ws", [WS_SUBPROTOCOL])
 
   socket.onopen = () => {
     console.log("WebSocket connected successfully")
+    // Ask the server for anything pushed while we were disconnected.
+    sendFrame("resume", lastSeq === null ? {} : { last_seq: lastSeq });
+    if (currentPostUUID) sendFrame("view_post", { post_uuid: currentPostUUID });
+    feedTopic = "";
+    subscribeFeed();
   }
 
   socket.onmessage = function (event) {
     try {
-      const data = JSON.parse(event.data);
+      const data = unwrapFrame(JSON.parse(event.data));
       console.log("WebSocket message received:", data);
 
-      if (data.type === "force_logout") {
+      if (data.type === "ack") {
+        pendingMessages.delete(data.id);
+        return;
+      } else if (data.type === "read_receipt") {
+        // The user we are chatting with read our messages.
+        if (data.reader_uuid === chatWith && data.with === currentUserUUID) {
+          document.querySelectorAll("#chat-history .message-item.self .message-status")
+            .forEach(el => el.textContent = "Read");
+        }
+        return;
+      } else if (data.type === "message_edited" || data.type === "message_deleted") {
+        const div = data.uuid && document.querySelector(`#chat-history .message-item[data-uuid="${data.uuid}"]`);
+        if (!div) return;
+        if (data.type === "message_deleted") {
+          markMessageDeleted(div);
+        } else {
+          div.querySelector(".message-content").innerHTML = data.content_html;
+          if (!div.querySelector(".message-edited")) {
+            div.querySelector(".message-time").insertAdjacentHTML("beforeend", ` <span class="message-edited">(edited)</span>`);
+          }
+        }
+        return;
+      } else if (data.type === "reaction_updated") {
+        if (data.post_uuid !== currentPostUUID) return;
+        const el = data.target === "post"
+          ? document.getElementById("modal-post-reactions")
+          : document.querySelector(`#modal-comments-list .reaction-bar[data-id="${data.comment_id}"]`);
+        if (el) {
+          el.querySelector(".likes").textContent = data.likes;
+          el.querySelector(".dislikes").textContent = data.dislikes;
+        }
+        return;
+      } else if (data.type === "post_created") {
+        handlePostCreated(data);
+        return;
+      } else if (data.type === "comment_created") {
+        handleCommentCreated(data.post_uuid, data.comment);
+        return;
+      } else if (data.type === "notification") {
+        handleNotification(data);
+        return;
+      } else if (data.type === "notifications_read") {
+        handleNotificationsRead(data.ids, data.unread);
+        return;
+      } else if (data.type === "room_message" || data.type === "room_membership" || data.room) {
+        // Group and room conversations are not shown in this UI yet.
+        return;
+      } else if (data.type === "resumed") {
+        lastSeq = data.last_seq;
+        return;
+      } else if (data.type === "resync") {
+        // Too much was missed to replay; reload the open conversation.
+        lastSeq = data.last_seq;
+        if (chatWith) openChat(chatWith);
+        return;
+      } else if (data.type === "error") {
+        console.error("Server rejected frame:", data.id, data.code, data.message);
+        if (pendingMessages.has(data.id)) {
+          pendingMessages.delete(data.id);
+          alert("Failed to send message. Please try again.");
+        }
+        return;
+      } else if (data.type === "force_logout") {
         alert("You have been logged out.");
         currentUserUUID = "";
         allUsers = [];
+        lastSeq = null;
         showLoginUI(); // Switch to login screen immediately
         return;
       } else if (data.type === "user_registered") {
@@ -617,6 +1111,10 @@ function connectWebSocket() {
           hideTypingIndicator();
         }
       } else {
+        if (data.seq) {
+          if (lastSeq !== null && data.seq <= lastSeq) return; // already applied
+          lastSeq = data.seq;
+        }
         if (data.from === chatWith) hideTypingIndicator();
         console.log("message dat in socket:::::", data);
 
@@ -649,6 +1147,18 @@ function connectWebSocket() {
 // })
 
 // Load Chat History
+// openChatFocused opens the chat with a user and puts the cursor in the input.
+function openChatFocused(userUUID) {
+  console.log(`Opening chat with ${userUUID} from notification click`);
+  openChat(userUUID);
+  setTimeout(() => {
+    const chatInput = document.getElementById('chat-input');
+    if (chatInput) {
+      chatInput.focus();
+    }
+  }, 100);
+}
+
 function openChat(userUUID) {
   console.log("Opening chat with user:", userUUID);
 
@@ -688,7 +1198,8 @@ function openChat(userUUID) {
 
   // Set the chat target
   chatWith = userUUID;
-  messagesOffset = 0;
+  messagesCursor = null;
+  hasMoreMessages = true;
 
   const chatHistory = document.getElementById("chat-history");
   if (!chatHistory) {
@@ -714,13 +1225,14 @@ function openChat(userUUID) {
 
   // Load messages
   loadMessages();
+  markChatRead();
 }
 
 function loadMessages() {
-  if (!chatWith || isLoadingMessages) return;
+  if (!chatWith || isLoadingMessages || !hasMoreMessages) return;
   isLoadingMessages = true; // lock here
 
-  console.log(`Loading messages with ${chatWith}, offset: ${messagesOffset}`);
+  console.log(`Loading messages with ${chatWith}, before: ${messagesCursor}`);
 
   const chatHistory = document.getElementById("chat-history");
   if (!chatHistory) {
@@ -730,9 +1242,10 @@ function loadMessages() {
   }
 
   // const shouldScroll = chatHistory.scrollTop === 0;
-  const isFirstLoad = messagesOffset === 0;
+  const isFirstLoad = messagesCursor === null;
+  const url = `/messages?with=${chatWith}` + (isFirstLoad ? "" : `&before=${messagesCursor}`);
 
-  fetch(`/messages?with=${chatWith}&offset=${messagesOffset}`, {
+  fetch(url, {
     method: "GET",
     credentials: "include"
   })
@@ -754,27 +1267,26 @@ function loadMessages() {
 
       return res.json();
     })
-    .then(messages => {
-      console.log("Received messages:", messages);
-
-      // Handle null response or ensure it's an array
-      if (!messages) {
-        console.log("No messages returned (null response)");
-        messages = [];
-      }
+    .then(page => {
+      console.log("Received messages:", page);
 
+      let messages = (page && page.messages) || [];
       if (!Array.isArray(messages)) {
         console.error("Expected array of messages but got:", typeof messages, messages);
         messages = [];
       }
+      messagesCursor = (page && page.next_cursor) || null;
+      hasMoreMessages = messagesCursor !== null;
+
+      // Skip messages a live push already rendered.
+      messages = messages.filter(msg =>
+        !chatHistory.querySelector(`.message-item[data-uuid="${msg.uuid}"]`));
 
       // Remove loading indicator
       const loadingIndicators = chatHistory.querySelectorAll('.loading-indicator');
       loadingIndicators.forEach(indicator => indicator.remove());
 
       if (messages.length > 0) {
-        messagesOffset += messages.length;
-
         if (isFirstLoad) {
           // First load: append messages in the order they come (oldest to newest)
           messages.forEach(msg => {
@@ -785,10 +1297,10 @@ function loadMessages() {
           // Scroll to bottom for first load
           chatHistory.scrollTop = chatHistory.scrollHeight;
         } else {
-          // Pagination load: prepend messages to top (but reverse them first since they come newest-first from DB)
+          // Pagination load: prepend the older page above what is shown
           const oldHeight = chatHistory.scrollHeight;
 
-          // Reverse the messages array since DB gives us newest-first but we want to prepend oldest-first
+          // Pages come oldest-first, so prepend from the newest down
           messages.reverse().forEach(msg => {
             const messageEl = createMessageElement(msg);
             chatHistory.prepend(messageEl);
@@ -801,7 +1313,7 @@ function loadMessages() {
         console.log("No messages to load");
 
         // Show "no messages" indicator if chat is empty and this is the first load
-        if (chatHistory.children.length === 0 && messagesOffset === 0) {
+        if (chatHistory.children.length === 0 && isFirstLoad) {
           const noMessagesDiv = document.createElement("div");
           noMessagesDiv.style.textAlign = "center";
           noMessagesDiv.style.color = "#666";
@@ -849,6 +1361,8 @@ function renderIncomingMessage(msg) {
 
     // Auto-scroll to the bottom to show the new message
     chatHistory.scrollTop = chatHistory.scrollHeight;
+
+    if (msg.from === chatWith) markChatRead();
   }
 
   // PART 3: Handle all notifications for messages that are NOT from the current user.
@@ -870,13 +1384,19 @@ function renderIncomingMessage(msg) {
     // 3b. If the chat with the sender is NOT the one that's currently open, show the pop-up notification.
     // This prevents a pop-up from appearing for a conversation you're actively viewing.
     if (!isRelevantToCurrentChat) {
-      // Pass the sender UUID so the notification becomes clickable
-      showCustomNotification(`New message from ${msg.from_nickname}`, msg.content, msg.from);
+      // Clicking the notification opens the chat with the sender
+      showCustomNotification(`New message from ${msg.from_nickname}`, msg.content, () => openChatFocused(msg.from));
     }
   }
 }
 
 
+// Tell the server we have read the open conversation.
+function markChatRead() {
+  if (!chatWith || !socket || socket.readyState !== WebSocket.OPEN) return;
+  sendFrame("mark_read", { with: chatWith });
+}
+
 // Update online status and re-render
 function renderOnlineUsers(users) {
   console.log("Rendering online users:", users)
@@ -890,6 +1410,7 @@ function renderOnlineUsers(users) {
       allUsers[existingUserIndex].isOnline = wsUser.is_online
       allUsers[existingUserIndex].lastMessage = wsUser.last_message || ""
       allUsers[existingUserIndex].lastMessageTime = wsUser.last_message_time
+      allUsers[existingUserIndex].unreadCount = wsUser.unread_count || 0
       console.log(`Updated user ${wsUser.nickname}:`, allUsers[existingUserIndex]);
     } else {
       // Add new user if not found
@@ -898,7 +1419,8 @@ function renderOnlineUsers(users) {
         nickname: wsUser.nickname,
         isOnline: wsUser.is_online,
         lastMessage: wsUser.last_message || "",
-        lastMessageTime: wsUser.last_message_time
+        lastMessageTime: wsUser.last_message_time,
+        unreadCount: wsUser.unread_count || 0
       };
       allUsers.push(newUser);
       console.log(`Added new user ${wsUser.nickname}:`, newUser);
@@ -995,6 +1517,14 @@ function updateUserList() {
       li.appendChild(statusSpan);
       li.appendChild(userInfoDiv);
 
+      if (user.unreadCount > 0 && user.uuid !== chatWith) {
+        li.classList.add("has-unread");
+        const badge = document.createElement("span");
+        badge.classList.add("unread-badge");
+        badge.textContent = user.unreadCount > 99 ? "99+" : user.unreadCount;
+        li.appendChild(badge);
+      }
+
       // Set click event to open chat with this user
       li.onclick = () => {
         openChat(user.uuid);
@@ -1106,7 +1636,8 @@ function setupMessageInput() {
       }
 
       const content = chatInput.value.trim();
-      if (!content) {
+      const files = document.getElementById("chat-files");
+      if (!content && files.files.length === 0) {
         console.log("Empty message, not sending");
         return;
       }
@@ -1123,22 +1654,27 @@ function setupMessageInput() {
         return;
       }
 
-      const msg = {
-        to: chatWith,
-        content: content,
-      };
+      const to = chatWith;
+      uploadAttachments(files).then(attachments => {
+        const msg = {
+          to: to,
+          content: content,
+          attachments: attachments,
+        };
+        const msgID = crypto.randomUUID ? crypto.randomUUID() : String(Date.now()) + Math.random();
 
-      console.log("Sending message:", msg);
+        console.log("Sending message:", msg);
 
-      try {
-        socket.send(JSON.stringify(msg));
+        pendingMessages.set(msgID, content);
+        sendFrame("chat_message", msg, msgID);
         chatInput.value = "";
+        files.value = "";
         lastInputContent = "";
         console.log("Message sent successfully");
-      } catch (error) {
+      }).catch(error => {
         console.error("Error sending message:", error);
         alert("Failed to send message. Please try again.");
-      }
+      });
     }
   });
 
@@ -1168,9 +1704,10 @@ function fetchCategories() {
       categories.forEach(cat => {
         const btn = document.createElement("button");
         btn.className = "category-btn";
-        btn.dataset.category = cat;
-        btn.textContent = cat;
-        btn.onclick = () => selectCategory(cat);
+        btn.dataset.category = cat.slug;
+        btn.textContent = `${cat.name} (${cat.post_count})`;
+        btn.title = cat.description;
+        btn.onclick = () => selectCategory(cat.slug);
         categoryFilter.appendChild(btn);
       });
 
@@ -1184,7 +1721,9 @@ function fetchCategories() {
 
 function selectCategory(category) {
   currentCategory = category;
-  postOffset = 0;
+  currentTag = "";
+  postsCursor = "";
+  subscribeFeed();
   document.getElementById("post-feed").innerHTML = "";
   loadPostFeed();
 
@@ -1198,44 +1737,109 @@ function selectCategory(category) {
   });
 }
 
+function renderPostItem(p) {
+  const div = document.createElement("div");
+  div.className = "post-item";
+  div.dataset.uuid = p.uuid;
+  const safeTitle = p.title.replace(/&/g, '&amp;').replace(/</g, '&lt;').replace(/>/g, '&gt;');
+
+  div.innerHTML = `
+    <strong>${safeTitle}</strong><br>
+    by ${p.nickname}<br>
+    <small>${new Date(p.created_at).toLocaleString()}</small><br>
+    <small>Categories: ${p.categories ? p.categories.join(', ') : 'None'}</small>
+    <div class="post-body">${p.content_html}</div>
+    ${renderAttachments(p.attachments)}
+    ${renderTags(p.tags)}
+    <small>👍 ${p.likes || 0} · 👎 ${p.dislikes || 0} · 💬 ${p.comment_count || 0}</small>
+  `;
+  div.onclick = () => openPostView(p.uuid);
+  return div;
+}
+
+// Tags are normalized by the server to letters, digits and dashes, so they
+// are safe to put in markup as they are.
+function renderTags(tags) {
+  if (!tags || tags.length === 0) return "";
+  return `<div class="post-tags">${tags.map(t => `<a class="post-tag" href="#" onclick="event.stopPropagation(); event.preventDefault(); selectTag('${t}')">#${t}</a>`).join("")}</div>`;
+}
+
+// selectTag filters the feed by a tag within the selected category.
+function selectTag(tag) {
+  currentTag = tag;
+  if (!postModal.classList.contains("hidden")) closePostModal();
+  resetPostFeed();
+}
+
+// suggestTags fills the tag autocomplete with tags starting like the last
+// one being typed.
+function suggestTags() {
+  const input = document.getElementById("post-tags");
+  const typed = input.value.split(",");
+  const last = typed.pop().trim();
+  if (!last) return;
+  const before = typed.map(t => t.trim()).filter(Boolean);
+  fetch(`/tags?q=${encodeURIComponent(last)}&limit=10`, { credentials: "include" })
+    .then(res => res.ok ? res.json() : [])
+    .then(tags => {
+      const list = document.getElementById("post-tags-suggestions");
+      list.innerHTML = "";
+      tags.forEach(t => {
+        const option = document.createElement("option");
+        option.value = [...before, t.name].join(", ");
+        option.label = `#${t.name} (${t.post_count})`;
+        list.appendChild(option);
+      });
+    })
+    .catch(err => console.error("Error loading tags:", err));
+}
+
+// subscribeFeed follows new posts in the selected category, or all of them.
+function subscribeFeed() {
+  if (!socket || socket.readyState !== WebSocket.OPEN) return;
+  const topic = currentCategory ? `category:${currentCategory}` : "posts";
+  if (topic === feedTopic) return;
+  if (feedTopic) sendFrame("unsubscribe", { topic: feedTopic });
+  sendFrame("subscribe", { topic });
+  feedTopic = topic;
+}
+
+// A new post goes on top of the feed when it is sorted by newest.
+function handlePostCreated(p) {
+  if (postSort !== "new") return;
+  if (currentTag && !(p.tags || []).includes(currentTag)) return;
+  const feed = document.getElementById("post-feed");
+  if (feed.querySelector(`.post-item[data-uuid="${p.uuid}"]`)) return;
+  feed.prepend(renderPostItem(p));
+}
+
 function loadPostFeed() {
-  let url = `/posts?offset=${postOffset}&limit=${postLimit}`;
+  let url = `/posts?sort=${postSort}&limit=${postLimit}`;
+  if (postSort === "top") {
+    url += `&window=${postWindow}`;
+  }
   if (currentCategory) {
     url += `&category=${encodeURIComponent(currentCategory)}`;
   }
+  if (currentTag) {
+    url += `&tag=${encodeURIComponent(currentTag)}`;
+  }
+  if (postsCursor) {
+    url += `&cursor=${encodeURIComponent(postsCursor)}`;
+  }
 
   fetch(url, {
     credentials: "include",
   })
     .then(res => res.json())
-    .then(posts => {
+    .then(page => {
+      const posts = page.posts;
       const feed = document.getElementById("post-feed");
       console.log("postssss", posts);
-      posts.forEach(p => {
-        const div = document.createElement("div");
-        div.className = "post-item";
-        const safeTitle = p.title.replace(/&/g, '&amp;').replace(/</g, '&lt;').replace(/>/g, '&gt;');
-        const safeContent = p.content.replace(/&/g, '&amp;').replace(/</g, '&lt;').replace(/>/g, '&gt;');
-
-        div.innerHTML = `
-          <strong>${safeTitle}</strong><br>
-          by ${p.nickname}<br>
-          <small>${new Date(p.created_at).toLocaleString()}</small><br>
-          <small>Categories: ${p.categories ? p.categories.join(', ') : 'None'}</small>
-          <p>${safeContent}</p>
-        `;
-        div.onclick = () => openPostView(p.uuid);
-        feed.appendChild(div);
-        console.log("feed", feed);
-      });
-
-      if (posts.length < postLimit) {
-        document.getElementById("load-more-btn").style.display = "none";
-      } else {
-        document.getElementById("load-more-btn").style.display = "block";
-      }
+      posts.forEach(p => feed.appendChild(renderPostItem(p)));
 
-      postOffset += posts.length;
+      postsCursor = page.next_cursor || "";
+      document.getElementById("load-more-btn").style.display = postsCursor ? "block" : "none";
     })
     .catch(err => {
       console.error("Error loading posts:", err);
@@ -1243,41 +1847,285 @@ function loadPostFeed() {
 }
 
 let currentPostUUID = ""
+let commentSort = "oldest"
+let commentsCursor = "" // next_comment_cursor of the last page, "" when all are loaded
+let commentCount = 0
+let feedTopic = "" // live feed subscription on the current socket
 
 function openPostView(uuid) {
   currentPostUUID = uuid
 
-  fetch(`/post?uuid=${uuid}`, { credentials: "include" })
+  fetch(`/post?uuid=${uuid}&sort=${commentSort}`, { credentials: "include" })
     .then(res => res.json())
     .then(data => {
       document.getElementById("modal-post-author").textContent = data.nickname;
       document.getElementById("modal-post-timestamp").textContent = new Date(data.created_at).toLocaleString();
       document.getElementById("modal-post-title").textContent = data.title;
-      document.getElementById("modal-post-content").textContent = data.content;
-
-      const commentsDiv = document.getElementById("modal-comments-list")
-      commentsDiv.innerHTML = ""
-      if (data.comments) {
-        data.comments.forEach(c => {
-          const d = document.createElement("div")
-          d.className = "comment-item";
-          const safeContent = c.content.replace(/&/g, '&amp;').replace(/</g, '&lt;').replace(/>/g, '&gt;');
-          d.innerHTML = `
-          <div class="comment-body">
-            <div class="comment-author">${c.author}</div>
-            <div class="comment-content">${safeContent}</div>
-          </div>
-        `;
-          commentsDiv.appendChild(d);
-        })
-      }
+      document.getElementById("modal-post-content").innerHTML = data.content_html + renderAttachments(data.attachments) + renderTags(data.tags);
+      if (data.edited) document.getElementById("modal-post-timestamp").textContent += " (edited)";
+      renderReactionBar(document.getElementById("modal-post-reactions"), "post", data.uuid, data);
+      renderChangeControls(document.getElementById("modal-post-reactions"), "post", data.uuid, data);
+
+      setCommentCount(data.comment_count);
+      document.getElementById("modal-comments-list").innerHTML = "";
+      renderComments(data.comments, data.next_comment_cursor);
       postModal.classList.remove("hidden");
       document.body.classList.add("modal-open");
+      // Ask for live reaction counts while the post is open.
+      if (socket && socket.readyState === WebSocket.OPEN) sendFrame("view_post", { post_uuid: uuid });
+    })
+}
+// renderComments appends a page of comment threads to the open post.
+function renderCommentItem(c) {
+  const d = document.createElement("div")
+  d.className = c.depth > 0 ? "comment-item comment-reply" : "comment-item";
+  d.style.marginLeft = `${c.depth * 24}px`;
+  d.dataset.uuid = c.uuid;
+  d.dataset.depth = c.depth;
+  // content_html is rendered and sanitized by the server.
+  const safeContent = c.deleted ? "<em>[deleted]</em>" : c.content_html;
+  d.innerHTML = `
+    <div class="comment-body">
+      <div class="comment-author">${c.author}${c.edited && !c.deleted ? " <small>(edited)</small>" : ""}</div>
+      <div class="comment-content">${safeContent}</div>
+      ${c.deleted ? "" : renderAttachments(c.attachments)}
+      <div class="reaction-bar"></div>
+    </div>
+  `;
+  if (!c.deleted) {
+    renderReactionBar(d.querySelector(".reaction-bar"), "comment", c.id, c);
+    renderChangeControls(d.querySelector(".reaction-bar"), "comment", c.id, c);
+    renderReplyControl(d.querySelector(".reaction-bar"), c);
+  }
+  return d;
+}
+
+// renderComments appends a page of comment threads to the open post. A
+// thread cut short gets a button for the rest of its replies.
+function renderComments(comments, nextCursor) {
+  const commentsDiv = document.getElementById("modal-comments-list");
+  let moreReplies = null;
+  (comments || []).forEach(c => {
+    if (c.depth === 0 && moreReplies) {
+      commentsDiv.appendChild(moreReplies);
+      moreReplies = null;
+    }
+    commentsDiv.appendChild(renderCommentItem(c));
+    if (c.more_replies_cursor) moreReplies = renderMoreRepliesButton(c.uuid, c.more_replies_cursor);
+  });
+  if (moreReplies) commentsDiv.appendChild(moreReplies);
+  commentsCursor = nextCursor || "";
+  document.getElementById("load-more-comments").style.display = commentsCursor ? "block" : "none";
+}
+
+// renderMoreRepliesButton loads the next page of a thread's replies in place
+// of the button, which moves after them while there are more.
+function renderMoreRepliesButton(threadUUID, cursor) {
+  const btn = document.createElement("button");
+  btn.className = "reaction-btn more-replies";
+  btn.textContent = "More replies";
+  btn.addEventListener("click", () => {
+    const postUUID = currentPostUUID;
+    fetch(`/comments?post=${postUUID}&thread=${threadUUID}&cursor=${encodeURIComponent(cursor)}`, { credentials: "include" })
+      .then(res => {
+        if (!res.ok) {
+          handleHttpError(res);
+          throw new Error(`HTTP ${res.status}`);
+        }
+        return res.json();
+      })
+      .then(page => {
+        if (postUUID !== currentPostUUID) return;
+        const list = btn.parentElement;
+        (page.comments || []).forEach(c => {
+          if (!list.querySelector(`.comment-item[data-uuid="${c.uuid}"]`)) list.insertBefore(renderCommentItem(c), btn);
+        });
+        if (page.next_cursor) cursor = page.next_cursor;
+        else btn.remove();
+      })
+      .catch(err => console.error("Error loading replies:", err));
+  });
+  return btn;
+}
+
+function setCommentCount(n) {
+  commentCount = n;
+  document.getElementById("modal-comments-count").textContent = n ? `(${n})` : "";
+}
+
+// handleCommentCreated places a live comment in the open post: a reply goes
+// after its parent's thread, a top-level comment at the end, or at the start
+// when sorted by newest. Top-level comments that belong on a page not loaded
+// yet are left for loadMoreComments.
+function handleCommentCreated(postUUID, c) {
+  if (postUUID !== currentPostUUID) return;
+  const list = document.getElementById("modal-comments-list");
+  if (list.querySelector(`.comment-item[data-uuid="${c.uuid}"]`)) return;
+  setCommentCount(commentCount + 1);
+
+  const item = renderCommentItem(c);
+  if (c.parent_uuid) {
+    const parent = list.querySelector(`.comment-item[data-uuid="${c.parent_uuid}"]`);
+    if (!parent) return;
+    let next = parent.nextElementSibling;
+    while (next && Number(next.dataset.depth) > Number(parent.dataset.depth)) next = next.nextElementSibling;
+    list.insertBefore(item, next);
+  } else if (commentSort === "newest") {
+    list.prepend(item);
+  } else if (!commentsCursor) {
+    list.appendChild(item);
+  }
+}
+
+function loadMoreComments() {
+  if (!commentsCursor || !currentPostUUID) return;
+  const postUUID = currentPostUUID;
+  fetch(`/comments?post=${postUUID}&sort=${commentSort}&cursor=${encodeURIComponent(commentsCursor)}`, { credentials: "include" })
+    .then(res => {
+      if (!res.ok) {
+        handleHttpError(res);
+        throw new Error(`HTTP ${res.status}`);
+      }
+      return res.json();
+    })
+    .then(page => {
+      if (postUUID === currentPostUUID) renderComments(page.comments, page.next_cursor);
     })
+    .catch(err => console.error("Error loading comments:", err));
 }
+
 function closePostModal() {
   postModal.classList.add("hidden");
   document.body.classList.remove("modal-open");
+  currentPostUUID = "";
+  if (socket && socket.readyState === WebSocket.OPEN) sendFrame("view_post", {});
+}
+
+// renderReactionBar draws like/dislike buttons for a post or comment.
+function renderReactionBar(el, target, id, r) {
+  el.dataset.target = target;
+  el.dataset.id = id;
+  el.innerHTML = `
+    <button class="reaction-btn${r.my_vote === 1 ? " active" : ""}" data-vote="like">👍 <span class="reaction-count likes">${r.likes || 0}</span></button>
+    <button class="reaction-btn${r.my_vote === -1 ? " active" : ""}" data-vote="dislike">👎 <span class="reaction-count dislikes">${r.dislikes || 0}</span></button>
+  `;
+  el.querySelectorAll(".reaction-btn").forEach(btn => {
+    btn.addEventListener("click", () => sendReaction(el, btn.dataset.vote));
+  });
+}
+
+// renderChangeControls adds edit and delete buttons for the author and
+// moderators. Edits reload the post.
+function renderChangeControls(bar, target, id, item) {
+  bar.parentElement.querySelectorAll(":scope > .change-controls").forEach(el => el.remove());
+  const canModerate = currentUserRole === "moderator" || currentUserRole === "admin";
+  if (item.author_uuid !== currentUserUUID && !canModerate) return;
+
+  const controls = document.createElement("div");
+  controls.className = "reaction-bar change-controls";
+
+  const edit = document.createElement("button");
+  edit.className = "reaction-btn";
+  edit.textContent = "Edit";
+  edit.addEventListener("click", () => {
+    const isPost = target === "post";
+    const title = isPost ? prompt("Title", item.title) : null;
+    if (isPost && title === null) return;
+    const content = prompt(isPost ? "Content" : "Comment", item.content);
+    if (content === null) return;
+    changeContent("PUT", isPost ? "/post" : "/comment",
+      isPost ? { uuid: id, title, content } : { id, content });
+  });
+
+  const del = document.createElement("button");
+  del.className = "reaction-btn";
+  del.textContent = "Delete";
+  del.addEventListener("click", () => {
+    if (!confirm(`Delete this ${target}?`)) return;
+    changeContent("DELETE", target === "post" ? `/post?uuid=${id}` : `/comment?id=${id}`);
+  });
+
+  controls.append(edit, del);
+  bar.after(controls);
+}
+
+// renderReplyControl adds a Reply button next to the change controls. It
+// sits outside the reaction bar, which is redrawn on every vote.
+function renderReplyControl(bar, c) {
+  let controls = bar.parentElement.querySelector(":scope > .change-controls");
+  if (!controls) {
+    controls = document.createElement("div");
+    controls.className = "reaction-bar change-controls";
+    bar.after(controls);
+  }
+  const reply = document.createElement("button");
+  reply.className = "reaction-btn";
+  reply.textContent = "Reply";
+  reply.addEventListener("click", () => {
+    const content = (prompt(`Reply to ${c.author}`) || "").trim();
+    if (content) postComment(content, c.uuid);
+  });
+  controls.prepend(reply);
+}
+
+// postComment adds a comment to the open post, as a reply when parentUUID is
+// given, and reloads the thread.
+function postComment(content, parentUUID, attachments) {
+  const postUUID = currentPostUUID;
+  return fetch("/comment", {
+    method: "POST",
+    credentials: "include",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({ post_uuid: postUUID, parent_comment_id: parentUUID, content, attachments })
+  }).then(res => {
+    if (!res.ok) {
+      handleHttpError(res);
+      throw new Error(`HTTP ${res.status}`);
+    }
+    openPostView(postUUID); // reload comments
+  })
+}
+
+function changeContent(method, url, body) {
+  const postUUID = currentPostUUID;
+  fetch(url, {
+    method,
+    credentials: "include",
+    headers: { "Content-Type": "application/json" },
+    body: body ? JSON.stringify(body) : undefined
+  })
+    .then(res => {
+      if (!res.ok) {
+        handleHttpError(res);
+        throw new Error(`HTTP ${res.status}`);
+      }
+      if (method === "DELETE" && url.startsWith("/post")) {
+        closePostModal();
+        resetPostFeed();
+      } else {
+        openPostView(postUUID);
+      }
+    })
+    .catch(err => console.error("Error saving changes:", err));
+}
+
+function sendReaction(el, vote) {
+  const isPost = el.dataset.target === "post";
+  fetch(isPost ? "/post/reaction" : "/comment/reaction", {
+    method: "POST",
+    credentials: "include",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify(isPost ? { post_uuid: el.dataset.id, vote } : { comment_id: Number(el.dataset.id), vote })
+  })
+    .then(res => {
+      if (!res.ok) {
+        handleHttpError(res);
+        throw new Error(`HTTP ${res.status}`);
+      }
+      return res.json();
+    })
+    .then(r => renderReactionBar(el, el.dataset.target, el.dataset.id, r))
+    .catch(err => console.error("Error saving reaction:", err));
 }
 
 function backToFeed() {
@@ -1347,6 +2195,7 @@ function submitPost() {
 
   // Correctly get all selected categories from the new dropdown
   const categories = [...select.selectedOptions].map(option => option.value);
+  const tags = document.getElementById("post-tags").value.split(",").map(t => t.trim()).filter(Boolean);
 
   if (!title || !content) {
     alert("Title and content are required.");
@@ -1358,12 +2207,14 @@ function submitPost() {
     return;
   }
 
-  fetch("/posts", {
-    method: "POST",
-    credentials: "include",
-    headers: { "Content-Type": "application/json" },
-    body: JSON.stringify({ title, content, categories }),
-  })
+  const files = document.getElementById("post-files");
+  uploadAttachments(files)
+    .then(attachments => fetch("/posts", {
+      method: "POST",
+      credentials: "include",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({ title, content, categories, tags, attachments }),
+    }))
     .then(res => {
       if (!res.ok) {
         // If the server returns an error, show it to the user
@@ -1378,6 +2229,8 @@ function submitPost() {
       // 1. Clear the form fields correctly
       document.getElementById("post-title").value = "";
       document.getElementById("post-content").value = "";
+      document.getElementById("post-tags").value = "";
+      files.value = "";
       select.selectedIndex = -1; // This deselects all options in the dropdown
 
       // 2. Hide the form
@@ -1397,7 +2250,7 @@ function submitPost() {
 
 
 function resetPostFeed() {
-  postOffset = 0
+  postsCursor = ""
   document.getElementById("post-feed").innerHTML = ""
   document.getElementById("load-more-btn").style.display = "block"
   loadPostFeed()
@@ -1409,13 +2262,8 @@ function handleTypingStart() {
 
   isCurrentlyTyping = true;
 
-  const typingMsg = {
-    type: "typing_start",
-    to: chatWith
-  };
-
   if (socket && socket.readyState === WebSocket.OPEN) {
-    socket.send(JSON.stringify(typingMsg));
+    sendFrame("typing_start", { to: chatWith });
     console.log("Sent typing_start to", chatWith);
   }
 }
@@ -1425,13 +2273,8 @@ function handleTypingStop() {
 
   isCurrentlyTyping = false;
 
-  const typingMsg = {
-    type: "typing_stop",
-    to: chatWith
-  };
-
   if (socket && socket.readyState === WebSocket.OPEN) {
-    socket.send(JSON.stringify(typingMsg));
+    sendFrame("typing_stop", { to: chatWith });
     console.log("Sent typing_stop to", chatWith);
   }
 }
@@ -1533,7 +2376,9 @@ function showErrorPage(title, message) {
         .then(data => {
           if (data) {
             currentUserUUID = data.user_uuid;
+            currentUserRole = data.role;
             updateWelcomeMessage(data.nickname);
+            setUnreadNotifications(data.unread_notifications);
             navigate("/", true);   // logged in → go to chat UI
           } else {
             navigate("/", false);  // not logged in → go to login UI
@@ -1556,3 +2401,150 @@ window.addEventListener("popstate", () => {
 //   renderRoute(window.location.pathname);
 // });
 
+// Notification center. The badge counts unread notifications; the panel
+// lists the latest ones and marks one read when it is opened.
+function setUnreadNotifications(n) {
+  unreadNotifications = n || 0;
+  const badge = document.getElementById("notifications-badge");
+  if (!badge) return;
+  badge.textContent = unreadNotifications > 99 ? "99+" : unreadNotifications;
+  badge.classList.toggle("hidden", unreadNotifications === 0);
+}
+
+function notificationTitle(n) {
+  switch (n.kind) {
+    case "reply": return `${n.actor_nickname} commented on your post`;
+    case "comment_reply": return `${n.actor_nickname} replied to your comment`;
+    case "mention": return `${n.actor_nickname} mentioned you`;
+    case "reaction": return `${n.actor_nickname} reacted to your ${n.target_type}`;
+    case "message": return `${n.actor_nickname} sent you a message`;
+    default: return `New activity from ${n.actor_nickname}`;
+  }
+}
+
+// openNotification marks a notification read and shows what it is about.
+function openNotification(n) {
+  document.getElementById("notifications-panel").classList.add("hidden");
+  if (!n.read) markNotificationsRead([n.id]);
+  if (n.post_uuid) {
+    openPostView(n.post_uuid);
+  } else if (n.target_type === "message") {
+    openChatFocused(n.actor);
+  }
+}
+
+function renderNotificationItem(n) {
+  const li = document.createElement("li");
+  li.className = "notification-item" + (n.read ? "" : " unread");
+  li.dataset.id = n.id;
+  const title = document.createElement("strong");
+  title.textContent = notificationTitle(n);
+  const text = document.createElement("p");
+  text.textContent = n.excerpt;
+  const time = document.createElement("small");
+  time.textContent = new Date(n.created_at).toLocaleString();
+  li.append(title, text, time);
+  li.addEventListener("click", () => openNotification(n));
+  return li;
+}
+
+function loadNotifications() {
+  fetch("/notifications", { credentials: "include" })
+    .then(res => {
+      if (!res.ok) {
+        handleHttpError(res);
+        throw new Error(`HTTP ${res.status}`);
+      }
+      return res.json();
+    })
+    .then(page => {
+      const list = document.getElementById("notifications-list");
+      list.innerHTML = "";
+      if (page.notifications.length === 0) list.innerHTML = `<li class="notification-empty">Nothing yet</li>`;
+      page.notifications.forEach(n => list.appendChild(renderNotificationItem(n)));
+      setUnreadNotifications(page.unread);
+    })
+    .catch(err => console.error("Error loading notifications:", err));
+}
+
+function toggleNotificationsPanel() {
+  const panel = document.getElementById("notifications-panel");
+  panel.classList.toggle("hidden");
+  if (!panel.classList.contains("hidden")) {
+    loadNotifications();
+    loadEmailPreferences();
+  }
+}
+
+function loadEmailPreferences() {
+  fetch("/notifications/email", { credentials: "include" })
+    .then(res => {
+      if (!res.ok) throw new Error(`HTTP ${res.status}`);
+      return res.json();
+    })
+    .then(prefs => {
+      const form = document.getElementById("email-preferences");
+      form.messages.checked = prefs.messages;
+      form.replies.checked = prefs.replies;
+      form.mentions.checked = prefs.mentions;
+      form.digest.value = prefs.digest;
+    })
+    .catch(err => console.error("Error loading email preferences:", err));
+}
+
+function saveEmailPreferences() {
+  const form = document.getElementById("email-preferences");
+  fetch("/notifications/email", {
+    method: "PUT",
+    credentials: "include",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({
+      messages: form.messages.checked,
+      replies: form.replies.checked,
+      mentions: form.mentions.checked,
+      digest: form.digest.value
+    })
+  })
+    .then(res => {
+      if (!res.ok) throw new Error(`HTTP ${res.status}`);
+    })
+    .catch(err => console.error("Error saving email preferences:", err));
+}
+
+// markNotificationsRead marks the given notifications read, or all of them
+// when ids is empty. Other tabs update from the notifications_read frame.
+function markNotificationsRead(ids) {
+  fetch("/notifications/read", {
+    method: "POST",
+    credentials: "include",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({ ids: ids })
+  })
+    .then(res => {
+      if (!res.ok) throw new Error(`HTTP ${res.status}`);
+      return res.json();
+    })
+    .then(data => handleNotificationsRead(data.ids, data.unread))
+    .catch(err => console.error("Error marking notifications read:", err));
+}
+
+function handleNotificationsRead(ids, unread) {
+  setUnreadNotifications(unread);
+  document.querySelectorAll("#notifications-list .notification-item.unread").forEach(li => {
+    if (!ids || ids.length === 0 || ids.includes(Number(li.dataset.id))) li.classList.remove("unread");
+  });
+}
+
+// handleNotification shows a new notification as a popup and, if the panel
+// is open, at the top of the list. Clicking the popup opens it.
+function handleNotification(n) {
+  setUnreadNotifications(unreadNotifications + 1);
+  const list = document.getElementById("notifications-list");
+  if (!document.getElementById("notifications-panel").classList.contains("hidden")) {
+    const empty = list.querySelector(".notification-empty");
+    if (empty) empty.remove();
+    list.prepend(renderNotificationItem(n));
+  }
+  // Messages already get the chat popup.
+  if (n.kind !== "message") showCustomNotification(notificationTitle(n), n.excerpt, () => openNotification(n));
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+)
+
+// Live feed subscriptions. A connection subscribes to topics and receives
+// events for them until it unsubscribes or disconnects:
+//
+//	posts            post_created for every new post
+//	category:<slug>  post_created for new posts in that category
+//	post:<uuid>      comment_created and reaction_updated for that post
+//
+// A post opened with view_post gets the post:<uuid> events without
+// subscribing.
+
+const (
+	TopicPosts          = "posts"
+	topicCategoryPrefix = "category:"
+	topicPostPrefix     = "post:"
+)
+
+// maxSubscriptions caps the topics one connection can hold.
+var maxSubscriptions = envInt("WS_MAX_SUBSCRIPTIONS", 50)
+
+var (
+	ErrInvalidTopic         = errors.New("topic must be posts, category:<slug> or post:<uuid>")
+	ErrTooManySubscriptions = errors.New("too many subscriptions on this connection")
+)
+
+func categoryTopic(slug string) string { return topicCategoryPrefix + slug }
+func postTopic(postUUID string) string { return topicPostPrefix + postUUID }
+
+func validTopic(topic string) bool {
+	if topic == TopicPosts {
+		return true
+	}
+	for _, prefix := range []string{topicCategoryPrefix, topicPostPrefix} {
+		if rest, ok := strings.CutPrefix(topic, prefix); ok && rest != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func handleSubscribeFrame(hub *Hub, client *Client, frame inboundFrame) {
+	var p SubscribePayload
+	if err := json.Unmarshal(frame.Payload, &p); err != nil || !validTopic(p.Topic) {
+		hub.SendToClient(client, errorFrame(frame.ID, "invalid_topic", ErrInvalidTopic.Error()))
+		return
+	}
+
+	if frame.Type == FrameUnsubscribe {
+		hub.Unsubscribe(client, p.Topic)
+	} else if err := hub.Subscribe(client, p.Topic); err != nil {
+		hub.SendToClient(client, errorFrame(frame.ID, "too_many_subscriptions", err.Error()))
+		return
+	}
+	hub.SendToClient(client, NewFrame(FrameAck, frame.ID, nil, nil))
+}
+
+// publishPostCreated sends a new post to the posts topic and to the topics
+// of its categories.
+func publishPostCreated(db *sql.DB, hub *Hub, postUUID string) {
+	post, _, err := loadPost(db, postUUID, "")
+	if err != nil {
+		log.Printf("Error loading post %s for post_created: %v", postUUID, err)
+		return
+	}
+
+	slugs, err := postCategorySlugs(db, postUUID)
+	if err != nil {
+		log.Printf("Error loading categories of post %s for post_created: %v", postUUID, err)
+	}
+	topics := []string{TopicPosts}
+	for _, slug := range slugs {
+		topics = append(topics, categoryTopic(slug))
+	}
+	hub.SendToTopics(topics, NewFrame(FramePostCreated, "", post, nil))
+}
+
+// publishCommentCreated sends a new comment to everyone following its post.
+func publishCommentCreated(db *sql.DB, hub *Hub, postUUID string, commentID int64) {
+	comment, err := loadComment(db, commentID)
+	if err != nil {
+		log.Printf("Error loading comment %d for comment_created: %v", commentID, err)
+		return
+	}
+	hub.SendToPostViewers(postUUID, NewFrame(FrameCommentCreated, "", CommentCreatedPayload{PostUUID: postUUID, Comment: comment}, nil))
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"testing"
+)
+
+// newSubscriptionHub starts a hub for in-process clients.
+func newSubscriptionHub(t *testing.T) (*Hub, *sql.DB) {
+	t.Helper()
+	db := newTestDB(t)
+	hub := NewHub(db, DefaultHubConfig())
+	go hub.Run()
+	t.Cleanup(func() { waitForIdleDB(t, db) })
+	return hub, db
+}
+
+// connect registers a resumed version 2 client for a new user.
+func connect(t *testing.T, hub *Hub, db *sql.DB, nickname string) *Client {
+	t.Helper()
+	c := &Client{Protocol: ProtocolV2, UserUUID: createTestUser(t, db, nickname), Nickname: nickname, Send: make(chan []byte, 256)}
+	hub.Register(c)
+	var zero int64
+	hub.Resume(c, "r", &zero)
+	return c
+}
+
+// received drains the frames of the given type queued for the client. Hub
+// calls return once their frames are queued, so nothing is still on its way.
+func received(c *Client, frameType string) int {
+	n := 0
+	for {
+		select {
+		case data := <-c.Send:
+			var env Envelope
+			json.Unmarshal(data, &env)
+			if env.Type == frameType {
+				n++
+			}
+		default:
+			return n
+		}
+	}
+}
+
+func TestValidTopic(t *testing.T) {
+	for topic, want := range map[string]bool{
+		TopicPosts:          true,
+		categoryTopic("go"): true,
+		postTopic("p1"):     true,
+		"category:":         false,
+		"post:":             false,
+		"posts:go":          false,
+		"":                  false,
+		"comments":          false,
+	} {
+		if got := validTopic(topic); got != want {
+			t.Errorf("validTopic(%q) = %v", topic, got)
+		}
+	}
+}
+
+func TestSendToTopics(t *testing.T) {
+	hub, db := newSubscriptionHub(t)
+	clients := map[string][]string{
+		"alice": {TopicPosts, categoryTopic("go")}, // both topics of the post: one frame
+		"bob":   {categoryTopic("go")},
+		"carol": {categoryTopic("rust")},
+		"dave":  nil,
+	}
+	want := map[string]int{"alice": 1, "bob": 1, "carol": 0, "dave": 0}
+	connected := map[string]*Client{}
+	for name, topics := range clients {
+		c := connect(t, hub, db, name)
+		for _, topic := range topics {
+			if err := hub.Subscribe(c, topic); err != nil {
+				t.Fatal(err)
+			}
+		}
+		connected[name] = c
+	}
+
+	hub.SendToTopics([]string{TopicPosts, categoryTopic("go")}, NewFrame(FramePostCreated, "", Post{Title: "New"}, nil))
+	for name, c := range connected {
+		if got := received(c, FramePostCreated); got != want[name] {
+			t.Errorf("%s got %d frames, want %d", name, got, want[name])
+		}
+	}
+
+	// Unsubscribing and disconnecting stop the events.
+	hub.Unsubscribe(connected["bob"], categoryTopic("go"))
+	hub.Unregister(connected["alice"])
+	hub.SendToTopics([]string{TopicPosts, categoryTopic("go")}, NewFrame(FramePostCreated, "", Post{Title: "Newer"}, nil))
+	if got := received(connected["bob"], FramePostCreated); got != 0 {
+		t.Errorf("bob got %d frames after unsubscribing", got)
+	}
+	var topics int
+	hub.do(func() { topics = len(hub.subscribers) })
+	if topics != 1 {
+		t.Errorf("%d topics left, want only carol's", topics)
+	}
+}
+
+func TestSendToPostViewers(t *testing.T) {
+	hub, db := newSubscriptionHub(t)
+	viewer, subscriber, both, other := connect(t, hub, db, "alice"), connect(t, hub, db, "bob"), connect(t, hub, db, "carol"), connect(t, hub, db, "dave")
+	hub.ViewPost(viewer, "p1")
+	hub.ViewPost(both, "p1")
+	hub.ViewPost(other, "p2")
+	for _, c := range []*Client{subscriber, both} {
+		if err := hub.Subscribe(c, postTopic("p1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hub.SendToPostViewers("p1", NewFrame(FrameCommentCreated, "", nil, nil))
+	for name, tt := range map[string]struct {
+		c    *Client
+		want int
+	}{
+		"viewer": {viewer, 1}, "subscriber": {subscriber, 1}, "viewer and subscriber": {both, 1}, "other post": {other, 0},
+	} {
+		if got := received(tt.c, FrameCommentCreated); got != tt.want {
+			t.Errorf("%s got %d frames, want %d", name, got, tt.want)
+		}
+	}
+
+	// Opening another post leaves the first; the subscription stays.
+	hub.ViewPost(both, "p2")
+	hub.ViewPost(viewer, "")
+	hub.SendToPostViewers("p1", NewFrame(FrameCommentCreated, "", nil, nil))
+	if got := received(viewer, FrameCommentCreated); got != 0 {
+		t.Errorf("viewer got %d frames after closing the post", got)
+	}
+	if got := received(both, FrameCommentCreated); got != 1 {
+		t.Errorf("subscriber viewing another post got %d frames, want 1", got)
+	}
+}
+
+func TestSubscriptionLimit(t *testing.T) {
+	old := maxSubscriptions
+	maxSubscriptions = 2
+	t.Cleanup(func() { maxSubscriptions = old })
+	hub, db := newSubscriptionHub(t)
+	c := connect(t, hub, db, "alice")
+
+	for _, topic := range []string{TopicPosts, categoryTopic("go"), TopicPosts} {
+		if err := hub.Subscribe(c, topic); err != nil {
+			t.Fatalf("subscribe %s: %v", topic, err)
+		}
+	}
+	if err := hub.Subscribe(c, categoryTopic("rust")); err != ErrTooManySubscriptions {
+		t.Errorf("subscription over the limit: %v", err)
+	}
+	hub.Unsubscribe(c, TopicPosts)
+	if err := hub.Subscribe(c, categoryTopic("rust")); err != nil {
+		t.Errorf("subscription after freeing a place: %v", err)
+	}
+}
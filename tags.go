@@ -0,0 +1,378 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Tags are free-form labels authors add to posts next to categories. Names
+// are normalized, so "#Go Lang" and "go-lang" are the same tag. Moderators
+// can merge a tag into another, which moves its posts and sends later uses
+// of its name to the other tag, and ban a tag, which hides it from posts and
+// listings and rejects it on new posts.
+
+const (
+	maxTagLen          = 32
+	defaultTagPageSize = 20
+	maxTagPageSize     = 100
+)
+
+// maxTagsPerPost caps the tags on one post.
+var maxTagsPerPost = envInt("POST_MAX_TAGS", 5)
+
+var (
+	ErrInvalidTag  = errors.New("tags must be 1-32 letters, digits or dashes")
+	ErrTooManyTags = fmt.Errorf("a post can have at most %d tags", maxTagsPerPost)
+	ErrTagBanned   = errors.New("tag is banned")
+	ErrTagNotFound = errors.New("tag not found")
+	ErrMergeSelf   = errors.New("cannot merge a tag into itself")
+)
+
+type Tag struct {
+	Name      string `json:"name"`
+	PostCount int    `json:"post_count"`
+	Banned    bool   `json:"banned,omitempty"`
+}
+
+// normalizeTag lowercases a tag, drops a leading '#' and joins words with
+// dashes. Anything but letters, digits, dashes, underscores and spaces makes
+// it invalid.
+func normalizeTag(s string) (string, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "#")
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		case r == '-' || r == '_' || unicode.IsSpace(r):
+			dash = true
+		default:
+			return "", ErrInvalidTag
+		}
+	}
+	tag := b.String()
+	if tag == "" || utf8.RuneCountInString(tag) > maxTagLen {
+		return "", ErrInvalidTag
+	}
+	return tag, nil
+}
+
+// normalizeTags normalizes the tags of a post and drops duplicates.
+func normalizeTags(raw []string) ([]string, error) {
+	tags := make([]string, 0, len(raw))
+	for _, s := range raw {
+		tag, err := normalizeTag(s)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	tags = uniqueStrings(tags, "")
+	if len(tags) > maxTagsPerPost {
+		return nil, ErrTooManyTags
+	}
+	return tags, nil
+}
+
+// tagPost links normalized tags to a post, creating tags that do not exist
+// yet and following merges.
+func tagPost(tx *sql.Tx, postID int64, tags []string) error {
+	for _, name := range tags {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO tags (name) VALUES (?)`, name); err != nil {
+			return err
+		}
+		var id int64
+		var banned bool
+		err := tx.QueryRow(`
+            SELECT t.id, t.banned_at IS NOT NULL
+            FROM tags a JOIN tags t ON t.id = COALESCE(a.merged_into, a.id)
+            WHERE a.name = ?`, name).Scan(&id, &banned)
+		if err != nil {
+			return err
+		}
+		if banned {
+			return fmt.Errorf("%w: %s", ErrTagBanned, name)
+		}
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO post_tags (post_id, tag_id) VALUES (?, ?)`, postID, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadPostTags returns the visible tags of each post, by post id.
+func LoadPostTags(db *sql.DB, postIDs []int64) (map[int64][]string, error) {
+	tags := map[int64][]string{}
+	if len(postIDs) == 0 {
+		return tags, nil
+	}
+	rows, err := db.Query(`
+        SELECT pt.post_id, t.name
+        FROM post_tags pt
+        JOIN tags t ON t.id = pt.tag_id
+        WHERE t.banned_at IS NULL AND pt.post_id IN (`+strings.Repeat("?,", len(postIDs)-1)+`?)
+        ORDER BY t.name`, toInterfaceSlice(postIDs)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var postID int64
+		var name string
+		if err := rows.Scan(&postID, &name); err != nil {
+			return nil, err
+		}
+		tags[postID] = append(tags[postID], name)
+	}
+	return tags, rows.Err()
+}
+
+// ListTags returns tags starting with prefix, most used first. Merged tags
+// are left out, and banned ones are listed instead of the others when
+// banned is set.
+func ListTags(db *sql.DB, prefix string, banned bool, limit int) ([]Tag, error) {
+	bannedCond := "t.banned_at IS NULL"
+	if banned {
+		bannedCond = "t.banned_at IS NOT NULL"
+	}
+	like := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix) + "%"
+	rows, err := db.Query(`
+        SELECT t.name, COUNT(p.id), t.banned_at IS NOT NULL
+        FROM tags t
+        LEFT JOIN post_tags pt ON pt.tag_id = t.id
+        LEFT JOIN posts p ON p.id = pt.post_id AND p.deleted_at IS NULL
+        WHERE t.merged_into IS NULL AND `+bannedCond+` AND t.name LIKE ? ESCAPE '\'
+        GROUP BY t.id
+        ORDER BY COUNT(p.id) DESC, t.name
+        LIMIT ?`, like, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []Tag{}
+	for rows.Next() {
+		var t Tag
+		if err := rows.Scan(&t.Name, &t.PostCount, &t.Banned); err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+	return tags, rows.Err()
+}
+
+// tagID looks up a tag by normalized name.
+func tagID(tx *sql.Tx, name string) (int64, error) {
+	var id int64
+	err := tx.QueryRow(`SELECT id FROM tags WHERE name = ?`, name).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, ErrTagNotFound
+	}
+	return id, err
+}
+
+// MergeTags moves the posts of from to into and makes later uses of from,
+// and of tags merged into it before, go to into.
+func MergeTags(db *sql.DB, from, into string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	fromID, err := tagID(tx, from)
+	if err != nil {
+		return err
+	}
+	intoID, err := tagID(tx, into)
+	if err != nil {
+		return err
+	}
+	// Merging into a merged tag means merging into its target.
+	if err := tx.QueryRow(`SELECT COALESCE(merged_into, id) FROM tags WHERE id = ?`, intoID).Scan(&intoID); err != nil {
+		return err
+	}
+	if fromID == intoID {
+		return ErrMergeSelf
+	}
+
+	_, err = tx.Exec(`INSERT OR IGNORE INTO post_tags (post_id, tag_id)
+        SELECT post_id, ? FROM post_tags WHERE tag_id = ?`, intoID, fromID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM post_tags WHERE tag_id = ?`, fromID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE tags SET merged_into = ? WHERE id = ? OR merged_into = ?`, intoID, fromID, fromID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// BanTag bans or unbans a tag. Its posts keep the link, so unbanning shows
+// the tag on them again.
+func BanTag(db *sql.DB, name string, banned bool, now time.Time) error {
+	stmt, args := `UPDATE tags SET banned_at = NULL WHERE name = ?`, []interface{}{name}
+	if banned {
+		stmt, args = `UPDATE tags SET banned_at = COALESCE(banned_at, ?) WHERE name = ?`, []interface{}{now, name}
+	}
+	res, err := db.Exec(stmt, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrTagNotFound
+	}
+	return nil
+}
+
+func writeTagError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrTagNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case ErrNotModerator:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case ErrInvalidTag, ErrMergeSelf:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Printf("Tag error: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+	}
+}
+
+// TagsHandler: GET /tags[?q=<prefix>][&limit=][&banned=true] lists tags by
+// use, for autocomplete and tag clouds. banned=true is for moderators.
+func TagsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		v := r.URL.Query()
+		banned, _ := strconv.ParseBool(v.Get("banned"))
+		if banned {
+			if err := requireModerator(db, userUUID); err != nil {
+				writeTagError(w, err)
+				return
+			}
+		}
+		limit := defaultTagPageSize
+		if limitStr := v.Get("limit"); limitStr != "" {
+			n, err := strconv.Atoi(limitStr)
+			if err != nil || n < 1 {
+				http.Error(w, "'limit' must be a positive number", http.StatusBadRequest)
+				return
+			}
+			limit = min(n, maxTagPageSize)
+		}
+		// Match the prefix the way tags are stored. A prefix that is not a
+		// valid tag start matches nothing.
+		tags := []Tag{}
+		prefix, err := normalizeTag(v.Get("q"))
+		if err == nil || strings.TrimPrefix(strings.TrimSpace(v.Get("q")), "#") == "" {
+			if tags, err = ListTags(db, prefix, banned, limit); err != nil {
+				writeTagError(w, err)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tags)
+	}
+}
+
+type MergeTagsRequest struct {
+	From string `json:"from"`
+	Into string `json:"into"`
+}
+
+// MergeTagsHandler: POST /tags/merge {from, into}
+func MergeTagsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err := requireModerator(db, userUUID); err != nil {
+			writeTagError(w, err)
+			return
+		}
+
+		var req MergeTagsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		from, err := normalizeTag(req.From)
+		if err != nil {
+			writeTagError(w, err)
+			return
+		}
+		into, err := normalizeTag(req.Into)
+		if err != nil {
+			writeTagError(w, err)
+			return
+		}
+
+		if err := MergeTags(db, from, into); err != nil {
+			writeTagError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type BanTagRequest struct {
+	Tag    string `json:"tag"`
+	Banned bool   `json:"banned"`
+}
+
+// BanTagHandler: POST /tags/ban {tag, banned}
+func BanTagHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err := requireModerator(db, userUUID); err != nil {
+			writeTagError(w, err)
+			return
+		}
+
+		var req BanTagRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		tag, err := normalizeTag(req.Tag)
+		if err != nil {
+			writeTagError(w, err)
+			return
+		}
+
+		if err := BanTag(db, tag, req.Banned, time.Now()); err != nil {
+			writeTagError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestNormalizeTag(t *testing.T) {
+	tests := []struct {
+		in, want string
+		err      error
+	}{
+		{"go", "go", nil},
+		{"#Go Lang", "go-lang", nil},
+		{"  go_lang  ", "go-lang", nil},
+		{"go--lang-", "go-lang", nil},
+		{"Café", "café", nil},
+		{"", "", ErrInvalidTag},
+		{"#", "", ErrInvalidTag},
+		{"c++", "", ErrInvalidTag},
+		{"abcdefghijklmnopqrstuvwxyz0123456789", "", ErrInvalidTag},
+	}
+	for _, tt := range tests {
+		got, err := normalizeTag(tt.in)
+		if got != tt.want || err != tt.err {
+			t.Errorf("normalizeTag(%q) = %q, %v; want %q, %v", tt.in, got, err, tt.want, tt.err)
+		}
+	}
+	if _, err := normalizeTags([]string{"a", "b", "c", "d", "e", "A", "#b"}); err != nil {
+		t.Errorf("duplicates counted against the limit: %v", err)
+	}
+	if _, err := normalizeTags([]string{"a", "b", "c", "d", "e", "f"}); err != ErrTooManyTags {
+		t.Errorf("too many tags: %v", err)
+	}
+}
+
+// tagTest posts as alice and reads back the tags of posts.
+type tagTest struct {
+	t     *testing.T
+	db    *sql.DB
+	alice string
+}
+
+func (tg *tagTest) post(tags ...string) int64 {
+	tg.t.Helper()
+	postUUID := uuid.New().String()
+	if err := InsertPost(tg.db, postUUID, tg.alice, "Title", "body", nil, tags, time.Now()); err != nil {
+		tg.t.Fatal(err)
+	}
+	id, _, err := resolveTarget(tg.db, TargetPost, postUUID, 0)
+	if err != nil {
+		tg.t.Fatal(err)
+	}
+	return id
+}
+
+func (tg *tagTest) tags(postIDs ...int64) [][]string {
+	tg.t.Helper()
+	byPost, err := LoadPostTags(tg.db, postIDs)
+	if err != nil {
+		tg.t.Fatal(err)
+	}
+	var out [][]string
+	for _, id := range postIDs {
+		out = append(out, byPost[id])
+	}
+	return out
+}
+
+func (tg *tagTest) list(prefix string, banned bool) []Tag {
+	tg.t.Helper()
+	tags, err := ListTags(tg.db, prefix, banned, 10)
+	if err != nil {
+		tg.t.Fatal(err)
+	}
+	return tags
+}
+
+func newTagTest(t *testing.T) *tagTest {
+	db := newTestDB(t)
+	return &tagTest{t: t, db: db, alice: createTestUser(t, db, "alice")}
+}
+
+func TestMergeTags(t *testing.T) {
+	tg := newTagTest(t)
+	a := tg.post("go")
+	b := tg.post("golang")
+	both := tg.post("go", "golang", "web")
+	c := tg.post("go-lang")
+
+	if err := MergeTags(tg.db, "go-lang", "golang"); err != nil {
+		t.Fatal(err)
+	}
+	if err := MergeTags(tg.db, "golang", "go"); err != nil {
+		t.Fatal(err)
+	}
+	got := tg.tags(a, b, both, c)
+	want := [][]string{{"go"}, {"go"}, {"go", "web"}, {"go"}}
+	if !slices.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("tags after merging: %v, want %v", got, want)
+	}
+	if tags := tg.list("go", false); len(tags) != 1 || tags[0] != (Tag{Name: "go", PostCount: 4}) {
+		t.Errorf("listed %+v, want go on 4 posts", tags)
+	}
+
+	// Later uses of the merged names, including the earlier merge, go to the
+	// target.
+	d := tg.post("golang", "go-lang")
+	if got := tg.tags(d); !slices.Equal(got[0], []string{"go"}) {
+		t.Errorf("new post tagged %v, want [go]", got[0])
+	}
+
+	for _, m := range []struct {
+		name, from, into string
+		err              error
+	}{
+		{"into itself", "go", "go", ErrMergeSelf},
+		{"into a tag merged into it", "go", "golang", ErrMergeSelf},
+		{"unknown source", "rust", "go", ErrTagNotFound},
+		{"unknown target", "go", "rust", ErrTagNotFound},
+	} {
+		if err := MergeTags(tg.db, m.from, m.into); err != m.err {
+			t.Errorf("%s: got %v, want %v", m.name, err, m.err)
+		}
+	}
+
+	// Merging into a merged tag follows it to its target.
+	if err := MergeTags(tg.db, "web", "golang"); err != nil {
+		t.Fatal(err)
+	}
+	if got := tg.tags(both); !slices.Equal(got[0], []string{"go"}) {
+		t.Errorf("tags %v, want [go]", got[0])
+	}
+}
+
+func TestBanTag(t *testing.T) {
+	tg := newTagTest(t)
+	post := tg.post("cheap-pills", "health")
+	tg.post("pills")
+	if err := MergeTags(tg.db, "pills", "cheap-pills"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := BanTag(tg.db, "cheap-pills", true, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if got := tg.tags(post); !slices.Equal(got[0], []string{"health"}) {
+		t.Errorf("tags %v, want the banned one hidden", got[0])
+	}
+	if tags := tg.list("", false); len(tags) != 1 || tags[0].Name != "health" {
+		t.Errorf("listed %+v", tags)
+	}
+	if tags := tg.list("", true); len(tags) != 1 || tags[0].Name != "cheap-pills" || !tags[0].Banned {
+		t.Errorf("listed as banned: %+v", tags)
+	}
+	// New posts can use neither the tag nor a name merged into it.
+	for _, tag := range []string{"cheap-pills", "pills"} {
+		err := InsertPost(tg.db, uuid.New().String(), tg.alice, "Title", "body", nil, []string{"health", tag}, time.Now())
+		if !errors.Is(err, ErrTagBanned) {
+			t.Errorf("post tagged %s: %v", tag, err)
+		}
+	}
+
+	if err := BanTag(tg.db, "cheap-pills", false, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if got := tg.tags(post); !slices.Equal(got[0], []string{"cheap-pills", "health"}) {
+		t.Errorf("tags after unbanning %v", got[0])
+	}
+	if err := BanTag(tg.db, "nothing", true, time.Now()); err != ErrTagNotFound {
+		t.Errorf("ban of unknown tag: %v", err)
+	}
+}
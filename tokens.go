@@ -0,0 +1,391 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Email verification and password reset work through links with a one-time
+// token, emailed through the outbox (see emails.go). Only an HMAC of each
+// token is stored, keyed with AUTH_TOKEN_SECRET, so neither a copy of the
+// database nor a guess without the secret yields a working link; the outbox
+// keeps the emailed link only until the email is sent or given up on. A token
+// expires after its TTL, is spent when redeemed, and is superseded when a
+// newer one is issued for the same purpose. Resetting a password ends all of
+// the user's sessions. With REQUIRE_EMAIL_VERIFICATION=true users cannot log
+// in until they have verified their address, and a login attempt with the
+// right password sends them a fresh link.
+
+const (
+	TokenVerifyEmail   = "verify_email"
+	TokenResetPassword = "reset_password"
+)
+
+var (
+	tokenSecret              = loadTokenSecret()
+	emailVerifyTTL           = envDuration("EMAIL_VERIFY_TTL", 48*time.Hour)
+	passwordResetTTL         = envDuration("PASSWORD_RESET_TTL", time.Hour)
+	tokenEmailInterval       = envDuration("TOKEN_EMAIL_INTERVAL", time.Minute) // least time between two links of a kind
+	requireEmailVerification = envString("REQUIRE_EMAIL_VERIFICATION", "false") == "true"
+)
+
+var (
+	ErrInvalidToken     = errors.New("this link is invalid or has expired")
+	ErrAlreadyVerified  = errors.New("email address already verified")
+	ErrEmailNotVerified = errors.New("email address not verified")
+)
+
+// loadTokenSecret reads AUTH_TOKEN_SECRET. Without it a random secret is
+// used, and links sent before a restart stop working.
+func loadTokenSecret() []byte {
+	if s := envString("AUTH_TOKEN_SECRET", ""); s != "" {
+		return []byte(s)
+	}
+	log.Printf("AUTH_TOKEN_SECRET is not set; verification and reset links will not survive a restart")
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatalf("Failed to generate token secret: %v", err)
+	}
+	return secret
+}
+
+// tokenHash is what the database keeps of a token. The purpose is part of
+// the MAC, so a token cannot be redeemed for anything else.
+func tokenHash(purpose, token string) string {
+	mac := hmac.New(sha256.New, tokenSecret)
+	mac.Write([]byte(purpose + ":" + token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// issueToken creates a token for the user, superseding their unspent tokens
+// for the same purpose.
+func issueToken(tx *sql.Tx, userUUID, purpose string, ttl time.Duration, now time.Time) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	if _, err := tx.Exec(`UPDATE auth_tokens SET used_at = ?
+        WHERE user_uuid = ? AND purpose = ? AND used_at IS NULL`, now, userUUID, purpose); err != nil {
+		return "", err
+	}
+	_, err := tx.Exec(`INSERT INTO auth_tokens (user_uuid, purpose, token_hash, created_at, expires_at)
+        VALUES (?, ?, ?, ?, ?)`, userUUID, purpose, tokenHash(purpose, token), now, now.Add(ttl))
+	return token, err
+}
+
+// redeemToken spends a token and returns the user it was issued to.
+func redeemToken(tx *sql.Tx, purpose, token string, now time.Time) (string, error) {
+	var id int64
+	var userUUID string
+	err := tx.QueryRow(`SELECT id, user_uuid FROM auth_tokens
+        WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND julianday(expires_at) > ?`,
+		tokenHash(purpose, token), purpose, julianDay(now.Unix())).Scan(&id, &userUUID)
+	if err == sql.ErrNoRows {
+		return "", ErrInvalidToken
+	}
+	if err != nil {
+		return "", err
+	}
+	res, err := tx.Exec(`UPDATE auth_tokens SET used_at = ? WHERE id = ? AND used_at IS NULL`, now, id)
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", ErrInvalidToken
+	}
+	return userUUID, nil
+}
+
+// tokenEmailData fills the verify_email and password_reset templates.
+type tokenEmailData struct {
+	Nickname string
+	Link     string
+	TTL      string
+}
+
+// queueTokenEmail issues a token and queues the email carrying its link,
+// which opens the forum with the token in the given query parameter. If the
+// user was sent a link for the same purpose within TOKEN_EMAIL_INTERVAL, it
+// does nothing, so the endpoints cannot be used to flood an inbox.
+func queueTokenEmail(tx *sql.Tx, userUUID, to, nickname, purpose, param string, ttl time.Duration, now time.Time) error {
+	var recent bool
+	err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM auth_tokens
+        WHERE user_uuid = ? AND purpose = ? AND julianday(created_at) > ?)`,
+		userUUID, purpose, julianDay(now.Add(-tokenEmailInterval).Unix())).Scan(&recent)
+	if err != nil || recent {
+		return err
+	}
+	token, err := issueToken(tx, userUUID, purpose, ttl, now)
+	if err != nil {
+		return err
+	}
+	data := tokenEmailData{
+		Nickname: nickname,
+		Link:     emailBaseURL + "/?" + param + "=" + url.QueryEscape(token),
+		TTL:      formatTTL(ttl),
+	}
+	name := "verify_email"
+	if purpose == TokenResetPassword {
+		name = "password_reset"
+	}
+	subject, body, err := renderEmail(name, data)
+	if err != nil {
+		return err
+	}
+	return QueueEmail(tx, userUUID, to, subject, body, true, now)
+}
+
+// formatTTL writes a token lifetime the way the emails mention it.
+func formatTTL(d time.Duration) string {
+	switch {
+	case d%(24*time.Hour) == 0:
+		return pluralize(int(d/(24*time.Hour)), "day")
+	case d%time.Hour == 0:
+		return pluralize(int(d/time.Hour), "hour")
+	}
+	return pluralize(int(d.Round(time.Minute)/time.Minute), "minute")
+}
+
+func pluralize(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+// SendVerificationEmail emails the user a link confirming their address.
+func SendVerificationEmail(db *sql.DB, userUUID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var email, nickname string
+	var verified bool
+	err = tx.QueryRow(`SELECT email, nickname, email_verified_at IS NOT NULL FROM users WHERE uuid = ?`,
+		userUUID).Scan(&email, &nickname, &verified)
+	if err != nil {
+		return err
+	}
+	if verified {
+		return ErrAlreadyVerified
+	}
+	if err := queueTokenEmail(tx, userUUID, email, nickname, TokenVerifyEmail, "verify", emailVerifyTTL, time.Now()); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	wakeEmailWorker()
+	return nil
+}
+
+// VerifyEmail redeems a verification token.
+func VerifyEmail(db *sql.DB, token string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	userUUID, err := redeemToken(tx, TokenVerifyEmail, token, now)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE users SET email_verified_at = COALESCE(email_verified_at, ?) WHERE uuid = ?`, now, userUUID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// EmailVerified reports whether the user has confirmed their address.
+func EmailVerified(db *sql.DB, userUUID string) (bool, error) {
+	var verified bool
+	err := db.QueryRow(`SELECT email_verified_at IS NOT NULL FROM users WHERE uuid = ?`, userUUID).Scan(&verified)
+	return verified, err
+}
+
+// RequestPasswordReset emails a reset link to the account with this address.
+// Unknown addresses are ignored without an error so callers cannot tell who
+// has an account.
+func RequestPasswordReset(db *sql.DB, email string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var userUUID, nickname string
+	err = tx.QueryRow(`SELECT uuid, nickname FROM users WHERE email = ?`, email).Scan(&userUUID, &nickname)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := queueTokenEmail(tx, userUUID, email, nickname, TokenResetPassword, "reset", passwordResetTTL, now); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	wakeEmailWorker()
+	return nil
+}
+
+// ResetPassword redeems a reset token, sets the new password and deletes all
+// of the user's sessions and pending logins. Following the link proves the
+// user reads the address, so it also counts as verifying it.
+func ResetPassword(db *sql.DB, token, password string) (string, error) {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return "", err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	userUUID, err := redeemToken(tx, TokenResetPassword, token, now)
+	if err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`UPDATE users SET password_hash = ?, email_verified_at = COALESCE(email_verified_at, ?)
+        WHERE uuid = ?`, hash, now, userUUID); err != nil {
+		return "", err
+	}
+	// Logins half-way through two-factor authentication used the old
+	// password too.
+	for _, table := range []string{"sessions", "login_challenges"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE user_uuid = ?`, userUUID); err != nil {
+			return "", err
+		}
+	}
+	return userUUID, tx.Commit()
+}
+
+type TokenRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"` // password resets only
+}
+
+// RequestVerificationHandler: POST /verify-email/request
+func RequestVerificationHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch err := SendVerificationEmail(db, userUUID); err {
+		case nil:
+		case ErrAlreadyVerified:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		default:
+			log.Printf("Error sending verification email: %v", err)
+			http.Error(w, "Failed to send verification email", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("Verification email sent"))
+	}
+}
+
+// VerifyEmailHandler: POST /verify-email {token}
+func VerifyEmailHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req TokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		switch err := VerifyEmail(db, req.Token); err {
+		case nil:
+		case ErrInvalidToken:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		default:
+			log.Printf("Error verifying email: %v", err)
+			http.Error(w, "Failed to verify email", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("Email verified"))
+	}
+}
+
+// RequestPasswordResetHandler: POST /password-reset/request {email}
+func RequestPasswordResetHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Email string `json:"email"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		req.Email = strings.TrimSpace(req.Email)
+		if req.Email == "" {
+			http.Error(w, "Missing email", http.StatusBadRequest)
+			return
+		}
+		if err := RequestPasswordReset(db, req.Email); err != nil {
+			log.Printf("Error requesting password reset: %v", err)
+			http.Error(w, "Failed to request password reset", http.StatusInternalServerError)
+			return
+		}
+		// The same answer whether or not the address has an account.
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("If an account uses this address, a reset link is on its way"))
+	}
+}
+
+// ResetPasswordHandler: POST /password-reset {token, password}
+func ResetPasswordHandler(db *sql.DB, hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req TokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		password, ok := newPassword(req.Password)
+		if !ok {
+			http.Error(w, "Missing password", http.StatusBadRequest)
+			return
+		}
+		userUUID, err := ResetPassword(db, req.Token, password)
+		switch err {
+		case nil:
+		case ErrInvalidToken:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		default:
+			log.Printf("Error resetting password: %v", err)
+			http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+			return
+		}
+
+		// The sessions are gone; close their sockets too.
+		hub.DisconnectUser(userUUID, forceLogoutFrame())
+		w.Write([]byte("Password reset, please log in"))
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"database/sql"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// issueTestToken issues a token for the user as of now.
+func issueTestToken(t *testing.T, db *sql.DB, userUUID, purpose string, ttl time.Duration, now time.Time) string {
+	t.Helper()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	token, err := issueToken(tx, userUUID, purpose, ttl, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func redeemTestToken(t *testing.T, db *sql.DB, purpose, token string, now time.Time) (string, error) {
+	t.Helper()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	userUUID, err := redeemToken(tx, purpose, token, now)
+	if err != nil {
+		return "", err
+	}
+	return userUUID, tx.Commit()
+}
+
+func TestRedeemToken(t *testing.T) {
+	now := testNow()
+	tests := []struct {
+		name    string
+		purpose string        // purpose it is redeemed for
+		at      time.Duration // when it is redeemed, after issuing
+		ok      bool
+	}{
+		{"fresh", TokenVerifyEmail, time.Minute, true},
+		{"just before expiry", TokenVerifyEmail, time.Hour - time.Second, true},
+		{"expired", TokenVerifyEmail, time.Hour, false},
+		{"wrong purpose", TokenResetPassword, time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			bob := createTestUser(t, db, "bob")
+			token := issueTestToken(t, db, bob, TokenVerifyEmail, time.Hour, now)
+
+			user, err := redeemTestToken(t, db, tt.purpose, token, now.Add(tt.at))
+			if !tt.ok {
+				if err != ErrInvalidToken {
+					t.Errorf("got %q, %v; want ErrInvalidToken", user, err)
+				}
+				return
+			}
+			if err != nil || user != bob {
+				t.Fatalf("got %q, %v", user, err)
+			}
+			if _, err := redeemTestToken(t, db, tt.purpose, token, now.Add(tt.at)); err != ErrInvalidToken {
+				t.Errorf("second redeem: %v", err)
+			}
+		})
+	}
+}
+
+func TestNewTokenSupersedesOld(t *testing.T) {
+	db := newTestDB(t)
+	bob := createTestUser(t, db, "bob")
+	now := testNow()
+	old := issueTestToken(t, db, bob, TokenVerifyEmail, time.Hour, now)
+	reset := issueTestToken(t, db, bob, TokenResetPassword, time.Hour, now)
+	fresh := issueTestToken(t, db, bob, TokenVerifyEmail, time.Hour, now)
+
+	if _, err := redeemTestToken(t, db, TokenVerifyEmail, old, now); err != ErrInvalidToken {
+		t.Errorf("superseded token: %v", err)
+	}
+	if _, err := redeemTestToken(t, db, TokenVerifyEmail, fresh, now); err != nil {
+		t.Errorf("newest token: %v", err)
+	}
+	// Tokens for other purposes are left alone.
+	if _, err := redeemTestToken(t, db, TokenResetPassword, reset, now); err != nil {
+		t.Errorf("reset token: %v", err)
+	}
+}
+
+func TestVerifyEmail(t *testing.T) {
+	db := newTestDB(t)
+	bob := createTestUser(t, db, "bob")
+	token := issueTestToken(t, db, bob, TokenVerifyEmail, time.Hour, time.Now())
+
+	if err := VerifyEmail(db, token); err != nil {
+		t.Fatal(err)
+	}
+	if verified, _ := EmailVerified(db, bob); !verified {
+		t.Error("address not verified")
+	}
+	if err := VerifyEmail(db, token); err != ErrInvalidToken {
+		t.Errorf("second redeem: %v", err)
+	}
+	if err := SendVerificationEmail(db, bob); err != ErrAlreadyVerified {
+		t.Errorf("new link for a verified address: %v", err)
+	}
+}
+
+var resetLink = regexp.MustCompile(`reset=([A-Za-z0-9_-]+)`)
+
+func TestResetPassword(t *testing.T) {
+	db := newTestDB(t)
+	bob := createTestUser(t, db, "bob")
+	alice := createTestUser(t, db, "alice")
+	for _, user := range []string{bob, bob, alice} {
+		if err := CreateSession(db, uuid.New().String(), user, time.Now().Add(time.Hour), "test", "127.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := CreateLoginChallenge(db, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Unknown addresses are ignored silently.
+	if err := RequestPasswordReset(db, "nobody@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RequestPasswordReset(db, "bob@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	var to, body string
+	if err := db.QueryRow(`SELECT to_address, body FROM email_outbox`).Scan(&to, &body); err != nil {
+		t.Fatal(err)
+	}
+	m := resetLink.FindStringSubmatch(body)
+	if to != "bob@example.com" || m == nil {
+		t.Fatalf("reset email to %q without a link:\n%s", to, body)
+	}
+	token := m[1]
+
+	// The link does nothing for another purpose.
+	if err := VerifyEmail(db, token); err != ErrInvalidToken {
+		t.Errorf("reset token used to verify: %v", err)
+	}
+	user, err := ResetPassword(db, token, "n3w-Passw0rd!")
+	if err != nil || user != bob {
+		t.Fatalf("got %q, %v", user, err)
+	}
+	var hash string
+	db.QueryRow(`SELECT password_hash FROM users WHERE uuid = ?`, bob).Scan(&hash)
+	if !CheckPasswordHash(hash, "n3w-Passw0rd!") {
+		t.Error("password not changed")
+	}
+	if verified, _ := EmailVerified(db, bob); !verified {
+		t.Error("following the link did not verify the address")
+	}
+	for _, table := range []string{"sessions", "login_challenges"} {
+		var bobs, alices int
+		db.QueryRow(`SELECT COUNT(*) FROM `+table+` WHERE user_uuid = ?`, bob).Scan(&bobs)
+		db.QueryRow(`SELECT COUNT(*) FROM `+table+` WHERE user_uuid = ?`, alice).Scan(&alices)
+		if bobs != 0 || alices != 1 {
+			t.Errorf("%s left: %d of bob's, %d of alice's; want 0 and 1", table, bobs, alices)
+		}
+	}
+	if _, err := ResetPassword(db, token, "an0ther-Passw0rd!"); err != ErrInvalidToken {
+		t.Errorf("second reset: %v", err)
+	}
+}
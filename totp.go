@@ -0,0 +1,622 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Optional two-factor authentication with time-based one-time passwords
+// (RFC 6238), as produced by authenticator apps. Users enroll by fetching a
+// secret and its otpauth:// URI, which apps read from a QR code, and then
+// confirming with a first code; confirming also hands out recovery codes.
+// A user with 2FA who logs in with the right password gets a login challenge
+// instead of a session: a short-lived cookie that POST /login/2fa exchanges,
+// together with a code or an unused recovery code, for a real session.
+// Admins can reset 2FA for users who lost both their device and codes.
+// Fresh challenges only need the password, so failed codes are also counted
+// per user: after TWO_FACTOR_MAX_FAILURES of them in a row, no code is
+// checked and no challenge issued for TWO_FACTOR_LOCKOUT, and each further
+// failure locks the user out again until a code works.
+
+const (
+	totpDigits = 6
+	totpPeriod = 30 // seconds per code
+	totpSkew   = 1  // periods accepted either side of now, for clock drift
+
+	recoveryCodeCount    = 10
+	maxChallengeAttempts = 5
+
+	loginChallengeCookie = "login_challenge"
+	tokenLoginChallenge  = "login_challenge"
+)
+
+var (
+	totpIssuer           = envString("TOTP_ISSUER", "Forum")
+	loginChallengeTTL    = envDuration("LOGIN_CHALLENGE_TTL", 5*time.Minute)
+	twoFactorMaxFailures = envInt("TWO_FACTOR_MAX_FAILURES", 10)
+	twoFactorLockout     = envDuration("TWO_FACTOR_LOCKOUT", 15*time.Minute)
+)
+
+var (
+	ErrTwoFactorEnabled    = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnabled = errors.New("two-factor authentication is not enabled")
+	ErrNoPendingSetup      = errors.New("start two-factor setup first")
+	ErrInvalidCode         = errors.New("invalid code")
+	ErrChallengeExpired    = errors.New("login expired, please log in again")
+	ErrWrongPassword       = errors.New("wrong password")
+	ErrTwoFactorLocked     = errors.New("too many wrong codes, try again later")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode is the code for one time step (HOTP, RFC 4226, with SHA-1).
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, n%1000000)
+}
+
+// checkTOTP returns the time step a code belongs to. Steps up to lastStep
+// were used already and are refused, so a code works only once.
+func checkTOTP(secret, code string, lastStep int64, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		return 0, false
+	}
+	code = strings.ReplaceAll(code, " ", "")
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > lastStep && subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI is the provisioning URI authenticator apps scan.
+func totpURI(secret, nickname string) string {
+	label := url.PathEscape(totpIssuer) + ":" + url.PathEscape(nickname)
+	q := url.Values{
+		"secret":    {secret},
+		"issuer":    {totpIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+func TwoFactorEnabled(db *sql.DB, userUUID string) (bool, error) {
+	var enabled bool
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM user_totp
+        WHERE user_uuid = ? AND confirmed_at IS NOT NULL)`, userUUID).Scan(&enabled)
+	return enabled, err
+}
+
+type TwoFactorStatus struct {
+	Enabled           bool `json:"enabled"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+}
+
+func GetTwoFactorStatus(db *sql.DB, userUUID string) (TwoFactorStatus, error) {
+	var s TwoFactorStatus
+	err := db.QueryRow(`SELECT
+            EXISTS(SELECT 1 FROM user_totp WHERE user_uuid = ? AND confirmed_at IS NOT NULL),
+            (SELECT COUNT(*) FROM totp_recovery_codes WHERE user_uuid = ? AND used_at IS NULL)`,
+		userUUID, userUUID).Scan(&s.Enabled, &s.RecoveryCodesLeft)
+	return s, err
+}
+
+type TOTPSetup struct {
+	Secret string `json:"secret"` // base32, for typing in by hand
+	URI    string `json:"uri"`    // otpauth:// URI, for a QR code
+}
+
+// BeginTOTPSetup gives the user a new secret to add to their app. It only
+// takes effect once ConfirmTOTPSetup sees a code generated from it.
+func BeginTOTPSetup(db *sql.DB, userUUID string) (TOTPSetup, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return TOTPSetup{}, err
+	}
+	defer tx.Rollback()
+
+	var nickname string
+	var enabled bool
+	err = tx.QueryRow(`SELECT nickname, EXISTS(SELECT 1 FROM user_totp
+            WHERE user_uuid = users.uuid AND confirmed_at IS NOT NULL)
+        FROM users WHERE uuid = ?`, userUUID).Scan(&nickname, &enabled)
+	if err != nil {
+		return TOTPSetup{}, err
+	}
+	if enabled {
+		return TOTPSetup{}, ErrTwoFactorEnabled
+	}
+
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return TOTPSetup{}, err
+	}
+	secret := totpEncoding.EncodeToString(key)
+	_, err = tx.Exec(`INSERT INTO user_totp (user_uuid, secret, created_at) VALUES (?, ?, ?)
+        ON CONFLICT(user_uuid) DO UPDATE SET secret = excluded.secret, created_at = excluded.created_at, last_step = 0`,
+		userUUID, secret, time.Now())
+	if err != nil {
+		return TOTPSetup{}, err
+	}
+	return TOTPSetup{Secret: secret, URI: totpURI(secret, nickname)}, tx.Commit()
+}
+
+// ConfirmTOTPSetup turns 2FA on once the user proves their app produces the
+// right codes, and returns their recovery codes.
+func ConfirmTOTPSetup(db *sql.DB, userUUID, code string) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var secret string
+	var confirmed bool
+	err = tx.QueryRow(`SELECT secret, confirmed_at IS NOT NULL FROM user_totp WHERE user_uuid = ?`,
+		userUUID).Scan(&secret, &confirmed)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoPendingSetup
+	}
+	if err != nil {
+		return nil, err
+	}
+	if confirmed {
+		return nil, ErrTwoFactorEnabled
+	}
+	now := time.Now()
+	step, ok := checkTOTP(secret, code, 0, now)
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+	if _, err := tx.Exec(`UPDATE user_totp SET confirmed_at = ?, last_step = ? WHERE user_uuid = ?`,
+		now, step, userUUID); err != nil {
+		return nil, err
+	}
+	codes, err := replaceRecoveryCodes(tx, userUUID)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// recoveryCodeHash is what the database keeps of a recovery code. Codes are
+// random enough that a plain hash does; they stay valid across restarts,
+// unlike the HMACs of short-lived tokens.
+func recoveryCodeHash(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// replaceRecoveryCodes issues a fresh set of recovery codes, invalidating the
+// user's old ones.
+func replaceRecoveryCodes(tx *sql.Tx, userUUID string) ([]string, error) {
+	if _, err := tx.Exec(`DELETE FROM totp_recovery_codes WHERE user_uuid = ?`, userUUID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 7)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		s := strings.ToLower(totpEncoding.EncodeToString(raw))[:10]
+		codes[i] = s[:5] + "-" + s[5:]
+		if _, err := tx.Exec(`INSERT INTO totp_recovery_codes (user_uuid, code_hash) VALUES (?, ?)`,
+			userUUID, recoveryCodeHash(codes[i])); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// checkPassword compares password with the user's.
+func checkPassword(db *sql.DB, userUUID, password string) error {
+	var hash string
+	if err := db.QueryRow(`SELECT password_hash FROM users WHERE uuid = ?`, userUUID).Scan(&hash); err != nil {
+		return err
+	}
+	if !CheckPasswordHash(hash, password) {
+		return ErrWrongPassword
+	}
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes, for when they
+// used up or lost the old ones.
+func RegenerateRecoveryCodes(db *sql.DB, userUUID, password string) ([]string, error) {
+	if err := checkPassword(db, userUUID, password); err != nil {
+		return nil, err
+	}
+	enabled, err := TwoFactorEnabled(db, userUUID)
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		return nil, ErrTwoFactorNotEnabled
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	codes, err := replaceRecoveryCodes(tx, userUUID)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// removeTwoFactor deletes the user's secret, recovery codes and pending login
+// challenges.
+func removeTwoFactor(db *sql.DB, userUUID string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range []string{"user_totp", "totp_recovery_codes", "login_challenges"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE user_uuid = ?`, userUUID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DisableTwoFactor turns 2FA off for the user, who must know their password.
+func DisableTwoFactor(db *sql.DB, userUUID, password string) error {
+	if err := checkPassword(db, userUUID, password); err != nil {
+		return err
+	}
+	return removeTwoFactor(db, userUUID)
+}
+
+// ResetTwoFactor is the admin's way to turn 2FA off for another user.
+func ResetTwoFactor(db *sql.DB, adminUUID, userUUID string) error {
+	if err := requireAdmin(db, adminUUID); err != nil {
+		return err
+	}
+	var exists bool
+	if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE uuid = ?)`, userUUID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrUserNotFound
+	}
+	log.Printf("Admin %s reset two-factor authentication of %s", adminUUID, userUUID)
+	return removeTwoFactor(db, userUUID)
+}
+
+// CreateLoginChallenge starts the second step of a login for a user whose
+// password checked out.
+func CreateLoginChallenge(db *sql.DB, userUUID string) (string, time.Time, error) {
+	now := time.Now()
+	var locked bool
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM user_totp WHERE user_uuid = ? AND julianday(locked_until) > ?)`,
+		userUUID, julianDay(now.Unix())).Scan(&locked)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if locked {
+		return "", time.Time{}, ErrTwoFactorLocked
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", time.Time{}, err
+	}
+	token := hex.EncodeToString(raw)
+	expiresAt := now.Add(loginChallengeTTL)
+	_, err = db.Exec(`INSERT INTO login_challenges (challenge_hash, user_uuid, created_at, expires_at) VALUES (?, ?, ?, ?)`,
+		tokenHash(tokenLoginChallenge, token), userUUID, now, expiresAt)
+	return token, expiresAt, err
+}
+
+// CompleteLoginChallenge checks the code, or recovery code, for a challenge
+// and returns the user to start a session for. A challenge allows
+// maxChallengeAttempts tries; after that the password must be entered again.
+func CompleteLoginChallenge(db *sql.DB, token, code, recoveryCode string) (string, error) {
+	now := time.Now()
+	hash := tokenHash(tokenLoginChallenge, token)
+	// Count the attempt before checking it, outside the transaction, so a
+	// failed attempt is never rolled back.
+	res, err := db.Exec(`UPDATE login_challenges SET attempts = attempts + 1
+        WHERE challenge_hash = ? AND attempts < ? AND julianday(expires_at) > ?`,
+		hash, maxChallengeAttempts, julianDay(now.Unix()))
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", ErrChallengeExpired
+	}
+	// The same for the user's count, which a working code resets.
+	res, err = db.Exec(`UPDATE user_totp SET failed_attempts = failed_attempts + 1,
+            locked_until = CASE WHEN failed_attempts + 1 >= ? THEN ? ELSE locked_until END
+        WHERE user_uuid = (SELECT user_uuid FROM login_challenges WHERE challenge_hash = ?)
+          AND (locked_until IS NULL OR julianday(locked_until) <= ?)`,
+		twoFactorMaxFailures, now.Add(twoFactorLockout), hash, julianDay(now.Unix()))
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// Either the user is locked out or 2FA was turned off meanwhile.
+		var enabled bool
+		err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM user_totp
+            WHERE user_uuid = (SELECT user_uuid FROM login_challenges WHERE challenge_hash = ?))`, hash).Scan(&enabled)
+		if err != nil {
+			return "", err
+		}
+		if !enabled {
+			return "", ErrChallengeExpired
+		}
+		return "", ErrTwoFactorLocked
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var userUUID, secret string
+	var lastStep int64
+	err = tx.QueryRow(`SELECT c.user_uuid, t.secret, t.last_step
+        FROM login_challenges c
+        JOIN user_totp t ON t.user_uuid = c.user_uuid AND t.confirmed_at IS NOT NULL
+        WHERE c.challenge_hash = ?`, hash).Scan(&userUUID, &secret, &lastStep)
+	if err == sql.ErrNoRows {
+		return "", ErrChallengeExpired // 2FA was reset meanwhile
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if recoveryCode != "" {
+		res, err := tx.Exec(`UPDATE totp_recovery_codes SET used_at = ?
+            WHERE user_uuid = ? AND code_hash = ? AND used_at IS NULL`, now, userUUID, recoveryCodeHash(recoveryCode))
+		if err != nil {
+			return "", err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return "", ErrInvalidCode
+		}
+	} else {
+		step, ok := checkTOTP(secret, code, lastStep, now)
+		if !ok {
+			return "", ErrInvalidCode
+		}
+		if _, err := tx.Exec(`UPDATE user_totp SET last_step = ? WHERE user_uuid = ?`, step, userUUID); err != nil {
+			return "", err
+		}
+	}
+	if _, err := tx.Exec(`UPDATE user_totp SET failed_attempts = 0, locked_until = NULL WHERE user_uuid = ?`, userUUID); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`DELETE FROM login_challenges WHERE challenge_hash = ? OR julianday(expires_at) <= ?`,
+		hash, julianDay(now.Unix())); err != nil {
+		return "", err
+	}
+	return userUUID, tx.Commit()
+}
+
+func writeTwoFactorError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrNotAdmin:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case ErrUserNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case ErrTwoFactorEnabled, ErrTwoFactorNotEnabled, ErrNoPendingSetup:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case ErrInvalidCode, ErrWrongPassword, ErrChallengeExpired:
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	case ErrTwoFactorLocked:
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	default:
+		log.Printf("Two-factor error: %v", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+	}
+}
+
+type TwoFactorRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+	Password     string `json:"password"`
+	UserUUID     string `json:"user_uuid"` // admin reset only
+}
+
+// TwoFactorStatusHandler: GET /2fa
+func TwoFactorStatusHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		status, err := GetTwoFactorStatus(db, userUUID)
+		if err != nil {
+			writeTwoFactorError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+// TwoFactorSetupHandler: POST /2fa/setup
+func TwoFactorSetupHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		setup, err := BeginTOTPSetup(db, userUUID)
+		if err != nil {
+			writeTwoFactorError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(setup)
+	}
+}
+
+// decodeTwoFactorRequest reads the body of the 2FA endpoints that take one.
+func decodeTwoFactorRequest(w http.ResponseWriter, r *http.Request) (TwoFactorRequest, bool) {
+	var req TwoFactorRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return req, false
+	}
+	return req, true
+}
+
+func writeRecoveryCodes(w http.ResponseWriter, codes []string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+// TwoFactorConfirmHandler: POST /2fa/confirm {code}
+func TwoFactorConfirmHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		req, ok := decodeTwoFactorRequest(w, r)
+		if !ok {
+			return
+		}
+		codes, err := ConfirmTOTPSetup(db, userUUID, req.Code)
+		if err != nil {
+			writeTwoFactorError(w, err)
+			return
+		}
+		writeRecoveryCodes(w, codes)
+	}
+}
+
+// TwoFactorRecoveryCodesHandler: POST /2fa/recovery-codes {password}
+func TwoFactorRecoveryCodesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		req, ok := decodeTwoFactorRequest(w, r)
+		if !ok {
+			return
+		}
+		codes, err := RegenerateRecoveryCodes(db, userUUID, req.Password)
+		if err != nil {
+			writeTwoFactorError(w, err)
+			return
+		}
+		writeRecoveryCodes(w, codes)
+	}
+}
+
+// TwoFactorDisableHandler: POST /2fa/disable {password}
+func TwoFactorDisableHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		req, ok := decodeTwoFactorRequest(w, r)
+		if !ok {
+			return
+		}
+		if err := DisableTwoFactor(db, userUUID, req.Password); err != nil {
+			writeTwoFactorError(w, err)
+			return
+		}
+		w.Write([]byte("Two-factor authentication disabled"))
+	}
+}
+
+// TwoFactorResetHandler: POST /2fa/reset {user_uuid}, admins only
+func TwoFactorResetHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		adminUUID, ok := UserUUIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		req, ok := decodeTwoFactorRequest(w, r)
+		if !ok {
+			return
+		}
+		if err := ResetTwoFactor(db, adminUUID, req.UserUUID); err != nil {
+			writeTwoFactorError(w, err)
+			return
+		}
+		w.Write([]byte("Two-factor authentication reset"))
+	}
+}
+
+// LoginTwoFactorHandler: POST /login/2fa {code} or {recovery_code}, with the
+// login_challenge cookie set by LoginHandler
+func LoginTwoFactorHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(loginChallengeCookie)
+		if err != nil {
+			writeTwoFactorError(w, ErrChallengeExpired)
+			return
+		}
+		req, ok := decodeTwoFactorRequest(w, r)
+		if !ok {
+			return
+		}
+		if req.Code == "" && req.RecoveryCode == "" {
+			http.Error(w, "Missing code", http.StatusBadRequest)
+			return
+		}
+		userUUID, err := CompleteLoginChallenge(db, cookie.Value, req.Code, req.RecoveryCode)
+		if err != nil {
+			writeTwoFactorError(w, err)
+			return
+		}
+		if err := startSession(w, r, db, userUUID); err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     loginChallengeCookie,
+			Value:    "",
+			Path:     "/login",
+			MaxAge:   -1,
+			HttpOnly: true,
+		})
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("Login successful"))
+	}
+}
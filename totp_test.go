@@ -0,0 +1,264 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key of the RFC 6238 test vectors,
+// "12345678901234567890", in base32.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCheckTOTP(t *testing.T) {
+	// The RFC's 8-digit codes, cut to their last six digits.
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, v := range vectors {
+		step, ok := checkTOTP(rfc6238Secret, v.code, 0, time.Unix(v.unix, 0))
+		if !ok || step != v.unix/totpPeriod {
+			t.Errorf("code %s at %d: step %d, ok %v", v.code, v.unix, step, ok)
+		}
+	}
+
+	now := time.Unix(1234567890, 0)
+	current := now.Unix() / totpPeriod
+	key, _ := totpEncoding.DecodeString(rfc6238Secret)
+	tests := []struct {
+		name     string
+		step     int64 // step the code is generated for
+		lastStep int64
+		ok       bool
+	}{
+		{"current", current, 0, true},
+		{"one step behind", current - 1, 0, true},
+		{"one step ahead", current + 1, 0, true},
+		{"two steps behind", current - 2, 0, false},
+		{"two steps ahead", current + 2, 0, false},
+		{"replayed", current, current, false},
+		{"older than last use", current - 1, current, false},
+		{"newer than last use", current + 1, current, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := checkTOTP(rfc6238Secret, totpCode(key, tt.step), tt.lastStep, now)
+			if ok != tt.ok || (ok && step != tt.step) {
+				t.Errorf("step %d, ok %v; want step %d, ok %v", step, ok, tt.step, tt.ok)
+			}
+		})
+	}
+
+	if _, ok := checkTOTP(rfc6238Secret, "005 924", 0, now); !ok {
+		t.Error("code with a space refused")
+	}
+	if _, ok := checkTOTP("not base32!", "005924", 0, now); ok {
+		t.Error("code accepted for a malformed secret")
+	}
+}
+
+// twoFactorTest is a user with 2FA turned on.
+type twoFactorTest struct {
+	db            *sql.DB
+	user          string
+	key           []byte
+	recoveryCodes []string
+}
+
+func newTwoFactorTest(t *testing.T) *twoFactorTest {
+	t.Helper()
+	db := newTestDB(t)
+	tf := &twoFactorTest{db: db, user: createTestUser(t, db, "bob")}
+	setup, err := BeginTOTPSetup(db, tf.user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf.key, _ = totpEncoding.DecodeString(setup.Secret)
+	tf.recoveryCodes, err = ConfirmTOTPSetup(db, tf.user, tf.code(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tf
+}
+
+// code returns the code offset steps from now. Setup used the current
+// step, so logins use the next one.
+func (tf *twoFactorTest) code(offset int64) string {
+	return totpCode(tf.key, time.Now().Unix()/totpPeriod+offset)
+}
+
+func (tf *twoFactorTest) challenge(t *testing.T) string {
+	t.Helper()
+	token, _, err := CreateLoginChallenge(tf.db, tf.user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestCompleteLoginChallenge(t *testing.T) {
+	tf := newTwoFactorTest(t)
+	token := tf.challenge(t)
+	if _, err := CompleteLoginChallenge(tf.db, token, "000000", ""); err != ErrInvalidCode {
+		t.Fatalf("wrong code: %v", err)
+	}
+	code := tf.code(1)
+	user, err := CompleteLoginChallenge(tf.db, token, code, "")
+	if err != nil || user != tf.user {
+		t.Fatalf("got %q, %v", user, err)
+	}
+	// A challenge is used up by the login, and the code by its step.
+	if _, err := CompleteLoginChallenge(tf.db, token, code, ""); err != ErrChallengeExpired {
+		t.Errorf("reused challenge: %v", err)
+	}
+	if _, err := CompleteLoginChallenge(tf.db, tf.challenge(t), code, ""); err != ErrInvalidCode {
+		t.Errorf("reused code: %v", err)
+	}
+}
+
+func TestRecoveryCodesAreSingleUse(t *testing.T) {
+	tf := newTwoFactorTest(t)
+	if len(tf.recoveryCodes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(tf.recoveryCodes), recoveryCodeCount)
+	}
+	code := tf.recoveryCodes[0]
+	if user, err := CompleteLoginChallenge(tf.db, tf.challenge(t), "", code); err != nil || user != tf.user {
+		t.Fatalf("recovery code: %q, %v", user, err)
+	}
+	if _, err := CompleteLoginChallenge(tf.db, tf.challenge(t), "", code); err != ErrInvalidCode {
+		t.Errorf("recovery code used twice: %v", err)
+	}
+	status, err := GetTwoFactorStatus(tf.db, tf.user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.RecoveryCodesLeft != recoveryCodeCount-1 {
+		t.Errorf("%d recovery codes left, want %d", status.RecoveryCodesLeft, recoveryCodeCount-1)
+	}
+}
+
+func TestLoginChallengeExpires(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, tf *twoFactorTest, token string)
+	}{
+		{"past its TTL", func(t *testing.T, tf *twoFactorTest, token string) {
+			if _, err := tf.db.Exec(`UPDATE login_challenges SET expires_at = ?`, time.Now().Add(-time.Second)); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"out of attempts", func(t *testing.T, tf *twoFactorTest, token string) {
+			for i := 0; i < maxChallengeAttempts; i++ {
+				if _, err := CompleteLoginChallenge(tf.db, token, "000000", ""); err != ErrInvalidCode {
+					t.Fatalf("attempt %d: %v", i+1, err)
+				}
+			}
+		}},
+		{"2FA reset", func(t *testing.T, tf *twoFactorTest, token string) {
+			if err := removeTwoFactor(tf.db, tf.user); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"2FA secret gone", func(t *testing.T, tf *twoFactorTest, token string) {
+			if _, err := tf.db.Exec(`DELETE FROM user_totp`); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tf := newTwoFactorTest(t)
+			token := tf.challenge(t)
+			tt.setup(t, tf, token)
+			if _, err := CompleteLoginChallenge(tf.db, token, tf.code(1), ""); err != ErrChallengeExpired {
+				t.Errorf("got %v, want ErrChallengeExpired", err)
+			}
+		})
+	}
+}
+
+func TestTwoFactorLockout(t *testing.T) {
+	old := twoFactorMaxFailures
+	twoFactorMaxFailures = 3
+	t.Cleanup(func() { twoFactorMaxFailures = old })
+
+	tf := newTwoFactorTest(t)
+	pending := tf.challenge(t)
+	// Failures count across challenges.
+	for i := 0; i < twoFactorMaxFailures; i++ {
+		if _, err := CompleteLoginChallenge(tf.db, tf.challenge(t), "000000", ""); err != ErrInvalidCode {
+			t.Fatalf("failure %d: %v", i+1, err)
+		}
+	}
+	if _, _, err := CreateLoginChallenge(tf.db, tf.user); err != ErrTwoFactorLocked {
+		t.Errorf("new challenge while locked: %v", err)
+	}
+	if _, err := CompleteLoginChallenge(tf.db, pending, tf.code(1), ""); err != ErrTwoFactorLocked {
+		t.Errorf("right code while locked: %v", err)
+	}
+
+	unlock := func() {
+		t.Helper()
+		if _, err := tf.db.Exec(`UPDATE user_totp SET locked_until = ?`, time.Now().Add(-time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Once the lockout is over, one more failure locks the user out again.
+	unlock()
+	if _, err := CompleteLoginChallenge(tf.db, tf.challenge(t), "000000", ""); err != ErrInvalidCode {
+		t.Fatalf("failure after the lockout: %v", err)
+	}
+	if _, _, err := CreateLoginChallenge(tf.db, tf.user); err != ErrTwoFactorLocked {
+		t.Errorf("new challenge after another failure: %v", err)
+	}
+
+	// A working code clears the count.
+	unlock()
+	if _, err := CompleteLoginChallenge(tf.db, tf.challenge(t), tf.code(1), ""); err != nil {
+		t.Fatalf("right code after the lockout: %v", err)
+	}
+	var failures int
+	var lockedUntil sql.NullTime
+	if err := tf.db.QueryRow(`SELECT failed_attempts, locked_until FROM user_totp`).Scan(&failures, &lockedUntil); err != nil {
+		t.Fatal(err)
+	}
+	if failures != 0 || lockedUntil.Valid {
+		t.Errorf("after a login: %d failures, locked until %v", failures, lockedUntil)
+	}
+}
+
+func TestResetTwoFactor(t *testing.T) {
+	tf := newTwoFactorTest(t)
+	mod := createTestUser(t, tf.db, "mod")
+	admin := createTestUser(t, tf.db, "admin")
+	if _, err := tf.db.Exec(`UPDATE users SET role = CASE uuid WHEN ? THEN 'moderator' ELSE 'admin' END
+        WHERE uuid IN (?, ?)`, mod, mod, admin); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, actor := range []string{tf.user, mod} {
+		if err := ResetTwoFactor(tf.db, actor, tf.user); err != ErrNotAdmin {
+			t.Errorf("reset by non-admin: %v", err)
+		}
+	}
+	if enabled, _ := TwoFactorEnabled(tf.db, tf.user); !enabled {
+		t.Fatal("2FA turned off by a non-admin")
+	}
+	if err := ResetTwoFactor(tf.db, admin, "no-such-user"); err != ErrUserNotFound {
+		t.Errorf("reset of unknown user: %v", err)
+	}
+	if err := ResetTwoFactor(tf.db, admin, tf.user); err != nil {
+		t.Fatal(err)
+	}
+	if enabled, _ := TwoFactorEnabled(tf.db, tf.user); enabled {
+		t.Error("2FA still on after an admin reset")
+	}
+}